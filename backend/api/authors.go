@@ -0,0 +1,65 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+
+	"docsmith/git"
+	"docsmith/models"
+	"docsmith/ws"
+)
+
+// anonymousEmail is the email of commits by share-link visitors without an
+// account.
+const anonymousEmail = "anonymous@docsmith.local"
+
+// userAuthor is who a user's commits are signed as. Users who haven't set a
+// display name or email are signed with their username and a placeholder
+// address.
+func userAuthor(user models.User) git.Author {
+	author := git.Author{Name: user.DisplayName, Email: user.Email}
+	if author.Name == "" {
+		author.Name = user.Username
+	}
+	if author.Email == "" {
+		author.Email = fmt.Sprintf("%s@users.docsmith.local", user.Username)
+	}
+	return author
+}
+
+// commitAuthor looks up who commits made by userID are signed as.
+func commitAuthor(db *sql.DB, userID interface{}) (git.Author, error) {
+	var user models.User
+	var displayName, email sql.NullString
+	err := db.QueryRow("select id, username, display_name, email from users where id = ?", userID).
+		Scan(&user.ID, &user.Username, &displayName, &email)
+	if err != nil {
+		return git.Author{}, fmt.Errorf("load user %v: %w", userID, err)
+	}
+	user.DisplayName = displayName.String
+	user.Email = email.String
+	return userAuthor(user), nil
+}
+
+// participantAuthor attributes a commit to a websocket participant.
+func participantAuthor(db *sql.DB, p ws.Participant) git.Author {
+	if !p.IsAnonymous {
+		if author, err := commitAuthor(db, p.UserID); err == nil {
+			return author
+		}
+	}
+	return git.Author{Name: p.Username, Email: anonymousEmail}
+}
+
+// sessionCoAuthors returns the other people connected to a document's live
+// session, to credit alongside author in a commit of the shared content.
+func sessionCoAuthors(db *sql.DB, hubs *ws.Registry, docID string, author git.Author) []git.Author {
+	var coAuthors []git.Author
+	for _, p := range hubs.Collaborators(docID) {
+		co := participantAuthor(db, ws.Participant{UserID: p.UserID, Username: p.Username, IsAnonymous: p.IsAnonymous})
+		if co != author {
+			coAuthors = append(coAuthors, co)
+		}
+	}
+	return coAuthors
+}
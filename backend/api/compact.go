@@ -0,0 +1,201 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/git"
+	"docsmith/models"
+)
+
+// DefaultCompactWindow is how far apart saves squashed together may be,
+// unless configured otherwise.
+const DefaultCompactWindow = 10 * time.Minute
+
+// saveMessages begin the messages of the commits made by saving a document
+// without asking for a version: live sessions' autosaves, saves with PUT and
+// creating it. Only these are squashed; versions made with a comment, or
+// the default "Update document" one, are kept.
+var saveMessages = []string{"Autosave document: ", "Save document: ", "Create document: "}
+
+func isSave(message string) bool {
+	for _, prefix := range saveMessages {
+		if strings.HasPrefix(message, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compactor squashes the saves in the history of the workspace
+// repositories, on a schedule and when asked to.
+type Compactor struct {
+	db       *sql.DB
+	repos    *Repos
+	window   time.Duration
+	interval time.Duration
+}
+
+// NewCompactor returns a Compactor squashing saves made within window of
+// each other. With a zero interval it only compacts when asked to.
+func NewCompactor(db *sql.DB, repos *Repos, window time.Duration, interval time.Duration) *Compactor {
+	return &Compactor{db: db, repos: repos, window: window, interval: interval}
+}
+
+// Start compacts every workspace in the background, every interval.
+func (cp *Compactor) Start() {
+	if cp.interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(cp.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := cp.CompactAll(); err != nil {
+				log.Printf("Failed to compact history: %v", err)
+			}
+		}
+	}()
+}
+
+// CompactAll compacts every workspace.
+func (cp *Compactor) CompactAll() error {
+	ids, err := cp.repos.WorkspaceIDs()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, id := range ids {
+		compaction, err := cp.Compact(id, cp.window, false)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("workspace %d: %w", id, err))
+			continue
+		}
+		if compaction.Removed > 0 {
+			log.Printf("Compacted workspace %d: squashed %d commits", id, compaction.Removed)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Compact squashes the saves of a workspace made within window of each
+// other, or on a dry run finds what would be squashed. Merge requests and
+// the reconciler are pointed at what their commits became, and the history
+// index is built again.
+func (cp *Compactor) Compact(workspaceID int, window time.Duration, dryRun bool) (*git.Compaction, error) {
+	repo, err := cp.repos.Workspace(workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	compaction, err := git.CompactHistory(repo, git.CompactOptions{Window: window, Squashable: isSave, DryRun: dryRun})
+	if err != nil {
+		return nil, err
+	}
+	if len(compaction.Rewritten) > 0 {
+		if err := cp.remap(repo, workspaceID, compaction.Rewritten); err != nil {
+			return nil, err
+		}
+		if err := clearHistoryIndex(cp.db, repo); err != nil {
+			return nil, err
+		}
+	}
+	return compaction, nil
+}
+
+// remap updates the commits recorded in the database to what they became.
+func (cp *Compactor) remap(repo *git.Repo, workspaceID int, rewritten map[string]string) error {
+	tx, err := cp.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`select m.id, m.merge_commit from merge_requests m join docs d on d.id = m.doc_id
+		where d.workspace_id = ? and m.merge_commit is not null and m.merge_commit != ''`, workspaceID)
+	if err != nil {
+		return fmt.Errorf("list merge requests: %w", err)
+	}
+	updated := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var commit string
+		if err := rows.Scan(&id, &commit); err != nil {
+			rows.Close()
+			return fmt.Errorf("list merge requests: %w", err)
+		}
+		if replaced, ok := rewritten[commit]; ok {
+			updated[id] = replaced
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("list merge requests: %w", err)
+	}
+	for id, commit := range updated {
+		if _, err := tx.Exec("update merge_requests set merge_commit = ? where id = ?", commit, id); err != nil {
+			return fmt.Errorf("update merge request %d: %w", id, err)
+		}
+	}
+
+	var head string
+	err = tx.QueryRow("select reconciled_head from repo_state where repo_path = ?", repo.Path).Scan(&head)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("load reconciled head: %w", err)
+	}
+	if replaced, ok := rewritten[head]; ok {
+		if _, err := tx.Exec("update repo_state set reconciled_head = ?, updated_at = ? where repo_path = ?", replaced, time.Now(), repo.Path); err != nil {
+			return fmt.Errorf("update reconciled head: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// compactWindow reads the window query parameter, defaulting to the
+// compactor's. It writes the error response and returns false if it's
+// invalid.
+func compactWindow(c *gin.Context, compactor *Compactor) (time.Duration, bool) {
+	window := compactor.window
+	if v := c.Query("window"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid window, use a duration like 15m"})
+			return 0, false
+		}
+		window = parsed
+	}
+	return window, true
+}
+
+// compactWorkspaceHandler lets the owner of a workspace squash the saves in
+// its history. GET is a dry run, showing what POST would squash.
+func compactWorkspaceHandler(db *sql.DB, compactor *Compactor) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		workspace, ok := memberWorkspace(c, db)
+		if !ok {
+			return
+		}
+		if workspace.Role != models.RoleOwner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can compact history"})
+			return
+		}
+		window, ok := compactWindow(c, compactor)
+		if !ok {
+			return
+		}
+
+		compaction, err := compactor.Compact(workspace.ID, window, c.Request.Method == http.MethodGet)
+		if err != nil {
+			log.Printf("Failed to compact workspace %d: %v", workspace.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compact history"})
+			return
+		}
+		c.JSON(http.StatusOK, compaction)
+	}
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"docsmith/db"
+	"docsmith/git"
+)
+
+// Compacting a workspace points its merge requests and the reconciler at
+// what their commits became.
+func TestCompactRemapsCommits(t *testing.T) {
+	dir := t.TempDir()
+	database, err := db.InitDB(filepath.Join(dir, "docsmith.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	repos := NewRepos(database, filepath.Join(dir, "repos"))
+	repo, err := repos.Workspace(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	author := git.Author{Name: "alice", Email: "alice@example.com"}
+	doc := git.Document{ID: "1", Path: "plan.md"}
+	save := func(content string, message string) string {
+		t.Helper()
+		if err := git.SaveDocument(repo, doc, content); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := git.CommitDocumentAs(repo, doc, message, author, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	save("one\n", "Create document: Plan")
+	save("two\n", "Save document: Plan")
+	save("three\n", "Save document: Plan")
+	if _, err := git.CreateDraft(repo, doc, "rewrite", "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.CommitDraft(repo, doc, "rewrite", "rewritten\n", "Rewrite plan", author); err != nil {
+		t.Fatal(err)
+	}
+	merge, err := git.MergeDraft(repo, doc, "rewrite", "rewritten\n", "Merge draft rewrite", author)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := save("four\n", "Save document: Plan")
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"insert into users (id, username, password_hash) values (1, 'alice', '')", nil},
+		{"insert into docs (id, user_id, title, content, updated_at, workspace_id, path) values (1, 1, 'Plan', 'four', ?, 1, 'plan.md')", []interface{}{time.Now()}},
+		{"insert into merge_requests (doc_id, draft, title, status, created_by, merge_commit, updated_at) values (1, 'rewrite', 'Rewrite', 'merged', 1, ?, ?)", []interface{}{merge, time.Now()}},
+		{"insert into repo_state (repo_path, reconciled_head, updated_at) values (?, ?, ?)", []interface{}{repo.Path, head, time.Now()}},
+	}
+	for _, s := range statements {
+		if _, err := database.Exec(s.query, s.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	compaction, err := NewCompactor(database, repos, DefaultCompactWindow, 0).Compact(1, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The draft starts from the last save, which is kept
+	if compaction.Removed != 1 {
+		t.Fatalf("removed %d commits, want 1", compaction.Removed)
+	}
+
+	var mergeCommit, reconciled string
+	if err := database.QueryRow("select merge_commit from merge_requests").Scan(&mergeCommit); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.QueryRow("select reconciled_head from repo_state where repo_path = ?", repo.Path).Scan(&reconciled); err != nil {
+		t.Fatal(err)
+	}
+	if mergeCommit == merge || mergeCommit != compaction.Rewritten[merge] {
+		t.Errorf("merge request points at %s, want %s", mergeCommit, compaction.Rewritten[merge])
+	}
+	if newHead, err := git.Head(repo); err != nil || reconciled != newHead {
+		t.Errorf("reconciled head is %s, want %s (%v)", reconciled, newHead, err)
+	}
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/git"
+	"docsmith/models"
+)
+
+type DraftRequest struct {
+	Name string `json:"name" binding:"required"`
+	// Version is the commit to fork from; the latest version of the document
+	// if empty.
+	Version string `json:"version"`
+}
+
+type UpdateDraftRequest struct {
+	Content string `json:"content"`
+	Message string `json:"message"`
+}
+
+// draftError answers a failed draft operation.
+func draftError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, git.ErrInvalidDraftName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Draft names are letters, digits, '.', '-' and '_', up to 100 characters"})
+	case errors.Is(err, git.ErrDraftExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Draft already exists"})
+	case errors.Is(err, git.ErrDraftNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Draft not found"})
+	default:
+		versionError(c, err, message)
+	}
+}
+
+func listDraftsHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		drafts, err := git.ListDrafts(repo, doc.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list drafts"})
+			return
+		}
+
+		c.JSON(http.StatusOK, drafts)
+	}
+}
+
+// createDraftHandler forks a document into a draft branch.
+func createDraftHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		var req DraftRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		file := documentFile(doc)
+		if req.Version == "" {
+			latest, err := git.LatestVersion(repo, file)
+			if err != nil {
+				versionError(c, err, "Failed to find the latest version")
+				return
+			}
+			req.Version = latest.Hash
+		}
+
+		draft, err := git.CreateDraft(repo, file, req.Name, req.Version)
+		if err != nil {
+			draftError(c, err, "Failed to create draft")
+			return
+		}
+
+		c.JSON(http.StatusCreated, draft)
+	}
+}
+
+// getDraftHandler returns the document as of the head of a draft.
+func getDraftHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		file := documentFile(doc)
+		version, err := git.GetDraft(repo, file, c.Param("draft"))
+		if err != nil {
+			draftError(c, err, "Failed to retrieve draft content")
+			return
+		}
+
+		response := versionResponse(doc, version)
+		response["draft"] = c.Param("draft")
+		response["read_only"] = false
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// updateDraftHandler commits new content to a draft. The main line of the
+// document is left alone.
+func updateDraftHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		var req UpdateDraftRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+
+		name := c.Param("draft")
+		message := req.Message
+		if message == "" {
+			message = fmt.Sprintf("Edit draft %s: %s", name, doc.Title)
+		}
+		file := documentFile(doc)
+		hash, err := git.CommitDraft(repo, file, name, req.Content, message, author)
+		if err != nil {
+			draftError(c, err, "Failed to commit draft")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":      doc.ID,
+			"draft":   name,
+			"hash":    hash,
+			"content": req.Content,
+			"message": message,
+		})
+	}
+}
+
+// deleteDraftHandler drops a draft, closing its open merge requests.
+func deleteDraftHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		name := c.Param("draft")
+		if err := git.DeleteDraft(repo, doc.ID, name); err != nil {
+			draftError(c, err, "Failed to delete draft")
+			return
+		}
+
+		_, err := db.Exec("update merge_requests set status = ?, updated_at = ? where doc_id = ? and draft = ? and status = ?",
+			models.MergeRequestClosed, time.Now(), doc.ID, name, models.MergeRequestOpen)
+		if err != nil {
+			log.Printf("Failed to close merge requests of draft %s: %v", name, err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Draft deleted"})
+	}
+}
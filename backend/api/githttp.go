@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/git"
+	"docsmith/ws"
+)
+
+// gitAuthMiddleware signs in git clients like authMiddleware does, but
+// challenges for basic auth, since git only sends credentials when asked.
+func gitAuthMiddleware(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := authenticate(db, c.GetHeader("Authorization"))
+		if err != nil {
+			c.Header("WWW-Authenticate", `Basic realm="DocSmith"`)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+
+		c.Set("userID", userID)
+		c.Next()
+	}
+}
+
+// gitWorkspace returns the ID of the workspace a request is for, from its
+// repository, <workspace name>.git, if the signed in user is a member. A
+// user's personal workspace is named after them.
+func gitWorkspace(c *gin.Context, db *sql.DB) (int, bool) {
+	name, ok := strings.CutSuffix(c.Param("repo"), ".git")
+	var id int
+	err := db.QueryRow(`select w.id from workspaces w join workspace_members m on m.workspace_id = w.id
+		where w.name = ? and m.user_id = ?`, name, c.GetInt("userID")).Scan(&id)
+	if !ok || err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Repository not found"})
+		return 0, false
+	}
+	return id, true
+}
+
+// gitRepo opens the repository a request is for.
+func gitRepo(c *gin.Context, db *sql.DB, repos *Repos) (*git.Repo, int, bool) {
+	workspaceID, ok := gitWorkspace(c, db)
+	if !ok {
+		return nil, 0, false
+	}
+	repo, err := repos.Workspace(workspaceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open repository"})
+		return nil, 0, false
+	}
+	return repo, workspaceID, true
+}
+
+// gitRequestBody returns the body of a git request, which may be gzipped.
+func gitRequestBody(c *gin.Context) (io.Reader, error) {
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		return gzip.NewReader(c.Request.Body)
+	}
+	return c.Request.Body, nil
+}
+
+// gitInfoRefsHandler starts a clone, fetch or push by listing the
+// repository's references.
+func gitInfoRefsHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		repo, _, ok := gitRepo(c, db, repos)
+		if !ok {
+			return
+		}
+		service := c.Query("service")
+		if service != git.UploadPackService && service != git.ReceivePackService {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the smart HTTP protocol is supported"})
+			return
+		}
+
+		var refs bytes.Buffer
+		if err := git.AdvertiseRefs(c.Request.Context(), repo, service, &refs); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list references"})
+			return
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, fmt.Sprintf("application/x-%s-advertisement", service), refs.Bytes())
+	}
+}
+
+// gitUploadPackHandler sends a clone or fetch the objects it asks for.
+func gitUploadPackHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		repo, _, ok := gitRepo(c, db, repos)
+		if !ok {
+			return
+		}
+		body, err := gitRequestBody(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Content-Type", "application/x-git-upload-pack-result")
+		if err := git.UploadPack(c.Request.Context(), repo, body, c.Writer); err != nil {
+			if !c.Writer.Written() {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Failed to send objects: %v", err)
+		}
+	}
+}
+
+// gitReceivePackHandler applies a push. It may only change the markdown
+// files of documents in the workspace the user owns, which are then updated
+// to match.
+func gitReceivePackHandler(db *sql.DB, repos *Repos, hubs *ws.Registry, reconciler *Reconciler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		repo, workspaceID, ok := gitRepo(c, db, repos)
+		if !ok {
+			return
+		}
+		userID := c.GetInt("userID")
+		var username string
+		if err := db.QueryRow("select username from users where id = ?", userID).Scan(&username); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+		body, err := gitRequestBody(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		check := func(path string, deleted bool) error {
+			var ownerID int
+			err := db.QueryRow("select user_id from docs where path = ? and workspace_id = ?", path, workspaceID).Scan(&ownerID)
+			if err != nil {
+				return fmt.Errorf("%s is not a document", path)
+			}
+			if ownerID != userID {
+				return fmt.Errorf("%s is not one of your documents", path)
+			}
+			if deleted {
+				return fmt.Errorf("%s can't be deleted by pushing", path)
+			}
+			return nil
+		}
+
+		var report bytes.Buffer
+		changed, err := git.ReceivePack(c.Request.Context(), repo, body, &report, check)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		removed := removedFiles(changed)
+		for _, file := range changed {
+			importDocument(db, hubs, reconciler, repo, workspaceID, file, removed, "push", fmt.Sprintf("Pushed by %s", username))
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		c.Data(http.StatusOK, "application/x-git-receive-pack-result", report.Bytes())
+	}
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+
+	"docsmith/git"
+	"docsmith/ws"
+)
+
+// gitServerTest serves a syncTest's workspace, alice, over smart HTTP. Bob
+// is a member with a document of his own, bob.md.
+type gitServerTest struct {
+	*syncTest
+	url string
+}
+
+func newGitServerTest(t *testing.T) *gitServerTest {
+	t.Helper()
+	st := newSyncTest(t)
+	doc := git.Document{ID: "2", Path: "bob.md"}
+	if err := git.SaveDocument(st.repo, doc, "bob's\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.CommitDocumentAs(st.repo, doc, "Create document: Bob", git.Author{Name: "bob", Email: "bob@example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"insert into users (id, username, password_hash) values (2, 'bob', ''), (3, 'carol', '')", nil},
+		{"insert into workspace_members (workspace_id, user_id, role) values (1, 1, 'owner'), (1, 2, 'member')", nil},
+		{"insert into docs (id, user_id, title, content, updated_at, workspace_id, path) values (2, 2, 'Bob', ?, ?, 1, 'bob.md')", []interface{}{"bob's\n", time.Now()}},
+	}
+	for _, s := range statements {
+		if _, err := st.db.Exec(s.query, s.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	hubs := ws.NewRegistry(NewHubStore(st.db, st.syncer.repos), nil)
+	routes := router.Group("/api/git", gitAuthMiddleware(st.db))
+	routes.GET("/:repo/info/refs", gitInfoRefsHandler(st.db, st.syncer.repos))
+	routes.POST("/:repo/git-upload-pack", gitUploadPackHandler(st.db, st.syncer.repos))
+	routes.POST("/:repo/git-receive-pack", gitReceivePackHandler(st.db, st.syncer.repos, hubs, st.reconciler))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return &gitServerTest{syncTest: st, url: server.URL + "/api/git/alice.git"}
+}
+
+func (gt *gitServerTest) auth(userID int, username string) *githttp.BasicAuth {
+	gt.t.Helper()
+	token, err := generateToken(userID)
+	if err != nil {
+		gt.t.Fatal(err)
+	}
+	return &githttp.BasicAuth{Username: username, Password: token}
+}
+
+// clone clones the workspace as alice.
+func (gt *gitServerTest) clone() (*gogit.Repository, string) {
+	gt.t.Helper()
+	dir := gt.t.TempDir()
+	r, err := gogit.PlainClone(dir, false, &gogit.CloneOptions{URL: gt.url, Auth: gt.auth(1, "alice")})
+	if err != nil {
+		gt.t.Fatal(err)
+	}
+	return r, dir
+}
+
+// commitClone writes files into a clone, removing those with no content, and
+// commits them.
+func commitClone(t *testing.T, r *gogit.Repository, dir string, message string, files map[string]string) {
+	t.Helper()
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range files {
+		if content == "" {
+			if _, err := w.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Add(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := &object.Signature{Name: "alice", Email: "alice@example.com", When: time.Now()}
+	if _, err := w.Commit(message, &gogit.CommitOptions{Author: alice, Committer: alice}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGitCloneAndPush(t *testing.T) {
+	gt := newGitServerTest(t)
+	r, dir := gt.clone()
+	content, err := os.ReadFile(filepath.Join(dir, "plan.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, body := git.DecodeDocument(string(content)); body != "one\ntwo\nthree\n" {
+		t.Errorf("cloned plan.md is %q", content)
+	}
+
+	commitClone(t, r, dir, "Edit plan", map[string]string{"plan.md": strings.Replace(string(content), "two", "TWO", 1)})
+	if err := r.Push(&gogit.PushOptions{Auth: gt.auth(1, "alice")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := gt.content(); got != "one\nTWO\nthree\n" {
+		t.Errorf("document is %q after pushing", got)
+	}
+	local, _ := r.Head()
+	if head, err := git.Head(gt.repo); err != nil || head != local.Hash().String() {
+		t.Errorf("workspace is at %s (%v), want %s", head, err, local.Hash())
+	}
+	if files, err := git.WorktreeChanges(gt.repo); err != nil || len(files) != 0 {
+		t.Errorf("worktree has changes %+v (%v) after the push", files, err)
+	}
+
+	// Strangers and bad credentials get nothing
+	if _, err := gogit.PlainClone(t.TempDir(), false, &gogit.CloneOptions{URL: gt.url, Auth: gt.auth(3, "carol")}); err == nil {
+		t.Errorf("a stranger cloned the workspace")
+	}
+	if _, err := gogit.PlainClone(t.TempDir(), false, &gogit.CloneOptions{URL: gt.url, Auth: &githttp.BasicAuth{Username: "alice", Password: "wrong"}}); err == nil {
+		t.Errorf("cloned with a wrong password")
+	}
+}
+
+// A push that touches anything but the user's own documents, deletes one,
+// or doesn't fast-forward is rejected and changes nothing.
+func TestGitPushRejected(t *testing.T) {
+	gt := newGitServerTest(t)
+	head, err := git.Head(gt.repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{"someone else's document", map[string]string{"bob.md": "mine now\n"}, "bob.md is not one of your documents"},
+		{"a new file", map[string]string{"notes.md": "notes\n"}, "notes.md is not a document"},
+		{"not markdown", map[string]string{"run.sh": "echo\n"}, "run.sh is not a document"},
+		{"deleting a document", map[string]string{"plan.md": ""}, "plan.md can't be deleted by pushing"},
+	}
+	for _, tt := range tests {
+		r, dir := gt.clone()
+		commitClone(t, r, dir, tt.name, tt.files)
+		err := r.Push(&gogit.PushOptions{Auth: gt.auth(1, "alice")})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("pushing %s: %v, want %q", tt.name, err, tt.want)
+		}
+		if now, err := git.Head(gt.repo); err != nil || now != head {
+			t.Errorf("pushing %s moved the workspace to %s (%v)", tt.name, now, err)
+		}
+	}
+
+	// Another clone's push gets in first; forcing over it is refused
+	ours, oursDir := gt.clone()
+	theirs, theirsDir := gt.clone()
+	commitClone(t, theirs, theirsDir, "Their edit", map[string]string{"plan.md": "---\nid: 1\n---\none\ntheirs\nthree\n"})
+	if err := theirs.Push(&gogit.PushOptions{Auth: gt.auth(1, "alice")}); err != nil {
+		t.Fatal(err)
+	}
+	pushed, err := git.Head(gt.repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitClone(t, ours, oursDir, "Our edit", map[string]string{"plan.md": "---\nid: 1\n---\none\nours\nthree\n"})
+	branch, _ := ours.Head()
+	spec := config.RefSpec("+" + branch.Name() + ":" + branch.Name())
+	err = ours.Push(&gogit.PushOptions{Auth: gt.auth(1, "alice"), RefSpecs: []config.RefSpec{spec}})
+	if err == nil || !strings.Contains(err.Error(), "non-fast-forward") {
+		t.Errorf("forcing a push: %v, want non-fast-forward", err)
+	}
+	if now, err := git.Head(gt.repo); err != nil || now != pushed {
+		t.Errorf("forcing a push moved the workspace to %s (%v)", now, err)
+	}
+	if got := gt.content(); got != "one\ntheirs\nthree\n" {
+		t.Errorf("document is %q, want their push", got)
+	}
+}
@@ -6,8 +6,8 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
-	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -21,6 +21,13 @@ import (
 type RegisterRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	DisplayName string `json:"display_name"`
+	Email string `json:"email"`
+}
+
+type UpdateProfileRequest struct {
+	DisplayName string `json:"display_name"`
+	Email string `json:"email"`
 }
 
 type LoginRequest struct {
@@ -31,6 +38,9 @@ type LoginRequest struct {
 type CreateDocumentRequest struct {
 	Title string `json:"title" binding:"required"`
 	Content string `json:"content"`
+	WorkspaceID int `json:"workspace_id"`
+	// Folder is where the document's file goes in the workspace's repository
+	Folder string `json:"folder"`
 }
 
 type UpdateDocumentRequest struct {
@@ -52,8 +62,9 @@ func registerHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		// The username also names the user's personal workspace
 		var count int
-		err := db.QueryRow("select count(*) from users where username = ?", req.Username).Scan(&count)
+		err := db.QueryRow("select (select count(*) from users where username = ?) + (select count(*) from workspaces where name = ?)", req.Username, req.Username).Scan(&count)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 			return 
@@ -64,27 +75,44 @@ func registerHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		req.DisplayName = strings.TrimSpace(req.DisplayName)
+		req.Email = strings.TrimSpace(req.Email)
+		if err := validateProfile(req.DisplayName, req.Email); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid credentials"})
 			return
 		}
 
-		result, err := db.Exec("insert into users (username, password_hash) values (?, ?)", 
-			req.Username, string(hashedPassword))
+		result, err := db.Exec("insert into users (username, password_hash, display_name, email) values (?, ?, ?, ?)", 
+			req.Username, string(hashedPassword), req.DisplayName, req.Email)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
 			return
 		}
 
 		userID, _ := result.LastInsertId()
+		if _, err := createWorkspace(db, req.Username, int(userID), true); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create workspace"})
+			return
+		}
 		token, err := generateToken(int(userID))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
 			return
 		}
 
-		c.JSON(http.StatusCreated, gin.H{"token": token, "user_id": userID, "username": req.Username})
+		c.JSON(http.StatusCreated, gin.H{
+			"token": token,
+			"user_id": userID,
+			"username": req.Username,
+			"display_name": req.DisplayName,
+			"email": req.Email,
+		})
 	}
 }
 
@@ -97,8 +125,9 @@ func loginHandler(db *sql.DB) gin.HandlerFunc {
 		}
 
 		var user models.User
-		err := db.QueryRow("select id, username, password_hash from users where username = ?", req.Username).Scan(
-			&user.ID, &user.Username, &user.PasswordHash)
+		var displayName, email sql.NullString
+		err := db.QueryRow("select id, username, password_hash, display_name, email from users where username = ?", req.Username).Scan(
+			&user.ID, &user.Username, &user.PasswordHash, &displayName, &email)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 			return 
@@ -117,15 +146,30 @@ func loginHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"token": token, "user_id": user.ID, "username": user.Username})
+		c.JSON(http.StatusOK, gin.H{
+			"token": token,
+			"user_id": user.ID,
+			"username": user.Username,
+			"display_name": displayName.String,
+			"email": email.String,
+		})
 	}
 }
 
+// getDocumentsHandler lists the user's documents and those in workspaces
+// they're a member of, or with ?workspace_id= those in one workspace.
 func getDocumentsHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, _ := c.Get("userID")
 		
-		rows, err := db.Query("select id, title, updated_at from docs where user_id = ? order by updated_at desc", userID)
+		query := `select id, workspace_id, title, folder, path, updated_at from docs
+			where (user_id = ? or workspace_id in (select workspace_id from workspace_members where user_id = ?))`
+		args := []interface{}{userID, userID}
+		if workspaceID := c.Query("workspace_id"); workspaceID != "" {
+			query += " and workspace_id = ?"
+			args = append(args, workspaceID)
+		}
+		rows, err := db.Query(query+" order by updated_at desc", args...)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch documents"})
 			return 
@@ -137,10 +181,13 @@ func getDocumentsHandler(db *sql.DB) gin.HandlerFunc {
 
 		for rows.Next() {
 			var doc models.Document
-			if err := rows.Scan(&doc.ID, &doc.Title, &doc.UpdatedAt); err != nil {
+			var workspaceID, path sql.NullString
+			if err := rows.Scan(&doc.ID, &workspaceID, &doc.Title, &doc.Folder, &path, &doc.UpdatedAt); err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to scan documents"})
 				return
 			}
+			doc.WorkspaceID = workspaceID.String
+			doc.Path = path.String
 			documents = append(documents, doc)
 		}
 
@@ -148,34 +195,50 @@ func getDocumentsHandler(db *sql.DB) gin.HandlerFunc {
 	}
 }
 
-func getDocumentHandler(db *sql.DB) gin.HandlerFunc {
+// getDocumentHandler returns a document, or with ?at=<time> the document as
+// it was then.
+func getDocumentHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, _ := c.Get("userID")
 		docID := c.Param("id")
 		
 		var doc models.Document
+		var workspaceID, path sql.NullString
 		
-		err := db.QueryRow("select id, user_id, title, content, updated_at from docs where id = ?", docID).
-			Scan(&doc.ID, &doc.UserID, &doc.Title, &doc.Content, &doc.UpdatedAt)
+		err := db.QueryRow("select id, user_id, workspace_id, title, folder, path, content, updated_at from docs where id = ?", docID).
+			Scan(&doc.ID, &doc.UserID, &workspaceID, &doc.Title, &doc.Folder, &path, &doc.Content, &doc.UpdatedAt)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "document not found"})
 			return 
 		}
+		doc.WorkspaceID = workspaceID.String
+		doc.Path = path.String
 		
-		// Convert both to strings for comparison
-		userIDStr := fmt.Sprintf("%v", userID)
-		docUserIDStr := fmt.Sprintf("%v", doc.UserID)
-		
-		if docUserIDStr != userIDStr {
+		allowed, err := documentAccess(db, docID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check access"})
+			return
+		}
+		if !allowed {
 			c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
 			return
 		}
 
+		if at := c.Query("at"); at != "" {
+			repo, _, err := repos.Document(docID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open repository"})
+				return
+			}
+			documentAt(c, repo, doc, at)
+			return
+		}
+
 		c.JSON(http.StatusOK, doc)
 	}
 }
 
-func createDocumentHandler(db *sql.DB, gitRepoPath string) gin.HandlerFunc {
+func createDocumentHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, _ := c.Get("userID")
 		var req CreateDocumentRequest
@@ -185,22 +248,60 @@ func createDocumentHandler(db *sql.DB, gitRepoPath string) gin.HandlerFunc {
 			return
 		}
 
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load user"})
+			return
+		}
+
+		// Documents go in the user's personal workspace unless they name
+		// one they're a member of
+		workspaceID := req.WorkspaceID
+		if workspaceID == 0 {
+			workspaceID, err = personalWorkspace(db, userID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find workspace"})
+				return
+			}
+		} else {
+			role, err := workspaceRole(db, workspaceID, userID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find workspace"})
+				return
+			}
+			if role == "" {
+				c.JSON(http.StatusForbidden, gin.H{"error": "not a member of the workspace"})
+				return
+			}
+		}
+		repo, err := repos.Workspace(workspaceID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open repository"})
+			return
+		}
+
 		now := time.Now()
 
-		result, err := db.Exec("insert into docs (user_id, title, content, updated_at) values (?, ?, ?, ?)", 
-			userID, req.Title, req.Content, now)
+		folder := normalizeFolder(req.Folder)
+
+		result, err := db.Exec("insert into docs (user_id, workspace_id, title, folder, content, updated_at) values (?, ?, ?, ?, ?, ?)", 
+			userID, workspaceID, req.Title, folder, req.Content, now)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create document"})
 			return
 		}
 		docID, _ := result.LastInsertId()
-		docPath := filepath.Join(gitRepoPath, fmt.Sprintf("%d.md", docID))
-		if err := git.SaveDocument(docPath, req.Content); err != nil {
+		file, err := placeDocument(db, repo, git.Document{ID: strconv.FormatInt(docID, 10)})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save document to git"})
+			return
+		}
+		if err := git.SaveDocument(repo, file, req.Content); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save document to git"})
 			return
 		}
 
-		if err := git.CommitChanges(gitRepoPath, fmt.Sprintf("Create document: %s", req.Title)); err != nil {
+		if _, err := git.CommitPaths(repo, []string{file.Path}, fmt.Sprintf("Create document: %s", req.Title), author, nil); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit changes"})
 			return
 		}
@@ -208,21 +309,24 @@ func createDocumentHandler(db *sql.DB, gitRepoPath string) gin.HandlerFunc {
 		c.JSON(http.StatusCreated, gin.H{
 			"id": docID,
 			"user_id": userID,
+			"workspace_id": workspaceID,
 			"title": req.Title,
+			"folder": folder,
+			"path": file.Path,
 			"content": req.Content,
 			"updated_at": now,
 		})
 	}
 }
 
-func updateDocumentHandler(db *sql.DB, gitRepoPath string, hub *ws.Hub) gin.HandlerFunc {
+func updateDocumentHandler(db *sql.DB, repos *Repos, hubs *ws.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		
 		userID, _ := c.Get("userID")
 		docID := c.Param("id")
 
-		id, err := strconv.Atoi(docID)
+		_, err := strconv.Atoi(docID)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid document id"})
 			return
@@ -243,12 +347,20 @@ func updateDocumentHandler(db *sql.DB, gitRepoPath string, hub *ws.Hub) gin.Hand
 			c.JSON(http.StatusNotFound, gin.H{"error": "document not found"})
 			return
 		}
-		userIDStr := fmt.Sprintf("%v", userID)
-		docUserIDStr := fmt.Sprintf("%v", existingDoc.UserID)
-		if userIDStr != docUserIDStr {
+		allowed, err := documentAccess(db, docID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check access"})
+			return
+		}
+		if !allowed {
 			c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
 			return
 		}
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load user"})
+			return
+		}
 		now := time.Now()
 
 		_, err = db.Exec("update docs set title = ?, content = ?, updated_at = ? where id = ?", req.Title, req.Content, now, docID)
@@ -256,29 +368,33 @@ func updateDocumentHandler(db *sql.DB, gitRepoPath string, hub *ws.Hub) gin.Hand
 			c.JSON(http.StatusNotFound, gin.H{"error": "failed to update document"})
 			return
 		}
-		docPath := filepath.Join(gitRepoPath, fmt.Sprintf("%d.md", id))
-		if err := git.SaveDocument(docPath, req.Content); err != nil {
+		repo, file, err := repos.Document(docID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open repository"})
+			return
+		}
+		// A new title renames the file
+		oldPath := file.Path
+		if file, err = placeDocument(db, repo, file); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save document to git"})
+			return
+		}
+		if err := git.SaveDocument(repo, file, req.Content); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save document to git"})
 			return
 		}
 
-		if err := git.CommitChanges(gitRepoPath, fmt.Sprintf("Create document: %s", req.Title)); err != nil {
+		if _, err := git.CommitPaths(repo, []string{oldPath, file.Path}, fmt.Sprintf("Save document: %s", req.Title), author, nil); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit changes"})
 			return
 		}
 
-		if hub != nil {
-            message := &ws.Message{
-                Type: "update",
-                Data: map[string]interface{}{
-                    "id":       id,
-                    "title":    req.Title,
-                    "content":  req.Content,
-                    "user_id":  userID,
-                },
-            }
-            hub.Broadcast <- message
-        }
+		hubs.Publish(docID, ws.Event{
+			Type:    ws.EventUpdated,
+			UserID:  fmt.Sprintf("%v", userID),
+			Title:   req.Title,
+			Content: &req.Content,
+		})
 
 		c.JSON(http.StatusCreated, gin.H{
 			"id": docID,
@@ -290,12 +406,12 @@ func updateDocumentHandler(db *sql.DB, gitRepoPath string, hub *ws.Hub) gin.Hand
 	}
 }
 
-func deleteDocumentHandler(db *sql.DB, gitRepoPath string) gin.HandlerFunc {
+func deleteDocumentHandler(db *sql.DB, repos *Repos, hubs *ws.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, _ := c.Get("userID")
 		docID := c.Param("id")
 
-		id, err := strconv.Atoi(docID)
+		_, err := strconv.Atoi(docID)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid document id"})
 			return
@@ -312,55 +428,212 @@ func deleteDocumentHandler(db *sql.DB, gitRepoPath string) gin.HandlerFunc {
 		}
 
 		
-		userIDStr := fmt.Sprintf("%v", userID)
-		docUserIDStr := fmt.Sprintf("%v", existingDoc.UserID)
-
-		if userIDStr != docUserIDStr {
+		allowed, err := documentAccess(db, docID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check access"})
+			return
+		}
+		if !allowed {
 			c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
 			return
 		}
 
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load user"})
+			return
+		}
+		repo, file, err := repos.Document(docID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open repository"})
+			return
+		}
+
 		_, err = db.Exec("delete from docs where id = ?", docID)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "document not found"})
 			return
 		}
-		docPath := filepath.Join(gitRepoPath, fmt.Sprintf("%d.md", id))
-		if err := git.DeleteDocument(docPath); err != nil {
+		if _, err := db.Exec("delete from doc_crdt_state where doc_id = ?", docID); err != nil {
+			log.Printf("Failed to delete crdt state of document %s: %v", docID, err)
+		}
+		if _, err := db.Exec("delete from merge_request_comments where merge_request_id in (select id from merge_requests where doc_id = ?)", docID); err != nil {
+			log.Printf("Failed to delete merge request comments of document %s: %v", docID, err)
+		}
+		if _, err := db.Exec("delete from merge_requests where doc_id = ?", docID); err != nil {
+			log.Printf("Failed to delete merge requests of document %s: %v", docID, err)
+		}
+
+		// Disconnect anyone still editing before the file goes away
+		hubs.Publish(docID, ws.Event{
+			Type:   ws.EventDeleted,
+			UserID: fmt.Sprintf("%v", userID),
+		})
+		if err := git.DeleteDocument(repo, file); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete document from git"})
 			return
 		}
 
-		if err := git.CommitChanges(gitRepoPath, fmt.Sprintf("Delete document: %s", existingDoc.Title)); err != nil {
+		if _, err := git.CommitPaths(repo, []string{file.Path}, fmt.Sprintf("Delete document: %s", existingDoc.Title), author, nil); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit changes"})
 			return
 		}
+		if err := git.DeleteDocumentTags(repo, docID); err != nil {
+			log.Printf("Failed to delete tags of document %s: %v", docID, err)
+		}
+		if err := git.DeleteDrafts(repo, docID); err != nil {
+			log.Printf("Failed to delete drafts of document %s: %v", docID, err)
+		}
 
 		c.JSON(http.StatusOK, gin.H{"message": "document deleted sucdessfully"})
 	}
 }
 
-func getDocumentHistoryHandler(gitRepoPath string) gin.HandlerFunc {
+type RenameDocumentRequest struct {
+	Title string `json:"title" binding:"required"`
+}
+
+// renameDocumentHandler renames a document, and its file to match, which is
+// committed as a rename.
+func renameDocumentHandler(db *sql.DB, repos *Repos, hubs *ws.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
 		docID := c.Param("id")
 
-		id, err := strconv.Atoi(docID)
+		var req RenameDocumentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var existingDoc models.Document
+		err := db.QueryRow("select user_id from docs where id = ?", docID).
+			Scan(&existingDoc.UserID)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid document id"})
+			c.JSON(http.StatusNotFound, gin.H{"error": "document not found"})
+			return
+		}
+		allowed, err := documentAccess(db, docID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check access"})
+			return
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
 			return
 		}
-		docPath := filepath.Join(gitRepoPath, fmt.Sprintf("%d.md", id))
-		history, err := git.GetDocumentHistory(gitRepoPath, docPath)
 
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load user"})
+			return
+		}
+		repo, file, err := repos.Document(docID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch document history"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open repository"})
 			return
 		}
 
-		c.JSON(http.StatusOK, history)
+		now := time.Now()
+		_, err = db.Exec("update docs set title = ?, updated_at = ? where id = ?", req.Title, now, docID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rename document"})
+			return
+		}
+		renamed, err := placeDocument(db, repo, file)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rename document file"})
+			return
+		}
+		if renamed.Path != file.Path {
+			if _, err := git.CommitPaths(repo, []string{file.Path, renamed.Path}, fmt.Sprintf("Rename document: %s", req.Title), author, nil); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit changes"})
+				return
+			}
+		}
+
+		hubs.Publish(docID, ws.Event{
+			Type:   ws.EventRenamed,
+			UserID: fmt.Sprintf("%v", userID),
+			Title:  req.Title,
+		})
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":         docID,
+			"title":      req.Title,
+			"path":       renamed.Path,
+			"updated_at": now,
+		})
 	}
 }
-func createDocumentVersionHandler(db *sql.DB, gitRepoPath string) gin.HandlerFunc {
+
+type MoveDocumentRequest struct {
+	Folder string `json:"folder"`
+}
+
+// moveDocumentHandler moves a document to another folder of its workspace's
+// repository, committed as a rename. An empty folder is the top of the
+// repository. Clients of the document hear of it as a rename.
+func moveDocumentHandler(db *sql.DB, repos *Repos, hubs *ws.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+
+		var req MoveDocumentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load user"})
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		folder := normalizeFolder(req.Folder)
+		now := time.Now()
+		if _, err := db.Exec("update docs set folder = ?, updated_at = ? where id = ?", folder, now, doc.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to move document"})
+			return
+		}
+		file := documentFile(doc)
+		moved, err := placeDocument(db, repo, file)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to move document file"})
+			return
+		}
+		if moved.Path != file.Path {
+			message := fmt.Sprintf("Move document: %s to /%s", doc.Title, folder)
+			if _, err := git.CommitPaths(repo, []string{file.Path, moved.Path}, message, author, nil); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit changes"})
+				return
+			}
+		}
+
+		hubs.Publish(doc.ID, ws.Event{
+			Type:   ws.EventRenamed,
+			UserID: fmt.Sprintf("%v", userID),
+			Title:  doc.Title,
+		})
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":         doc.ID,
+			"folder":     folder,
+			"path":       moved.Path,
+			"updated_at": now,
+		})
+	}
+}
+
+func createDocumentVersionHandler(db *sql.DB, repos *Repos, hubs *ws.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, _ := c.Get("userID")
 		docID := c.Param("id")
@@ -386,14 +659,24 @@ func createDocumentVersionHandler(db *sql.DB, gitRepoPath string) gin.HandlerFun
 			return
 		}
 
-		userIDStr := fmt.Sprintf("%v", userID)
-		docUserIDStr := fmt.Sprintf("%v", existingDoc.UserID)
-
-		if userIDStr != docUserIDStr {
+		allowed, err := documentAccess(db, docID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+			return
+		}
+		if !allowed {
 			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 			return
 		}
 
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+		// Whoever is editing live shares the credit for the version
+		coAuthors := sessionCoAuthors(db, hubs, docID, author)
+
 		// Update the document in the database
 		now := time.Now()
 		_, err = db.Exec("UPDATE docs SET title = ?, content = ?, updated_at = ? WHERE id = ?",
@@ -404,8 +687,18 @@ func createDocumentVersionHandler(db *sql.DB, gitRepoPath string) gin.HandlerFun
 		}
 
 		// Save to git and commit with the provided comment
-		docPath := filepath.Join(gitRepoPath, fmt.Sprintf("%d.md", id))
-		if err := git.SaveDocument(docPath, req.Content); err != nil {
+		repo, file, err := repos.Document(docID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open repository"})
+			return
+		}
+		// A new title renames the file
+		oldPath := file.Path
+		if file, err = placeDocument(db, repo, file); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save document to git"})
+			return
+		}
+		if err := git.SaveDocument(repo, file, req.Content); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save document to git"})
 			return
 		}
@@ -415,12 +708,21 @@ func createDocumentVersionHandler(db *sql.DB, gitRepoPath string) gin.HandlerFun
 			commitMessage = fmt.Sprintf("Update document: %s", req.Title)
 		}
 
-		commitHash, err := git.CommitChangesWithHash(gitRepoPath, commitMessage)
+		commitHash, err := git.CommitPaths(repo, []string{oldPath, file.Path}, commitMessage, author, coAuthors)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit changes"})
 			return
 		}
 
+		hubs.Publish(docID, ws.Event{
+			Type:    ws.EventVersion,
+			UserID:  fmt.Sprintf("%v", userID),
+			Title:   req.Title,
+			Content: &req.Content,
+			Hash:    commitHash,
+			Message: commitMessage,
+		})
+
 		c.JSON(http.StatusOK, gin.H{
 			"id":         id,
 			"hash":       commitHash,
@@ -500,7 +802,7 @@ func getDocumentByShareHandler(db *sql.DB) gin.HandlerFunc {
 	}
 }
 
-func getDocumentPermissionsHandler(db *sql.DB) gin.HandlerFunc {
+func getDocumentPermissionsHandler(db *sql.DB, hubs *ws.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, _ := c.Get("userID")
 		docID := c.Param("id")
@@ -556,10 +858,8 @@ func getDocumentPermissionsHandler(db *sql.DB) gin.HandlerFunc {
 			})
 		}
 		
-		// Get active collaborators
-		var collaborators []gin.H
-		// This would typically be populated from an active sessions table
-		// or from WebSocket connections, but we'll leave it empty for simplicity
+		// Get active collaborators from the document's live hub
+		collaborators := hubs.Collaborators(docID)
 		
 		c.JSON(http.StatusOK, gin.H{
 			"is_owner": isOwner,
@@ -571,28 +871,7 @@ func getDocumentPermissionsHandler(db *sql.DB) gin.HandlerFunc {
 }
 
 
-func getDocumentVersionsHandler(gitRepoPath string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		docID := c.Param("id")
-		
-		id, err := strconv.Atoi(docID)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
-			return
-		}
-
-		docPath := filepath.Join(gitRepoPath, fmt.Sprintf("%d.md", id))
-		history, err := git.GetDocumentHistory(gitRepoPath, docPath)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch document versions"})
-			return
-		}
-
-		c.JSON(http.StatusOK, history)
-	}
-}
-
-func restoreDocumentVersionHandler(db *sql.DB, gitRepoPath string) gin.HandlerFunc {
+func restoreDocumentVersionHandler(db *sql.DB, repos *Repos, hubs *ws.Registry) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Log request information
 		docID := c.Param("id")
@@ -629,22 +908,38 @@ func restoreDocumentVersionHandler(db *sql.DB, gitRepoPath string) gin.HandlerFu
 		log.Printf("DB: Document found, owner user_id: %v", existingDoc.UserID)
 
 		// Log the permissions check
-		userIDStr := fmt.Sprintf("%v", userID)
-		docUserIDStr := fmt.Sprintf("%v", existingDoc.UserID)
-		log.Printf("PERMISSION CHECK: Current user: %s, Document owner: %s", userIDStr, docUserIDStr)
+		allowed, err := documentAccess(db, docID, userID)
+		if err != nil {
+			log.Printf("ERROR: Failed to check access to document %s: %v", docID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+			return
+		}
+		log.Printf("PERMISSION CHECK: Current user: %v, Document owner: %v, allowed: %v", userID, existingDoc.UserID, allowed)
 
-		if userIDStr != docUserIDStr {
-			log.Printf("ACCESS DENIED: User %s attempted to restore document %s owned by user %s", 
-				userIDStr, docID, docUserIDStr)
+		if !allowed {
+			log.Printf("ACCESS DENIED: User %v attempted to restore document %s owned by user %v", 
+				userID, docID, existingDoc.UserID)
 			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 			return
 		}
-		log.Printf("ACCESS GRANTED: User %s has permission to restore document %s", userIDStr, docID)
+		log.Printf("ACCESS GRANTED: User %v has permission to restore document %s", userID, docID)
+
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			log.Printf("ERROR: Failed to load user %v: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
 
 		// Get the content from the specified version
-		docPath := filepath.Join(gitRepoPath, fmt.Sprintf("%d.md", id))
-		log.Printf("GIT: Retrieving content at path %s for version %s", docPath, versionHash)
-		content, err := git.GetDocumentContentAtVersion(gitRepoPath, docPath, versionHash)
+		repo, file, err := repos.Document(docID)
+		if err != nil {
+			log.Printf("ERROR: Failed to open repository: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open repository"})
+			return
+		}
+		log.Printf("GIT: Retrieving content at path %s for version %s", file.Path, versionHash)
+		content, err := git.GetDocumentContentAtVersion(repo, file, versionHash)
 		if err != nil {
 			log.Printf("ERROR: Failed to get version content: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve version content"})
@@ -677,8 +972,8 @@ func restoreDocumentVersionHandler(db *sql.DB, gitRepoPath string) gin.HandlerFu
 		log.Printf("DB: Update successful, rows affected: %d", rowsAffected)
 
 		// Save to git and create a new commit indicating restoration
-		log.Printf("GIT: Saving document to path: %s", docPath)
-		if err := git.SaveDocument(docPath, content); err != nil {
+		log.Printf("GIT: Saving document to path: %s", file.Path)
+		if err := git.SaveDocument(repo, file, content); err != nil {
 			log.Printf("ERROR: Failed to save document to git: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save document to git"})
 			return
@@ -687,7 +982,7 @@ func restoreDocumentVersionHandler(db *sql.DB, gitRepoPath string) gin.HandlerFu
 
 		commitMessage := fmt.Sprintf("Restored document '%s' to version %s", title, versionHash[:7])
 		log.Printf("GIT: Creating commit with message: %s", commitMessage)
-		newHash, err := git.CommitChangesWithHash(gitRepoPath, commitMessage)
+		newHash, err := git.CommitDocumentAs(repo, file, commitMessage, author, nil)
 		if err != nil {
 			log.Printf("ERROR: Failed to commit changes: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit changes"})
@@ -695,6 +990,15 @@ func restoreDocumentVersionHandler(db *sql.DB, gitRepoPath string) gin.HandlerFu
 		}
 		log.Printf("GIT: Changes committed successfully with hash: %s", newHash)
 
+		hubs.Publish(docID, ws.Event{
+			Type:    ws.EventRestored,
+			UserID:  fmt.Sprintf("%v", userID),
+			Title:   title,
+			Content: &content,
+			Hash:    newHash,
+			Message: commitMessage,
+		})
+
 		c.JSON(http.StatusOK, gin.H{
 			"id":         id,
 			"hash":       newHash,
@@ -734,10 +1038,12 @@ func shareDocumentHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		userIDStr := fmt.Sprintf("%v", userID)
-		docUserIDStr := fmt.Sprintf("%v", existingDoc.UserID)
-
-		if userIDStr != docUserIDStr {
+		allowed, err := documentAccess(db, docID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+			return
+		}
+		if !allowed {
 			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
 			return
 		}
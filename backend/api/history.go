@@ -0,0 +1,236 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/git"
+)
+
+const (
+	defaultVersionsLimit = 50
+	maxVersionsLimit     = 200
+)
+
+// historyMutex keeps the history index from being updated twice at once.
+var historyMutex sync.Mutex
+
+// indexHistory brings the history index of a repository up to HEAD,
+// walking only the commits made since it was last brought up to date. If
+// history was rewritten under it, it is built again.
+func indexHistory(db *sql.DB, repo *git.Repo) error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	var indexed string
+	err := db.QueryRow("select head from commit_index_state where repo_path = ?", repo.Path).Scan(&indexed)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("load indexed head: %w", err)
+	}
+	head, err := git.Head(repo)
+	if err != nil {
+		return err
+	}
+	if head == indexed {
+		return nil
+	}
+
+	walk, err := git.HistorySince(repo, func(hash string) (bool, error) {
+		var count int
+		err := db.QueryRow("select count(*) from commit_index where repo_path = ? and hash = ?", repo.Path, hash).Scan(&count)
+		return count > 0, err
+	})
+	if err != nil {
+		return err
+	}
+	rewritten := indexed != ""
+	for _, hash := range walk.Reached {
+		if hash == indexed {
+			rewritten = false
+		}
+	}
+	if rewritten {
+		if err := clearHistoryIndex(db, repo); err != nil {
+			return err
+		}
+		walk, err = git.HistorySince(repo, func(string) (bool, error) { return false, nil })
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var seq int
+	if err := tx.QueryRow("select coalesce(max(seq), 0) from commit_index where repo_path = ?", repo.Path).Scan(&seq); err != nil {
+		return fmt.Errorf("load history index: %w", err)
+	}
+	for _, commit := range walk.Commits {
+		seq++
+		_, err := tx.Exec("insert into commit_index (repo_path, hash, seq, message, author, author_email, timestamp) values (?, ?, ?, ?, ?, ?, ?)",
+			repo.Path, commit.Hash, seq, commit.Message, commit.Author, commit.AuthorEmail, commit.Timestamp.UTC())
+		if err != nil {
+			return fmt.Errorf("index commit %s: %w", commit.Hash, err)
+		}
+		for documentID, path := range commit.Documents {
+			_, err := tx.Exec("insert into commit_documents (repo_path, hash, doc_id, path) values (?, ?, ?, ?)", repo.Path, commit.Hash, documentID, path)
+			if err != nil {
+				return fmt.Errorf("index commit %s: %w", commit.Hash, err)
+			}
+		}
+	}
+	_, err = tx.Exec(`insert into commit_index_state (repo_path, head, updated_at) values (?, ?, ?)
+		on conflict(repo_path) do update set head = excluded.head, updated_at = excluded.updated_at`,
+		repo.Path, walk.Head, time.Now())
+	if err != nil {
+		return fmt.Errorf("save indexed head: %w", err)
+	}
+	return tx.Commit()
+}
+
+// clearHistoryIndex forgets a repository's history, to be indexed again
+// when it's next read.
+func clearHistoryIndex(db *sql.DB, repo *git.Repo) error {
+	for _, table := range []string{"commit_documents", "commit_index", "commit_index_state"} {
+		if _, err := db.Exec("delete from "+table+" where repo_path = ?", repo.Path); err != nil {
+			return fmt.Errorf("clear history index: %w", err)
+		}
+	}
+	return nil
+}
+
+// VersionPage is a page of a document's history, newest first.
+type VersionPage struct {
+	Versions []git.Commit `json:"versions"`
+	// NextCursor fetches the next page; it's empty on the last one.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// getDocumentVersionsHandler lists a document's versions from the history
+// index, newest first, a page at a time. Query parameters:
+//
+//	limit   versions per page, 50 by default and at most 200
+//	cursor  the next_cursor of the previous page
+//	author  only versions by this author, by name or email
+//	since   only versions made at or after this time
+//	until   only versions made at or before this time
+//	q       only versions whose message contains this text
+//	named   only versions the document has tags for, if true
+func getDocumentVersionsHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		limit := defaultVersionsLimit
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxVersionsLimit {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid limit, use 1 to %d", maxVersionsLimit)})
+				return
+			}
+			limit = n
+		}
+
+		query := `select c.hash, c.message, c.author, c.author_email, c.timestamp, d.path
+			from commit_documents d join commit_index c on c.repo_path = d.repo_path and c.hash = d.hash
+			where d.repo_path = ? and d.doc_id = ?`
+		args := []interface{}{repo.Path, doc.ID}
+		for _, bound := range []struct{ param, op string }{{"since", ">="}, {"until", "<="}} {
+			v := c.Query(bound.param)
+			if v == "" {
+				continue
+			}
+			t, err := parseTime(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			query += " and c.timestamp " + bound.op + " ?"
+			args = append(args, t.UTC())
+		}
+		if author := c.Query("author"); author != "" {
+			query += " and (c.author = ? collate nocase or c.author_email = ? collate nocase)"
+			args = append(args, author, author)
+		}
+		if text := c.Query("q"); text != "" {
+			query += " and instr(lower(c.message), lower(?)) > 0"
+			args = append(args, text)
+		}
+		if named, _ := strconv.ParseBool(c.Query("named")); named {
+			tags, err := git.ListDocumentTags(repo, doc.ID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list tags"})
+				return
+			}
+			if len(tags) == 0 {
+				c.JSON(http.StatusOK, VersionPage{Versions: []git.Commit{}})
+				return
+			}
+			placeholders := make([]string, len(tags))
+			for i, tag := range tags {
+				placeholders[i] = "?"
+				args = append(args, tag.Hash)
+			}
+			query += " and c.hash in (" + strings.Join(placeholders, ", ") + ")"
+		}
+
+		if err := indexHistory(db, repo); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch document versions"})
+			return
+		}
+		if cursor := c.Query("cursor"); cursor != "" {
+			var seq int
+			err := db.QueryRow("select seq from commit_index where repo_path = ? and hash = ?", repo.Path, cursor).Scan(&seq)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+				return
+			}
+			query += " and c.seq < ?"
+			args = append(args, seq)
+		}
+		query += " order by c.seq desc limit ?"
+		args = append(args, limit+1)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch document versions"})
+			return
+		}
+		defer rows.Close()
+		page := VersionPage{Versions: []git.Commit{}}
+		for rows.Next() {
+			var version git.Commit
+			if err := rows.Scan(&version.Hash, &version.Message, &version.Author, &version.AuthorEmail, &version.Timestamp, &version.Path); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch document versions"})
+				return
+			}
+			version.CoAuthors = git.ParseCoAuthors(version.Message)
+			page.Versions = append(page.Versions, version)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch document versions"})
+			return
+		}
+		if len(page.Versions) > limit {
+			page.Versions = page.Versions[:limit]
+			page.NextCursor = page.Versions[limit-1].Hash
+		}
+		c.JSON(http.StatusOK, page)
+	}
+}
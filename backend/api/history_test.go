@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"docsmith/git"
+)
+
+// commitAt saves plan.md and commits it as author, made at a given time.
+func (st *syncTest) commitAt(content string, message string, author git.Author, at time.Time) string {
+	st.t.Helper()
+	if err := git.SaveDocument(st.repo, git.Document{ID: "1", Path: "plan.md"}, content); err != nil {
+		st.t.Fatal(err)
+	}
+	r, err := gogit.PlainOpen(st.repo.Path)
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	if _, err := w.Add("plan.md"); err != nil {
+		st.t.Fatal(err)
+	}
+	signature := &object.Signature{Name: author.Name, Email: author.Email, When: at}
+	hash, err := w.Commit(message, &gogit.CommitOptions{Author: signature, Committer: signature})
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	return hash.String()
+}
+
+func TestDocumentVersions(t *testing.T) {
+	st := newSyncTest(t)
+	alice := git.Author{Name: "alice", Email: "alice@example.com"}
+	bob := git.Author{Name: "bob", Email: "Bob@Example.com"}
+	var hashes []string
+	monday := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		author := alice
+		if i%2 == 1 {
+			author = bob
+		}
+		message := fmt.Sprintf("Save document: Plan\n\nEdit %d", i)
+		if i == 3 {
+			message = "Tidy up the wording"
+		}
+		hashes = append(hashes, st.commitAt(fmt.Sprintf("revision %d\n", i), message, author, monday.Add(time.Duration(i)*24*time.Hour)))
+	}
+	// Other documents' commits aren't versions
+	other := git.Document{ID: "2", Path: "other.md"}
+	if err := git.SaveDocument(st.repo, other, "other\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.CommitDocumentAs(st.repo, other, "Create document: Other", alice, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/documents/:id/versions", func(c *gin.Context) {
+		c.Set("userID", 1)
+	}, getDocumentVersionsHandler(st.db, st.syncer.repos))
+	versions := func(query url.Values) (int, VersionPage) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/documents/1/versions?"+query.Encode(), nil))
+		var page VersionPage
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, page
+	}
+	// short lists a page's versions by their index in hashes
+	short := func(page VersionPage) string {
+		var found []string
+		for _, v := range page.Versions {
+			name := v.Hash[:7]
+			for i, hash := range hashes {
+				if hash == v.Hash {
+					name = fmt.Sprint(i)
+				}
+			}
+			found = append(found, name)
+		}
+		return strings.Join(found, ",")
+	}
+
+	// Pages follow each other, newest first, down to the document's creation
+	var all []string
+	cursor := ""
+	for pages := 0; pages < 5; pages++ {
+		code, page := versions(url.Values{"limit": {"2"}, "cursor": {cursor}})
+		if code != http.StatusOK {
+			t.Fatalf("page %d answered %d", pages, code)
+		}
+		all = append(all, short(page))
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	created := st.parentOf(hashes[0])
+	if got, want := strings.Join(all, "|"), "4,3|2,1|0,"+created[:7]; got != want {
+		t.Errorf("pages are %s, want %s", got, want)
+	}
+
+	tests := []struct {
+		query url.Values
+		want  string
+	}{
+		{url.Values{"author": {"bob"}}, "3,1"},
+		{url.Values{"author": {"bob@example.com"}}, "3,1"},
+		{url.Values{"q": {"WORDING"}}, "3"},
+		{url.Values{"q": {"edit 1"}}, "1"},
+		{url.Values{"since": {"2026-03-03T09:00:00Z"}, "until": {"2026-03-05T00:00Z"}}, "2,1"},
+		{url.Values{"author": {"alice"}, "until": {"2026-03-04T09:00:00Z"}, "limit": {"1"}}, "2"},
+		{url.Values{"named": {"true"}}, ""},
+	}
+	for _, tt := range tests {
+		if code, page := versions(tt.query); code != http.StatusOK || short(page) != tt.want {
+			t.Errorf("%s: found %s (%d), want %s", tt.query.Encode(), short(page), code, tt.want)
+		}
+	}
+
+	if _, err := git.TagDocumentVersion(st.repo, git.Document{ID: "1", Path: "plan.md"}, "v1", hashes[2], "", alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, page := versions(url.Values{"named": {"true"}}); short(page) != "2" {
+		t.Errorf("named versions are %s, want 2", short(page))
+	}
+
+	for _, query := range []url.Values{{"limit": {"0"}}, {"limit": {"201"}}, {"cursor": {"nonsense"}}, {"since": {"last week"}}} {
+		if code, _ := versions(query); code != http.StatusBadRequest {
+			t.Errorf("%s answered %d", query.Encode(), code)
+		}
+	}
+
+	// New commits are indexed as they come, and rewritten history is
+	// indexed again
+	newest := st.commitAt("revision 5\n", "Save document: Plan", alice, monday.Add(7*24*time.Hour))
+	if _, page := versions(url.Values{"limit": {"1"}}); len(page.Versions) != 1 || page.Versions[0].Hash != newest {
+		t.Errorf("latest version is %+v, want %s", page.Versions, newest)
+	}
+	r, err := gogit.PlainOpen(st.repo.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reset(&gogit.ResetOptions{Commit: plumbing.NewHash(hashes[1]), Mode: gogit.HardReset}); err != nil {
+		t.Fatal(err)
+	}
+	hashes = append(hashes[:2], st.commitAt("rewritten\n", "Rewrite", bob, monday.Add(8*24*time.Hour)))
+	if _, page := versions(nil); short(page) != "2,1,0,"+created[:7] {
+		t.Errorf("versions after a rewrite are %s", short(page))
+	}
+}
+
+// parentOf is the first parent of a commit.
+func (st *syncTest) parentOf(hash string) string {
+	st.t.Helper()
+	r, err := gogit.PlainOpen(st.repo.Path)
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	c, err := r.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	return c.ParentHashes[0].String()
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"docsmith/git"
+	"docsmith/ws"
+)
+
+// hubStore gives the websocket hubs access to documents in the database and
+// the git repositories.
+type hubStore struct {
+	db    *sql.DB
+	repos *Repos
+}
+
+// NewHubStore returns the ws.Store backing document hubs with the database
+// and the git repositories.
+func NewHubStore(db *sql.DB, repos *Repos) ws.Store {
+	return &hubStore{db: db, repos: repos}
+}
+
+func (s *hubStore) LoadDocument(documentID string) (string, error) {
+	var content sql.NullString
+	err := s.db.QueryRow("select content from docs where id = ?", documentID).Scan(&content)
+	return content.String, err
+}
+
+func (s *hubStore) LoadCRDTState(documentID string) ([]byte, error) {
+	var state []byte
+	err := s.db.QueryRow("select state from doc_crdt_state where doc_id = ?", documentID).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return state, err
+}
+
+func (s *hubStore) SaveDocument(documentID string, content string, crdtState []byte) error {
+	now := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("update docs set content = ?, updated_at = ? where id = ?", content, now, documentID); err != nil {
+		return fmt.Errorf("update document: %w", err)
+	}
+	if crdtState != nil {
+		_, err = tx.Exec(`insert into doc_crdt_state (doc_id, state, updated_at) values (?, ?, ?)
+			on conflict(doc_id) do update set state = excluded.state, updated_at = excluded.updated_at`,
+			documentID, crdtState, now)
+		if err != nil {
+			return fmt.Errorf("save crdt state: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *hubStore) CommitDocument(documentID string, content string, participants []ws.Participant) error {
+	var title string
+	if err := s.db.QueryRow("select title from docs where id = ?", documentID).Scan(&title); err != nil {
+		return fmt.Errorf("load document: %w", err)
+	}
+
+	repo, file, err := s.repos.Document(documentID)
+	if err != nil {
+		return err
+	}
+	if err := git.SaveDocument(repo, file, content); err != nil {
+		return fmt.Errorf("save document to git: %w", err)
+	}
+
+	author := git.SystemAuthor
+	var coAuthors []git.Author
+	for i, p := range participants {
+		if i == 0 {
+			author = participantAuthor(s.db, p)
+		} else {
+			coAuthors = append(coAuthors, participantAuthor(s.db, p))
+		}
+	}
+
+	message := fmt.Sprintf("Autosave document: %s", title)
+	if _, err := git.CommitDocumentAs(repo, file, message, author, coAuthors); err != nil {
+		return fmt.Errorf("commit changes: %w", err)
+	}
+	return nil
+}
+
+// RenameDocument renames a document as renameDocumentHandler does, moving
+// its file to go with the new title.
+func (s *hubStore) RenameDocument(documentID string, title string, by ws.Participant) error {
+	repo, file, err := s.repos.Document(documentID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("update docs set title = ?, updated_at = ? where id = ?", title, time.Now(), documentID); err != nil {
+		return fmt.Errorf("rename document: %w", err)
+	}
+	renamed, err := placeDocument(s.db, repo, file)
+	if err != nil {
+		return err
+	}
+	if renamed.Path != file.Path {
+		if _, err := git.CommitPaths(repo, []string{file.Path, renamed.Path}, fmt.Sprintf("Rename document: %s", title), participantAuthor(s.db, by), nil); err != nil {
+			return fmt.Errorf("commit rename: %w", err)
+		}
+	}
+	return nil
+}
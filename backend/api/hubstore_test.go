@@ -0,0 +1,65 @@
+package api
+
+import (
+	"os"
+	"testing"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"docsmith/git"
+	"docsmith/ws"
+)
+
+// A title given over the socket is kept, and the file renamed to match.
+func TestHubStoreRenameDocument(t *testing.T) {
+	st := newSyncTest(t)
+	store := NewHubStore(st.db, st.syncer.repos)
+	if err := store.RenameDocument("1", "Road Map", ws.Participant{UserID: "1", Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var title, path string
+	if err := st.db.QueryRow("select title, path from docs where id = 1").Scan(&title, &path); err != nil {
+		t.Fatal(err)
+	}
+	if title != "Road Map" || path != "road-map.md" {
+		t.Errorf("document is %q at %s", title, path)
+	}
+	if _, err := os.Stat(st.repo.DocumentPath(git.Document{Path: "plan.md"})); !os.IsNotExist(err) {
+		t.Errorf("plan.md is still there: %v", err)
+	}
+	head, err := git.Head(st.repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := st.lastCommit(); last.Message != "Rename document: Road Map" || last.Author.Name != "alice" {
+		t.Errorf("last commit is %q by %s", last.Message, last.Author.Name)
+	}
+
+	// Keeping the title leaves the file where it is
+	if err := store.RenameDocument("1", "Road Map", ws.Participant{UserID: "1", Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := git.Head(st.repo); err != nil || again != head {
+		t.Errorf("renaming to the same title committed %s (%v)", again, err)
+	}
+}
+
+// lastCommit is the commit at the head of the workspace's repository.
+func (st *syncTest) lastCommit() *object.Commit {
+	st.t.Helper()
+	r, err := gogit.PlainOpen(st.repo.Path)
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	head, err := r.Head()
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	c, err := r.CommitObject(head.Hash())
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"docsmith/git"
+	"docsmith/models"
+)
+
+// documentFile is where a document loaded by memberDocument is kept in its
+// workspace's repository.
+func documentFile(doc models.Document) git.Document {
+	return git.Document{ID: doc.ID, Path: doc.Path}
+}
+
+// normalizeFolder turns a folder as a user gives it into a path of slugs,
+// so "Design Docs/API" becomes "design-docs/api". The top of the
+// repository is "".
+func normalizeFolder(folder string) string {
+	var parts []string
+	for _, part := range strings.Split(strings.ReplaceAll(folder, `\`, "/"), "/") {
+		if strings.TrimSpace(part) != "" {
+			parts = append(parts, git.Slug(part))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// documentPath is where a document's file goes: in its folder, named after
+// a slug of its title. A name already taken, by another document of the
+// workspace or any other file, is made unique with the document's ID. The
+// README at the top of the repository is never taken over.
+func documentPath(db *sql.DB, repo *git.Repo, doc git.Document, workspaceID int, folder string, title string) (string, error) {
+	taken := func(p string) (bool, error) {
+		if p == doc.Path {
+			return false, nil
+		}
+		if strings.EqualFold(p, "README.md") {
+			return true, nil
+		}
+		if _, err := os.Stat(repo.DocumentPath(git.Document{Path: p})); err == nil {
+			return true, nil
+		}
+		var count int
+		err := db.QueryRow("select count(*) from docs where workspace_id = ? and path = ? and id != ?", workspaceID, p, doc.ID).Scan(&count)
+		return count > 0, err
+	}
+
+	slug := git.Slug(title)
+	for _, name := range []string{slug, slug + "-" + doc.ID} {
+		p := path.Join(folder, name+".md")
+		isTaken, err := taken(p)
+		if err != nil {
+			return "", fmt.Errorf("check path %s: %w", p, err)
+		}
+		if !isTaken {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("no free path for document %s in %q", doc.ID, folder)
+}
+
+// placeDocument moves a document's file to where its folder and title, as
+// the database has them, now put it, and records its new path. The move is
+// left for the caller to commit. It returns where the document is kept.
+func placeDocument(db *sql.DB, repo *git.Repo, doc git.Document) (git.Document, error) {
+	var workspaceID int
+	var folder, title string
+	if err := db.QueryRow("select workspace_id, folder, title from docs where id = ?", doc.ID).Scan(&workspaceID, &folder, &title); err != nil {
+		return doc, fmt.Errorf("load document %s: %w", doc.ID, err)
+	}
+	p, err := documentPath(db, repo, doc, workspaceID, folder, title)
+	if err != nil {
+		return doc, err
+	}
+	placed := git.Document{ID: doc.ID, Path: p}
+	if doc.Path != "" && doc.Path != p {
+		if err := git.MoveDocument(repo, doc, placed); err != nil {
+			return doc, err
+		}
+	}
+	if _, err := db.Exec("update docs set path = ? where id = ?", p, doc.ID); err != nil {
+		return doc, fmt.Errorf("record path of document %s: %w", doc.ID, err)
+	}
+	return placed, nil
+}
+
+// MoveToReadablePaths moves the files of documents from before files were
+// named after titles, kept as <id>.md at the top of the repository, to
+// where placeDocument puts them, adding their ID as front matter. Each
+// workspace gets one commit.
+func (r *Repos) MoveToReadablePaths() error {
+	rows, err := r.db.Query("select id, workspace_id, content from docs where path is null and workspace_id is not null order by id")
+	if err != nil {
+		return fmt.Errorf("list documents: %w", err)
+	}
+	type legacyDocument struct {
+		id      string
+		content string
+	}
+	workspaces := make(map[int][]legacyDocument)
+	var order []int
+	for rows.Next() {
+		var doc legacyDocument
+		var workspaceID int
+		var content sql.NullString
+		if err := rows.Scan(&doc.id, &workspaceID, &content); err != nil {
+			rows.Close()
+			return fmt.Errorf("list documents: %w", err)
+		}
+		doc.content = content.String
+		if _, ok := workspaces[workspaceID]; !ok {
+			order = append(order, workspaceID)
+		}
+		workspaces[workspaceID] = append(workspaces[workspaceID], doc)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("list documents: %w", err)
+	}
+
+	for _, workspaceID := range order {
+		repo, err := r.Workspace(workspaceID)
+		if err != nil {
+			return fmt.Errorf("open repository of workspace %d: %w", workspaceID, err)
+		}
+		var paths []string
+		for _, doc := range workspaces[workspaceID] {
+			legacy := git.Document{ID: doc.id, Path: git.LegacyPath(doc.id)}
+			// keep the file's content, so the commit only moves it; a
+			// document without a file starts from the database's
+			content := doc.content
+			if raw, err := os.ReadFile(repo.DocumentPath(legacy)); err == nil {
+				_, content = git.DecodeDocument(string(raw))
+				paths = append(paths, legacy.Path)
+			} else {
+				legacy.Path = ""
+			}
+
+			placed, err := placeDocument(r.db, repo, legacy)
+			if err != nil {
+				return err
+			}
+			if err := git.SaveDocument(repo, placed, content); err != nil {
+				return fmt.Errorf("save document %s: %w", doc.id, err)
+			}
+			paths = append(paths, placed.Path)
+		}
+		if _, err := git.CommitPaths(repo, paths, "Name document files after their titles", git.SystemAuthor, nil); err != nil {
+			return fmt.Errorf("commit readable paths of workspace %d: %w", workspaceID, err)
+		}
+	}
+	return nil
+}
+
+// documentChange is a changed file of a workspace's repository as a change
+// to a document, with the front matter taken off its contents.
+type documentChange struct {
+	git.ChangedFile
+	// DocumentID is empty for a file that is no document's.
+	DocumentID string
+	// MovedFrom is where the document was, if the file is where it was
+	// renamed or moved to.
+	MovedFrom string
+}
+
+// removedFiles maps the files a change removed to their old contents. A
+// document the change moved has its old contents there, as nothing was at
+// its new path.
+func removedFiles(files []git.ChangedFile) map[string]string {
+	removed := make(map[string]string)
+	for _, file := range files {
+		if file.Deleted {
+			removed[file.Path] = file.OldContent
+		}
+	}
+	return removed
+}
+
+// changedDocument finds the document a changed file is: the one of the
+// workspace kept at the file's path, or else the one its front matter
+// names. A document found by its front matter whose own file is gone was
+// renamed or moved outside DocSmith, and its new path is recorded; if its
+// file is still there, the file is a copy and no document's. removed holds
+// the files removed by the same change.
+func changedDocument(db *sql.DB, repo *git.Repo, workspaceID int, file git.ChangedFile, removed map[string]string) (documentChange, error) {
+	change := documentChange{ChangedFile: file}
+	id, content := git.DecodeDocument(file.Content)
+	_, change.OldContent = git.DecodeDocument(file.OldContent)
+	change.Content = content
+
+	err := db.QueryRow("select id from docs where workspace_id = ? and path = ?", workspaceID, file.Path).Scan(&change.DocumentID)
+	if err != sql.ErrNoRows || file.Deleted || id == "" {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return change, err
+	}
+
+	var oldPath sql.NullString
+	err = db.QueryRow("select path from docs where id = ? and workspace_id = ?", id, workspaceID).Scan(&oldPath)
+	if err == sql.ErrNoRows {
+		return change, nil
+	}
+	if err != nil {
+		return change, err
+	}
+	if oldPath.Valid {
+		if _, err := os.Stat(repo.DocumentPath(git.Document{Path: oldPath.String})); err == nil {
+			return change, nil
+		}
+	}
+
+	folder := path.Dir(file.Path)
+	if folder == "." {
+		folder = ""
+	}
+	if _, err := db.Exec("update docs set path = ?, folder = ? where id = ?", file.Path, folder, id); err != nil {
+		return change, fmt.Errorf("record path of document %s: %w", id, err)
+	}
+	change.DocumentID = id
+	change.MovedFrom = oldPath.String
+	if old, ok := removed[oldPath.String]; ok {
+		_, change.OldContent = git.DecodeDocument(old)
+	} else {
+		// without the old contents, take it as only a move
+		change.OldContent = change.Content
+	}
+	return change, nil
+}
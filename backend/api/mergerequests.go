@@ -0,0 +1,443 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/git"
+	"docsmith/models"
+	"docsmith/ws"
+)
+
+type CreateMergeRequestRequest struct {
+	Draft       string `json:"draft" binding:"required"`
+	Title       string `json:"title" binding:"required"`
+	Description string `json:"description"`
+}
+
+type CommentRequest struct {
+	Body string `json:"body" binding:"required"`
+}
+
+type MergeRequestMergeRequest struct {
+	// Content resolves the conflicts of the merge. Without it, a merge with
+	// conflicts is refused.
+	Content *string `json:"content"`
+	Message string  `json:"message"`
+}
+
+const mergeRequestColumns = "id, doc_id, draft, title, description, status, created_by, approved_by, merge_commit, created_at, updated_at"
+
+// rowScanner is a *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMergeRequest(row rowScanner) (models.MergeRequest, error) {
+	var mr models.MergeRequest
+	var description, mergeCommit sql.NullString
+	var approvedBy sql.NullInt64
+	err := row.Scan(&mr.ID, &mr.DocumentID, &mr.Draft, &mr.Title, &description, &mr.Status,
+		&mr.CreatedBy, &approvedBy, &mergeCommit, &mr.CreatedAt, &mr.UpdatedAt)
+	if err != nil {
+		return mr, err
+	}
+	mr.Description = description.String
+	mr.MergeCommit = mergeCommit.String
+	if approvedBy.Valid {
+		id := int(approvedBy.Int64)
+		mr.ApprovedBy = &id
+	}
+	return mr, nil
+}
+
+// documentMergeRequest loads a merge request of a document. It writes the
+// error response and returns false when there is none.
+func documentMergeRequest(c *gin.Context, db *sql.DB, doc models.Document) (models.MergeRequest, bool) {
+	id, err := strconv.Atoi(c.Param("requestId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid merge request ID"})
+		return models.MergeRequest{}, false
+	}
+
+	mr, err := scanMergeRequest(db.QueryRow("SELECT "+mergeRequestColumns+" FROM merge_requests WHERE id = ? AND doc_id = ?", id, doc.ID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Merge request not found"})
+		return mr, false
+	}
+	return mr, true
+}
+
+// openMergeRequest is documentMergeRequest for a request that is still open.
+func openMergeRequest(c *gin.Context, db *sql.DB, doc models.Document) (models.MergeRequest, bool) {
+	mr, ok := documentMergeRequest(c, db, doc)
+	if ok && mr.Status != models.MergeRequestOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Merge request is %s", mr.Status)})
+		return mr, false
+	}
+	return mr, ok
+}
+
+func mergeRequestComments(db *sql.DB, requestID int) ([]models.MergeRequestComment, error) {
+	rows, err := db.Query(`SELECT c.id, c.merge_request_id, c.user_id, u.username, c.body, c.created_at
+		FROM merge_request_comments c JOIN users u ON u.id = c.user_id
+		WHERE c.merge_request_id = ? ORDER BY c.created_at, c.id`, requestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []models.MergeRequestComment{}
+	for rows.Next() {
+		var comment models.MergeRequestComment
+		if err := rows.Scan(&comment.ID, &comment.MergeRequestID, &comment.UserID, &comment.Username, &comment.Body, &comment.CreatedAt); err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+// listMergeRequestsHandler lists a document's merge requests, newest first,
+// optionally only those with ?status=.
+func listMergeRequestsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+
+		query := "SELECT " + mergeRequestColumns + " FROM merge_requests WHERE doc_id = ?"
+		args := []interface{}{doc.ID}
+		if status := c.Query("status"); status != "" {
+			query += " AND status = ?"
+			args = append(args, status)
+		}
+		rows, err := db.Query(query+" ORDER BY created_at DESC, id DESC", args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list merge requests"})
+			return
+		}
+		defer rows.Close()
+
+		requests := []models.MergeRequest{}
+		for rows.Next() {
+			mr, err := scanMergeRequest(rows)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list merge requests"})
+				return
+			}
+			requests = append(requests, mr)
+		}
+
+		c.JSON(http.StatusOK, requests)
+	}
+}
+
+// createMergeRequestHandler proposes merging a draft into the document. A
+// draft has at most one open merge request.
+func createMergeRequestHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		var req CreateMergeRequestRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		file := documentFile(doc)
+		if _, err := git.GetDraft(repo, file, req.Draft); err != nil {
+			draftError(c, err, "Failed to read draft")
+			return
+		}
+
+		var open int
+		err := db.QueryRow("SELECT COUNT(*) FROM merge_requests WHERE doc_id = ? AND draft = ? AND status = ?",
+			doc.ID, req.Draft, models.MergeRequestOpen).Scan(&open)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create merge request"})
+			return
+		}
+		if open > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Draft already has an open merge request"})
+			return
+		}
+
+		now := time.Now()
+		result, err := db.Exec(`INSERT INTO merge_requests (doc_id, draft, title, description, status, created_by, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			doc.ID, req.Draft, req.Title, req.Description, models.MergeRequestOpen, userID, now, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create merge request"})
+			return
+		}
+		id, _ := result.LastInsertId()
+
+		mr, err := scanMergeRequest(db.QueryRow("SELECT "+mergeRequestColumns+" FROM merge_requests WHERE id = ?", id))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load merge request"})
+			return
+		}
+		c.JSON(http.StatusCreated, mr)
+	}
+}
+
+// getMergeRequestHandler returns a merge request for review: its comments,
+// the changes the draft makes, and for open requests a preview of the
+// merge, with any conflicts.
+func getMergeRequestHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+		mr, ok := documentMergeRequest(c, db, doc)
+		if !ok {
+			return
+		}
+
+		comments, err := mergeRequestComments(db, mr.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load comments"})
+			return
+		}
+		response := gin.H{"merge_request": mr, "comments": comments}
+
+		file := documentFile(doc)
+		switch mr.Status {
+		case models.MergeRequestOpen:
+			merge, err := git.PreviewMerge(repo, file, mr.Draft, doc.Content)
+			if err != nil {
+				draftError(c, err, "Failed to preview merge")
+				return
+			}
+			response["merge"] = merge
+			if merge.Base != "" {
+				diff, err := git.DiffVersions(repo, file, merge.Base, merge.Draft)
+				if err != nil {
+					versionError(c, err, "Failed to diff draft")
+					return
+				}
+				response["diff"] = diff
+			}
+		case models.MergeRequestMerged:
+			// What the merge changed on the main line
+			diff, err := git.DiffVersions(repo, file, mr.MergeCommit+"^1", mr.MergeCommit)
+			if err != nil {
+				versionError(c, err, "Failed to diff merge")
+				return
+			}
+			response["diff"] = diff
+		}
+
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func commentMergeRequestHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		mr, ok := documentMergeRequest(c, db, doc)
+		if !ok {
+			return
+		}
+
+		var req CommentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		now := time.Now()
+		result, err := db.Exec("INSERT INTO merge_request_comments (merge_request_id, user_id, body, created_at) VALUES (?, ?, ?, ?)",
+			mr.ID, userID, req.Body, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add comment"})
+			return
+		}
+		id, _ := result.LastInsertId()
+
+		comment := models.MergeRequestComment{
+			ID:             int(id),
+			MergeRequestID: mr.ID,
+			Body:           req.Body,
+			CreatedAt:      now,
+		}
+		err = db.QueryRow("SELECT id, username FROM users WHERE id = ?", userID).Scan(&comment.UserID, &comment.Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+		c.JSON(http.StatusCreated, comment)
+	}
+}
+
+// approveMergeRequestHandler approves an open merge request for merging.
+func approveMergeRequestHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		mr, ok := openMergeRequest(c, db, doc)
+		if !ok {
+			return
+		}
+
+		now := time.Now()
+		if _, err := db.Exec("UPDATE merge_requests SET approved_by = ?, updated_at = ? WHERE id = ?", userID, now, mr.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to approve merge request"})
+			return
+		}
+		approvedBy, _ := strconv.Atoi(fmt.Sprintf("%v", userID))
+		mr.ApprovedBy = &approvedBy
+		mr.UpdatedAt = now
+
+		c.JSON(http.StatusOK, mr)
+	}
+}
+
+func closeMergeRequestHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		mr, ok := openMergeRequest(c, db, doc)
+		if !ok {
+			return
+		}
+
+		now := time.Now()
+		if _, err := db.Exec("UPDATE merge_requests SET status = ?, updated_at = ? WHERE id = ?", models.MergeRequestClosed, now, mr.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to close merge request"})
+			return
+		}
+		mr.Status = models.MergeRequestClosed
+		mr.UpdatedAt = now
+
+		c.JSON(http.StatusOK, mr)
+	}
+}
+
+// mergeMergeRequestHandler merges an approved draft into the document with
+// a three-way merge. If both sides changed the same lines, the merge is
+// refused with the conflicts marked in the content, until the request is
+// repeated with the resolved content.
+func mergeMergeRequestHandler(db *sql.DB, repos *Repos, hubs *ws.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+		mr, ok := openMergeRequest(c, db, doc)
+		if !ok {
+			return
+		}
+		if mr.ApprovedBy == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Merge request must be approved before merging"})
+			return
+		}
+
+		var req MergeRequestMergeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+
+		file := documentFile(doc)
+		var content string
+		if req.Content != nil {
+			if git.HasConflictMarkers(*req.Content) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Content still has conflict markers"})
+				return
+			}
+			content = *req.Content
+		} else {
+			merge, err := git.PreviewMerge(repo, file, mr.Draft, doc.Content)
+			if err != nil {
+				draftError(c, err, "Failed to merge draft")
+				return
+			}
+			if len(merge.Conflicts) > 0 {
+				c.JSON(http.StatusConflict, gin.H{"error": "Merge has conflicts", "merge": merge})
+				return
+			}
+			content = merge.Content
+		}
+
+		message := req.Message
+		if message == "" {
+			message = fmt.Sprintf("Merge draft %s: %s", mr.Draft, mr.Title)
+		}
+		hash, err := git.MergeDraft(repo, file, mr.Draft, content, message, author)
+		if err != nil {
+			draftError(c, err, "Failed to merge draft")
+			return
+		}
+
+		now := time.Now()
+		if _, err := db.Exec("UPDATE docs SET content = ?, updated_at = ? WHERE id = ?", content, now, doc.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update document"})
+			return
+		}
+		_, err = db.Exec("UPDATE merge_requests SET status = ?, merge_commit = ?, updated_at = ? WHERE id = ?",
+			models.MergeRequestMerged, hash, now, mr.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update merge request"})
+			return
+		}
+		mr.Status = models.MergeRequestMerged
+		mr.MergeCommit = hash
+		mr.UpdatedAt = now
+
+		hubs.Publish(doc.ID, ws.Event{
+			Type:    ws.EventMerged,
+			UserID:  fmt.Sprintf("%v", userID),
+			Title:   doc.Title,
+			Content: &content,
+			Hash:    hash,
+			Message: message,
+		})
+
+		c.JSON(http.StatusOK, gin.H{
+			"merge_request": mr,
+			"hash":          hash,
+			"content":       content,
+		})
+	}
+}
@@ -2,12 +2,16 @@ package api
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -15,7 +19,7 @@ const (
 )
 
 type Claims struct {
-	UserID int `json: "user_id"`
+	UserID int `json:"user_id"`
 	jwt.StandardClaims
 }
 
@@ -40,28 +44,88 @@ func authMiddleware(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		bearerToken := strings.Split(authHeader, " ")
-		if len(bearerToken) != 2 || bearerToken[0] != "Bearer" {
+		userID, err := authenticate(db, authHeader)
+		if errors.Is(err, errAuthFormat) {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Authentication Format"})
 			c.Abort()
 			return
 		}
-
-		tokenString := bearerToken[1]
-		claims := &Claims{}
-
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(secretKey), nil
-		})
-
-		if err != nil || !token.Valid {
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
 			c.Abort()
 			return
 		}
 
-		c.Set("userID", claims.UserID)
+		c.Set("userID", userID)
 		c.Next()
 	}
 
 }
+
+// parseToken validates a signed token and returns its claims.
+func parseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return []byte(secretKey), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	// Tokens issued before the user_id tag was fixed carry their user
+	// under "UserID" and decode as user 0
+	if claims.UserID == 0 {
+		return nil, fmt.Errorf("token names no user")
+	}
+	return claims, nil
+}
+
+var errAuthFormat = errors.New("invalid authentication format")
+
+// authenticate returns the user an Authorization header signs in: a bearer
+// token, or basic auth with a username and either their password or a
+// token, as git and other tools send.
+func authenticate(db *sql.DB, authHeader string) (int, error) {
+	scheme, credentials, found := strings.Cut(authHeader, " ")
+	if !found {
+		return 0, errAuthFormat
+	}
+	switch scheme {
+	case "Bearer":
+		claims, err := parseToken(credentials)
+		if err != nil {
+			return 0, err
+		}
+		return claims.UserID, nil
+	case "Basic":
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return 0, errAuthFormat
+		}
+		username, password, found := strings.Cut(string(decoded), ":")
+		if !found {
+			return 0, errAuthFormat
+		}
+
+		var userID int
+		var passwordHash string
+		err = db.QueryRow("select id, password_hash from users where username = ?", username).Scan(&userID, &passwordHash)
+		if err != nil {
+			return 0, fmt.Errorf("unknown user %s", username)
+		}
+		if claims, err := parseToken(password); err == nil && claims.UserID == userID {
+			return userID, nil
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+			return 0, fmt.Errorf("invalid credentials")
+		}
+		return userID, nil
+	}
+	return 0, errAuthFormat
+}
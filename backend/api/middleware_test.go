@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestParseToken(t *testing.T) {
+	token, err := generateToken(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := parseToken(token); err != nil || claims.UserID != 7 {
+		t.Fatalf("parseToken = %+v, %v, want user 7", claims, err)
+	}
+
+	sign := func(claims jwt.Claims) string {
+		t.Helper()
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secretKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	expires := time.Now().Add(time.Hour).Unix()
+	tests := map[string]string{
+		// As issued while the tag was malformed
+		"old format": sign(jwt.MapClaims{"UserID": 7, "exp": expires}),
+		"no user":    sign(jwt.MapClaims{"exp": expires}),
+		"user 0":     sign(&Claims{StandardClaims: jwt.StandardClaims{ExpiresAt: expires}}),
+		"expired":    sign(&Claims{UserID: 7, StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Hour).Unix()}}),
+		"wrong key": func() string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: 7}).SignedString([]byte("other"))
+			return signed
+		}(),
+		"garbage": "not.a.token",
+	}
+	for name, token := range tests {
+		if claims, err := parseToken(token); err == nil {
+			t.Errorf("%s: parseToken accepted user %d", name, claims.UserID)
+		}
+		if userID, err := authenticate(nil, "Bearer "+token); err == nil {
+			t.Errorf("%s: authenticate accepted user %d", name, userID)
+		}
+	}
+}
+
+func TestAuthenticateFormat(t *testing.T) {
+	for _, header := range []string{"Bearer", "Token abc", "Basic !!!", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice"))} {
+		if _, err := authenticate(nil, header); err != errAuthFormat {
+			t.Errorf("authenticate(%q) = %v, want errAuthFormat", header, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/models"
+)
+
+// validateProfile checks the display name and email a user signs commits
+// with. Both are optional.
+func validateProfile(displayName string, email string) error {
+	if len([]rune(displayName)) > maxDisplayNameLength {
+		return fmt.Errorf("display name is longer than %d characters", maxDisplayNameLength)
+	}
+	if strings.ContainsAny(displayName, "<>\n") {
+		return fmt.Errorf("display name may not contain <, > or line breaks")
+	}
+	if email == "" {
+		return nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("invalid email address")
+	}
+	return nil
+}
+
+func getProfileHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+
+		var user models.User
+		var displayName, email sql.NullString
+		err := db.QueryRow("select id, username, display_name, email from users where id = ?", userID).
+			Scan(&user.ID, &user.Username, &displayName, &email)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		user.DisplayName = displayName.String
+		user.Email = email.String
+
+		c.JSON(http.StatusOK, user)
+	}
+}
+
+func updateProfileHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+
+		var req UpdateProfileRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.DisplayName = strings.TrimSpace(req.DisplayName)
+		req.Email = strings.TrimSpace(req.Email)
+		if err := validateProfile(req.DisplayName, req.Email); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		_, err := db.Exec("update users set display_name = ?, email = ? where id = ?", req.DisplayName, req.Email, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update profile"})
+			return
+		}
+
+		getProfileHandler(db)(c)
+	}
+}
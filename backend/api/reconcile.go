@@ -0,0 +1,457 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/git"
+	"docsmith/ws"
+)
+
+// worktreeSource is the Source of an edit that hasn't been committed.
+const worktreeSource = "worktree"
+
+// ExternalConflict is an edit made outside DocSmith that overlaps unsaved
+// changes to the document. Neither side is applied until it's resolved.
+type ExternalConflict struct {
+	DocumentID string `json:"document_id"`
+	Path       string `json:"path"`
+	// Source is the commit the edit arrived in, "worktree", the remote it
+	// was pulled from, or "push".
+	Source     string          `json:"source"`
+	External   string          `json:"external"`
+	Merge      git.MergeResult `json:"merge"`
+	DetectedAt time.Time       `json:"detected_at"`
+}
+
+// Reconciler brings edits made directly in the workspace repositories, by
+// hand commits or by changing files in the worktree, into the docs table and
+// the live sessions.
+type Reconciler struct {
+	db       *sql.DB
+	repos    *Repos
+	hubs     *ws.Registry
+	interval time.Duration
+
+	mutex     sync.Mutex
+	conflicts map[string]ExternalConflict
+	// pending is the content of each changed worktree file at the last
+	// check, by repository. Files are only taken once they stop changing, so
+	// DocSmith's own writes are committed before they can be mistaken for
+	// external edits.
+	pending map[string]map[string]string
+}
+
+func NewReconciler(db *sql.DB, repos *Repos, hubs *ws.Registry, interval time.Duration) *Reconciler {
+	return &Reconciler{
+		db:        db,
+		repos:     repos,
+		hubs:      hubs,
+		interval:  interval,
+		conflicts: make(map[string]ExternalConflict),
+		pending:   make(map[string]map[string]string),
+	}
+}
+
+// Start reconciles in the background, every interval.
+func (rc *Reconciler) Start() {
+	go func() {
+		ticker := time.NewTicker(rc.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := rc.Reconcile(); err != nil {
+				log.Printf("Failed to reconcile: %v", err)
+			}
+		}
+	}()
+}
+
+// Conflict returns the unresolved external edit of a document, if any.
+func (rc *Reconciler) Conflict(documentID string) (ExternalConflict, bool) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	conflict, ok := rc.conflicts[documentID]
+	return conflict, ok
+}
+
+func (rc *Reconciler) resolved(documentID string) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	delete(rc.conflicts, documentID)
+}
+
+// Reconcile checks every workspace repository.
+func (rc *Reconciler) Reconcile() error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	ids, err := rc.repos.WorkspaceIDs()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, id := range ids {
+		if err := rc.reconcile(id); err != nil {
+			errs = append(errs, fmt.Errorf("workspace %d: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reconcile ingests the commits made outside DocSmith in a workspace's
+// repository since the last run, then worktree files changed since the last
+// commit.
+func (rc *Reconciler) reconcile(workspaceID int) error {
+	repo, err := rc.repos.Workspace(workspaceID)
+	if err != nil {
+		return err
+	}
+
+	since, err := rc.reconciledHead(repo)
+	if err != nil {
+		return err
+	}
+	changes, err := git.ExternalCommits(repo, since)
+	if err != nil {
+		return err
+	}
+	removed := removedFiles(changes.Files)
+	for _, file := range changes.Files {
+		owner := ""
+		if len(changes.Commits) > 0 {
+			owner = changes.Commits[0].AuthorEmail
+		}
+		rc.ingest(repo, workspaceID, file, removed, changes.Head, owner)
+	}
+	if changes.Head != since {
+		if err := rc.saveReconciledHead(repo, changes.Head); err != nil {
+			return err
+		}
+	}
+
+	files, err := git.WorktreeChanges(repo)
+	if err != nil {
+		return err
+	}
+	pending := make(map[string]string)
+	removed = removedFiles(files)
+	for _, file := range files {
+		pending[file.Path] = file.Content
+		if previous, ok := rc.pending[repo.Path][file.Path]; ok && previous == file.Content {
+			rc.ingest(repo, workspaceID, file, removed, worktreeSource, "")
+		}
+	}
+	rc.pending[repo.Path] = pending
+	return nil
+}
+
+// reconciledHead is the commit a repository is reconciled up to. The first
+// time, that is the current HEAD.
+func (rc *Reconciler) reconciledHead(repo *git.Repo) (string, error) {
+	var head string
+	err := rc.db.QueryRow("select reconciled_head from repo_state where repo_path = ?", repo.Path).Scan(&head)
+	if err == sql.ErrNoRows {
+		if head, err = git.Head(repo); err != nil {
+			return "", err
+		}
+		return head, rc.saveReconciledHead(repo, head)
+	}
+	return head, err
+}
+
+func (rc *Reconciler) saveReconciledHead(repo *git.Repo, head string) error {
+	_, err := rc.db.Exec(`insert into repo_state (repo_path, reconciled_head, updated_at) values (?, ?, ?)
+		on conflict(repo_path) do update set reconciled_head = excluded.reconciled_head, updated_at = excluded.updated_at`,
+		repo.Path, head, time.Now())
+	return err
+}
+
+// ingest applies an external edit of a file in a workspace's repository,
+// one of a change that removed the files in removed. Edits to documents are
+// merged with their unsaved changes; new files become documents.
+func (rc *Reconciler) ingest(repo *git.Repo, workspaceID int, changed git.ChangedFile, removed map[string]string, source string, authorEmail string) {
+	if strings.EqualFold(changed.Path, "README.md") {
+		return
+	}
+
+	file, err := changedDocument(rc.db, repo, workspaceID, changed, removed)
+	if err != nil {
+		log.Printf("Failed to find the document of %s: %v", changed.Path, err)
+		return
+	}
+	docID := file.DocumentID
+	var title string
+	var content sql.NullString
+	if docID != "" {
+		err = rc.db.QueryRow("select title, content from docs where id = ?", docID).Scan(&title, &content)
+	}
+	switch {
+	case docID == "" && file.Deleted:
+		return
+	case docID == "":
+		rc.createDocument(repo, workspaceID, file.ChangedFile, authorEmail)
+		return
+	case err != nil:
+		log.Printf("Failed to load document %s: %v", docID, err)
+		return
+	case file.Deleted:
+		log.Printf("%s was deleted outside DocSmith; document %s is kept", file.Path, docID)
+		return
+	}
+
+	// Commit the file as it was edited, and where it was moved from;
+	// unsaved changes stay unsaved
+	paths := []string{file.Path}
+	if file.MovedFrom != "" {
+		paths = append(paths, file.MovedFrom)
+	}
+	commitWorktree := func(message string) {
+		if source != worktreeSource {
+			return
+		}
+		if _, err := git.CommitPaths(repo, paths, message, git.SystemAuthor, nil); err != nil {
+			log.Printf("Failed to commit external edit of document %s: %v", docID, err)
+		}
+	}
+
+	current := content.String
+	if file.Content == current {
+		delete(rc.conflicts, docID)
+		if file.MovedFrom != "" {
+			commitWorktree(fmt.Sprintf("Import external move: %s", title))
+		}
+		return
+	}
+	if existing, ok := rc.conflicts[docID]; ok && existing.External == file.Content {
+		return
+	}
+
+	updated := file.Content
+	if current != file.OldContent {
+		// The document has changes of its own since the file was last in
+		// step with it
+		merge := git.Merge3(file.OldContent, current, file.Content, "docsmith", "external")
+		if len(merge.Conflicts) > 0 {
+			rc.raise(ExternalConflict{
+				DocumentID: docID,
+				Path:       file.Path,
+				Source:     source,
+				External:   file.Content,
+				Merge:      merge,
+				DetectedAt: time.Now(),
+			}, title, fmt.Sprintf("%s was edited outside DocSmith in a way that conflicts with unsaved changes", file.Path))
+			return
+		}
+		updated = merge.Content
+	}
+	delete(rc.conflicts, docID)
+
+	if _, err := rc.db.Exec("update docs set content = ?, updated_at = ? where id = ?", updated, time.Now(), docID); err != nil {
+		log.Printf("Failed to import external edit of document %s: %v", docID, err)
+		return
+	}
+	commitWorktree(fmt.Sprintf("Import external edit: %s", title))
+
+	rc.hubs.Publish(docID, ws.Event{
+		Type:    ws.EventUpdated,
+		Title:   title,
+		Content: &updated,
+		Message: "Edited outside DocSmith",
+	})
+}
+
+// raise holds back an edit that conflicts with a document's unsaved changes
+// until it's resolved, and tells the document's session. The caller holds
+// rc.mutex.
+func (rc *Reconciler) raise(conflict ExternalConflict, title string, message string) {
+	rc.conflicts[conflict.DocumentID] = conflict
+	rc.hubs.Publish(conflict.DocumentID, ws.Event{
+		Type:    ws.EventConflict,
+		Title:   title,
+		Message: message,
+	})
+	log.Printf("Edit of %s from %s conflicts with unsaved changes to document %s", conflict.Path, conflict.Source, conflict.DocumentID)
+}
+
+// raiseConflict is raise for edits pulled or pushed into a workspace.
+func (rc *Reconciler) raiseConflict(conflict ExternalConflict, title string, message string) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.raise(conflict, title, message)
+}
+
+// createDocument makes a document of a new markdown file in a workspace,
+// owned by the member with the committer's email or else the workspace's
+// owner. The file stays where it is, with the document's ID written into
+// its front matter.
+func (rc *Reconciler) createDocument(repo *git.Repo, workspaceID int, file git.ChangedFile, authorEmail string) {
+	ownerID, err := rc.importOwner(workspaceID, authorEmail)
+	if err != nil {
+		log.Printf("No user to own %s: %v", file.Path, err)
+		return
+	}
+
+	_, content := git.DecodeDocument(file.Content)
+	title := documentTitle(content, strings.TrimSuffix(path.Base(file.Path), ".md"))
+	folder := path.Dir(file.Path)
+	if folder == "." {
+		folder = ""
+	}
+	now := time.Now()
+
+	result, err := rc.db.Exec("insert into docs (user_id, workspace_id, title, folder, path, content, updated_at) values (?, ?, ?, ?, ?, ?, ?)",
+		ownerID, workspaceID, title, folder, file.Path, content, now)
+	if err != nil {
+		log.Printf("Failed to create a document for %s: %v", file.Path, err)
+		return
+	}
+	newID, _ := result.LastInsertId()
+
+	doc := git.Document{ID: strconv.FormatInt(newID, 10), Path: file.Path}
+	if err := git.SaveDocument(repo, doc, content); err != nil {
+		log.Printf("Failed to write the id of document %s into %s: %v", doc.ID, file.Path, err)
+		return
+	}
+	message := fmt.Sprintf("Import %s as document: %s", file.Path, title)
+	if _, err := git.CommitPaths(repo, []string{file.Path}, message, git.SystemAuthor, nil); err != nil {
+		log.Printf("Failed to commit imported document %s: %v", doc.ID, err)
+	}
+	log.Printf("Imported %s as document %s", file.Path, doc.ID)
+}
+
+// importOwner finds the member of a workspace to own an imported document.
+func (rc *Reconciler) importOwner(workspaceID int, email string) (int, error) {
+	var id int
+	if email != "" {
+		err := rc.db.QueryRow(`select u.id from users u join workspace_members m on m.user_id = u.id
+			where m.workspace_id = ? and (u.email = ? or u.username || '@users.docsmith.local' = ?)
+			order by u.id limit 1`, workspaceID, email, email).Scan(&id)
+		if err == nil {
+			return id, nil
+		}
+	}
+	err := rc.db.QueryRow("select owner_id from workspaces where id = ?", workspaceID).Scan(&id)
+	return id, err
+}
+
+// documentTitle is the first heading of content, or else fallback.
+func documentTitle(content string, fallback string) string {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			if title := strings.TrimSpace(strings.TrimPrefix(line, "# ")); title != "" {
+				return title
+			}
+		}
+	}
+	return fallback
+}
+
+type ResolveConflictRequest struct {
+	Content string `json:"content"`
+}
+
+// getExternalConflictHandler returns an external edit of the document that
+// conflicts with its unsaved changes.
+func getExternalConflictHandler(db *sql.DB, reconciler *Reconciler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		if reconciler == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No conflicting external edit"})
+			return
+		}
+		conflict, ok := reconciler.Conflict(doc.ID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No conflicting external edit"})
+			return
+		}
+		c.JSON(http.StatusOK, conflict)
+	}
+}
+
+// resolveExternalConflictHandler settles a conflicting external edit with
+// the content the user chose, and commits it.
+func resolveExternalConflictHandler(db *sql.DB, repos *Repos, hubs *ws.Registry, reconciler *Reconciler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+		if reconciler == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No conflicting external edit"})
+			return
+		}
+		if _, ok := reconciler.Conflict(doc.ID); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No conflicting external edit"})
+			return
+		}
+
+		var req ResolveConflictRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if git.HasConflictMarkers(req.Content) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Content still has conflict markers"})
+			return
+		}
+
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+
+		now := time.Now()
+		if _, err := db.Exec("UPDATE docs SET content = ?, updated_at = ? WHERE id = ?", req.Content, now, doc.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update document"})
+			return
+		}
+		file := documentFile(doc)
+		if err := git.SaveDocument(repo, file, req.Content); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save document to git"})
+			return
+		}
+		message := fmt.Sprintf("Resolve external edit: %s", doc.Title)
+		hash, err := git.CommitDocumentAs(repo, file, message, author, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit changes"})
+			return
+		}
+		reconciler.resolved(doc.ID)
+
+		hubs.Publish(doc.ID, ws.Event{
+			Type:    ws.EventUpdated,
+			UserID:  fmt.Sprintf("%v", userID),
+			Title:   doc.Title,
+			Content: &req.Content,
+			Hash:    hash,
+			Message: message,
+		})
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":         doc.ID,
+			"hash":       hash,
+			"content":    req.Content,
+			"message":    message,
+			"updated_at": now,
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"docsmith/git"
+)
+
+// handEdit changes a file in the workspace's repository as someone editing
+// it outside DocSmith would, committing it by hand if commit is set.
+func (st *syncTest) handEdit(path string, from string, to string, commit bool) {
+	st.t.Helper()
+	file := filepath.Join(st.repo.Path, path)
+	content, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		st.t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		st.t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(strings.Replace(string(content), from, to, 1)), 0644); err != nil {
+		st.t.Fatal(err)
+	}
+	if !commit {
+		return
+	}
+	r, err := gogit.PlainOpen(st.repo.Path)
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	if _, err := w.Add(path); err != nil {
+		st.t.Fatal(err)
+	}
+	bob := &object.Signature{Name: "bob", Email: "bob@example.com", When: time.Now()}
+	if _, err := w.Commit("Edit "+path, &gogit.CommitOptions{Author: bob, Committer: bob}); err != nil {
+		st.t.Fatal(err)
+	}
+}
+
+func (st *syncTest) reconcile() {
+	st.t.Helper()
+	if err := st.reconciler.Reconcile(); err != nil {
+		st.t.Fatal(err)
+	}
+}
+
+func TestReconcileCommits(t *testing.T) {
+	st := newSyncTest(t)
+	st.reconcile()
+
+	st.handEdit("plan.md", "two", "TWO", true)
+	st.reconcile()
+	if got := st.content(); got != "one\nTWO\nthree\n" {
+		t.Errorf("document is %q after a hand commit", got)
+	}
+
+	// Unsaved edits that don't overlap are merged
+	if _, err := st.db.Exec("update docs set content = ? where id = 1", "ONE\nTWO\nthree\n"); err != nil {
+		t.Fatal(err)
+	}
+	st.handEdit("plan.md", "three", "THREE", true)
+	st.reconcile()
+	if got := st.content(); got != "ONE\nTWO\nTHREE\n" {
+		t.Errorf("document is %q after merging a hand commit", got)
+	}
+	if _, ok := st.reconciler.Conflict("1"); ok {
+		t.Errorf("a clean merge raised a conflict")
+	}
+
+	// A new file becomes a document, owned by the workspace's owner
+	st.handEdit("notes/ideas.md", "", "# Ideas\n\nMore of them.\n", true)
+	st.reconcile()
+	var id, title, folder, content string
+	var userID int
+	err := st.db.QueryRow("select id, user_id, title, folder, content from docs where path = 'notes/ideas.md'").Scan(&id, &userID, &title, &folder, &content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 1 || title != "Ideas" || folder != "notes" || content != "# Ideas\n\nMore of them.\n" {
+		t.Errorf("imported document is %d %q in %q: %q", userID, title, folder, content)
+	}
+	v, err := git.LatestVersion(st.repo, git.Document{ID: id, Path: "notes/ideas.md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Content != content || !strings.HasPrefix(v.Message, "Import notes/ideas.md as document") {
+		t.Errorf("imported document's version is %+v", v)
+	}
+}
+
+// An external edit that overlaps unsaved changes is held back until it's
+// resolved, rather than overwriting them.
+func TestReconcileConflict(t *testing.T) {
+	st := newSyncTest(t)
+	st.reconcile()
+	if _, err := st.db.Exec("update docs set content = ? where id = 1", "one\nours\nthree\n"); err != nil {
+		t.Fatal(err)
+	}
+	st.handEdit("plan.md", "two", "theirs", true)
+	st.reconcile()
+	if got := st.content(); got != "one\nours\nthree\n" {
+		t.Errorf("document is %q, want the unsaved edits kept", got)
+	}
+	head, err := git.Head(st.repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflict, ok := st.reconciler.Conflict("1")
+	if !ok {
+		t.Fatal("no conflict raised")
+	}
+	if conflict.Source != head || conflict.Path != "plan.md" || conflict.External != "one\ntheirs\nthree\n" || len(conflict.Merge.Conflicts) != 1 {
+		t.Errorf("conflict is %+v", conflict)
+	}
+
+	// Taking the edit settles it, and later edits come through again
+	if _, err := st.db.Exec("update docs set content = ? where id = 1", "one\ntheirs\nthree\n"); err != nil {
+		t.Fatal(err)
+	}
+	st.handEdit("plan.md", "three", "four", true)
+	st.reconcile()
+	if _, ok := st.reconciler.Conflict("1"); ok {
+		t.Errorf("the conflict is still raised")
+	}
+	if got := st.content(); got != "one\ntheirs\nfour\n" {
+		t.Errorf("document is %q after the conflict settled", got)
+	}
+}
+
+// Files changed in the worktree are taken once they stop changing, and
+// committed for the editor.
+func TestReconcileWorktree(t *testing.T) {
+	st := newSyncTest(t)
+	st.reconcile()
+
+	st.handEdit("plan.md", "two", "TWO", false)
+	st.reconcile()
+	if got := st.content(); got != "one\ntwo\nthree\n" {
+		t.Errorf("document is %q while the file is still changing", got)
+	}
+	st.reconcile()
+	if got := st.content(); got != "one\nTWO\nthree\n" {
+		t.Errorf("document is %q after the file settled", got)
+	}
+	if last := st.lastCommit(); last.Message != "Import external edit: Plan" || last.Author.Name != git.SystemAuthor.Name {
+		t.Errorf("last commit is %q by %s", last.Message, last.Author.Name)
+	}
+	files, err := git.WorktreeChanges(st.repo)
+	if err != nil || len(files) != 0 {
+		t.Errorf("worktree still has changes %+v (%v)", files, err)
+	}
+}
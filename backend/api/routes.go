@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"docsmith/ws"
 	"math/rand"
-	"net/http"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -13,12 +12,12 @@ import (
 
 // Update your SetupRouter function with these new routes
 
-func SetupRouter(db *sql.DB, gitRepoPath string) *gin.Engine {
+func SetupRouter(db *sql.DB, repos *Repos, hubs *ws.Registry, syncer *Syncer, reconciler *Reconciler, compactor *Compactor) *gin.Engine {
 	router := gin.Default()
 
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
@@ -34,39 +33,96 @@ func SetupRouter(db *sql.DB, gitRepoPath string) *gin.Engine {
 	// Public shared document route (accessible without login)
 	router.GET("/api/shared/:shareId", getDocumentByShareHandler(db))
 
-	// WebSocket endpoint (we'll now validate access within the handler)
-	router.GET("/ws", func(c *gin.Context) {
-		// Get document ID from query param
-		docID := c.Query("docId")
-		if docID == "" {
-			c.String(http.StatusBadRequest, "Missing document ID")
-			return
-		}
-		
-		// Setup hub if it doesn't exist
-		hub := ws.GetOrCreateHub(docID)
-		ws.ServeWs(hub, c.Writer, c.Request)
-	})
+	// WebSocket endpoint, authenticated by token or share link
+	router.GET("/ws", websocketHandler(db, hubs))
+
+	// Workspace repositories over git smart HTTP, signed in like the API:
+	// git clone http://<host>/api/git/<workspace>.git
+	gitRoutes := router.Group("/api/git")
+	gitRoutes.Use(gitAuthMiddleware(db))
+	{
+		gitRoutes.GET("/:repo/info/refs", gitInfoRefsHandler(db, repos))
+		gitRoutes.POST("/:repo/git-upload-pack", gitUploadPackHandler(db, repos))
+		gitRoutes.POST("/:repo/git-receive-pack", gitReceivePackHandler(db, repos, hubs, reconciler))
+	}
 
 	// Protected routes
 	auth := router.Group("/api")
 	auth.Use(authMiddleware(db))
 	{
+		// Profile of the signed in user, used to sign their commits
+		auth.GET("/me", getProfileHandler(db))
+		auth.PUT("/me", updateProfileHandler(db))
+
+		// Workspaces, each with its own repository
+		auth.GET("/workspaces", listWorkspacesHandler(db))
+		auth.POST("/workspaces", createWorkspaceHandler(db))
+		auth.GET("/workspaces/:id/members", listWorkspaceMembersHandler(db))
+		auth.POST("/workspaces/:id/members", addWorkspaceMemberHandler(db))
+		auth.DELETE("/workspaces/:id/members/:userId", removeWorkspaceMemberHandler(db))
+		auth.GET("/workspaces/:id/compact", compactWorkspaceHandler(db, compactor))
+		auth.POST("/workspaces/:id/compact", compactWorkspaceHandler(db, compactor))
+
+		// Sync a workspace with its remote git server, which its owner can
+		// set, or else its repository on the default one
+		auth.GET("/workspaces/:id/sync", syncStatusHandler(db, syncer))
+		auth.POST("/workspaces/:id/sync/pull", syncPullHandler(db, syncer))
+		auth.POST("/workspaces/:id/sync/push", syncPushHandler(db, syncer))
+		auth.GET("/workspaces/:id/remote", getWorkspaceRemoteHandler(db, syncer))
+		auth.PUT("/workspaces/:id/remote", setWorkspaceRemoteHandler(db, syncer))
+		auth.DELETE("/workspaces/:id/remote", deleteWorkspaceRemoteHandler(db, syncer))
+
 		// Document CRUD operations
 		auth.GET("/documents", getDocumentsHandler(db))
-		auth.GET("/documents/:id", getDocumentHandler(db))
-		auth.POST("/documents", createDocumentHandler(db, gitRepoPath))
-		auth.PUT("/documents/:id", updateDocumentHandler(db, gitRepoPath, nil))
-		auth.DELETE("/documents/:id", deleteDocumentHandler(db, gitRepoPath))
+		auth.GET("/documents/:id", getDocumentHandler(db, repos))
+		auth.POST("/documents", createDocumentHandler(db, repos))
+		auth.PUT("/documents/:id", updateDocumentHandler(db, repos, hubs))
+		auth.PATCH("/documents/:id", renameDocumentHandler(db, repos, hubs))
+		auth.POST("/documents/:id/move", moveDocumentHandler(db, repos, hubs))
+		auth.DELETE("/documents/:id", deleteDocumentHandler(db, repos, hubs))
+		auth.GET("/search", searchHandler(db))
 		
 		// Document version management
-		auth.GET("/documents/:id/versions", getDocumentVersionsHandler(gitRepoPath))
-		auth.POST("/documents/:id/versions", createDocumentVersionHandler(db, gitRepoPath))
-		auth.POST("/documents/:id/versions/:versionId/restore", restoreDocumentVersionHandler(db, gitRepoPath))
+		auth.GET("/documents/:id/versions", getDocumentVersionsHandler(db, repos))
+		auth.POST("/documents/:id/versions", createDocumentVersionHandler(db, repos, hubs))
+		auth.GET("/documents/:id/versions/:versionId", getDocumentVersionHandler(db, repos))
+		auth.POST("/documents/:id/versions/:versionId/restore", restoreDocumentVersionHandler(db, repos, hubs))
+		auth.POST("/documents/:id/versions/:versionId/revert", revertDocumentVersionHandler(db, repos, hubs))
+		auth.GET("/documents/:id/blame", blameDocumentHandler(db, repos))
+		auth.GET("/documents/:id/versions/:versionId/diff", diffVersionsHandler(db, repos))
+		auth.GET("/documents/:id/versions/:versionId/diff/:otherId", diffVersionsHandler(db, repos))
 		
+		// Named versions
+		auth.GET("/documents/:id/tags", listDocumentTagsHandler(db, repos))
+		auth.POST("/documents/:id/tags", createDocumentTagHandler(db, repos))
+		auth.GET("/documents/:id/tags/:tag", getDocumentTagHandler(db, repos))
+		auth.PUT("/documents/:id/tags/:tag", moveDocumentTagHandler(db, repos))
+		auth.DELETE("/documents/:id/tags/:tag", deleteDocumentTagHandler(db, repos))
+
+		// Drafts and merge requests
+		auth.GET("/documents/:id/drafts", listDraftsHandler(db, repos))
+		auth.POST("/documents/:id/drafts", createDraftHandler(db, repos))
+		auth.GET("/documents/:id/drafts/:draft", getDraftHandler(db, repos))
+		auth.PUT("/documents/:id/drafts/:draft", updateDraftHandler(db, repos))
+		auth.DELETE("/documents/:id/drafts/:draft", deleteDraftHandler(db, repos))
+		auth.GET("/documents/:id/merge-requests", listMergeRequestsHandler(db))
+		auth.POST("/documents/:id/merge-requests", createMergeRequestHandler(db, repos))
+		auth.GET("/documents/:id/merge-requests/:requestId", getMergeRequestHandler(db, repos))
+		auth.POST("/documents/:id/merge-requests/:requestId/comments", commentMergeRequestHandler(db))
+		auth.POST("/documents/:id/merge-requests/:requestId/approve", approveMergeRequestHandler(db))
+		auth.POST("/documents/:id/merge-requests/:requestId/close", closeMergeRequestHandler(db))
+		auth.POST("/documents/:id/merge-requests/:requestId/merge", mergeMergeRequestHandler(db, repos, hubs))
+
+		// Edits made directly in the repository
+		auth.GET("/documents/:id/external-edit", getExternalConflictHandler(db, reconciler))
+		auth.POST("/documents/:id/external-edit/resolve", resolveExternalConflictHandler(db, repos, hubs, reconciler))
+
 		// Document sharing
 		auth.POST("/documents/:id/share", shareDocumentHandler(db))
-		auth.GET("/documents/:id/permissions", getDocumentPermissionsHandler(db))
+		auth.GET("/documents/:id/permissions", getDocumentPermissionsHandler(db, hubs))
+
+		// Websocket hub health
+		auth.GET("/ws/metrics", wsMetricsHandler(hubs))
 	}
 
 	return router
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// Matches are marked with these in what FTS5 returns, so the text around
+// them can be escaped before they become <mark> tags.
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+// SearchResult is a document matching a search, best match first.
+type SearchResult struct {
+	ID          int       `json:"id"`
+	WorkspaceID string    `json:"workspace_id,omitempty"`
+	Title       string    `json:"title"`
+	Folder      string    `json:"folder"`
+	Path        string    `json:"path,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Highlight is the title and Snippet the best matching part of the
+	// content, as HTML with the matches in <mark> tags.
+	Highlight string `json:"highlight"`
+	Snippet   string `json:"snippet"`
+}
+
+// searchQuery turns what the user typed into an FTS5 query matching every
+// word. "Quoted words" match as a phrase and a word or phrase ending in *
+// matches as a prefix. Everything else is taken literally, so nothing typed
+// can be an FTS5 syntax error.
+func searchQuery(q string) string {
+	var terms []string
+	add := func(term string) {
+		prefix := strings.HasSuffix(term, "*")
+		term = strings.TrimSpace(strings.TrimRight(term, "*"))
+		if term == "" {
+			return
+		}
+		term = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		if q[0] == '"' {
+			end := strings.IndexByte(q[1:], '"')
+			if end < 0 {
+				add(q[1:])
+				break
+			}
+			phrase := q[1 : end+1]
+			q = q[end+2:]
+			if strings.HasPrefix(q, "*") {
+				phrase += "*"
+				q = q[1:]
+			}
+			add(phrase)
+			continue
+		}
+		end := strings.IndexAny(q, " \t\n\"")
+		if end < 0 {
+			end = len(q)
+		}
+		add(q[:end])
+		q = q[end:]
+	}
+	return strings.Join(terms, " ")
+}
+
+// markMatches escapes text from FTS5 as HTML, turning its match markers
+// into <mark> tags.
+func markMatches(text string) string {
+	text = html.EscapeString(text)
+	text = strings.ReplaceAll(text, matchStart, "<mark>")
+	return strings.ReplaceAll(text, matchEnd, "</mark>")
+}
+
+// searchAvailable reports whether SQLite was built with FTS5, which the
+// search index needs.
+func searchAvailable(db *sql.DB) bool {
+	var fts5 bool
+	err := db.QueryRow("select sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5)
+	return err == nil && fts5
+}
+
+// searchHandler searches the title and content of the documents the user
+// owns, collaborates on or shares a workspace with, best match first, with
+// ?q=. Matches in the title count for more than those in the content.
+// ?limit= caps the results, 20 by default and at most 100.
+func searchHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+
+		if !searchAvailable(db) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Search isn't available on this server"})
+			return
+		}
+		query := searchQuery(c.Query("q"))
+		if query == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is required"})
+			return
+		}
+		limit := defaultSearchLimit
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxSearchLimit {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid limit, use 1 to %d", maxSearchLimit)})
+				return
+			}
+			limit = n
+		}
+
+		rows, err := db.Query(`select d.id, d.workspace_id, d.title, d.folder, d.path, d.updated_at,
+				highlight(docs_fts, 0, ?, ?), coalesce(snippet(docs_fts, 1, ?, ?, '…', 24), '')
+			from docs_fts join docs d on d.id = docs_fts.rowid
+			where docs_fts match ?
+				and (d.user_id = ?
+					or exists (select 1 from collaborators cb where cb.doc_id = d.id and cb.user_id = ?)
+					or exists (select 1 from workspace_members m where m.workspace_id = d.workspace_id and m.user_id = ?))
+			order by bm25(docs_fts, 10.0, 1.0)
+			limit ?`,
+			matchStart, matchEnd, matchStart, matchEnd, query, userID, userID, userID, limit)
+		if err != nil {
+			log.Printf("Failed to search documents for %q: %v", query, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search documents"})
+			return
+		}
+		defer rows.Close()
+
+		results := []SearchResult{}
+		for rows.Next() {
+			var result SearchResult
+			var workspaceID, path sql.NullString
+			if err := rows.Scan(&result.ID, &workspaceID, &result.Title, &result.Folder, &path, &result.UpdatedAt,
+				&result.Highlight, &result.Snippet); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search documents"})
+				return
+			}
+			result.WorkspaceID = workspaceID.String
+			result.Path = path.String
+			result.Highlight = markMatches(result.Highlight)
+			result.Snippet = markMatches(result.Snippet)
+			results = append(results, result)
+		}
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search documents"})
+			return
+		}
+		c.JSON(http.StatusOK, results)
+	}
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/db"
+)
+
+var searchQueries = []struct {
+	typed string
+	query string
+}{
+	{"", ""},
+	{"  \t", ""},
+	{"plan", `"plan"`},
+	{"road  map", `"road" "map"`},
+	{"road\tmap\nplan", `"road" "map" "plan"`},
+	{`"road map"`, `"road map"`},
+	{`"road map" plan`, `"road map" "plan"`},
+	{`"road map`, `"road map"`},
+	{`say "hi`, `"say" "hi"`},
+	{`"`, ""},
+	{`""`, ""},
+	{`" "`, ""},
+	{`a"b`, `"a" "b"`},
+	{`"x""y"`, `"x" "y"`},
+	{"plan*", `"plan"*`},
+	{`"road ma"*`, `"road ma"*`},
+	{`"road ma*"`, `"road ma"*`},
+	{"*", ""},
+	{"**", ""},
+	{"* plan", `"plan"`},
+	{"co*op", `"co*op"`},
+	{"a NEAR b", `"a" "NEAR" "b"`},
+	{"NEAR(a b)", `"NEAR(a" "b)"`},
+	{"plan -draft", `"plan" "-draft"`},
+	{"-", `"-"`},
+	{"a OR b AND NOT c", `"a" "OR" "b" "AND" "NOT" "c"`},
+	{"title:plan", `"title:plan"`},
+	{"^plan", `"^plan"`},
+	{"(plan)", `"(plan)"`},
+	{"it's", `"it's"`},
+}
+
+func TestSearchQuery(t *testing.T) {
+	for _, tt := range searchQueries {
+		if got := searchQuery(tt.typed); got != tt.query {
+			t.Errorf("searchQuery(%q) = %s, want %s", tt.typed, got, tt.query)
+		}
+	}
+}
+
+func TestMarkMatches(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", ""},
+		{"plain text", "plain text"},
+		{matchStart + "plan" + matchEnd + " and " + matchStart + "map" + matchEnd, "<mark>plan</mark> and <mark>map</mark>"},
+		{"<b>" + matchStart + "plan" + matchEnd + "</b>", "&lt;b&gt;<mark>plan</mark>&lt;/b&gt;"},
+		{matchStart + "<script>" + matchEnd, "<mark>&lt;script&gt;</mark>"},
+		{`"quoted" & 'single'`, "&#34;quoted&#34; &amp; &#39;single&#39;"},
+		{"<mark>typed</mark>", "&lt;mark&gt;typed&lt;/mark&gt;"},
+	}
+	for _, tt := range tests {
+		if got := markMatches(tt.text); got != tt.want {
+			t.Errorf("markMatches(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// Search only finds documents the user owns, collaborates on or shares a
+// workspace with. It needs SQLite built with FTS5, with -tags sqlite_fts5.
+func TestSearchScoping(t *testing.T) {
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "docsmith.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if !searchAvailable(database) {
+		t.Skip("SQLite was built without FTS5")
+	}
+
+	now := time.Now()
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"insert into users (id, username, password_hash) values (1, 'alice', ''), (2, 'bob', ''), (3, 'carol', '')", nil},
+		{"insert into workspaces (id, name, owner_id, personal) values (1, 'alice', 1, 1), (2, 'bob', 2, 1), (3, 'team', 2, 0)", nil},
+		{"insert into workspace_members (workspace_id, user_id, role) values (1, 1, 'owner'), (2, 2, 'owner'), (3, 2, 'owner'), (3, 1, 'member')", nil},
+		{"insert into docs (id, user_id, title, content, updated_at, workspace_id) values (1, 1, 'Alice', '<b>roadmap</b> for alice', ?, 1)", []interface{}{now}},
+		{"insert into docs (id, user_id, title, content, updated_at, workspace_id) values (2, 2, 'Bob', 'roadmap for bob', ?, 2)", []interface{}{now}},
+		{"insert into docs (id, user_id, title, content, updated_at, workspace_id) values (3, 2, 'Team', 'roadmap for the team', ?, 3)", []interface{}{now}},
+		{"insert into docs (id, user_id, title, content, updated_at, workspace_id) values (4, 2, 'Roadmap', 'shared with alice', ?, 2)", []interface{}{now}},
+		{"insert into collaborators (doc_id, user_id, display_name, last_active) values (4, 1, 'alice', ?)", []interface{}{now}},
+	}
+	for _, s := range statements {
+		if _, err := database.Exec(s.query, s.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/search", func(c *gin.Context) {
+		userID, _ := strconv.Atoi(c.GetHeader("X-User"))
+		c.Set("userID", userID)
+	}, searchHandler(database))
+	search := func(userID int, q string) (int, []SearchResult) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/search?q="+url.QueryEscape(q), nil)
+		r.Header.Set("X-User", strconv.Itoa(userID))
+		router.ServeHTTP(w, r)
+		var results []SearchResult
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, results
+	}
+	ids := func(results []SearchResult) string {
+		var ids []string
+		for _, r := range results {
+			ids = append(ids, strconv.Itoa(r.ID))
+		}
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+
+	for userID, want := range map[int]string{1: "1,3,4", 2: "2,3,4", 3: ""} {
+		code, results := search(userID, "roadmap")
+		if code != http.StatusOK || ids(results) != want {
+			t.Errorf("user %d found %s (%d), want %s", userID, ids(results), code, want)
+		}
+	}
+
+	// The title counts for more, and the snippet is escaped
+	_, results := search(1, "roadmap")
+	if len(results) == 0 || results[0].ID != 4 || results[0].Highlight != "<mark>Roadmap</mark>" {
+		t.Errorf("best match is %+v, want document 4", results)
+	}
+	for _, r := range results {
+		if r.ID == 1 && !strings.Contains(r.Snippet, "&lt;b&gt;<mark>roadmap</mark>&lt;/b&gt;") {
+			t.Errorf("snippet is %q", r.Snippet)
+		}
+	}
+
+	// Nothing typed is an FTS5 syntax error
+	for _, tt := range searchQueries {
+		code, _ := search(1, tt.typed)
+		if tt.query == "" && code != http.StatusBadRequest || tt.query != "" && code != http.StatusOK {
+			t.Errorf("searching for %q answered %d", tt.typed, code)
+		}
+	}
+}
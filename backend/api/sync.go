@@ -0,0 +1,660 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/git"
+	"docsmith/models"
+	"docsmith/ws"
+)
+
+// SyncStatus is the state of syncing a workspace with its remote.
+type SyncStatus struct {
+	Remote       string     `json:"remote"`
+	URL          string     `json:"url"`
+	Interval     string     `json:"interval,omitempty"`
+	PushOnCommit bool       `json:"push_on_commit"`
+	LastPush     *time.Time `json:"last_push,omitempty"`
+	LastPull     *time.Time `json:"last_pull,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// errNoRemote is returned when syncing a workspace that has no remote.
+var errNoRemote = errors.New("no remote configured")
+
+// SyncOptions configure a Syncer.
+type SyncOptions struct {
+	// Default is the remote of the workspaces that haven't set their own,
+	// with {workspace} in its URL standing for the workspace's name. Its
+	// Name is used for every workspace's remote. It may have no URL.
+	Default      git.Remote
+	Interval     time.Duration
+	PushOnCommit bool
+	// AllowLocal lets workspaces set a path on the server as their remote.
+	AllowLocal bool
+}
+
+// Syncer keeps the workspace repositories in sync with their remotes: it
+// pushes after commits and on a schedule, and pulls commits made elsewhere
+// into the docs table. A workspace's owner can set its remote, with the
+// credentials to reach it; otherwise it has its own repository on the
+// default remote, if there is one. Each workspace has its own status.
+type Syncer struct {
+	db         *sql.DB
+	repos      *Repos
+	hubs       *ws.Registry
+	reconciler *Reconciler
+	options    SyncOptions
+	commits    chan struct{}
+
+	mutex   sync.Mutex
+	synced  map[int]*SyncStatus
+	pending map[int]bool
+}
+
+// syncedWorkspace is a workspace and its remote.
+type syncedWorkspace struct {
+	id     int
+	name   string
+	remote git.Remote
+}
+
+// NewSyncer returns a Syncer. With a zero interval it only syncs when asked
+// to, or after commits if PushOnCommit is set. Conflicts with unsaved
+// changes are left to reconciler.
+func NewSyncer(db *sql.DB, repos *Repos, hubs *ws.Registry, reconciler *Reconciler, options SyncOptions) *Syncer {
+	if options.Default.Name == "" {
+		options.Default.Name = "origin"
+	}
+	return &Syncer{
+		db:         db,
+		repos:      repos,
+		hubs:       hubs,
+		reconciler: reconciler,
+		options:    options,
+		commits:    make(chan struct{}, 1),
+		synced:     make(map[int]*SyncStatus),
+		pending:    make(map[int]bool),
+	}
+}
+
+// Start configures the remote of every workspace that has one and syncs in
+// the background.
+func (s *Syncer) Start() error {
+	if s.options.Default.URL != "" && !strings.Contains(s.options.Default.URL, "{workspace}") {
+		return fmt.Errorf("remote URL %s has no {workspace} to put each workspace's name in", s.options.Default.URL)
+	}
+	workspaces, err := s.workspaces()
+	if err != nil {
+		return err
+	}
+	for _, w := range workspaces {
+		if _, err := s.repo(w); err != nil {
+			return err
+		}
+	}
+	if s.options.PushOnCommit {
+		git.OnCommit(func(repo *git.Repo) {
+			id, ok := s.repos.WorkspaceID(repo)
+			if !ok {
+				return
+			}
+			s.mutex.Lock()
+			s.pending[id] = true
+			s.mutex.Unlock()
+			select {
+			case s.commits <- struct{}{}:
+			default:
+				// a push is already due
+			}
+		})
+	}
+	go s.run()
+	return nil
+}
+
+func (s *Syncer) run() {
+	var tick <-chan time.Time
+	if s.options.Interval > 0 {
+		ticker := time.NewTicker(s.options.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		s.Sync()
+	}
+	for {
+		select {
+		case <-tick:
+			s.Sync()
+		case <-s.commits:
+			s.mutex.Lock()
+			pending := s.pending
+			s.pending = make(map[int]bool)
+			s.mutex.Unlock()
+
+			workspaces, err := s.workspaces()
+			if err != nil {
+				log.Printf("Failed to list workspaces: %v", err)
+				continue
+			}
+			for _, w := range workspaces {
+				if !pending[w.id] {
+					continue
+				}
+				// The remote may have moved on; pull before trying again
+				if err := s.push(w); err != nil {
+					if _, err = s.pull(w); err == nil {
+						s.push(w)
+					}
+				}
+			}
+		}
+	}
+}
+
+// workspaces lists the workspaces with a remote to sync with.
+func (s *Syncer) workspaces() ([]syncedWorkspace, error) {
+	rows, err := s.db.Query("select id, name from workspaces order by id")
+	if err != nil {
+		return nil, fmt.Errorf("list workspaces: %w", err)
+	}
+	var all []syncedWorkspace
+	for rows.Next() {
+		var w syncedWorkspace
+		if err := rows.Scan(&w.id, &w.name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("list workspaces: %w", err)
+		}
+		all = append(all, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list workspaces: %w", err)
+	}
+
+	var workspaces []syncedWorkspace
+	for _, w := range all {
+		w, err := s.withRemote(w.id, w.name)
+		if errors.Is(err, errNoRemote) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, w)
+	}
+	return workspaces, nil
+}
+
+// workspace returns a workspace to sync by its ID.
+func (s *Syncer) workspace(id int) (syncedWorkspace, error) {
+	var name string
+	if err := s.db.QueryRow("select name from workspaces where id = ?", id).Scan(&name); err != nil {
+		return syncedWorkspace{}, fmt.Errorf("find workspace %d: %w", id, err)
+	}
+	return s.withRemote(id, name)
+}
+
+// withRemote pairs a workspace with its remote: the one its owner set, or
+// else its own repository on the default remote. It returns errNoRemote if
+// there's neither.
+func (s *Syncer) withRemote(id int, name string) (syncedWorkspace, error) {
+	w := syncedWorkspace{id: id, name: name}
+	remote, err := workspaceRemote(s.db, id)
+	switch {
+	case err == nil:
+		w.remote = remote
+	case !errors.Is(err, sql.ErrNoRows):
+		return w, fmt.Errorf("load remote of workspace %s: %w", name, err)
+	case s.options.Default.URL == "":
+		return w, errNoRemote
+	default:
+		w.remote = s.options.Default
+		w.remote.URL = strings.ReplaceAll(s.options.Default.URL, "{workspace}", url.PathEscape(name))
+	}
+	w.remote.Name = s.options.Default.Name
+	return w, nil
+}
+
+// repo opens the repository of a workspace with its remote configured.
+func (s *Syncer) repo(w syncedWorkspace) (*git.Repo, error) {
+	repo, err := s.repos.Workspace(w.id)
+	if err != nil {
+		return nil, err
+	}
+	if err := git.AddRemote(repo, w.remote); err != nil {
+		return nil, fmt.Errorf("workspace %s: %w", w.name, err)
+	}
+	return repo, nil
+}
+
+// Status returns the state of syncing a workspace.
+func (s *Syncer) Status(workspaceID int) (SyncStatus, error) {
+	w, err := s.workspace(workspaceID)
+	if err != nil {
+		return SyncStatus{}, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := SyncStatus{Remote: w.remote.Name, URL: w.remote.URL, PushOnCommit: s.options.PushOnCommit}
+	if s.options.Interval > 0 {
+		status.Interval = s.options.Interval.String()
+	}
+	if synced := s.synced[w.id]; synced != nil {
+		status.LastPush, status.LastPull, status.LastError = synced.LastPush, synced.LastPull, synced.LastError
+	}
+	return status, nil
+}
+
+// record notes how a pull, or a push if pulled is false, of a workspace
+// went.
+func (s *Syncer) record(w syncedWorkspace, err error, pulled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := s.synced[w.id]
+	if status == nil {
+		status = &SyncStatus{}
+		s.synced[w.id] = status
+	}
+	if err != nil {
+		status.LastError = err.Error()
+		return
+	}
+	now := time.Now()
+	if pulled {
+		status.LastPull = &now
+	} else {
+		status.LastPush = &now
+	}
+	status.LastError = ""
+}
+
+// Sync pulls and then pushes every workspace with a remote. A workspace
+// that fails to pull isn't pushed.
+func (s *Syncer) Sync() error {
+	workspaces, err := s.workspaces()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, w := range workspaces {
+		if _, err := s.pull(w); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := s.push(w); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Push sends a workspace's local commits to its remote.
+func (s *Syncer) Push(workspaceID int) error {
+	w, err := s.workspace(workspaceID)
+	if err != nil {
+		return err
+	}
+	return s.push(w)
+}
+
+func (s *Syncer) push(w syncedWorkspace) error {
+	repo, err := s.repo(w)
+	if err == nil {
+		err = git.Push(repo, w.remote)
+	}
+	if err != nil {
+		log.Printf("Failed to push workspace %s to %s: %v", w.name, w.remote.Name, err)
+		err = fmt.Errorf("workspace %s: %w", w.name, err)
+	}
+	s.record(w, err, false)
+	return err
+}
+
+// Pull merges the commits on a workspace's remote into it and imports the
+// documents they changed into the docs table.
+func (s *Syncer) Pull(workspaceID int) (*git.PullResult, error) {
+	w, err := s.workspace(workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	return s.pull(w)
+}
+
+func (s *Syncer) pull(w syncedWorkspace) (*git.PullResult, error) {
+	repo, err := s.repo(w)
+	var result *git.PullResult
+	if err == nil {
+		result, err = git.Pull(repo, w.remote)
+	}
+	if err != nil {
+		log.Printf("Failed to pull workspace %s from %s: %v", w.name, w.remote.Name, err)
+		err = fmt.Errorf("workspace %s: %w", w.name, err)
+		s.record(w, err, true)
+		return nil, err
+	}
+	removed := removedFiles(result.Changed)
+	for _, file := range result.Changed {
+		importDocument(s.db, s.hubs, s.reconciler, repo, w.id, file, removed, w.remote.Name, fmt.Sprintf("Pulled from %s", w.remote.Name))
+	}
+	s.record(w, nil, true)
+	return result, nil
+}
+
+// workspaceRemote loads the remote a workspace's owner set, or returns
+// sql.ErrNoRows. Its Name is left to the caller.
+func workspaceRemote(db *sql.DB, workspaceID int) (git.Remote, error) {
+	var remote git.Remote
+	err := db.QueryRow(`select url, username, password, ssh_key, ssh_key_passphrase, known_hosts
+		from workspace_remotes where workspace_id = ?`, workspaceID).
+		Scan(&remote.URL, &remote.Username, &remote.Password, &remote.SSHKey, &remote.SSHKeyPassphrase, &remote.KnownHosts)
+	return remote, err
+}
+
+// validRemoteURL reports whether a workspace may use url as its remote: a
+// git server over SSH or HTTP, or a path on this server if allowLocal is
+// set.
+func validRemoteURL(remoteURL string, allowLocal bool) bool {
+	if u, err := url.Parse(remoteURL); err == nil && u.Scheme != "" && u.Host != "" {
+		switch u.Scheme {
+		case "ssh", "http", "https", "git":
+			return true
+		}
+		return false
+	}
+	if filepath.IsAbs(remoteURL) || strings.HasPrefix(remoteURL, "file://") {
+		return allowLocal
+	}
+	// scp-like user@host:path
+	at := strings.Index(remoteURL, "@")
+	colon := strings.Index(remoteURL, ":")
+	return at > 0 && colon > at+1 && colon < len(remoteURL)-1
+}
+
+// importDocument brings a document of a workspace changed by a pull or a
+// push into the docs table and any live session. Edits not yet committed
+// are kept if they don't overlap the change, which came from source;
+// if they do, the reconciler holds on to the change until the conflict is
+// resolved. removed holds the files the pull or push removed.
+func importDocument(db *sql.DB, hubs *ws.Registry, reconciler *Reconciler, repo *git.Repo, workspaceID int, changed git.ChangedFile, removed map[string]string, source string, message string) {
+	if !strings.HasSuffix(changed.Path, ".md") {
+		return
+	}
+	file, err := changedDocument(db, repo, workspaceID, changed, removed)
+	if err != nil {
+		log.Printf("Failed to find the document of %s: %v", changed.Path, err)
+		return
+	}
+	docID := file.DocumentID
+	if docID == "" {
+		log.Printf("%s changed %s, but there is no document to import it into", source, file.Path)
+		return
+	}
+
+	var title string
+	var content sql.NullString
+	err = db.QueryRow("select title, content from docs where id = ?", docID).Scan(&title, &content)
+	if err != nil {
+		log.Printf("Failed to load document %s: %v", docID, err)
+		return
+	}
+	if file.Deleted {
+		log.Printf("%s deleted %s; document %s is kept", source, file.Path, docID)
+		return
+	}
+
+	merged := git.Merge3(file.OldContent, content.String, file.Content, "local", source)
+	if len(merged.Conflicts) > 0 {
+		// Keep the unsaved edits until the user settles it
+		if reconciler == nil {
+			log.Printf("Uncommitted edits to document %s conflict with %s; keeping them", docID, source)
+			return
+		}
+		reconciler.raiseConflict(ExternalConflict{
+			DocumentID: docID,
+			Path:       file.Path,
+			Source:     source,
+			External:   file.Content,
+			Merge:      merged,
+			DetectedAt: time.Now(),
+		}, title, fmt.Sprintf("%s changed %s in a way that conflicts with unsaved changes", source, file.Path))
+		return
+	}
+	updated := merged.Content
+	if updated == content.String {
+		return
+	}
+
+	if _, err := db.Exec("update docs set content = ?, updated_at = ? where id = ?", updated, time.Now(), docID); err != nil {
+		log.Printf("Failed to import document %s: %v", docID, err)
+		return
+	}
+	hubs.Publish(docID, ws.Event{
+		Type:    ws.EventUpdated,
+		Title:   title,
+		Content: &updated,
+		Message: message,
+	})
+}
+
+// syncWorkspace loads the workspace whose sync or remote is asked about,
+// which only its owner can see to. It writes the error response and returns
+// false if syncing is off or the user isn't the owner.
+func syncWorkspace(c *gin.Context, db *sql.DB, syncer *Syncer) (models.Workspace, bool) {
+	if syncer == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No remote configured"})
+		return models.Workspace{}, false
+	}
+	workspace, ok := memberWorkspace(c, db)
+	if !ok {
+		return workspace, false
+	}
+	if workspace.Role != models.RoleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can sync the workspace"})
+		return workspace, false
+	}
+	return workspace, true
+}
+
+// syncError writes the response for a failed sync of a workspace.
+func syncError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errNoRemote):
+		c.JSON(http.StatusNotFound, gin.H{"error": "No remote configured"})
+	case errors.Is(err, git.ErrPullConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+	}
+}
+
+// syncStatusHandler reports the state of syncing a workspace with its
+// remote.
+func syncStatusHandler(db *sql.DB, syncer *Syncer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		workspace, ok := syncWorkspace(c, db, syncer)
+		if !ok {
+			return
+		}
+		status, err := syncer.Status(workspace.ID)
+		if errors.Is(err, errNoRemote) {
+			syncError(c, err)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sync status"})
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+func syncPullHandler(db *sql.DB, syncer *Syncer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		workspace, ok := syncWorkspace(c, db, syncer)
+		if !ok {
+			return
+		}
+		result, err := syncer.Pull(workspace.ID)
+		if err != nil {
+			syncError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+func syncPushHandler(db *sql.DB, syncer *Syncer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		workspace, ok := syncWorkspace(c, db, syncer)
+		if !ok {
+			return
+		}
+		if err := syncer.Push(workspace.ID); err != nil {
+			syncError(c, err)
+			return
+		}
+		status, err := syncer.Status(workspace.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sync status"})
+			return
+		}
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+// SetWorkspaceRemoteRequest sets a workspace's remote. Credentials left out
+// are kept as they were; empty ones are cleared.
+type SetWorkspaceRemoteRequest struct {
+	URL              string  `json:"url" binding:"required"`
+	Username         string  `json:"username"`
+	Password         *string `json:"password"`
+	SSHKey           *string `json:"ssh_key"`
+	SSHKeyPassphrase *string `json:"ssh_key_passphrase"`
+	KnownHosts       *string `json:"known_hosts"`
+}
+
+// remoteView is a workspace's remote as shown to its owner, without the
+// credentials.
+func remoteView(remote git.Remote, updatedAt time.Time) models.WorkspaceRemote {
+	return models.WorkspaceRemote{
+		URL:           remote.URL,
+		Username:      remote.Username,
+		HasPassword:   remote.Password != "",
+		HasSSHKey:     remote.SSHKey != "",
+		HasKnownHosts: remote.KnownHosts != "",
+		UpdatedAt:     updatedAt,
+	}
+}
+
+// getWorkspaceRemoteHandler shows the remote the workspace's owner set.
+func getWorkspaceRemoteHandler(db *sql.DB, syncer *Syncer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		workspace, ok := syncWorkspace(c, db, syncer)
+		if !ok {
+			return
+		}
+		remote, err := workspaceRemote(db, workspace.ID)
+		var updatedAt time.Time
+		if err == nil {
+			err = db.QueryRow("select updated_at from workspace_remotes where workspace_id = ?", workspace.ID).Scan(&updatedAt)
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No remote configured"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load remote"})
+			return
+		}
+		c.JSON(http.StatusOK, remoteView(remote, updatedAt))
+	}
+}
+
+// setWorkspaceRemoteHandler sets the remote the workspace syncs with, in
+// place of the default one, and the credentials to reach it.
+func setWorkspaceRemoteHandler(db *sql.DB, syncer *Syncer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		workspace, ok := syncWorkspace(c, db, syncer)
+		if !ok {
+			return
+		}
+		var req SetWorkspaceRemoteRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !validRemoteURL(req.URL, syncer.options.AllowLocal) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Remote URL must be an ssh or http(s) git URL"})
+			return
+		}
+
+		remote, err := workspaceRemote(db, workspace.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load remote"})
+			return
+		}
+		remote.URL, remote.Username = req.URL, req.Username
+		for _, set := range []struct {
+			value *string
+			field *string
+		}{
+			{req.Password, &remote.Password},
+			{req.SSHKey, &remote.SSHKey},
+			{req.SSHKeyPassphrase, &remote.SSHKeyPassphrase},
+			{req.KnownHosts, &remote.KnownHosts},
+		} {
+			if set.value != nil {
+				*set.field = *set.value
+			}
+		}
+		if err := remote.Check(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		now := time.Now()
+		_, err = db.Exec(`insert into workspace_remotes (workspace_id, url, username, password, ssh_key, ssh_key_passphrase, known_hosts, updated_at)
+			values (?, ?, ?, ?, ?, ?, ?, ?)
+			on conflict(workspace_id) do update set url = excluded.url, username = excluded.username, password = excluded.password,
+				ssh_key = excluded.ssh_key, ssh_key_passphrase = excluded.ssh_key_passphrase, known_hosts = excluded.known_hosts,
+				updated_at = excluded.updated_at`,
+			workspace.ID, remote.URL, remote.Username, remote.Password, remote.SSHKey, remote.SSHKeyPassphrase, remote.KnownHosts, now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save remote"})
+			return
+		}
+		c.JSON(http.StatusOK, remoteView(remote, now))
+	}
+}
+
+// deleteWorkspaceRemoteHandler forgets the workspace's remote, leaving it
+// to sync with the default remote, if there is one.
+func deleteWorkspaceRemoteHandler(db *sql.DB, syncer *Syncer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		workspace, ok := syncWorkspace(c, db, syncer)
+		if !ok {
+			return
+		}
+		result, err := db.Exec("delete from workspace_remotes where workspace_id = ?", workspace.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete remote"})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No remote configured"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Remote deleted"})
+	}
+}
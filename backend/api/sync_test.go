@@ -0,0 +1,265 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"docsmith/db"
+	"docsmith/git"
+	"docsmith/ws"
+)
+
+// syncTest is a workspace with one document, plan.md, whose remote is a
+// bare repository on disk.
+type syncTest struct {
+	t          *testing.T
+	db         *sql.DB
+	syncer     *Syncer
+	reconciler *Reconciler
+	repo       *git.Repo
+	bare       string
+}
+
+func newSyncTest(t *testing.T) *syncTest {
+	t.Helper()
+	dir := t.TempDir()
+	database, err := db.InitDB(filepath.Join(dir, "docsmith.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	repos := NewRepos(database, filepath.Join(dir, "repos"))
+	repo, err := repos.Workspace(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare := filepath.Join(dir, "remote.git")
+	if _, err := gogit.PlainInit(bare, true); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := git.Document{ID: "1", Path: "plan.md"}
+	if err := git.SaveDocument(repo, doc, "one\ntwo\nthree\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.CommitDocumentAs(repo, doc, "Create document: Plan", git.Author{Name: "alice", Email: "alice@example.com"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"insert into users (id, username, password_hash) values (1, 'alice', '')", nil},
+		{"insert into workspaces (id, name, owner_id, personal) values (1, 'alice', 1, 1)", nil},
+		{"insert into docs (id, user_id, title, content, updated_at, workspace_id, path) values (1, 1, 'Plan', ?, ?, 1, 'plan.md')", []interface{}{"one\ntwo\nthree\n", time.Now()}},
+		{"insert into workspace_remotes (workspace_id, url, updated_at) values (1, ?, ?)", []interface{}{bare, time.Now()}},
+	}
+	for _, s := range statements {
+		if _, err := database.Exec(s.query, s.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hubs := ws.NewRegistry(NewHubStore(database, repos), nil)
+	reconciler := NewReconciler(database, repos, hubs, time.Second)
+	return &syncTest{
+		t:          t,
+		db:         database,
+		syncer:     NewSyncer(database, repos, hubs, reconciler, SyncOptions{AllowLocal: true}),
+		reconciler: reconciler,
+		repo:       repo,
+		bare:       bare,
+	}
+}
+
+// remoteEdit changes plan.md in a clone of the remote, as someone else, and
+// pushes it.
+func (st *syncTest) remoteEdit(from string, to string) {
+	st.t.Helper()
+	dir := st.t.TempDir()
+	r, err := gogit.PlainClone(dir, false, &gogit.CloneOptions{URL: st.bare})
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	file := filepath.Join(dir, "plan.md")
+	content, err := os.ReadFile(file)
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(strings.Replace(string(content), from, to, 1)), 0644); err != nil {
+		st.t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	if _, err := w.Add("plan.md"); err != nil {
+		st.t.Fatal(err)
+	}
+	bob := &object.Signature{Name: "bob", Email: "bob@example.com", When: time.Now()}
+	if _, err := w.Commit("Edit plan", &gogit.CommitOptions{Author: bob, Committer: bob}); err != nil {
+		st.t.Fatal(err)
+	}
+	if err := r.Push(&gogit.PushOptions{}); err != nil {
+		st.t.Fatal(err)
+	}
+}
+
+// remoteHead is the commit the remote's branch points at.
+func (st *syncTest) remoteHead() string {
+	st.t.Helper()
+	r, err := gogit.PlainOpen(st.bare)
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	ref, err := r.Head()
+	if err != nil {
+		st.t.Fatal(err)
+	}
+	return ref.Hash().String()
+}
+
+func (st *syncTest) content() string {
+	st.t.Helper()
+	var content string
+	if err := st.db.QueryRow("select content from docs where id = 1").Scan(&content); err != nil {
+		st.t.Fatal(err)
+	}
+	return content
+}
+
+func TestSyncPushAndPull(t *testing.T) {
+	st := newSyncTest(t)
+	if err := st.syncer.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	head, err := git.Head(st.repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote := st.remoteHead(); remote != head {
+		t.Fatalf("remote is at %s, want %s", remote, head)
+	}
+
+	st.remoteEdit("three", "THREE")
+	result, err := st.syncer.Pull(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.From != head || result.To != st.remoteHead() || len(result.Changed) != 1 {
+		t.Errorf("pulled %+v, want a fast forward from %s to %s", result, head, st.remoteHead())
+	}
+	if got := st.content(); got != "one\ntwo\nTHREE\n" {
+		t.Errorf("document is %q after pulling", got)
+	}
+
+	status, err := st.syncer.Status(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.URL != st.bare || status.LastPush == nil || status.LastPull == nil || status.LastError != "" {
+		t.Errorf("status is %+v", status)
+	}
+}
+
+// Unsaved edits that don't overlap the pulled change are kept.
+func TestSyncPullMergesUnsavedEdits(t *testing.T) {
+	st := newSyncTest(t)
+	if err := st.syncer.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.db.Exec("update docs set content = ? where id = 1", "ONE\ntwo\nthree\n"); err != nil {
+		t.Fatal(err)
+	}
+	st.remoteEdit("three", "THREE")
+	if _, err := st.syncer.Pull(1); err != nil {
+		t.Fatal(err)
+	}
+	if got := st.content(); got != "ONE\ntwo\nTHREE\n" {
+		t.Errorf("document is %q after pulling", got)
+	}
+	if _, ok := st.reconciler.Conflict("1"); ok {
+		t.Errorf("a clean merge raised a conflict")
+	}
+}
+
+// A pulled change that conflicts with unsaved edits is held back until
+// it's resolved, rather than overwriting them.
+func TestSyncPullConflict(t *testing.T) {
+	st := newSyncTest(t)
+	if err := st.syncer.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.db.Exec("update docs set content = ? where id = 1", "one\nours\nthree\n"); err != nil {
+		t.Fatal(err)
+	}
+	st.remoteEdit("two", "theirs")
+	if _, err := st.syncer.Pull(1); err != nil {
+		t.Fatal(err)
+	}
+	if got := st.content(); got != "one\nours\nthree\n" {
+		t.Errorf("document is %q, want the unsaved edits kept", got)
+	}
+	conflict, ok := st.reconciler.Conflict("1")
+	if !ok {
+		t.Fatal("no conflict raised")
+	}
+	if conflict.Source != "origin" || conflict.Path != "plan.md" || conflict.External != "one\ntheirs\nthree\n" || len(conflict.Merge.Conflicts) != 1 {
+		t.Errorf("conflict is %+v", conflict)
+	}
+}
+
+func TestSyncWithoutRemote(t *testing.T) {
+	st := newSyncTest(t)
+	if _, err := st.db.Exec("delete from workspace_remotes"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.syncer.Push(1); !errors.Is(err, errNoRemote) {
+		t.Errorf("pushing without a remote: %v", err)
+	}
+	if workspaces, err := st.syncer.workspaces(); err != nil || len(workspaces) != 0 {
+		t.Errorf("workspaces to sync are %v (%v), want none", workspaces, err)
+	}
+
+	// The default remote stands in, with the workspace's name in its URL
+	st.syncer.options.Default.URL = filepath.Join(filepath.Dir(st.bare), "{workspace}.git")
+	w, err := st.syncer.workspace(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(filepath.Dir(st.bare), "alice.git"); w.remote.URL != want {
+		t.Errorf("remote is %s, want %s", w.remote.URL, want)
+	}
+}
+
+func TestValidRemoteURL(t *testing.T) {
+	tests := []struct {
+		url        string
+		allowLocal bool
+		want       bool
+	}{
+		{"https://github.com/you/notes.git", false, true},
+		{"ssh://git@github.com/you/notes.git", false, true},
+		{"git@github.com:you/notes.git", false, true},
+		{"ftp://example.com/notes.git", false, false},
+		{"/srv/git/notes.git", false, false},
+		{"/srv/git/notes.git", true, true},
+		{"file:///srv/git/notes.git", false, false},
+		{"file:///srv/git/notes.git", true, true},
+		{"notes", true, false},
+		{"git@github.com:", false, false},
+	}
+	for _, tt := range tests {
+		if got := validRemoteURL(tt.url, tt.allowLocal); got != tt.want {
+			t.Errorf("validRemoteURL(%q, %v) = %v, want %v", tt.url, tt.allowLocal, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/git"
+)
+
+type TagRequest struct {
+	Name string `json:"name" binding:"required"`
+	// Version is the commit to tag; the latest version of the document if
+	// empty.
+	Version string `json:"version"`
+	Message string `json:"message"`
+}
+
+type MoveTagRequest struct {
+	Version string `json:"version" binding:"required"`
+	Message string `json:"message"`
+}
+
+// tagError answers a failed tag operation.
+func tagError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, git.ErrInvalidTagName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tag names are letters, digits, '.', '-' and '_', up to 100 characters"})
+	case errors.Is(err, git.ErrTagExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Tag already exists"})
+	case errors.Is(err, git.ErrTagNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+	default:
+		versionError(c, err, message)
+	}
+}
+
+func listDocumentTagsHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		tags, err := git.ListDocumentTags(repo, doc.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list tags"})
+			return
+		}
+
+		c.JSON(http.StatusOK, tags)
+	}
+}
+
+func createDocumentTagHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		var req TagRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+
+		file := documentFile(doc)
+		if req.Version == "" {
+			latest, err := git.LatestVersion(repo, file)
+			if err != nil {
+				versionError(c, err, "Failed to find the latest version")
+				return
+			}
+			req.Version = latest.Hash
+		}
+
+		tag, err := git.TagDocumentVersion(repo, file, req.Name, req.Version, req.Message, author)
+		if err != nil {
+			tagError(c, err, "Failed to create tag")
+			return
+		}
+
+		c.JSON(http.StatusCreated, tag)
+	}
+}
+
+func moveDocumentTagHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		var req MoveTagRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+
+		file := documentFile(doc)
+		tag, err := git.MoveDocumentTag(repo, file, c.Param("tag"), req.Version, req.Message, author)
+		if err != nil {
+			tagError(c, err, "Failed to move tag")
+			return
+		}
+
+		c.JSON(http.StatusOK, tag)
+	}
+}
+
+func deleteDocumentTagHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		if err := git.DeleteDocumentTag(repo, doc.ID, c.Param("tag")); err != nil {
+			tagError(c, err, "Failed to delete tag")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Tag deleted"})
+	}
+}
+
+// getDocumentTagHandler returns the document as of a tagged version.
+func getDocumentTagHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		file := documentFile(doc)
+		version, err := git.GetVersion(repo, file, git.DocumentTagRevision(doc.ID, c.Param("tag")))
+		if errors.Is(err, git.ErrVersionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Tag not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve version content"})
+			return
+		}
+
+		response := versionResponse(doc, version)
+		response["tag"] = c.Param("tag")
+		c.JSON(http.StatusOK, response)
+	}
+}
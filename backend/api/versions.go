@@ -0,0 +1,277 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/git"
+	"docsmith/models"
+	"docsmith/ws"
+)
+
+// currentVersion names the document as it is now, rather than a commit,
+// wherever a version is expected.
+const currentVersion = "current"
+
+// memberDocument loads a document the signed in user owns or shares a
+// workspace with. It writes the error response and returns false when the
+// document can't be used.
+func memberDocument(c *gin.Context, db *sql.DB) (models.Document, bool) {
+	userID, _ := c.Get("userID")
+	var doc models.Document
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid document ID"})
+		return doc, false
+	}
+
+	var content, workspaceID, path sql.NullString
+	err = db.QueryRow("SELECT id, user_id, workspace_id, title, folder, path, content, updated_at FROM docs WHERE id = ?", id).
+		Scan(&doc.ID, &doc.UserID, &workspaceID, &doc.Title, &doc.Folder, &path, &content, &doc.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Document not found"})
+		return doc, false
+	}
+	doc.Content = content.String
+	doc.WorkspaceID = workspaceID.String
+	doc.Path = path.String
+
+	allowed, err := documentAccess(db, doc.ID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+		return doc, false
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return doc, false
+	}
+	return doc, true
+}
+
+// versionError answers a failed git lookup of a version.
+func versionError(c *gin.Context, err error, message string) {
+	if errors.Is(err, git.ErrVersionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// diffVersionsHandler compares two versions of a document. Without otherId,
+// or with otherId "current", the version is compared with the document as
+// it is now.
+func diffVersionsHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		file := documentFile(doc)
+		from := c.Param("versionId")
+		to := c.Param("otherId")
+
+		var diff *git.Diff
+		var err error
+		if to == "" || to == currentVersion {
+			diff, err = git.DiffWithContent(repo, file, from, doc.Content)
+			if diff != nil {
+				diff.To = currentVersion
+			}
+		} else {
+			diff, err = git.DiffVersions(repo, file, from, to)
+		}
+		if err != nil {
+			versionError(c, err, "Failed to diff versions")
+			return
+		}
+
+		c.JSON(http.StatusOK, diff)
+	}
+}
+
+// timeLayouts are the forms accepted for "at" times, most precise first.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+}
+
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339 such as 2026-09-01T00:00Z", value)
+}
+
+// versionResponse is a read-only view of a document at a version. Titles
+// aren't versioned, so the current title is given.
+func versionResponse(doc models.Document, version *git.Version) gin.H {
+	return gin.H{
+		"id":        doc.ID,
+		"title":     doc.Title,
+		"version":   version.Commit,
+		"content":   version.Content,
+		"read_only": true,
+	}
+}
+
+// getDocumentVersionHandler shows a document as of a version, without
+// restoring it.
+func getDocumentVersionHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		file := documentFile(doc)
+		version, err := git.GetVersion(repo, file, c.Param("versionId"))
+		if err != nil {
+			versionError(c, err, "Failed to retrieve version content")
+			return
+		}
+
+		c.JSON(http.StatusOK, versionResponse(doc, version))
+	}
+}
+
+// documentAt answers GET /documents/:id?at=<time> with the document as of
+// the last commit touching it at that time.
+func documentAt(c *gin.Context, repo *git.Repo, doc models.Document, at string) {
+	t, err := parseTime(at)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	file := documentFile(doc)
+	version, err := git.VersionAt(repo, file, t)
+	if err != nil {
+		versionError(c, err, "Failed to retrieve version content")
+		return
+	}
+
+	c.JSON(http.StatusOK, versionResponse(doc, version))
+}
+
+// blameDocumentHandler annotates each line of a document with the commit
+// that last changed it.
+func blameDocumentHandler(db *sql.DB, repos *Repos) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		file := documentFile(doc)
+		lines, err := git.BlameDocument(repo, file, doc.Content)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to blame document"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": doc.ID, "lines": lines})
+	}
+}
+
+// revertDocumentVersionHandler undoes the changes one version made to a
+// document, keeping every later edit. If later edits overlap the change,
+// nothing is committed and the conflicts are returned.
+func revertDocumentVersionHandler(db *sql.DB, repos *Repos, hubs *ws.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		doc, ok := memberDocument(c, db)
+		if !ok {
+			return
+		}
+		repo, ok := documentRepo(c, repos, doc)
+		if !ok {
+			return
+		}
+
+		author, err := commitAuthor(db, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+
+		file := documentFile(doc)
+		revert, err := git.RevertVersion(repo, file, c.Param("versionId"), doc.Content)
+		if errors.Is(err, git.ErrNothingToRevert) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Version doesn't change this document"})
+			return
+		}
+		if err != nil {
+			versionError(c, err, "Failed to revert version")
+			return
+		}
+		if len(revert.Conflicts) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Later edits conflict with the change", "revert": revert})
+			return
+		}
+		if revert.Content == doc.Content {
+			c.JSON(http.StatusConflict, gin.H{"error": "Change is already undone"})
+			return
+		}
+
+		now := time.Now()
+		if _, err := db.Exec("UPDATE docs SET content = ?, updated_at = ? WHERE id = ?", revert.Content, now, doc.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update document"})
+			return
+		}
+		if err := git.SaveDocument(repo, file, revert.Content); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save document to git"})
+			return
+		}
+
+		subject, _, _ := strings.Cut(revert.Reverted.Message, "\n")
+		message := fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.", subject, revert.Reverted.Hash)
+		hash, err := git.CommitDocumentAs(repo, file, message, author, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit changes"})
+			return
+		}
+
+		hubs.Publish(doc.ID, ws.Event{
+			Type:    ws.EventReverted,
+			UserID:  fmt.Sprintf("%v", userID),
+			Title:   doc.Title,
+			Content: &revert.Content,
+			Hash:    hash,
+			Message: message,
+		})
+
+		c.JSON(http.StatusOK, gin.H{
+			"id":         doc.ID,
+			"hash":       hash,
+			"reverted":   revert.Reverted,
+			"title":      doc.Title,
+			"content":    revert.Content,
+			"message":    message,
+			"updated_at": now,
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/ws"
+)
+
+// maxDisplayNameLength caps the name anonymous share visitors pick for
+// themselves.
+const maxDisplayNameLength = 64
+
+// websocketHandler upgrades /ws connections after checking that the caller
+// may open the requested document. Browsers can't set headers on a websocket
+// handshake, so the token may also be passed as the "token" query parameter.
+// Visitors with a share link pass "shareId" instead of, or as well as, a token.
+func websocketHandler(db *sql.DB, hubs *ws.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get document ID from query param
+		docID := c.Query("docId")
+		if docID == "" {
+			c.String(http.StatusBadRequest, "Missing document ID")
+			return
+		}
+
+		identity, status, err := authorizeWebsocket(db, c, docID)
+		if err != nil {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Setup hub if it doesn't exist
+		hub := hubs.GetOrCreateHub(docID)
+		ws.ServeWs(hub, identity, c.Writer, c.Request)
+	}
+}
+
+// authorizeWebsocket resolves who is connecting and what they may do. It
+// returns the HTTP status to reject the handshake with when err is set.
+func authorizeWebsocket(db *sql.DB, c *gin.Context, docID string) (ws.Identity, int, error) {
+	var ownerID int
+	err := db.QueryRow("SELECT user_id FROM docs WHERE id = ?", docID).Scan(&ownerID)
+	if err != nil {
+		return ws.Identity{}, http.StatusNotFound, fmt.Errorf("document not found")
+	}
+
+	tokenString := c.Query("token")
+	if header := c.GetHeader("Authorization"); tokenString == "" && strings.HasPrefix(header, "Bearer ") {
+		tokenString = strings.TrimPrefix(header, "Bearer ")
+	}
+	shareID := c.Query("shareId")
+
+	if tokenString == "" && shareID == "" {
+		return ws.Identity{}, http.StatusUnauthorized, fmt.Errorf("authentication required")
+	}
+
+	var identity ws.Identity
+	if tokenString != "" {
+		claims, err := parseToken(tokenString)
+		if err != nil {
+			return ws.Identity{}, http.StatusUnauthorized, fmt.Errorf("invalid or expired token")
+		}
+
+		var username string
+		err = db.QueryRow("SELECT username FROM users WHERE id = ?", claims.UserID).Scan(&username)
+		if err != nil {
+			return ws.Identity{}, http.StatusUnauthorized, fmt.Errorf("unknown user")
+		}
+		identity.UserID = fmt.Sprintf("%d", claims.UserID)
+		identity.Username = username
+
+		if claims.UserID == ownerID {
+			identity.CanEdit = true
+			return identity, http.StatusOK, nil
+		}
+
+		member, err := documentAccess(db, docID, claims.UserID)
+		if err != nil {
+			return ws.Identity{}, http.StatusInternalServerError, fmt.Errorf("failed to check workspace members")
+		}
+		if member {
+			identity.CanEdit = true
+			return identity, http.StatusOK, nil
+		}
+
+		var count int
+		err = db.QueryRow("SELECT count(*) FROM collaborators WHERE doc_id = ? AND user_id = ?",
+			docID, claims.UserID).Scan(&count)
+		if err != nil {
+			return ws.Identity{}, http.StatusInternalServerError, fmt.Errorf("failed to check collaborators")
+		}
+		if count > 0 {
+			identity.CanEdit = true
+			return identity, http.StatusOK, nil
+		}
+
+		if shareID == "" {
+			return ws.Identity{}, http.StatusForbidden, fmt.Errorf("access denied")
+		}
+	}
+
+	var canEdit bool
+	var expireAt time.Time
+	err = db.QueryRow("SELECT can_edit, expire_at FROM doc_shares WHERE share_id = ? AND doc_id = ?",
+		shareID, docID).Scan(&canEdit, &expireAt)
+	if err != nil {
+		return ws.Identity{}, http.StatusForbidden, fmt.Errorf("share link not valid for this document")
+	}
+	if time.Now().After(expireAt) {
+		return ws.Identity{}, http.StatusForbidden, fmt.Errorf("share link has expired")
+	}
+	identity.CanEdit = canEdit
+
+	if identity.UserID == "" {
+		identity.IsAnonymous = true
+		identity.UserID = fmt.Sprintf("anon-%d", rand.Int63())
+		identity.Username = strings.TrimSpace(c.Query("username"))
+		if name := []rune(identity.Username); len(name) > maxDisplayNameLength {
+			identity.Username = string(name[:maxDisplayNameLength])
+		}
+		if identity.Username == "" {
+			identity.Username = "Anonymous"
+		}
+	}
+
+	return identity, http.StatusOK, nil
+}
+
+// wsMetricsHandler reports how the websocket hubs of this instance are
+// coping with their clients.
+func wsMetricsHandler(hubs *ws.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, hubs.Metrics())
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/db"
+)
+
+func TestAuthorizeWebsocket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "docsmith.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	now := time.Now()
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"insert into users (id, username, password_hash) values (1, 'alice', ''), (2, 'bob', ''), (3, 'carol', ''), (4, 'dave', '')", nil},
+		{"insert into workspaces (id, name, owner_id, personal) values (1, 'alice', 1, 1), (2, 'team', 1, 0)", nil},
+		{"insert into workspace_members (workspace_id, user_id, role) values (1, 1, 'owner'), (2, 1, 'owner'), (2, 2, 'member')", nil},
+		{"insert into docs (id, user_id, title, content, updated_at, workspace_id) values (1, 1, 'Plan', '', ?, 2), (2, 1, 'Notes', '', ?, 1)", []interface{}{now, now}},
+		{"insert into collaborators (doc_id, user_id, display_name, last_active) values (1, 3, 'carol', ?)", []interface{}{now}},
+		{`insert into doc_shares (doc_id, share_id, can_edit, created_by, expire_at) values
+			(1, 'view', 0, 1, ?), (1, 'edit', 1, 1, ?), (1, 'old', 1, 1, ?), (2, 'notes', 1, 1, ?)`,
+			[]interface{}{now.Add(time.Hour), now.Add(time.Hour), now.Add(-time.Hour), now.Add(time.Hour)}},
+	}
+	for _, s := range statements {
+		if _, err := database.Exec(s.query, s.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := func(userID int) string {
+		t.Helper()
+		signed, err := generateToken(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name      string
+		doc       string
+		query     url.Values
+		header    string
+		status    int
+		user      string
+		canEdit   bool
+		anonymous bool
+	}{
+		{name: "no credentials", doc: "1", status: http.StatusUnauthorized},
+		{name: "missing document", doc: "9", query: url.Values{"token": {token(1)}}, status: http.StatusNotFound},
+		{name: "bad token", doc: "1", query: url.Values{"token": {"nonsense"}}, status: http.StatusUnauthorized},
+		{name: "unknown user", doc: "1", query: url.Values{"token": {token(99)}}, status: http.StatusUnauthorized},
+		{name: "owner", doc: "1", query: url.Values{"token": {token(1)}}, status: http.StatusOK, user: "alice", canEdit: true},
+		{name: "bearer header", doc: "1", header: "Bearer " + token(1), status: http.StatusOK, user: "alice", canEdit: true},
+		{name: "workspace member", doc: "1", query: url.Values{"token": {token(2)}}, status: http.StatusOK, user: "bob", canEdit: true},
+		{name: "outside the workspace", doc: "2", query: url.Values{"token": {token(2)}}, status: http.StatusForbidden},
+		{name: "collaborator", doc: "1", query: url.Values{"token": {token(3)}}, status: http.StatusOK, user: "carol", canEdit: true},
+		{name: "stranger", doc: "1", query: url.Values{"token": {token(4)}}, status: http.StatusForbidden},
+		{name: "stranger with a link", doc: "1", query: url.Values{"token": {token(4)}, "shareId": {"view"}}, status: http.StatusOK, user: "dave"},
+		{name: "read-only link", doc: "1", query: url.Values{"shareId": {"view"}}, status: http.StatusOK, user: "Anonymous", anonymous: true},
+		{name: "editing link", doc: "1", query: url.Values{"shareId": {"edit"}, "username": {"  Zoe "}}, status: http.StatusOK, user: "Zoe", canEdit: true, anonymous: true},
+		{name: "long name", doc: "1", query: url.Values{"shareId": {"view"}, "username": {strings.Repeat("é", 100)}}, status: http.StatusOK, user: strings.Repeat("é", maxDisplayNameLength), anonymous: true},
+		{name: "expired link", doc: "1", query: url.Values{"shareId": {"old"}}, status: http.StatusForbidden},
+		{name: "another document's link", doc: "1", query: url.Values{"shareId": {"notes"}}, status: http.StatusForbidden},
+		{name: "unknown link", doc: "1", query: url.Values{"shareId": {"nope"}}, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/ws?"+tt.query.Encode(), nil)
+		if tt.header != "" {
+			c.Request.Header.Set("Authorization", tt.header)
+		}
+		identity, status, err := authorizeWebsocket(database, c, tt.doc)
+		if status != tt.status || (err == nil) != (tt.status == http.StatusOK) {
+			t.Errorf("%s: status %d (%v), want %d", tt.name, status, err, tt.status)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if identity.Username != tt.user || identity.CanEdit != tt.canEdit || identity.IsAnonymous != tt.anonymous {
+			t.Errorf("%s: identity is %+v", tt.name, identity)
+		}
+		if tt.anonymous && !strings.HasPrefix(identity.UserID, "anon-") {
+			t.Errorf("%s: anonymous visitor has user ID %s", tt.name, identity.UserID)
+		}
+	}
+}
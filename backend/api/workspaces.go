@@ -0,0 +1,473 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"docsmith/git"
+	"docsmith/models"
+)
+
+// Repos finds the git repository of each workspace. They are kept in
+// directories of root named after the workspace's ID.
+type Repos struct {
+	db   *sql.DB
+	root string
+}
+
+func NewRepos(db *sql.DB, root string) *Repos {
+	return &Repos{db: db, root: root}
+}
+
+func (r *Repos) path(workspaceID int) string {
+	return filepath.Join(r.root, strconv.Itoa(workspaceID))
+}
+
+// Workspace returns the repository of a workspace, creating it the first
+// time.
+func (r *Repos) Workspace(workspaceID int) (*git.Repo, error) {
+	return git.OpenRepo(r.path(workspaceID))
+}
+
+// Document returns the repository a document is kept in, and its file
+// there.
+func (r *Repos) Document(documentID string) (*git.Repo, git.Document, error) {
+	var workspaceID int
+	var path sql.NullString
+	if err := r.db.QueryRow("select workspace_id, path from docs where id = ?", documentID).Scan(&workspaceID, &path); err != nil {
+		return nil, git.Document{}, fmt.Errorf("find workspace of document %s: %w", documentID, err)
+	}
+	repo, err := r.Workspace(workspaceID)
+	return repo, git.Document{ID: documentID, Path: path.String}, err
+}
+
+// WorkspaceID returns the workspace a repository belongs to.
+func (r *Repos) WorkspaceID(repo *git.Repo) (int, bool) {
+	root, err := filepath.Abs(r.root)
+	if err != nil || filepath.Dir(repo.Path) != root {
+		return 0, false
+	}
+	id, err := strconv.Atoi(filepath.Base(repo.Path))
+	return id, err == nil
+}
+
+// WorkspaceIDs lists every workspace.
+func (r *Repos) WorkspaceIDs() ([]int, error) {
+	rows, err := r.db.Query("select id from workspaces order by id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SplitShared moves the history of the repository every document used to
+// share, at sharedPath, into the workspace repositories: each document's
+// file goes to its workspace, with the commits that changed it, and its
+// drafts and tags. Merge requests are updated to what their merge commits
+// became. The shared repository is then kept beside the new ones, renamed.
+// It does nothing if there's no shared repository.
+func (r *Repos) SplitShared(sharedPath string) error {
+	if _, err := os.Stat(filepath.Join(sharedPath, ".git")); os.IsNotExist(err) {
+		return nil
+	}
+
+	rows, err := r.db.Query("select id, workspace_id from docs where workspace_id is not null")
+	if err != nil {
+		return fmt.Errorf("list documents: %w", err)
+	}
+	documents := make(map[string]string)
+	workspaces := make(map[string]bool)
+	for rows.Next() {
+		var documentID string
+		var workspaceID int
+		if err := rows.Scan(&documentID, &workspaceID); err != nil {
+			rows.Close()
+			return fmt.Errorf("list documents: %w", err)
+		}
+		documents[git.LegacyPath(documentID)] = r.path(workspaceID)
+		workspaces[r.path(workspaceID)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("list documents: %w", err)
+	}
+
+	// Every repository keeps the README; files of deleted documents are
+	// left behind
+	var readme []string
+	for dest := range workspaces {
+		readme = append(readme, dest)
+	}
+	commits, err := git.SplitRepo(sharedPath, func(file string) []string {
+		if file == "README.md" {
+			return readme
+		}
+		if dest, ok := documents[file]; ok {
+			return []string{dest}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("split %s: %w", sharedPath, err)
+	}
+
+	if err := r.remapMergeCommits(documents, commits); err != nil {
+		for dest := range commits {
+			os.RemoveAll(dest)
+		}
+		return err
+	}
+	if _, err := r.db.Exec("delete from repo_state where repo_path = ?", sharedPath); err != nil {
+		log.Printf("Failed to forget the state of %s: %v", sharedPath, err)
+	}
+	if err := os.Rename(sharedPath, sharedPath+".pre-workspaces"); err != nil {
+		return fmt.Errorf("move %s aside: %w", sharedPath, err)
+	}
+	log.Printf("Split %s into %d workspace repositories", sharedPath, len(commits))
+	return nil
+}
+
+// remapMergeCommits points merged merge requests at what their merge
+// commits became when the shared repository was split.
+func (r *Repos) remapMergeCommits(documents map[string]string, commits map[string]map[string]string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("select id, doc_id, merge_commit from merge_requests where merge_commit is not null and merge_commit != ''")
+	if err != nil {
+		return fmt.Errorf("list merge requests: %w", err)
+	}
+	updated := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var documentID, commit string
+		if err := rows.Scan(&id, &documentID, &commit); err != nil {
+			rows.Close()
+			return fmt.Errorf("list merge requests: %w", err)
+		}
+		if replayed, ok := commits[documents[git.LegacyPath(documentID)]][commit]; ok {
+			updated[id] = replayed
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("list merge requests: %w", err)
+	}
+
+	for id, commit := range updated {
+		if _, err := tx.Exec("update merge_requests set merge_commit = ? where id = ?", commit, id); err != nil {
+			return fmt.Errorf("update merge request %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// documentRepo opens the repository of a document loaded by memberDocument.
+// It writes the error response and returns false if it can't.
+func documentRepo(c *gin.Context, repos *Repos, doc models.Document) (*git.Repo, bool) {
+	workspaceID, err := strconv.Atoi(doc.WorkspaceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Document is not in a workspace"})
+		return nil, false
+	}
+	repo, err := repos.Workspace(workspaceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open repository"})
+		return nil, false
+	}
+	return repo, true
+}
+
+var errWorkspaceExists = errors.New("workspace already exists")
+
+// createWorkspace makes a workspace owned by ownerID, who is its first
+// member.
+func createWorkspace(db *sql.DB, name string, ownerID int, personal bool) (int, error) {
+	var count int
+	if err := db.QueryRow("select count(*) from workspaces where name = ?", name).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		return 0, errWorkspaceExists
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("insert into workspaces (name, owner_id, personal) values (?, ?, ?)", name, ownerID, personal)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	if _, err := tx.Exec("insert into workspace_members (workspace_id, user_id, role) values (?, ?, ?)", id, ownerID, models.RoleOwner); err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// personalWorkspace returns the ID of a user's personal workspace.
+func personalWorkspace(db *sql.DB, userID interface{}) (int, error) {
+	var id int
+	err := db.QueryRow("select id from workspaces where owner_id = ? and personal = 1", userID).Scan(&id)
+	return id, err
+}
+
+// workspaceRole returns the role a user has in a workspace, or "" if they
+// aren't a member.
+func workspaceRole(db *sql.DB, workspaceID interface{}, userID interface{}) (string, error) {
+	var role string
+	err := db.QueryRow("select role from workspace_members where workspace_id = ? and user_id = ?", workspaceID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// documentAccess reports whether a user can use a document: they own it
+// or are a member of its workspace, as they must be to reach it through
+// /api/git.
+func documentAccess(db *sql.DB, docID interface{}, userID interface{}) (bool, error) {
+	var count int
+	err := db.QueryRow(`select count(*) from docs d where d.id = ? and (d.user_id = ? or exists (
+		select 1 from workspace_members m where m.workspace_id = d.workspace_id and m.user_id = ?))`,
+		docID, userID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// memberWorkspace loads a workspace the signed in user is a member of. It
+// writes the error response and returns false when they aren't.
+func memberWorkspace(c *gin.Context, db *sql.DB) (models.Workspace, bool) {
+	userID, _ := c.Get("userID")
+	var workspace models.Workspace
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workspace ID"})
+		return workspace, false
+	}
+	err = db.QueryRow(`select w.id, w.name, w.owner_id, w.personal, w.created_at, m.role
+		from workspaces w join workspace_members m on m.workspace_id = w.id
+		where w.id = ? and m.user_id = ?`, id, userID).
+		Scan(&workspace.ID, &workspace.Name, &workspace.OwnerID, &workspace.Personal, &workspace.CreatedAt, &workspace.Role)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return workspace, false
+	}
+	return workspace, true
+}
+
+type CreateWorkspaceRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type AddWorkspaceMemberRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+// listWorkspacesHandler returns the workspaces the user is a member of.
+func listWorkspacesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		rows, err := db.Query(`select w.id, w.name, w.owner_id, w.personal, w.created_at, m.role
+			from workspaces w join workspace_members m on m.workspace_id = w.id
+			where m.user_id = ? order by w.personal desc, w.name`, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspaces"})
+			return
+		}
+		defer rows.Close()
+
+		workspaces := []models.Workspace{}
+		for rows.Next() {
+			var w models.Workspace
+			if err := rows.Scan(&w.ID, &w.Name, &w.OwnerID, &w.Personal, &w.CreatedAt, &w.Role); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan workspaces"})
+				return
+			}
+			workspaces = append(workspaces, w)
+		}
+		c.JSON(http.StatusOK, workspaces)
+	}
+}
+
+// createWorkspaceHandler makes a workspace for a team, owned by the user.
+func createWorkspaceHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		var req CreateWorkspaceRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// The name is used in the workspace's clone URL
+		req.Name = strings.TrimSpace(req.Name)
+		if !validWorkspaceName(req.Name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Workspace names may only contain letters, digits, '.', '_' and '-'"})
+			return
+		}
+
+		id, err := createWorkspace(db, req.Name, userID, false)
+		if errors.Is(err, errWorkspaceExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Workspace name is taken"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workspace"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"id":       id,
+			"name":     req.Name,
+			"owner_id": userID,
+			"personal": false,
+			"role":     models.RoleOwner,
+		})
+	}
+}
+
+func validWorkspaceName(name string) bool {
+	if name == "" || len(name) > 100 || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("._-", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+func listWorkspaceMembersHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		workspace, ok := memberWorkspace(c, db)
+		if !ok {
+			return
+		}
+		rows, err := db.Query(`select u.id, u.username, m.role
+			from workspace_members m join users u on u.id = m.user_id
+			where m.workspace_id = ? order by u.username`, workspace.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+			return
+		}
+		defer rows.Close()
+
+		members := []models.WorkspaceMember{}
+		for rows.Next() {
+			var m models.WorkspaceMember
+			if err := rows.Scan(&m.UserID, &m.Username, &m.Role); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan members"})
+				return
+			}
+			members = append(members, m)
+		}
+		c.JSON(http.StatusOK, members)
+	}
+}
+
+// addWorkspaceMemberHandler lets the owner of a team workspace add a user.
+func addWorkspaceMemberHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		workspace, ok := memberWorkspace(c, db)
+		if !ok {
+			return
+		}
+		if workspace.Role != models.RoleOwner {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can add members"})
+			return
+		}
+		if workspace.Personal {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Personal workspaces have no other members"})
+			return
+		}
+
+		var req AddWorkspaceMemberRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var member models.WorkspaceMember
+		err := db.QueryRow("select id, username from users where username = ?", req.Username).Scan(&member.UserID, &member.Username)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		member.Role = models.RoleMember
+		_, err = db.Exec("insert or ignore into workspace_members (workspace_id, user_id, role) values (?, ?, ?)", workspace.ID, member.UserID, member.Role)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add member"})
+			return
+		}
+		c.JSON(http.StatusCreated, member)
+	}
+}
+
+// removeWorkspaceMemberHandler lets the owner remove a member, or a member
+// leave. The owner can't leave.
+func removeWorkspaceMemberHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetInt("userID")
+		workspace, ok := memberWorkspace(c, db)
+		if !ok {
+			return
+		}
+		memberID, err := strconv.Atoi(c.Param("userId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+		if workspace.Role != models.RoleOwner && memberID != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can remove members"})
+			return
+		}
+		if memberID == workspace.OwnerID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "The owner can't be removed"})
+			return
+		}
+
+		var count int
+		if err := db.QueryRow("select count(*) from docs where workspace_id = ? and user_id = ?", workspace.ID, memberID).Scan(&count); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check documents"})
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Member still has documents in the workspace"})
+			return
+		}
+
+		result, err := db.Exec("delete from workspace_members where workspace_id = ? and user_id = ?", workspace.ID, memberID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+	}
+}
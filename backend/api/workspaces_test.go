@@ -0,0 +1,172 @@
+package api
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"docsmith/db"
+	"docsmith/git"
+)
+
+// sharedRepoTest is a database of two workspaces whose documents are still
+// in the one repository they used to share.
+type sharedRepoTest struct {
+	db     *sql.DB
+	repos  *Repos
+	shared *git.Repo
+	merge  string
+}
+
+func newSharedRepoTest(t *testing.T) *sharedRepoTest {
+	t.Helper()
+	dir := t.TempDir()
+	database, err := db.InitDB(filepath.Join(dir, "docsmith.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	shared, err := git.OpenRepo(filepath.Join(dir, "docsmith-repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	author := git.Author{Name: "alice", Email: "alice@example.com"}
+	save := func(id string, content string, message string) {
+		t.Helper()
+		doc := git.Document{ID: id, Path: git.LegacyPath(id)}
+		if err := git.SaveDocument(shared, doc, content); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := git.CommitDocumentAs(shared, doc, message, author, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save("1", "plan\n", "Create document: Plan")
+	save("2", "notes\n", "Create document: Notes")
+	save("3", "gone\n", "Create document: Gone")
+	plan := git.Document{ID: "1", Path: git.LegacyPath("1")}
+	if _, err := git.CreateDraft(shared, plan, "rewrite", "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.CommitDraft(shared, plan, "rewrite", "new plan\n", "Rewrite plan", author); err != nil {
+		t.Fatal(err)
+	}
+	merge, err := git.MergeDraft(shared, plan, "rewrite", "new plan\n", "Merge draft rewrite", author)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Document 3 was deleted since
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"insert into users (id, username, password_hash) values (1, 'alice', '')", nil},
+		{"insert into workspaces (id, name, owner_id, personal) values (1, 'alice', 1, 1), (2, 'team', 1, 0)", nil},
+		{"insert into docs (id, user_id, title, content, updated_at, workspace_id) values (1, 1, 'Plan', 'new plan', ?, 1)", []interface{}{time.Now()}},
+		{"insert into docs (id, user_id, title, content, updated_at, workspace_id) values (2, 1, 'Notes', 'notes', ?, 2)", []interface{}{time.Now()}},
+		{"insert into merge_requests (doc_id, draft, title, status, created_by, merge_commit, updated_at) values (1, 'rewrite', 'Rewrite', 'merged', 1, ?, ?)", []interface{}{merge, time.Now()}},
+		{"insert into repo_state (repo_path, reconciled_head, updated_at) values (?, ?, ?)", []interface{}{shared.Path, merge, time.Now()}},
+	}
+	for _, s := range statements {
+		if _, err := database.Exec(s.query, s.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &sharedRepoTest{db: database, repos: NewRepos(database, filepath.Join(dir, "repos")), shared: shared, merge: merge}
+}
+
+func (st *sharedRepoTest) mergeCommit(t *testing.T) string {
+	t.Helper()
+	var commit string
+	if err := st.db.QueryRow("select merge_commit from merge_requests").Scan(&commit); err != nil {
+		t.Fatal(err)
+	}
+	return commit
+}
+
+func TestSplitShared(t *testing.T) {
+	st := newSharedRepoTest(t)
+	if err := st.repos.SplitShared(st.shared.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each workspace has the README and its own documents; the deleted
+	// document's file is left behind
+	for id, want := range map[int][]string{1: {"1.md", "README.md"}, 2: {"2.md", "README.md"}} {
+		for _, file := range want {
+			if _, err := os.Stat(filepath.Join(st.repos.path(id), file)); err != nil {
+				t.Errorf("workspace %d is missing %s: %v", id, file, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(st.repos.path(id), "3.md")); !os.IsNotExist(err) {
+			t.Errorf("workspace %d has the deleted document: %v", id, err)
+		}
+	}
+
+	// The merge request points at the merge in its workspace
+	commit := st.mergeCommit(t)
+	if commit == st.merge {
+		t.Fatalf("merge request still points at %s", commit)
+	}
+	r, err := gogit.PlainOpen(st.repos.path(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := r.CommitObject(plumbing.NewHash(commit))
+	if err != nil {
+		t.Fatalf("merge request points at %s: %v", commit, err)
+	}
+	if merged.Message != "Merge draft rewrite" {
+		t.Errorf("merge request points at %q", merged.Message)
+	}
+	if _, err := r.Reference(plumbing.ReferenceName(git.DraftBranch("1", "rewrite")), true); err != nil {
+		t.Errorf("the draft didn't move with its document: %v", err)
+	}
+
+	// The shared repository is kept aside and forgotten
+	if _, err := os.Stat(st.shared.Path); !os.IsNotExist(err) {
+		t.Errorf("the shared repository is still in place: %v", err)
+	}
+	if _, err := os.Stat(st.shared.Path + ".pre-workspaces"); err != nil {
+		t.Errorf("the shared repository wasn't kept: %v", err)
+	}
+	var n int
+	if err := st.db.QueryRow("select count(*) from repo_state where repo_path = ?", st.shared.Path).Scan(&n); err != nil || n != 0 {
+		t.Errorf("%d states kept for the shared repository (%v)", n, err)
+	}
+
+	// Starting again finds nothing to split
+	if err := st.repos.SplitShared(st.shared.Path); err != nil {
+		t.Errorf("splitting again: %v", err)
+	}
+}
+
+// A split that fails leaves everything as it was, to try again.
+func TestSplitSharedFailure(t *testing.T) {
+	st := newSharedRepoTest(t)
+	if _, err := gogit.PlainInit(st.repos.path(2), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.repos.SplitShared(st.shared.Path); err == nil {
+		t.Fatal("split into an existing repository")
+	}
+	if _, err := os.Stat(st.repos.path(1)); !os.IsNotExist(err) {
+		t.Errorf("workspace 1's repository was left behind: %v", err)
+	}
+	if _, err := gogit.PlainOpen(st.repos.path(2)); err != nil {
+		t.Errorf("the existing repository was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(st.shared.Path, ".git")); err != nil {
+		t.Errorf("the shared repository was moved: %v", err)
+	}
+	if commit := st.mergeCommit(t); commit != st.merge {
+		t.Errorf("merge request points at %s, want %s", commit, st.merge)
+	}
+}
@@ -0,0 +1,31 @@
+// Command wsschema writes the JSON schema of the WebSocket protocol, for the
+// frontend to validate messages against. Run it through go generate in ws.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"docsmith/ws"
+)
+
+func main() {
+	output := flag.String("o", "", "file to write the schema to (default stdout)")
+	flag.Parse()
+
+	data, err := json.MarshalIndent(ws.Schema(), "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode schema: %v", err)
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		log.Fatalf("Failed to write schema: %v", err)
+	}
+}
@@ -24,6 +24,16 @@ func InitDB(dbPath string) (*sql.DB, error) {
         return nil, err
     }
 
+    if err = RunMigrations(db); err != nil {
+        log.Printf("Error migrating database: %v", err)
+        return nil, err
+    }
+
+    if err = setupSearch(db); err != nil {
+        log.Printf("Error setting up search: %v", err)
+        return nil, err
+    }
+
     log.Println("Database initialized successfully")
     return db, nil
 }
@@ -33,7 +43,9 @@ func createTables(db *sql.DB) error {
 	CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		username TEXT NOT NULL UNIQUE,
-		password_hash TEXT NOT NULL
+		password_hash TEXT NOT NULL,
+		display_name TEXT,
+		email TEXT
 	);
 	`
 
@@ -44,10 +56,50 @@ func createTables(db *sql.DB) error {
 		title TEXT NOT NULL,
 		content TEXT,
 		updated_at DATETIME NOT NULL,
+		workspace_id INTEGER REFERENCES workspaces (id),
+		folder TEXT NOT NULL DEFAULT '',
+		path TEXT,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	`
+
+	createWorkspacesTable := `
+	CREATE TABLE IF NOT EXISTS workspaces (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		owner_id INTEGER NOT NULL,
+		personal BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	`
+
+	createWorkspaceMembersTable := `
+	CREATE TABLE IF NOT EXISTS workspace_members (
+		workspace_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL DEFAULT 'member',
+		PRIMARY KEY (workspace_id, user_id),
+		FOREIGN KEY (workspace_id) REFERENCES workspaces (id) ON DELETE CASCADE,
 		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
 	);
 	`
 	
+	// A workspace's remote git server, with the credentials to reach it
+	createWorkspaceRemotesTable := `
+	CREATE TABLE IF NOT EXISTS workspace_remotes (
+		workspace_id INTEGER PRIMARY KEY,
+		url TEXT NOT NULL,
+		username TEXT NOT NULL DEFAULT '',
+		password TEXT NOT NULL DEFAULT '',
+		ssh_key TEXT NOT NULL DEFAULT '',
+		ssh_key_passphrase TEXT NOT NULL DEFAULT '',
+		known_hosts TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME NOT NULL,
+		FOREIGN KEY (workspace_id) REFERENCES workspaces (id) ON DELETE CASCADE
+	);
+	`
+
 	createDocSharesTable := `
 	CREATE TABLE IF NOT EXISTS doc_shares (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -75,6 +127,87 @@ func createTables(db *sql.DB) error {
 	);
 	`
 
+	createDocCRDTStateTable := `
+	CREATE TABLE IF NOT EXISTS doc_crdt_state (
+		doc_id INTEGER PRIMARY KEY,
+		state BLOB NOT NULL,
+		updated_at DATETIME NOT NULL,
+		FOREIGN KEY (doc_id) REFERENCES docs (id) ON DELETE CASCADE
+	);
+	`
+
+	createMergeRequestsTable := `
+	CREATE TABLE IF NOT EXISTS merge_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		doc_id INTEGER NOT NULL,
+		draft TEXT NOT NULL,
+		title TEXT NOT NULL,
+		description TEXT,
+		status TEXT NOT NULL DEFAULT 'open',
+		created_by INTEGER NOT NULL,
+		approved_by INTEGER,
+		merge_commit TEXT,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME NOT NULL,
+		FOREIGN KEY (doc_id) REFERENCES docs (id) ON DELETE CASCADE,
+		FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE CASCADE,
+		FOREIGN KEY (approved_by) REFERENCES users (id) ON DELETE SET NULL
+	);
+	`
+
+	createMergeRequestCommentsTable := `
+	CREATE TABLE IF NOT EXISTS merge_request_comments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		merge_request_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		body TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (merge_request_id) REFERENCES merge_requests (id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+	`
+
+	createRepoStateTable := `
+	CREATE TABLE IF NOT EXISTS repo_state (
+		repo_path TEXT PRIMARY KEY,
+		reconciled_head TEXT NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+	`
+
+	// The history index: each workspace repository's commits, with the
+	// documents each changed, kept up to date as history is read
+	createCommitIndexTable := `
+	CREATE TABLE IF NOT EXISTS commit_index (
+		repo_path TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		message TEXT NOT NULL,
+		author TEXT NOT NULL,
+		author_email TEXT NOT NULL,
+		timestamp DATETIME NOT NULL,
+		PRIMARY KEY (repo_path, hash)
+	);
+	`
+
+	createCommitDocumentsTable := `
+	CREATE TABLE IF NOT EXISTS commit_documents (
+		repo_path TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		doc_id INTEGER NOT NULL,
+		path TEXT NOT NULL,
+		PRIMARY KEY (repo_path, hash, doc_id)
+	);
+	`
+
+	createCommitIndexStateTable := `
+	CREATE TABLE IF NOT EXISTS commit_index_state (
+		repo_path TEXT PRIMARY KEY,
+		head TEXT NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+	`
+
 	_, err := db.Exec(createUsersTable)
 	if err != nil {
 		return err
@@ -85,6 +218,21 @@ func createTables(db *sql.DB) error {
 		return err
 	}
 	
+	_, err = db.Exec(createWorkspacesTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(createWorkspaceMembersTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(createWorkspaceRemotesTable)
+	if err != nil {
+		return err
+	}
+	
 	_, err = db.Exec(createDocSharesTable)
 	if err != nil {
 		return err
@@ -95,5 +243,40 @@ func createTables(db *sql.DB) error {
 		return err
 	}
 
+	_, err = db.Exec(createDocCRDTStateTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(createMergeRequestsTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(createMergeRequestCommentsTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(createRepoStateTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(createCommitIndexTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(createCommitDocumentsTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(createCommitIndexStateTable)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
\ No newline at end of file
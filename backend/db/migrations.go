@@ -1,10 +1,41 @@
 package db
 
-import "database/sql"
+import (
+	"database/sql"
+	"fmt"
+)
+
+// addedColumn is a column added to a table after the table was first
+// created. createTables includes it for new databases.
+type addedColumn struct {
+	table      string
+	name       string
+	definition string
+}
+
+var addedColumns = []addedColumn{
+	{table: "users", name: "display_name", definition: "TEXT"},
+	{table: "users", name: "email", definition: "TEXT"},
+	{table: "docs", name: "workspace_id", definition: "INTEGER REFERENCES workspaces (id)"},
+	{table: "docs", name: "folder", definition: "TEXT NOT NULL DEFAULT ''"},
+	{table: "docs", name: "path", definition: "TEXT"},
+}
 
 func RunMigrations(db *sql.DB) error {
 	migrations := []string{
 		addIndexToDocuments,
+		addPersonalWorkspaces,
+		addWorkspaceOwners,
+		moveDocumentsToWorkspaces,
+		addWorkspaceIndexToDocuments,
+		addPathIndexToDocuments,
+		addDocumentIndexToCommitDocuments,
+	}
+
+	for _, column := range addedColumns {
+		if err := addColumn(db, column); err != nil {
+			return err
+		}
 	}
 
 	for _, migration := range migrations {
@@ -15,6 +46,77 @@ func RunMigrations(db *sql.DB) error {
 	return nil
 }
 
+// addColumn adds a column unless the table already has it. SQLite has no
+// "add column if not exists".
+func addColumn(db *sql.DB, column addedColumn) error {
+	rows, err := db.Query(fmt.Sprintf("pragma table_info(%s)", column.table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    bool
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column.name {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("alter table %s add column %s %s", column.table, column.name, column.definition))
+	return err
+}
+
 const addIndexToDocuments = `
 	create index if not exists idx_docs_user_id on docs(user_id)
-`
\ No newline at end of file
+`
+
+// Every user has a personal workspace named after them, which documents
+// from before workspaces move into.
+const addPersonalWorkspaces = `
+	insert into workspaces (name, owner_id, personal)
+	select username, id, 1 from users
+	where id not in (select owner_id from workspaces where personal = 1)
+`
+
+const addWorkspaceOwners = `
+	insert or ignore into workspace_members (workspace_id, user_id, role)
+	select id, owner_id, 'owner' from workspaces
+`
+
+const moveDocumentsToWorkspaces = `
+	update docs set workspace_id = (
+		select id from workspaces where owner_id = docs.user_id and personal = 1
+	)
+	where workspace_id is null
+`
+
+const addWorkspaceIndexToDocuments = `
+	create index if not exists idx_docs_workspace_id on docs(workspace_id)
+`
+
+// No two documents of a workspace share a file. Documents from before files
+// were named after titles have no path until the repositories are moved
+// over at startup.
+const addPathIndexToDocuments = `
+	create unique index if not exists idx_docs_workspace_path on docs(workspace_id, path)
+`
+
+// A document's history is read through the commits that changed it, newest
+// first.
+const addDocumentIndexToCommitDocuments = `
+	create index if not exists idx_commit_documents_doc_id on commit_documents(doc_id, repo_path)
+`
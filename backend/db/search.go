@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// The search index is an FTS5 table over the title and content of docs,
+// which it reads back from docs for snippets. Triggers keep it up to date,
+// so every write to docs reaches it however it was made.
+var searchTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS docs_fts_insert AFTER INSERT ON docs BEGIN
+		INSERT INTO docs_fts (rowid, title, content) VALUES (new.id, new.title, coalesce(new.content, ''));
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS docs_fts_delete AFTER DELETE ON docs BEGIN
+		INSERT INTO docs_fts (docs_fts, rowid, title, content) VALUES ('delete', old.id, old.title, coalesce(old.content, ''));
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS docs_fts_update AFTER UPDATE OF title, content ON docs BEGIN
+		INSERT INTO docs_fts (docs_fts, rowid, title, content) VALUES ('delete', old.id, old.title, coalesce(old.content, ''));
+		INSERT INTO docs_fts (rowid, title, content) VALUES (new.id, new.title, coalesce(new.content, ''));
+	END`,
+}
+
+var searchTriggerNames = []string{"docs_fts_insert", "docs_fts_delete", "docs_fts_update"}
+
+// setupSearch creates the search index, filling it from docs if it's new or
+// was left behind while running without FTS5. Without FTS5 it removes the
+// triggers, which would otherwise fail every write to docs. go-sqlite3 only
+// includes FTS5 when built with -tags sqlite_fts5.
+func setupSearch(db *sql.DB) error {
+	var fts5 bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		return fmt.Errorf("check for FTS5: %w", err)
+	}
+	if !fts5 {
+		log.Printf("SQLite was built without FTS5, search is disabled; build with -tags sqlite_fts5 to enable it")
+		for _, name := range searchTriggerNames {
+			if _, err := db.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				return fmt.Errorf("drop search trigger: %w", err)
+			}
+		}
+		return nil
+	}
+
+	_, err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS docs_fts USING fts5(
+		title, content, content='docs', content_rowid='id', tokenize='unicode61 remove_diacritics 2'
+	)`)
+	if err != nil {
+		return fmt.Errorf("create search index: %w", err)
+	}
+
+	var triggers int
+	err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'docs_fts_%'").Scan(&triggers)
+	if err != nil {
+		return fmt.Errorf("check search triggers: %w", err)
+	}
+	if triggers < len(searchTriggers) {
+		if err := rebuildSearch(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildSearch fills the search index from docs and sets up the triggers
+// keeping it up to date.
+func rebuildSearch(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO docs_fts (docs_fts) VALUES ('rebuild')"); err != nil {
+		return fmt.Errorf("fill search index: %w", err)
+	}
+	for _, trigger := range searchTriggers {
+		if _, err := tx.Exec(trigger); err != nil {
+			return fmt.Errorf("create search trigger: %w", err)
+		}
+	}
+	return tx.Commit()
+}
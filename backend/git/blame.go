@@ -0,0 +1,123 @@
+package git
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// BlameLine is a line of a document with the commit that last changed it.
+// Commit is nil for lines changed since the last commit.
+type BlameLine struct {
+	Line   int     `json:"line"`
+	Text   string  `json:"text"`
+	Commit *Commit `json:"commit"`
+}
+
+// BlameDocument annotates each line of content, the document's current
+// text, with the commit that last changed it. Content may be ahead of the
+// repository; lines that differ from HEAD have no commit. Lines are
+// followed back across renames and moves of the document; lines merged
+// from a draft are blamed on the merge.
+func BlameDocument(repo *Repo, doc Document, content string) ([]BlameLine, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+
+	ref, err := r.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head reference: %w", err)
+	}
+	head, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	log, err := documentLog(r, head, doc, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replay the main line's changes, oldest first: lines a change keeps
+	// keep their blame, the rest are blamed on it. An empty log means the
+	// document was never committed, and every line is new.
+	var committed string
+	var blamed []plumbing.Hash
+	for i := len(log) - 1; i >= 0; i-- {
+		text, err := documentContent(log[i].file)
+		if err != nil {
+			return nil, err
+		}
+		blamed = carryBlame(committed, text, blamed, log[i].commit.Hash)
+		committed = text
+	}
+
+	commits := make(map[plumbing.Hash]*Commit)
+	commitFor := func(hash plumbing.Hash) (*Commit, error) {
+		if c, ok := commits[hash]; ok {
+			return c, nil
+		}
+		obj, err := r.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("get commit object: %w", err)
+		}
+		c := commitInfo(obj)
+		commits[hash] = &c
+		return &c, nil
+	}
+
+	// Walk the current content against HEAD's: unchanged lines keep their
+	// blame, the rest are uncommitted.
+	lines := []BlameLine{}
+	headLine := 0
+	for _, d := range diff.Do(committed, content) {
+		for _, text := range splitLines(DiffEqual, d.Text) {
+			switch d.Type {
+			case diffmatchpatch.DiffDelete:
+				headLine++
+				continue
+			case diffmatchpatch.DiffInsert:
+				lines = append(lines, BlameLine{Line: len(lines) + 1, Text: text.text})
+			default:
+				line := BlameLine{Line: len(lines) + 1, Text: text.text}
+				if headLine < len(blamed) {
+					if line.Commit, err = commitFor(blamed[headLine]); err != nil {
+						return nil, err
+					}
+				}
+				lines = append(lines, line)
+				headLine++
+			}
+		}
+	}
+	return lines, nil
+}
+
+// carryBlame blames the lines of to, a change from from whose lines are
+// blamed on the commits in blamed: unchanged lines keep their commit and
+// the rest get commit.
+func carryBlame(from string, to string, blamed []plumbing.Hash, commit plumbing.Hash) []plumbing.Hash {
+	var result []plumbing.Hash
+	line := 0
+	for _, d := range diff.Do(from, to) {
+		for range splitLines(DiffEqual, d.Text) {
+			switch d.Type {
+			case diffmatchpatch.DiffDelete:
+				line++
+			case diffmatchpatch.DiffInsert:
+				result = append(result, commit)
+			default:
+				if line < len(blamed) {
+					result = append(result, blamed[line])
+				} else {
+					result = append(result, commit)
+				}
+				line++
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,97 @@
+package git
+
+import "testing"
+
+func TestBlameDocument(t *testing.T) {
+	repo, err := OpenRepo(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := Document{ID: "1", Path: "plan.md"}
+	first := splitCommit(t, repo, doc, "one\ntwo\nthree\n", "Create document: Plan")
+	if err := SaveDocument(repo, doc, "one\nTWO\nthree\n"); err != nil {
+		t.Fatal(err)
+	}
+	second, err := CommitDocumentAs(repo, doc, "Save document: Plan", bob, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lines are followed across the move
+	moved := Document{ID: "1", Path: "notes/plan.md"}
+	if err := MoveDocument(repo, doc, moved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CommitPaths(repo, []string{doc.Path, moved.Path}, "Move document: Plan to /notes", alice, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A line merged from a draft is blamed on the merge, not the draft
+	if _, err := CreateDraft(repo, moved, "four", "HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CommitDraft(repo, moved, "four", "one\nTWO\nthree\nfour\n", "Add four", bob); err != nil {
+		t.Fatal(err)
+	}
+	merge, err := MergeDraft(repo, moved, "four", "one\nTWO\nthree\nfour\n", "Merge draft four", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Uncommitted lines have no commit, and removed lines are gone
+	lines, err := BlameDocument(repo, moved, "one\nthree\nfour\nfive\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		text   string
+		commit string
+	}{
+		{"one", first},
+		{"three", first},
+		{"four", merge},
+		{"five", ""},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("blamed %d lines, want %d: %+v", len(lines), len(want), lines)
+	}
+	for i, w := range want {
+		line := lines[i]
+		hash := ""
+		if line.Commit != nil {
+			hash = line.Commit.Hash
+		}
+		if line.Line != i+1 || line.Text != w.text || hash != w.commit {
+			t.Errorf("line %d is %d %q from %s, want %q from %s", i+1, line.Line, line.Text, hash, w.text, w.commit)
+		}
+	}
+
+	lines, err = BlameDocument(repo, moved, "one\nTWO\nthree\nfour\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 4 || lines[1].Commit == nil || lines[1].Commit.Hash != second || lines[1].Commit.Author != "bob" {
+		t.Errorf("the changed line is blamed on %+v, want bob's %s", lines[1].Commit, second)
+	}
+}
+
+func TestBlameUncommitted(t *testing.T) {
+	repo, err := OpenRepo(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	splitCommit(t, repo, Document{ID: "2", Path: "other.md"}, "other\n", "Create document: Other")
+
+	lines, err := BlameDocument(repo, Document{ID: "1", Path: "plan.md"}, "one\ntwo\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("blamed %d lines, want 2", len(lines))
+	}
+	for _, line := range lines {
+		if line.Commit != nil {
+			t.Errorf("line %d of a new document is blamed on %s", line.Line, line.Commit.Hash)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package git
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// CompactOptions says what CompactHistory squashes.
+type CompactOptions struct {
+	// Window is how far apart the first and last commits squashed into one
+	// may have been made.
+	Window time.Duration
+	// Squashable reports whether a commit's message is that of a plain
+	// save, which may be squashed, rather than a version someone asked for.
+	Squashable func(message string) bool
+	// DryRun finds what would be squashed without changing anything.
+	DryRun bool
+}
+
+// Squash is a run of commits squashed into one.
+type Squash struct {
+	// Hash is the commit they became, empty on a dry run.
+	Hash        string   `json:"hash,omitempty"`
+	Author      string   `json:"author"`
+	AuthorEmail string   `json:"author_email"`
+	Paths       []string `json:"paths"`
+	// Commits are the commits squashed, oldest first.
+	Commits []Commit `json:"commits"`
+}
+
+// Compaction is what CompactHistory squashed, or would on a dry run.
+type Compaction struct {
+	DryRun   bool     `json:"dry_run"`
+	Squashes []Squash `json:"squashes"`
+	// Removed is how many commits shorter the history is.
+	Removed int `json:"removed"`
+	// Rewritten maps every commit whose hash changed to its new hash. The
+	// commits of a squash map to the commit they became.
+	Rewritten map[string]string `json:"-"`
+}
+
+// CompactHistory squashes runs of consecutive commits on the current branch
+// made by the same author, within options.Window of each other, that change
+// the same files and that options.Squashable accepts. Merges, tagged
+// commits, commits drafts or merged drafts branch from, and everything
+// already on a remote-tracking branch are kept as they are. The squashed
+// commit has the content, author and date of the run's last commit and the
+// message of its first, with the co-authors of them all.
+//
+// Drafts and tags are moved to what their commits became, and the objects
+// left unreachable are pruned before the repository is repacked.
+func CompactHistory(repo *Repo, options CompactOptions) (*Compaction, error) {
+	started := time.Now()
+	tagged, err := TaggedCommits(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	headRef, err := r.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head reference: %w", err)
+	}
+
+	// the current branch, oldest first
+	var mainline []*object.Commit
+	c, err := r.CommitObject(headRef.Hash())
+	for err == nil {
+		mainline = append(mainline, c)
+		if c.NumParents() == 0 {
+			break
+		}
+		c, err = c.Parent(0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("walk history: %w", err)
+	}
+	onMainline := make(map[plumbing.Hash]bool)
+	for i, j := 0, len(mainline)-1; i < j; i, j = i+1, j-1 {
+		mainline[i], mainline[j] = mainline[j], mainline[i]
+	}
+	for _, c := range mainline {
+		onMainline[c.Hash] = true
+	}
+
+	published, err := publishedCommits(r)
+	if err != nil {
+		return nil, err
+	}
+	start := 0
+	for i, c := range mainline {
+		if published[c.Hash] {
+			start = i + 1
+		}
+	}
+	branchPoints, err := branchPoints(r, headRef.Name(), mainline, onMainline)
+	if err != nil {
+		return nil, err
+	}
+
+	compaction := &Compaction{DryRun: options.DryRun, Squashes: []Squash{}, Rewritten: make(map[string]string)}
+	var groups [][]*object.Commit
+	var run []*object.Commit
+	var runPaths []string
+	flush := func() {
+		if len(run) > 1 {
+			groups = append(groups, run)
+		}
+		run = nil
+	}
+	for _, c := range mainline[start:] {
+		if c.NumParents() != 1 || tagged[c.Hash.String()] || branchPoints[c.Hash] || !options.Squashable(c.Message) {
+			flush()
+			continue
+		}
+		paths, err := commitPaths(c)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(paths)
+		if len(run) > 0 && (c.Author.Email != run[0].Author.Email ||
+			strings.Join(paths, "\n") != strings.Join(runPaths, "\n") ||
+			c.Author.When.Sub(run[0].Author.When) > options.Window) {
+			flush()
+		}
+		if len(run) == 0 {
+			runPaths = paths
+		}
+		run = append(run, c)
+	}
+	flush()
+
+	for _, group := range groups {
+		last := group[len(group)-1]
+		squash := Squash{Author: last.Author.Name, AuthorEmail: last.Author.Email, Commits: []Commit{}}
+		squash.Paths, _ = commitPaths(last)
+		sort.Strings(squash.Paths)
+		for _, c := range group {
+			squash.Commits = append(squash.Commits, commitInfo(c))
+		}
+		compaction.Squashes = append(compaction.Squashes, squash)
+		compaction.Removed += len(group) - 1
+	}
+	if options.DryRun || len(groups) == 0 {
+		return compaction, nil
+	}
+
+	rewritten := make(map[plumbing.Hash]plumbing.Hash)
+	// rewrite gives what a commit becomes once its parents are rewritten.
+	// Main line commits are rewritten in order, so by the time a commit
+	// refers to one it is done.
+	var rewrite func(hash plumbing.Hash) (plumbing.Hash, error)
+	rewrite = func(hash plumbing.Hash) (plumbing.Hash, error) {
+		if replaced, ok := rewritten[hash]; ok {
+			return replaced, nil
+		}
+		if onMainline[hash] {
+			return hash, nil
+		}
+		c, err := r.CommitObject(hash)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("get commit object: %w", err)
+		}
+		replaced, err := rewriteParents(r, c, rewrite)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		rewritten[hash] = replaced
+		return replaced, nil
+	}
+
+	squashOf := make(map[plumbing.Hash]int)
+	for i, group := range groups {
+		for _, c := range group {
+			squashOf[c.Hash] = i
+		}
+	}
+	for _, c := range mainline[start:] {
+		i, squashed := squashOf[c.Hash]
+		if !squashed {
+			replaced, err := rewriteParents(r, c, rewrite)
+			if err != nil {
+				return nil, err
+			}
+			if replaced != c.Hash {
+				rewritten[c.Hash] = replaced
+			}
+			continue
+		}
+		group := groups[i]
+		if c.Hash != group[len(group)-1].Hash {
+			continue
+		}
+		parent, err := rewrite(group[0].ParentHashes[0])
+		if err != nil {
+			return nil, err
+		}
+		hash, err := squashCommits(r, group, parent)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range group {
+			rewritten[c.Hash] = hash
+		}
+		compaction.Squashes[i].Hash = hash.String()
+	}
+
+	if err := moveRefs(r, rewrite); err != nil {
+		return nil, err
+	}
+	for old, replaced := range rewritten {
+		if old != replaced {
+			compaction.Rewritten[old.String()] = replaced.String()
+		}
+	}
+	committed(repo)
+
+	// The squashed commits are on no branch now
+	if err := r.Prune(git.PruneOptions{OnlyObjectsOlderThan: started, Handler: r.DeleteObject}); err != nil {
+		return nil, fmt.Errorf("prune: %w", err)
+	}
+	if err := r.RepackObjects(&git.RepackConfig{}); err != nil {
+		return nil, fmt.Errorf("repack: %w", err)
+	}
+	return compaction, nil
+}
+
+// publishedCommits are the commits of the remote-tracking branches, which
+// the remote already has and so can't be rewritten.
+func publishedCommits(r *git.Repository) (map[plumbing.Hash]bool, error) {
+	refs, err := r.References()
+	if err != nil {
+		return nil, fmt.Errorf("list references: %w", err)
+	}
+	var queue []plumbing.Hash
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name().IsRemote() && ref.Type() == plumbing.HashReference {
+			queue = append(queue, ref.Hash())
+		}
+		return nil
+	})
+	refs.Close()
+	if err != nil {
+		return nil, fmt.Errorf("list references: %w", err)
+	}
+
+	published := make(map[plumbing.Hash]bool)
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if published[hash] {
+			continue
+		}
+		published[hash] = true
+		c, err := r.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("get commit object: %w", err)
+		}
+		queue = append(queue, c.ParentHashes...)
+	}
+	return published, nil
+}
+
+// branchPoints are the main line commits that other branches and tags
+// point at, or that commits off the main line, on drafts, tagged or merged
+// in, have as parents. Squashing them away would change what those are
+// based on.
+func branchPoints(r *git.Repository, head plumbing.ReferenceName, mainline []*object.Commit, onMainline map[plumbing.Hash]bool) (map[plumbing.Hash]bool, error) {
+	var queue []plumbing.Hash
+	for _, c := range mainline {
+		if c.NumParents() > 1 {
+			queue = append(queue, c.ParentHashes[1:]...)
+		}
+	}
+	points := make(map[plumbing.Hash]bool)
+	refs, err := r.References()
+	if err != nil {
+		return nil, fmt.Errorf("list references: %w", err)
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || ref.Name().IsRemote() || ref.Name() == head {
+			return nil
+		}
+		hash := ref.Hash()
+		if tag, err := r.TagObject(hash); err == nil {
+			hash = tag.Target
+		}
+		if onMainline[hash] {
+			points[hash] = true
+		}
+		queue = append(queue, hash)
+		return nil
+	})
+	refs.Close()
+	if err != nil {
+		return nil, fmt.Errorf("list references: %w", err)
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if seen[hash] || onMainline[hash] {
+			continue
+		}
+		seen[hash] = true
+		c, err := r.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("get commit object: %w", err)
+		}
+		for _, parent := range c.ParentHashes {
+			if onMainline[parent] {
+				points[parent] = true
+			}
+		}
+		queue = append(queue, c.ParentHashes...)
+	}
+	return points, nil
+}
+
+// rewriteParents stores a copy of c with its parents rewritten, and
+// returns its hash. If no parent changed, c is kept as it is.
+func rewriteParents(r *git.Repository, c *object.Commit, rewrite func(plumbing.Hash) (plumbing.Hash, error)) (plumbing.Hash, error) {
+	parents := make([]plumbing.Hash, len(c.ParentHashes))
+	changed := false
+	for i, parent := range c.ParentHashes {
+		replaced, err := rewrite(parent)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		parents[i] = replaced
+		changed = changed || replaced != parent
+	}
+	if !changed {
+		return c.Hash, nil
+	}
+	return storeCommit(r, &object.Commit{
+		Author:       c.Author,
+		Committer:    c.Committer,
+		MergeTag:     c.MergeTag,
+		Message:      c.Message,
+		TreeHash:     c.TreeHash,
+		ParentHashes: parents,
+		Encoding:     c.Encoding,
+	})
+}
+
+// squashCommits stores the commit a run of commits is squashed into, on
+// top of parent.
+func squashCommits(r *git.Repository, group []*object.Commit, parent plumbing.Hash) (plumbing.Hash, error) {
+	first, last := group[0], group[len(group)-1]
+	subject, _, _ := strings.Cut(first.Message, "\n")
+
+	var coAuthors []Author
+	seen := map[string]bool{last.Author.Email: true}
+	for _, c := range group {
+		for _, co := range ParseCoAuthors(c.Message) {
+			if !seen[co.Email] {
+				seen[co.Email] = true
+				coAuthors = append(coAuthors, co)
+			}
+		}
+	}
+
+	return storeCommit(r, &object.Commit{
+		Author:       last.Author,
+		Committer:    last.Committer,
+		Message:      withCoAuthors(subject, coAuthors),
+		TreeHash:     last.TreeHash,
+		ParentHashes: []plumbing.Hash{parent},
+	})
+}
+
+func storeCommit(r *git.Repository, commit *object.Commit) (plumbing.Hash, error) {
+	obj := r.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("encode commit: %w", err)
+	}
+	hash, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("store commit: %w", err)
+	}
+	return hash, nil
+}
+
+// moveRefs points every branch and tag at what its commit became. Annotated
+// tags are recreated with the same tagger and message.
+func moveRefs(r *git.Repository, rewrite func(plumbing.Hash) (plumbing.Hash, error)) error {
+	refs, err := r.References()
+	if err != nil {
+		return fmt.Errorf("list references: %w", err)
+	}
+	var moved []*plumbing.Reference
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || ref.Name().IsRemote() {
+			return nil
+		}
+		tag, err := r.TagObject(ref.Hash())
+		if err != nil {
+			replaced, err := rewrite(ref.Hash())
+			if err != nil {
+				return err
+			}
+			if replaced != ref.Hash() {
+				moved = append(moved, plumbing.NewHashReference(ref.Name(), replaced))
+			}
+			return nil
+		}
+
+		target, err := rewrite(tag.Target)
+		if err != nil {
+			return err
+		}
+		if target == tag.Target {
+			return nil
+		}
+		obj := r.Storer.NewEncodedObject()
+		retagged := &object.Tag{Name: tag.Name, Tagger: tag.Tagger, Message: tag.Message, TargetType: tag.TargetType, Target: target}
+		if err := retagged.Encode(obj); err != nil {
+			return fmt.Errorf("encode tag %s: %w", ref.Name().Short(), err)
+		}
+		hash, err := r.Storer.SetEncodedObject(obj)
+		if err != nil {
+			return fmt.Errorf("store tag %s: %w", ref.Name().Short(), err)
+		}
+		moved = append(moved, plumbing.NewHashReference(ref.Name(), hash))
+		return nil
+	})
+	refs.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range moved {
+		if err := r.Storer.SetReference(ref); err != nil {
+			return fmt.Errorf("set %s: %w", ref.Name().Short(), err)
+		}
+	}
+	return nil
+}
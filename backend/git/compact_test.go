@@ -0,0 +1,245 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+var (
+	alice = Author{Name: "alice", Email: "alice@example.com"}
+	bob   = Author{Name: "bob", Email: "bob@example.com"}
+)
+
+// historyRepo builds up a document's history in a new repository.
+type historyRepo struct {
+	t    *testing.T
+	repo *Repo
+	doc  Document
+	n    int
+}
+
+func newHistoryRepo(t *testing.T) *historyRepo {
+	repo, err := OpenRepo(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &historyRepo{t: t, repo: repo, doc: Document{ID: "1", Path: "plan.md"}}
+}
+
+// commit saves a new revision of the document as author and returns its
+// commit.
+func (h *historyRepo) commit(message string, author Author) string {
+	h.t.Helper()
+	h.n++
+	if err := SaveDocument(h.repo, h.doc, fmt.Sprintf("revision %d\n", h.n)); err != nil {
+		h.t.Fatal(err)
+	}
+	hash, err := CommitDocumentAs(h.repo, h.doc, message, author, nil)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return hash
+}
+
+func (h *historyRepo) open() *git.Repository {
+	h.t.Helper()
+	r, err := git.PlainOpen(h.repo.Path)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return r
+}
+
+func (h *historyRepo) head() *object.Commit {
+	h.t.Helper()
+	r := h.open()
+	ref, err := r.Head()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	c, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return c
+}
+
+// mainline lists the subjects of the current branch, oldest first.
+func (h *historyRepo) mainline() []string {
+	h.t.Helper()
+	var subjects []string
+	for c := h.head(); ; {
+		subject, _, _ := strings.Cut(c.Message, "\n")
+		subjects = append([]string{subject}, subjects...)
+		if c.NumParents() == 0 {
+			return subjects
+		}
+		var err error
+		if c, err = c.Parent(0); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+}
+
+func isSave(message string) bool {
+	return strings.HasPrefix(message, "Save")
+}
+
+func TestCompactHistory(t *testing.T) {
+	h := newHistoryRepo(t)
+	h.commit("Create plan", alice)
+	run := []string{h.commit("Save plan", alice), h.commit("Save plan", alice), h.commit("Save plan", alice)}
+	tagged := h.commit("Save plan", alice)
+	if _, err := TagDocumentVersion(h.repo, h.doc, "v1", tagged, "First draft", alice); err != nil {
+		t.Fatal(err)
+	}
+	branchPoint := h.commit("Save plan", alice)
+	if _, err := CreateDraft(h.repo, h.doc, "rewrite", branchPoint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CommitDraft(h.repo, h.doc, "rewrite", "rewritten\n", "Rewrite plan", bob); err != nil {
+		t.Fatal(err)
+	}
+	afterBranch := []string{h.commit("Save plan", alice), h.commit("Save plan", alice)}
+	version := h.commit("Version of plan", alice)
+	merge, err := MergeDraft(h.repo, h.doc, "rewrite", "merged\n", "Merge draft rewrite", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byBob := []string{h.commit("Save plan", bob), h.commit("Save plan", bob)}
+	h.commit("Save plan", alice)
+
+	before := h.mainline()
+	tree := h.head().TreeHash
+	// The commits left behind are pruned, so note those that should be kept
+	kept := make(map[string]*object.Commit)
+	for _, hash := range []string{tagged, branchPoint, version, merge} {
+		c, err := h.open().CommitObject(plumbing.NewHash(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept[hash] = c
+	}
+	options := CompactOptions{Window: time.Hour, Squashable: isSave}
+
+	// A dry run finds the runs but changes nothing
+	options.DryRun = true
+	dry, err := CompactHistory(h.repo, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dry.Removed != 4 || len(dry.Squashes) != 3 || len(dry.Rewritten) != 0 {
+		t.Fatalf("dry run removed %d in %d squashes, rewrote %d", dry.Removed, len(dry.Squashes), len(dry.Rewritten))
+	}
+	if got := h.mainline(); strings.Join(got, ",") != strings.Join(before, ",") {
+		t.Fatalf("dry run changed history to %v", got)
+	}
+
+	options.DryRun = false
+	compaction, err := CompactHistory(h.repo, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Initial commit",
+		"Create plan",
+		"Save plan", // the run of three
+		"Save plan", // tagged
+		"Save plan", // drafted from
+		"Save plan", // the two after it
+		"Version of plan",
+		"Merge draft rewrite",
+		"Save plan", // bob's two
+		"Save plan",
+	}
+	if got := h.mainline(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("history is %v, want %v", got, want)
+	}
+	if compaction.Removed != 4 || len(compaction.Squashes) != 3 {
+		t.Fatalf("removed %d in %d squashes", compaction.Removed, len(compaction.Squashes))
+	}
+	if h.head().TreeHash != tree {
+		t.Errorf("compacting changed the content")
+	}
+
+	// The squashed commits all map to what they became, and everything
+	// after the first squash to its copy
+	for i, commits := range [][]string{run, afterBranch, byBob} {
+		squash := compaction.Squashes[i]
+		if squash.Hash == "" || len(squash.Commits) != len(commits) {
+			t.Fatalf("squash %d is %+v", i, squash)
+		}
+		for _, c := range commits {
+			if compaction.Rewritten[c] != squash.Hash {
+				t.Errorf("%s maps to %s, want squash %d %s", c, compaction.Rewritten[c], i, squash.Hash)
+			}
+		}
+	}
+	r := h.open()
+	for hash, old := range kept {
+		replaced, ok := compaction.Rewritten[hash]
+		if !ok {
+			t.Fatalf("%s is missing from the rewritten commits", hash)
+		}
+		c, err := r.CommitObject(plumbing.NewHash(replaced))
+		if err != nil {
+			t.Fatalf("%s maps to %s: %v", hash, replaced, err)
+		}
+		if c.Message != old.Message || c.TreeHash != old.TreeHash || c.NumParents() != old.NumParents() {
+			t.Errorf("%s was kept as %s, but changed", hash, replaced)
+		}
+	}
+
+	// The map can be applied in one lookup, as Compactor.remap does: every
+	// commit it maps to exists and none has moved again
+	for old, replaced := range compaction.Rewritten {
+		if _, err := r.CommitObject(plumbing.NewHash(replaced)); err != nil {
+			t.Errorf("%s maps to missing commit %s", old, replaced)
+		}
+		if again, ok := compaction.Rewritten[replaced]; ok {
+			t.Errorf("%s maps to %s, which maps on to %s", old, replaced, again)
+		}
+	}
+
+	// The tag and the draft follow their commits
+	tags, err := ListDocumentTags(h.repo, h.doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Hash != compaction.Rewritten[tagged] {
+		t.Errorf("tags are %+v, want v1 at %s", tags, compaction.Rewritten[tagged])
+	}
+	draft, err := r.Reference(plumbing.ReferenceName(DraftBranch(h.doc.ID, "rewrite")), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	draftHead, err := r.CommitObject(draft.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if draftHead.ParentHashes[0].String() != compaction.Rewritten[branchPoint] {
+		t.Errorf("draft starts from %s, want %s", draftHead.ParentHashes[0], compaction.Rewritten[branchPoint])
+	}
+	merged, err := r.CommitObject(plumbing.NewHash(compaction.Rewritten[merge]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.ParentHashes[1] != draft.Hash() {
+		t.Errorf("merge has draft parent %s, want %s", merged.ParentHashes[1], draft.Hash())
+	}
+
+	// Nothing is left to squash
+	again, err := CompactHistory(h.repo, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Removed != 0 || len(again.Rewritten) != 0 {
+		t.Errorf("compacting again removed %d and rewrote %d", again.Removed, len(again.Rewritten))
+	}
+}
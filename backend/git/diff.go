@@ -0,0 +1,435 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// diffContext is how many unchanged lines surround each hunk.
+const diffContext = 3
+
+// Kinds of DiffLine and DiffSegment.
+const (
+	DiffEqual  = "equal"
+	DiffInsert = "insert"
+	DiffDelete = "delete"
+)
+
+// Diff compares two versions of a document. Unified is the diff as git
+// prints it; Hunks has the same changes structured for side-by-side
+// rendering.
+type Diff struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Unified   string `json:"unified"`
+	Hunks     []Hunk `json:"hunks"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+// Hunk is a run of changed lines with the unchanged lines around them. Line
+// numbers start at 1.
+type Hunk struct {
+	OldStart int        `json:"old_start"`
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// DiffLine is one line of a hunk. OldLine and NewLine are 0 on the side the
+// line isn't on. Changed lines that replace one another carry Words, the
+// word-level changes between them.
+type DiffLine struct {
+	Type    string        `json:"type"`
+	OldLine int           `json:"old_line,omitempty"`
+	NewLine int           `json:"new_line,omitempty"`
+	Text    string        `json:"text"`
+	Words   []DiffSegment `json:"words,omitempty"`
+	// noNewline marks a last line without a trailing newline
+	noNewline bool
+}
+
+// DiffSegment is a piece of a changed line.
+type DiffSegment struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// diffLine is a line of either version, without its newline.
+type diffLine struct {
+	kind string
+	text string
+	// noNewline marks a last line without a trailing newline
+	noNewline bool
+}
+
+// DiffVersions compares a document at two commits. A document missing from
+// a commit compares as empty.
+func DiffVersions(repo *Repo, doc Document, fromHash string, toHash string) (*Diff, error) {
+	from, err := contentAt(repo, doc, fromHash)
+	if err != nil {
+		return nil, err
+	}
+	to, err := contentAt(repo, doc, toHash)
+	if err != nil {
+		return nil, err
+	}
+	d := DiffContents(doc.Path, from, to)
+	d.From, d.To = fromHash, toHash
+	return d, nil
+}
+
+// DiffWithContent compares a document at a commit with content that may not
+// be committed yet, such as the live document.
+func DiffWithContent(repo *Repo, doc Document, fromHash string, content string) (*Diff, error) {
+	from, err := contentAt(repo, doc, fromHash)
+	if err != nil {
+		return nil, err
+	}
+	d := DiffContents(doc.Path, from, content)
+	d.From = fromHash
+	return d, nil
+}
+
+// contentAt reads a document at a revision: a full or abbreviated commit
+// hash, or a reference name.
+func contentAt(repo *Repo, doc Document, commitHash string) (string, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return "", fmt.Errorf("git plain open: %w", err)
+	}
+
+	commit, err := resolveCommit(r, commitHash)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := documentFile(commit, doc)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return documentContent(file)
+}
+
+// DiffContents compares two texts of the document kept at path.
+func DiffContents(path string, from string, to string) *Diff {
+	var lines []diffLine
+	for _, d := range diff.Do(from, to) {
+		kind := DiffEqual
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			kind = DiffInsert
+		case diffmatchpatch.DiffDelete:
+			kind = DiffDelete
+		}
+		lines = append(lines, splitLines(kind, d.Text)...)
+	}
+
+	result := &Diff{Hunks: buildHunks(lines)}
+	for _, hunk := range result.Hunks {
+		for _, line := range hunk.Lines {
+			switch line.Type {
+			case DiffInsert:
+				result.Additions++
+			case DiffDelete:
+				result.Deletions++
+			}
+		}
+	}
+	result.Unified = unified(path, result.Hunks)
+	return result
+}
+
+func splitLines(kind string, text string) []diffLine {
+	var lines []diffLine
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+		lines = append(lines, diffLine{
+			kind:      kind,
+			text:      strings.TrimSuffix(line, "\n"),
+			noNewline: !strings.HasSuffix(line, "\n"),
+		})
+	}
+	return lines
+}
+
+// buildHunks groups changed lines, with diffContext lines of context, into
+// hunks. Changes closer than twice the context share a hunk.
+func buildHunks(lines []diffLine) []Hunk {
+	var hunks []Hunk
+	oldLine, newLine := 1, 1
+	// positions of each line in the old and new text
+	oldAt := make([]int, len(lines))
+	newAt := make([]int, len(lines))
+	for i, line := range lines {
+		oldAt[i], newAt[i] = oldLine, newLine
+		if line.kind != DiffInsert {
+			oldLine++
+		}
+		if line.kind != DiffDelete {
+			newLine++
+		}
+	}
+
+	for i := 0; i < len(lines); {
+		if lines[i].kind == DiffEqual {
+			i++
+			continue
+		}
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(lines) {
+			if lines[end].kind != DiffEqual {
+				end++
+				continue
+			}
+			run := end
+			for run < len(lines) && lines[run].kind == DiffEqual {
+				run++
+			}
+			if run == len(lines) || run-end > 2*diffContext {
+				end += min(diffContext, run-end)
+				break
+			}
+			end = run
+		}
+
+		hunk := Hunk{OldStart: oldAt[start], NewStart: newAt[start]}
+		for j := start; j < end; j++ {
+			line := DiffLine{Type: lines[j].kind, Text: lines[j].text, noNewline: lines[j].noNewline}
+			if lines[j].kind != DiffInsert {
+				line.OldLine = oldAt[j]
+				hunk.OldLines++
+			}
+			if lines[j].kind != DiffDelete {
+				line.NewLine = newAt[j]
+				hunk.NewLines++
+			}
+			hunk.Lines = append(hunk.Lines, line)
+		}
+		// git numbers an empty side by the line before it
+		if hunk.OldLines == 0 {
+			hunk.OldStart--
+		}
+		if hunk.NewLines == 0 {
+			hunk.NewStart--
+		}
+		addWordDiffs(hunk.Lines)
+		hunks = append(hunks, hunk)
+		i = end
+	}
+	return hunks
+}
+
+// addWordDiffs pairs each run of deleted lines with the inserted lines that
+// follow it, and marks the words that changed between each pair.
+func addWordDiffs(lines []DiffLine) {
+	for i := 0; i < len(lines); {
+		if lines[i].Type != DiffDelete {
+			i++
+			continue
+		}
+		deleted := i
+		for i < len(lines) && lines[i].Type == DiffDelete {
+			i++
+		}
+		inserted := i
+		for i < len(lines) && lines[i].Type == DiffInsert {
+			i++
+		}
+		for k := 0; deleted+k < inserted && inserted+k < i; k++ {
+			before, after := &lines[deleted+k], &lines[inserted+k]
+			before.Words, after.Words = wordDiff(before.Text, after.Text)
+		}
+	}
+}
+
+// wordDiff compares two lines token by token, returning the segments of
+// each.
+func wordDiff(from string, to string) ([]DiffSegment, []DiffSegment) {
+	fromTokens, toTokens := tokenize(from), tokenize(to)
+	codes := make(map[string]rune)
+	var tokens []string
+	encode := func(words []string) []rune {
+		runes := make([]rune, len(words))
+		for i, word := range words {
+			code, ok := codes[word]
+			if !ok {
+				code = rune(len(tokens))
+				codes[word] = code
+				tokens = append(tokens, word)
+			}
+			runes[i] = code
+		}
+		return runes
+	}
+	a, b := encode(fromTokens), encode(toTokens)
+
+	var oldSegments, newSegments []DiffSegment
+	for _, d := range tokenDiff(a, b) {
+		var text strings.Builder
+		for _, code := range d.runes {
+			text.WriteString(tokens[code])
+		}
+		segment := DiffSegment{Type: d.kind, Text: text.String()}
+		if d.kind != DiffInsert {
+			oldSegments = appendSegment(oldSegments, segment)
+		}
+		if d.kind != DiffDelete {
+			newSegments = appendSegment(newSegments, segment)
+		}
+	}
+	return oldSegments, newSegments
+}
+
+// appendSegment adds a segment, joining it to the last one if they are of
+// the same type; unchanged text is split by changes on the other side only.
+func appendSegment(segments []DiffSegment, segment DiffSegment) []DiffSegment {
+	if n := len(segments); n > 0 && segments[n-1].Type == segment.Type {
+		segments[n-1].Text += segment.Text
+		return segments
+	}
+	return append(segments, segment)
+}
+
+type tokenChange struct {
+	kind  string
+	runes []rune
+}
+
+// tokenDiff is a longest common subsequence diff over token codes. Lines are
+// short, so the quadratic table is cheap.
+func tokenDiff(a []rune, b []rune) []tokenChange {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var changes []tokenChange
+	add := func(kind string, code rune) {
+		if n := len(changes); n > 0 && changes[n-1].kind == kind {
+			changes[n-1].runes = append(changes[n-1].runes, code)
+			return
+		}
+		changes = append(changes, tokenChange{kind: kind, runes: []rune{code}})
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			add(DiffEqual, a[i])
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			add(DiffInsert, b[j])
+			j++
+		default:
+			add(DiffDelete, a[i])
+			i++
+		}
+	}
+	return changes
+}
+
+// markdownMarkers are characters that, repeated, form a single Markdown
+// token: emphasis, code spans, headings, rules and strikethrough.
+const markdownMarkers = "*_`#~=-"
+
+// tokenize splits a line into words, runs of whitespace, runs of a Markdown
+// marker and single punctuation characters, so that a changed word or a
+// word that became bold shows up on its own.
+func tokenize(line string) []string {
+	var tokens []string
+	runes := []rune(line)
+	for i := 0; i < len(runes); {
+		j := i + 1
+		switch r := runes[i]; {
+		case isWordRune(r):
+			for j < len(runes) && (isWordRune(runes[j]) || isInnerWordRune(runes, j)) {
+				j++
+			}
+		case unicode.IsSpace(r):
+			for j < len(runes) && unicode.IsSpace(runes[j]) {
+				j++
+			}
+		case strings.ContainsRune(markdownMarkers, r):
+			for j < len(runes) && runes[j] == r {
+				j++
+			}
+		}
+		tokens = append(tokens, string(runes[i:j]))
+		i = j
+	}
+	return tokens
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// isInnerWordRune reports whether runes[i] is an apostrophe or hyphen inside
+// a word, as in "don't" or "well-known".
+func isInnerWordRune(runes []rune, i int) bool {
+	if runes[i] != '\'' && runes[i] != '’' && runes[i] != '-' {
+		return false
+	}
+	return i+1 < len(runes) && isWordRune(runes[i+1])
+}
+
+// unified formats hunks as a unified diff.
+func unified(name string, hunks []Hunk) string {
+	if len(hunks) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- a/%s\n+++ b/%s\n", name, name)
+	for _, hunk := range hunks {
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(hunk.OldStart, hunk.OldLines), hunkRange(hunk.NewStart, hunk.NewLines))
+		for _, line := range hunk.Lines {
+			prefix := " "
+			switch line.Type {
+			case DiffInsert:
+				prefix = "+"
+			case DiffDelete:
+				prefix = "-"
+			}
+			b.WriteString(prefix + line.Text + "\n")
+			if line.noNewline {
+				b.WriteString("\\ No newline at end of file\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+func hunkRange(start int, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
@@ -0,0 +1,160 @@
+package git
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The unified diffs are as git diff prints them.
+func TestDiffContents(t *testing.T) {
+	tests := []struct {
+		name      string
+		from, to  string
+		unified   string
+		additions int
+		deletions int
+	}{
+		{name: "unchanged", from: "a\nb\n", to: "a\nb\n"},
+		{
+			name: "created", from: "", to: "a\nb\n",
+			unified:   "--- a/plan.md\n+++ b/plan.md\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+			additions: 2,
+		},
+		{
+			name: "emptied", from: "a\nb\n", to: "",
+			unified:   "--- a/plan.md\n+++ b/plan.md\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+			deletions: 2,
+		},
+		{
+			name: "context", from: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", to: "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n",
+			unified:   "--- a/plan.md\n+++ b/plan.md\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+			additions: 1, deletions: 1,
+		},
+		{
+			name: "two hunks",
+			from: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n",
+			to:   "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\nfifteen\n",
+			unified: "--- a/plan.md\n+++ b/plan.md\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+				"@@ -12,4 +12,4 @@\n 12\n 13\n 14\n-15\n+fifteen\n",
+			additions: 2, deletions: 2,
+		},
+		{
+			name: "no newline", from: "a\nb", to: "a\nc",
+			unified:   "--- a/plan.md\n+++ b/plan.md\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+			additions: 1, deletions: 1,
+		},
+		{
+			name: "newline added", from: "a\nb", to: "a\nb\n",
+			unified:   "--- a/plan.md\n+++ b/plan.md\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+			additions: 1, deletions: 1,
+		},
+	}
+	for _, tt := range tests {
+		d := DiffContents("plan.md", tt.from, tt.to)
+		if d.Unified != tt.unified || d.Additions != tt.additions || d.Deletions != tt.deletions {
+			t.Errorf("%s: diff is +%d -%d\n%s\nwant +%d -%d\n%s", tt.name, d.Additions, d.Deletions, d.Unified, tt.additions, tt.deletions, tt.unified)
+		}
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	d := DiffContents("plan.md", "keep\nthe quick fox\nend\n", "keep\nthe slow fox\nend\n")
+	if len(d.Hunks) != 1 {
+		t.Fatalf("%d hunks", len(d.Hunks))
+	}
+	want := []DiffLine{
+		{Type: DiffEqual, OldLine: 1, NewLine: 1, Text: "keep"},
+		{Type: DiffDelete, OldLine: 2, Text: "the quick fox", Words: []DiffSegment{
+			{DiffEqual, "the "}, {DiffDelete, "quick"}, {DiffEqual, " fox"},
+		}},
+		{Type: DiffInsert, NewLine: 2, Text: "the slow fox", Words: []DiffSegment{
+			{DiffEqual, "the "}, {DiffInsert, "slow"}, {DiffEqual, " fox"},
+		}},
+		{Type: DiffEqual, OldLine: 3, NewLine: 3, Text: "end"},
+	}
+	if hunk := d.Hunks[0]; hunk.OldStart != 1 || hunk.OldLines != 3 || hunk.NewStart != 1 || hunk.NewLines != 3 || !reflect.DeepEqual(hunk.Lines, want) {
+		t.Errorf("hunk is %+v", hunk)
+	}
+}
+
+func TestWordDiff(t *testing.T) {
+	tests := []struct {
+		from, to      string
+		before, after []DiffSegment
+	}{
+		{
+			"make it work", "make it **work**",
+			[]DiffSegment{{DiffEqual, "make it work"}},
+			[]DiffSegment{{DiffEqual, "make it "}, {DiffInsert, "**"}, {DiffEqual, "work"}, {DiffInsert, "**"}},
+		},
+		{
+			"don't stop", "do not stop",
+			[]DiffSegment{{DiffDelete, "don't"}, {DiffEqual, " stop"}},
+			[]DiffSegment{{DiffInsert, "do not"}, {DiffEqual, " stop"}},
+		},
+		{
+			"## Plan", "# Plan",
+			[]DiffSegment{{DiffDelete, "##"}, {DiffEqual, " Plan"}},
+			[]DiffSegment{{DiffInsert, "#"}, {DiffEqual, " Plan"}},
+		},
+	}
+	for _, tt := range tests {
+		before, after := wordDiff(tt.from, tt.to)
+		if !reflect.DeepEqual(before, tt.before) || !reflect.DeepEqual(after, tt.after) {
+			t.Errorf("wordDiff(%q, %q) = %v, %v, want %v, %v", tt.from, tt.to, before, after, tt.before, tt.after)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	got := tokenize("don't  use well-known **bold**, ok?")
+	want := []string{"don't", "  ", "use", " ", "well-known", " ", "**", "bold", "**", ",", " ", "ok", "?"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tokenize = %q, want %q", got, want)
+	}
+}
+
+func TestDiffVersions(t *testing.T) {
+	repo, err := OpenRepo(filepath.Join(t.TempDir(), "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := Head(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := Document{ID: "1", Path: "plan.md"}
+	first := splitCommit(t, repo, doc, "one\ntwo\n", "Create document: Plan")
+	second := splitCommit(t, repo, doc, "one\n2\n", "Save document: Plan")
+
+	d, err := DiffVersions(repo, doc, first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.From != first || d.To != second || d.Unified != "--- a/plan.md\n+++ b/plan.md\n@@ -1,2 +1,2 @@\n one\n-two\n+2\n" {
+		t.Errorf("diff is %+v", d)
+	}
+
+	// The front matter isn't part of it, and a commit without the document
+	// compares as empty
+	d, err = DiffVersions(repo, doc, before, first[:7])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Additions != 2 || d.Deletions != 0 {
+		t.Errorf("diff from before the document is %s", d.Unified)
+	}
+
+	d, err = DiffWithContent(repo, doc, second, "one\n2\nthree\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Additions != 1 || d.Deletions != 0 || d.To != "" {
+		t.Errorf("diff with the live content is %+v", d)
+	}
+
+	if _, err := DiffVersions(repo, doc, first, "0000000"); err == nil {
+		t.Errorf("diffed against a missing commit")
+	}
+}
@@ -0,0 +1,387 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// Document is a document's file in a repository. The file is named after
+// the document's title and may be renamed or moved; its front matter
+// carries the ID, which finds the file in commits from before it moved.
+type Document struct {
+	ID string
+	// Path is relative to the repository, with forward slashes.
+	Path string
+}
+
+// LegacyPath is where a document was kept before files were named after
+// titles.
+func LegacyPath(documentID string) string {
+	return documentID + ".md"
+}
+
+// maxSlugLength keeps file names readable when titles are long.
+const maxSlugLength = 60
+
+// Slug turns a title or folder name into a file name: lower case letters
+// and digits, with anything else between them a single hyphen.
+func Slug(title string) string {
+	var slug []rune
+	hyphen := false
+	for _, r := range strings.ToLower(title) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			hyphen = true
+			continue
+		}
+		if hyphen && len(slug) > 0 {
+			slug = append(slug, '-')
+		}
+		hyphen = false
+		slug = append(slug, r)
+	}
+	if len(slug) > maxSlugLength {
+		slug = []rune(strings.TrimRight(string(slug[:maxSlugLength]), "-"))
+	}
+	if len(slug) == 0 {
+		return "untitled"
+	}
+	return string(slug)
+}
+
+const frontMatterDelimiter = "---\n"
+
+// splitFrontMatter splits a file into the lines of its YAML front matter
+// and the rest. ok is false for a file without front matter.
+func splitFrontMatter(file string) (matter string, rest string, ok bool) {
+	if !strings.HasPrefix(file, frontMatterDelimiter) {
+		return "", file, false
+	}
+	body := file[len(frontMatterDelimiter):]
+	if strings.HasPrefix(body, frontMatterDelimiter) {
+		return "", body[len(frontMatterDelimiter):], true
+	}
+	end := strings.Index(body, "\n"+frontMatterDelimiter)
+	if end < 0 {
+		return "", file, false
+	}
+	return body[:end+1], body[end+1+len(frontMatterDelimiter):], true
+}
+
+// EncodeDocument is the file a document is kept in: its content with the
+// document's ID added to the front matter, which it is given if it has
+// none. Empty front matter is left in the content, after the ID's, since
+// DecodeDocument couldn't tell it from none.
+func EncodeDocument(documentID string, content string) string {
+	idLine := fmt.Sprintf("id: %s\n", documentID)
+	if matter, _, ok := splitFrontMatter(content); ok && matter != "" {
+		return frontMatterDelimiter + idLine + content[len(frontMatterDelimiter):]
+	}
+	return frontMatterDelimiter + idLine + frontMatterDelimiter + content
+}
+
+// DecodeDocument splits a document's file into the ID in its front matter
+// and its content, undoing EncodeDocument. The ID is empty for a file
+// without one.
+func DecodeDocument(file string) (documentID string, content string) {
+	matter, rest, ok := splitFrontMatter(file)
+	if !ok {
+		return "", file
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(matter, "\n") {
+		if value, isID := strings.CutPrefix(line, "id:"); isID && documentID == "" {
+			documentID = strings.Trim(strings.TrimSpace(value), `"'`)
+			continue
+		}
+		if line != "" {
+			kept = append(kept, line)
+		}
+	}
+	if documentID == "" {
+		return "", file
+	}
+	if len(kept) == 0 {
+		return documentID, rest
+	}
+	return documentID, frontMatterDelimiter + strings.Join(kept, "") + frontMatterDelimiter + rest
+}
+
+// fileDocumentID reads the document ID from a file's front matter.
+func fileDocumentID(file *object.File) (string, error) {
+	contents, err := file.Contents()
+	if err != nil {
+		return "", fmt.Errorf("get file contents: %w", err)
+	}
+	id, _ := DecodeDocument(contents)
+	return id, nil
+}
+
+// documentContent reads a document's content from its file.
+func documentContent(file *object.File) (string, error) {
+	contents, err := file.Contents()
+	if err != nil {
+		return "", fmt.Errorf("get file contents: %w", err)
+	}
+	_, content := DecodeDocument(contents)
+	return content, nil
+}
+
+// isDocumentFile reports whether file is the document's: it names the
+// document in its front matter, or names none and is where the document
+// was kept before files were named after titles.
+func isDocumentFile(file *object.File, documentID string) (bool, error) {
+	id, err := fileDocumentID(file)
+	if err != nil {
+		return false, err
+	}
+	return id == documentID || id == "" && file.Name == LegacyPath(documentID), nil
+}
+
+// documentFile finds a document's file in a commit: at the document's
+// path, unless the file there is another document's, or else the markdown
+// file naming the document in its front matter, or else the file it was
+// kept in before files were named after titles. It returns
+// object.ErrFileNotFound if the document isn't in the commit.
+func documentFile(commit *object.Commit, doc Document) (*object.File, error) {
+	file, err := commit.File(doc.Path)
+	if err != nil && !errors.Is(err, object.ErrFileNotFound) {
+		return nil, fmt.Errorf("get file at commit: %w", err)
+	}
+	if err == nil {
+		ok, err := isDocumentFile(file, doc.ID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return file, nil
+		}
+	}
+
+	files, err := commit.Files()
+	if err != nil {
+		return nil, fmt.Errorf("list files: %w", err)
+	}
+	var found *object.File
+	err = files.ForEach(func(f *object.File) error {
+		if !strings.HasSuffix(f.Name, ".md") {
+			return nil
+		}
+		id, err := fileDocumentID(f)
+		if err != nil {
+			return err
+		}
+		if id == doc.ID {
+			found = f
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found != nil {
+		return found, nil
+	}
+
+	return legacyFile(commit, doc.ID)
+}
+
+// legacyFile finds a document in a commit from before files were named
+// after titles.
+func legacyFile(commit *object.Commit, documentID string) (*object.File, error) {
+	file, err := commit.File(LegacyPath(documentID))
+	if err != nil {
+		if errors.Is(err, object.ErrFileNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("get file at commit: %w", err)
+	}
+	ok, err := isDocumentFile(file, documentID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, object.ErrFileNotFound
+	}
+	return file, nil
+}
+
+// parentFile finds a document's file in a parent of a commit, given its
+// file in the commit: at the same path, or else among the files the commit
+// removed, which is where it was renamed or moved from. It is nil if the
+// commit added the document.
+func parentFile(commit *object.Commit, file *object.File, parent *object.Commit, documentID string) (*object.File, error) {
+	same, err := parent.File(file.Name)
+	if err != nil && !errors.Is(err, object.ErrFileNotFound) {
+		return nil, fmt.Errorf("get file at commit: %w", err)
+	}
+	if err == nil {
+		ok, err := isDocumentFile(same, documentID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return same, nil
+		}
+	}
+
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, fmt.Errorf("diff trees: %w", err)
+	}
+	for _, change := range changes {
+		if change.From.Name == "" || change.From.Name == change.To.Name || !strings.HasSuffix(change.From.Name, ".md") {
+			continue
+		}
+		moved, err := parent.File(change.From.Name)
+		if err != nil {
+			return nil, fmt.Errorf("get file at commit: %w", err)
+		}
+		id, err := fileDocumentID(moved)
+		if err != nil {
+			return nil, err
+		}
+		if id == documentID {
+			return moved, nil
+		}
+	}
+
+	file, err = legacyFile(parent, documentID)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, nil
+	}
+	return file, err
+}
+
+// documentCommit is a commit that changed a document, with the document's
+// file as of the commit.
+type documentCommit struct {
+	commit *object.Commit
+	file   *object.File
+}
+
+// documentLog lists the commits from head back that changed a document,
+// newest first. Renaming or moving the file counts as a change, and the
+// document is followed to where it was before. With firstParent only the
+// main line is walked, leaving out the commits of merged drafts.
+func documentLog(r *git.Repository, head *object.Commit, doc Document, firstParent bool) ([]documentCommit, error) {
+	// files holds the document's file in each commit reached so far; nil
+	// where the document isn't
+	files := make(map[plumbing.Hash]*object.File)
+	file, err := documentFile(head, doc)
+	if err != nil && !errors.Is(err, object.ErrFileNotFound) {
+		return nil, err
+	}
+	files[head.Hash] = file
+
+	var log []documentCommit
+	visit := func(c *object.Commit) error {
+		file, known := files[c.Hash]
+		if !known {
+			var err error
+			if file, err = documentFile(c, doc); err != nil && !errors.Is(err, object.ErrFileNotFound) {
+				return err
+			}
+		}
+
+		var before *object.File
+		for i, parentHash := range c.ParentHashes {
+			if firstParent && i > 0 {
+				break
+			}
+			var previous *object.File
+			if file != nil {
+				parent, err := r.CommitObject(parentHash)
+				if err != nil {
+					return fmt.Errorf("get commit object: %w", err)
+				}
+				if previous, err = parentFile(c, file, parent, doc.ID); err != nil {
+					return err
+				}
+			}
+			if _, ok := files[parentHash]; !ok {
+				files[parentHash] = previous
+			}
+			if i == 0 {
+				before = previous
+			}
+		}
+
+		if file != nil && (before == nil || before.Name != file.Name || before.Hash != file.Hash) {
+			log = append(log, documentCommit{commit: c, file: file})
+		}
+		return nil
+	}
+
+	if firstParent {
+		for c := head; ; {
+			if err := visit(c); err != nil {
+				return nil, err
+			}
+			if c.NumParents() == 0 {
+				break
+			}
+			if c, err = c.Parent(0); err != nil {
+				return nil, fmt.Errorf("get parent commit: %w", err)
+			}
+		}
+		return log, nil
+	}
+
+	iter, err := r.Log(&git.LogOptions{From: head.Hash, Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return nil, fmt.Errorf("git log: %w", err)
+	}
+	defer iter.Close()
+	if err := iter.ForEach(visit); err != nil {
+		return nil, err
+	}
+	return log, nil
+}
+
+// MoveDocument moves a document's file in the worktree, to be committed as
+// a rename. Folders left empty are removed.
+func MoveDocument(repo *Repo, from Document, to Document) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	target := repo.DocumentPath(to)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("create folder: %w", err)
+	}
+	err := os.Rename(repo.DocumentPath(from), target)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("move document: %w", err)
+	}
+	removeEmptyFolders(repo, path.Dir(from.Path))
+	return nil
+}
+
+// removeEmptyFolders removes a folder of the worktree, and then its
+// parents, for as long as they are empty.
+func removeEmptyFolders(repo *Repo, folder string) {
+	for folder != "." && folder != "/" && folder != "" {
+		if err := os.Remove(filepath.Join(repo.Path, filepath.FromSlash(folder))); err != nil {
+			return
+		}
+		folder = path.Dir(folder)
+	}
+}
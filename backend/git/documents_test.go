@@ -0,0 +1,51 @@
+package git
+
+import "testing"
+
+func TestEncodeDocument(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		file    string
+	}{
+		{"plain", "# Plan\n", "---\nid: 7\n---\n# Plan\n"},
+		{"empty", "", "---\nid: 7\n---\n"},
+		{"front matter", "---\ntags: [a]\n---\n# Plan\n", "---\nid: 7\ntags: [a]\n---\n# Plan\n"},
+		{"blank front matter", "---\n\n---\n# Plan\n", "---\nid: 7\n\n---\n# Plan\n"},
+		{"empty front matter", "---\n---\n# Plan\n", "---\nid: 7\n---\n---\n---\n# Plan\n"},
+		{"rule", "---\n# Plan\n", "---\nid: 7\n---\n---\n# Plan\n"},
+		{"rules", "---\n---\n", "---\nid: 7\n---\n---\n---\n"},
+		{"front matter of its own ID", "---\nid: 3\n---\nx", "---\nid: 7\nid: 3\n---\nx"},
+		{"no newline", "---", "---\nid: 7\n---\n---"},
+	}
+	for _, tt := range tests {
+		file := EncodeDocument("7", tt.content)
+		if file != tt.file {
+			t.Errorf("%s: EncodeDocument(%q) = %q, want %q", tt.name, tt.content, file, tt.file)
+		}
+		id, content := DecodeDocument(file)
+		if id != "7" || content != tt.content {
+			t.Errorf("%s: DecodeDocument(%q) = %q, %q, want 7, %q", tt.name, file, id, content, tt.content)
+		}
+	}
+}
+
+// Files written outside DocSmith may have no ID.
+func TestDecodeDocument(t *testing.T) {
+	tests := []struct {
+		file    string
+		id      string
+		content string
+	}{
+		{"# Plan\n", "", "# Plan\n"},
+		{"---\ntags: [a]\n---\n# Plan\n", "", "---\ntags: [a]\n---\n# Plan\n"},
+		{"---\nid: \"7\"\n---\n# Plan\n", "7", "# Plan\n"},
+		{"---\ntitle: Plan\nid: 7\n---\n", "7", "---\ntitle: Plan\n---\n"},
+		{"---\nid: 7\n# Plan\n", "", "---\nid: 7\n# Plan\n"},
+	}
+	for _, tt := range tests {
+		if id, content := DecodeDocument(tt.file); id != tt.id || content != tt.content {
+			t.Errorf("DecodeDocument(%q) = %q, %q, want %q, %q", tt.file, id, content, tt.id, tt.content)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+var (
+	// ErrInvalidDraftName is returned for names validRefName rejects.
+	ErrInvalidDraftName = errors.New("invalid draft name")
+	// ErrDraftExists is returned when creating a draft that already exists.
+	ErrDraftExists = errors.New("draft already exists")
+	// ErrDraftNotFound is returned for a draft that doesn't exist.
+	ErrDraftNotFound = errors.New("draft not found")
+)
+
+// Draft is a branch a document is edited on apart from the main line. It is
+// stored under drafts/<document id>/, and committed to without touching the
+// worktree.
+type Draft struct {
+	Name string `json:"name"`
+	Head Commit `json:"head"`
+}
+
+// DraftMerge is a preview of merging a draft into the main line.
+type DraftMerge struct {
+	// Base is the commit the draft and the main line last had in common.
+	Base  string `json:"base"`
+	Head  string `json:"head"`
+	Draft string `json:"draft"`
+	MergeResult
+}
+
+// draftPrefix is the namespace of a document's drafts.
+func draftPrefix(documentID string) string {
+	return fmt.Sprintf("drafts/%s/", documentID)
+}
+
+// DraftBranch is the branch of a draft, usable wherever a version is
+// expected.
+func DraftBranch(documentID string, name string) string {
+	return string(plumbing.NewBranchReferenceName(draftPrefix(documentID) + name))
+}
+
+// draftRef looks up the branch of a draft.
+func draftRef(r *git.Repository, documentID string, name string) (*plumbing.Reference, error) {
+	ref, err := r.Reference(plumbing.ReferenceName(DraftBranch(documentID, name)), true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrDraftNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get draft %s: %w", name, err)
+	}
+	return ref, nil
+}
+
+// ListDrafts returns a document's drafts, most recently changed first.
+func ListDrafts(repo *Repo, documentID string) ([]Draft, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+
+	refs, err := r.Branches()
+	if err != nil {
+		return nil, fmt.Errorf("list branches: %w", err)
+	}
+	defer refs.Close()
+
+	prefix := draftPrefix(documentID)
+	drafts := []Draft{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().Short()
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		commit, err := r.CommitObject(ref.Hash())
+		if err != nil {
+			return fmt.Errorf("read draft %s: %w", name, err)
+		}
+		drafts = append(drafts, Draft{Name: strings.TrimPrefix(name, prefix), Head: commitInfo(commit)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(drafts, func(i, j int) bool {
+		return drafts[i].Head.Timestamp.After(drafts[j].Head.Timestamp)
+	})
+	return drafts, nil
+}
+
+// CreateDraft forks a document into a new draft at a revision, which must
+// contain the document.
+func CreateDraft(repo *Repo, doc Document, name string, revision string) (*Draft, error) {
+	if !validRefName(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDraftName, name)
+	}
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	if _, err := draftRef(r, doc.ID, name); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDraftExists, name)
+	}
+
+	commit, err := commitWithDocument(r, doc, revision)
+	if err != nil {
+		return nil, err
+	}
+	branch := plumbing.NewHashReference(plumbing.ReferenceName(DraftBranch(doc.ID, name)), commit.Hash)
+	if err := r.Storer.SetReference(branch); err != nil {
+		return nil, fmt.Errorf("create branch: %w", err)
+	}
+	return &Draft{Name: name, Head: commitInfo(commit)}, nil
+}
+
+// GetDraft reads a document as of the head of a draft.
+func GetDraft(repo *Repo, doc Document, name string) (*Version, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	ref, err := draftRef(r, doc.ID, name)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	return versionOf(commit, doc)
+}
+
+// CommitDraft commits new content for a document to a draft. It returns the
+// new head of the draft, or the old one if the content didn't change.
+func CommitDraft(repo *Repo, doc Document, name string, content string, message string, author Author) (string, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return "", fmt.Errorf("git plain open: %w", err)
+	}
+	ref, err := draftRef(r, doc.ID, name)
+	if err != nil {
+		return "", err
+	}
+	head, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return "", fmt.Errorf("get commit object: %w", err)
+	}
+	tree, err := head.Tree()
+	if err != nil {
+		return "", fmt.Errorf("get tree: %w", err)
+	}
+
+	// keep the document wherever it is on the draft
+	path := doc.Path
+	if file, err := documentFile(head, doc); err == nil {
+		path = file.Name
+	}
+	treeHash, err := writeTreeWithFile(r.Storer, tree, path, EncodeDocument(doc.ID, content))
+	if err != nil {
+		return "", err
+	}
+	if treeHash == head.TreeHash {
+		return head.Hash.String(), nil
+	}
+
+	options := commitOptions(author)
+	commit := &object.Commit{
+		Author:       *options.Author,
+		Committer:    *options.Committer,
+		Message:      message,
+		TreeHash:     treeHash,
+		ParentHashes: []plumbing.Hash{head.Hash},
+	}
+	obj := r.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return "", fmt.Errorf("encode commit: %w", err)
+	}
+	hash, err := r.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return "", fmt.Errorf("store commit: %w", err)
+	}
+	if err := r.Storer.CheckAndSetReference(plumbing.NewHashReference(ref.Name(), hash), ref); err != nil {
+		return "", fmt.Errorf("update branch: %w", err)
+	}
+	committed(repo)
+	return hash.String(), nil
+}
+
+// DeleteDraft removes a draft's branch. Commits merged from it stay in the
+// history.
+func DeleteDraft(repo *Repo, documentID string, name string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return fmt.Errorf("git plain open: %w", err)
+	}
+	ref, err := draftRef(r, documentID, name)
+	if err != nil {
+		return err
+	}
+	return r.Storer.RemoveReference(ref.Name())
+}
+
+// DeleteDrafts removes every draft of a document, for when the document
+// itself is deleted.
+func DeleteDrafts(repo *Repo, documentID string) error {
+	drafts, err := ListDrafts(repo, documentID)
+	if err != nil {
+		return err
+	}
+	for _, draft := range drafts {
+		if err := DeleteDraft(repo, documentID, draft.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PreviewMerge three-way merges a draft into current, the document as it is
+// on the main line, without committing anything.
+func PreviewMerge(repo *Repo, doc Document, name string, current string) (*DraftMerge, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	ref, err := draftRef(r, doc.ID, name)
+	if err != nil {
+		return nil, err
+	}
+	draft, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	headRef, err := r.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head reference: %w", err)
+	}
+	head, err := r.CommitObject(headRef.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+
+	merge := &DraftMerge{Head: head.Hash.String(), Draft: draft.Hash.String()}
+	bases, err := head.MergeBase(draft)
+	if err != nil {
+		return nil, fmt.Errorf("find merge base: %w", err)
+	}
+
+	var base string
+	if len(bases) > 0 {
+		merge.Base = bases[0].Hash.String()
+		if base, err = contentAt(repo, doc, merge.Base); err != nil {
+			return nil, err
+		}
+	}
+	theirs, err := contentAt(repo, doc, merge.Draft)
+	if err != nil {
+		return nil, err
+	}
+
+	merge.MergeResult = Merge3(base, current, theirs, "current", "draft "+name)
+	return merge, nil
+}
+
+// MergeDraft commits content, a draft merged into the document, to the main
+// line as a merge commit with the draft's head as second parent.
+func MergeDraft(repo *Repo, doc Document, name string, content string, message string, author Author) (string, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return "", fmt.Errorf("git plain open: %w", err)
+	}
+	ref, err := draftRef(r, doc.ID, name)
+	if err != nil {
+		return "", err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return "", fmt.Errorf("get head reference: %w", err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("get worktree: %w", err)
+	}
+
+	if err := SaveDocument(repo, doc, content); err != nil {
+		return "", fmt.Errorf("save document: %w", err)
+	}
+	if _, err := w.Add(doc.Path); err != nil {
+		return "", fmt.Errorf("adding file %s: %w", doc.Path, err)
+	}
+
+	options := commitOptions(author)
+	options.Parents = []plumbing.Hash{head.Hash(), ref.Hash()}
+	// Record the merge even when the draft's changes were already in
+	options.AllowEmptyCommits = true
+	hash, err := w.Commit(message, options)
+	if err != nil {
+		return "", fmt.Errorf("committing merge: %w", err)
+	}
+	committed(repo)
+	return hash.String(), nil
+}
+
+// writeTreeWithFile stores a copy of tree with the file at path set to
+// content, and returns the new tree's hash. A nil tree is empty.
+func writeTreeWithFile(s storer.EncodedObjectStorer, tree *object.Tree, path string, content string) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	if tree != nil {
+		entries = append(entries, tree.Entries...)
+	}
+
+	var entry object.TreeEntry
+	if name, rest, nested := strings.Cut(path, "/"); nested {
+		var subtree *object.Tree
+		if tree != nil {
+			var err error
+			subtree, err = tree.Tree(name)
+			if err != nil && !errors.Is(err, object.ErrDirectoryNotFound) {
+				return plumbing.ZeroHash, fmt.Errorf("get tree %s: %w", name, err)
+			}
+		}
+		hash, err := writeTreeWithFile(s, subtree, rest, content)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entry = object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: hash}
+	} else {
+		blob := s.NewEncodedObject()
+		blob.SetType(plumbing.BlobObject)
+		writer, err := blob.Writer()
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("write blob: %w", err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("write blob: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("write blob: %w", err)
+		}
+		hash, err := s.SetEncodedObject(blob)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("store blob: %w", err)
+		}
+		entry = object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: hash}
+	}
+
+	replaced := false
+	for i := range entries {
+		if entries[i].Name == entry.Name {
+			entries[i] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		entries = append(entries, entry)
+	}
+	// git orders entries by name, with directories sorting as if they ended
+	// in a slash
+	sortKey := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortKey(entries[i]) < sortKey(entries[j])
+	})
+
+	obj := s.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("encode tree: %w", err)
+	}
+	hash, err := s.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("store tree: %w", err)
+	}
+	return hash, nil
+}
@@ -0,0 +1,254 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ExternalChanges are changes to the repository made outside DocSmith, such
+// as commits made by hand.
+type ExternalChanges struct {
+	Head    string        `json:"head"`
+	Commits []Commit      `json:"commits"`
+	Files   []ChangedFile `json:"files"`
+}
+
+// Head returns the hash of the commit HEAD points at.
+func Head(repo *Repo) (string, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return "", fmt.Errorf("git plain open: %w", err)
+	}
+	ref, err := r.Head()
+	if err != nil {
+		return "", fmt.Errorf("get head reference: %w", err)
+	}
+	return ref.Hash().String(), nil
+}
+
+// ExternalCommits finds the commits added to HEAD since a commit that
+// DocSmith didn't make, recognised by their committer, and the markdown
+// files they changed. Each file's OldContent is as of since and its Content
+// as of HEAD.
+func ExternalCommits(repo *Repo, since string) (*ExternalChanges, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	ref, err := r.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head reference: %w", err)
+	}
+	changes := &ExternalChanges{Head: ref.Hash().String(), Commits: []Commit{}, Files: []ChangedFile{}}
+	if changes.Head == since {
+		return changes, nil
+	}
+
+	head, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	// since may be gone if history was rewritten; then everything is new
+	sinceCommit, err := r.CommitObject(plumbing.NewHash(since))
+	if err != nil && !errors.Is(err, plumbing.ErrObjectNotFound) {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+
+	touched := make(map[string]bool)
+	seen := make(map[plumbing.Hash]bool)
+	queue := []*object.Commit{head}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if seen[c.Hash] {
+			continue
+		}
+		seen[c.Hash] = true
+		if sinceCommit != nil {
+			if old, err := c.IsAncestor(sinceCommit); err != nil || old {
+				continue
+			}
+		}
+
+		if c.Committer.Email != SystemAuthor.Email {
+			changes.Commits = append(changes.Commits, commitInfo(c))
+			paths, err := commitPaths(c)
+			if err != nil {
+				return nil, err
+			}
+			for _, path := range paths {
+				touched[path] = true
+			}
+		}
+		err := c.Parents().ForEach(func(parent *object.Commit) error {
+			queue = append(queue, parent)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("get parents: %w", err)
+		}
+	}
+
+	var sinceTree *object.Tree
+	if sinceCommit != nil {
+		if sinceTree, err = sinceCommit.Tree(); err != nil {
+			return nil, fmt.Errorf("get tree: %w", err)
+		}
+	}
+	headTree, err := head.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+	for path := range touched {
+		if !strings.HasSuffix(path, ".md") {
+			continue
+		}
+		oldContent, _, err := treeFile(sinceTree, path)
+		if err != nil {
+			return nil, err
+		}
+		content, exists, err := treeFile(headTree, path)
+		if err != nil {
+			return nil, err
+		}
+		changes.Files = append(changes.Files, ChangedFile{Path: path, OldContent: oldContent, Content: content, Deleted: !exists})
+	}
+	sort.Slice(changes.Files, func(i, j int) bool {
+		return changes.Files[i].Path < changes.Files[j].Path
+	})
+	return changes, nil
+}
+
+// commitPaths lists the files a commit changed from its first parent.
+func commitPaths(c *object.Commit) ([]string, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+	var parentTree *object.Tree
+	if c.NumParents() > 0 {
+		parent, err := c.Parent(0)
+		if err != nil {
+			return nil, fmt.Errorf("get parent: %w", err)
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return nil, fmt.Errorf("get tree: %w", err)
+		}
+	}
+	diff, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, fmt.Errorf("diff trees: %w", err)
+	}
+	var paths []string
+	for _, change := range diff {
+		if change.From.Name != "" {
+			paths = append(paths, change.From.Name)
+		}
+		if change.To.Name != "" && change.To.Name != change.From.Name {
+			paths = append(paths, change.To.Name)
+		}
+	}
+	return paths, nil
+}
+
+// WorktreeChanges lists the markdown files in the worktree that differ from
+// HEAD. Each file's OldContent is as of HEAD and its Content as on disk.
+func WorktreeChanges(repo *Repo) ([]ChangedFile, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("get worktree: %w", err)
+	}
+	status, err := w.Status()
+	if err != nil {
+		return nil, fmt.Errorf("get status: %w", err)
+	}
+	ref, err := r.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head reference: %w", err)
+	}
+	head, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	tree, err := head.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+
+	files := []ChangedFile{}
+	for path, fileStatus := range status {
+		if !strings.HasSuffix(path, ".md") || fileStatus.Worktree == git.Unmodified && fileStatus.Staging == git.Unmodified {
+			continue
+		}
+		oldContent, _, err := treeFile(tree, path)
+		if err != nil {
+			return nil, err
+		}
+		content, err := os.ReadFile(filepath.Join(repo.Path, filepath.FromSlash(path)))
+		if os.IsNotExist(err) {
+			files = append(files, ChangedFile{Path: path, OldContent: oldContent, Deleted: true})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read file %s: %w", path, err)
+		}
+		files = append(files, ChangedFile{Path: path, OldContent: oldContent, Content: string(content)})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+// CommitPaths commits the current state of some files, given relative to the
+// repository, leaving other changes in the worktree alone. Deleted files are
+// committed as deletions, and co-authors are recorded as Co-authored-by
+// trailers. It returns the new commit hash, or the HEAD hash if the files
+// had no changes.
+func CommitPaths(repo *Repo, paths []string, message string, author Author, coAuthors []Author) (string, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return "", fmt.Errorf("git plain open: %w", err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("get worktree: %w", err)
+	}
+	for _, path := range paths {
+		if _, err := w.Add(path); err != nil {
+			return "", fmt.Errorf("adding file %s: %w", path, err)
+		}
+	}
+
+	hash, err := w.Commit(withCoAuthors(message, coAuthors), commitOptions(author))
+	if errors.Is(err, git.ErrEmptyCommit) {
+		ref, err := r.Head()
+		if err != nil {
+			return "", fmt.Errorf("get head reference: %w", err)
+		}
+		return ref.Hash().String(), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("committing changes: %w", err)
+	}
+	committed(repo)
+	return hash.String(), nil
+}
@@ -1,9 +1,12 @@
 package git
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/go-git/go-git/v5"
@@ -12,13 +15,99 @@ import (
 )
 
 type Commit struct {
-	Hash      string    `json:"hash"`
-	Message   string    `json:"message"`
-	Author    string    `json:"author"`
-	Timestamp time.Time `json:"timestamp"`
+	Hash        string    `json:"hash"`
+	Message     string    `json:"message"`
+	Author      string    `json:"author"`
+	AuthorEmail string    `json:"author_email"`
+	// CoAuthors are read from the message's Co-authored-by trailers.
+	CoAuthors   []Author  `json:"co_authors,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	// Path is where the document was, in a document's history.
+	Path        string    `json:"path,omitempty"`
 }
 
-func InitRepo(repoPath string) error {
+// Author identifies who a commit is attributed to.
+type Author struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// SystemAuthor commits on behalf of DocSmith itself, and is the committer of
+// every commit made for a user.
+var SystemAuthor = Author{Name: "DocSmith", Email: "docsmith@example.com"}
+
+// ErrVersionNotFound is returned for a revision that names no commit.
+var ErrVersionNotFound = errors.New("version not found")
+
+// resolveCommit finds the commit a revision names: a full or abbreviated
+// hash, or a reference.
+func resolveCommit(r *git.Repository, revision string) (*object.Commit, error) {
+	hash, err := r.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrVersionNotFound, revision)
+	}
+	commit, err := r.CommitObject(*hash)
+	if err == plumbing.ErrObjectNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrVersionNotFound, revision)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	return commit, nil
+}
+
+const coAuthorTrailer = "Co-authored-by: "
+
+// withCoAuthors appends a Co-authored-by trailer for each co-author.
+func withCoAuthors(message string, coAuthors []Author) string {
+	if len(coAuthors) == 0 {
+		return message
+	}
+	var trailers []string
+	for _, co := range coAuthors {
+		trailers = append(trailers, fmt.Sprintf("%s%s <%s>", coAuthorTrailer, co.Name, co.Email))
+	}
+	return strings.TrimRight(message, "\n") + "\n\n" + strings.Join(trailers, "\n")
+}
+
+// ParseCoAuthors reads the Co-authored-by trailers of a commit message.
+func ParseCoAuthors(message string) []Author {
+	var coAuthors []Author
+	for _, line := range strings.Split(message, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, coAuthorTrailer) {
+			continue
+		}
+		name, email, ok := strings.Cut(strings.TrimPrefix(line, coAuthorTrailer), "<")
+		if !ok {
+			continue
+		}
+		coAuthors = append(coAuthors, Author{
+			Name:  strings.TrimSpace(name),
+			Email: strings.TrimSuffix(strings.TrimSpace(email), ">"),
+		})
+	}
+	return coAuthors
+}
+
+// commitOptions authors a commit as author, committed by DocSmith.
+func commitOptions(author Author) *git.CommitOptions {
+	now := time.Now()
+	return &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  author.Name,
+			Email: author.Email,
+			When:  now,
+		},
+		Committer: &object.Signature{
+			Name:  SystemAuthor.Name,
+			Email: SystemAuthor.Email,
+			When:  now,
+		},
+	}
+}
+
+func initRepo(repoPath string) error {
 	_, err := os.Stat(filepath.Join(repoPath, ".git"))
 	if os.IsNotExist(err) {
 		_, err = git.PlainInit(repoPath, false)
@@ -48,120 +137,70 @@ func createInitialCommit(repoPath string) error {
 	if err != nil {
 		return err
 	}
-	_, err = w.Add("READNE.md")
+	_, err = w.Add("README.md")
 	if err != nil{
 		return err
 	}
 
-	_, err = w.Commit("Initial commit", &git.CommitOptions{
-		Author: &object.Signature {
-			Name: "DocSmith",
-			Email: "docsmith@example.com",
-			When: time.Now(),
-		},
-	})
+	_, err = w.Commit("Initial commit", commitOptions(SystemAuthor))
 	return err
 }
 
-func SaveDocument(docPath string, content string) error {
-	return os.WriteFile(docPath, []byte(content), 0644)
+// SaveDocument writes a document's file, with its ID in the front matter.
+func SaveDocument(repo *Repo, doc Document, content string) error {
+	docPath := repo.DocumentPath(doc)
+	if err := os.MkdirAll(filepath.Dir(docPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(docPath, []byte(EncodeDocument(doc.ID, content)), 0644)
 }
 
-func DeleteDocument(docPath string) error {
+// DeleteDocument removes a document's file, and any folders that leaves
+// empty.
+func DeleteDocument(repo *Repo, doc Document) error {
+	docPath := repo.DocumentPath(doc)
 	_, err := os.Stat(docPath)
 	if os.IsNotExist(err) {
 		return nil
 	}
-	return os.Remove(docPath)
-}
-
-func CommitChanges(repoPath string, message string) error {
-    // Check if the repo path exists
-    if _, err := os.Stat(repoPath); os.IsNotExist(err) {
-        return fmt.Errorf("repository path does not exist: %s", repoPath)
-    }
-
-    // Open the repository
-    r, err := git.PlainOpen(repoPath)
-    if err != nil {
-        return fmt.Errorf("failed to open git repository: %w", err)
-    }
-
-    // Get worktree
-    w, err := r.Worktree()
-    if err != nil {
-        return fmt.Errorf("failed to get worktree: %w", err)
-    }
-
-    // Check status
-    status, err := w.Status()
-    if err != nil {
-        return fmt.Errorf("failed to get git status: %w", err)
-    }
-
-    // If no changes, return early
-    if status.IsClean() {
-        return nil
-    }
-
-    // Add files
-    for file := range status {
-        _, err = w.Add(file)
-        if err != nil {
-            return fmt.Errorf("failed to add file %s: %w", file, err)
-        }
-    }
-
-    // Commit
-    _, err = w.Commit(message, &git.CommitOptions{
-        Author: &object.Signature{
-            Name:  "DocSmith",
-            Email: "docsmith@example.com",
-            When:  time.Now(),
-        },
-    })
-    if err != nil {
-        return fmt.Errorf("failed to commit: %w", err)
-    }
-
-    return nil
+	if err := os.Remove(docPath); err != nil {
+		return err
+	}
+	removeEmptyFolders(repo, path.Dir(doc.Path))
+	return nil
 }
 
-func GetDocumentHistory(repoPath string, docPath string) ([]Commit, error) {
-	var commits []Commit
-	
-	r, err := git.PlainOpen(repoPath)
+func GetDocumentContentAtVersion(repo *Repo, doc Document, commitHash string) (string, error) {
+	r, err := git.PlainOpen(repo.Path)
 	if err != nil {
-		return commits, err
+		return "", fmt.Errorf("git plain open: %w", err)
 	}
 
-	relativePath, err := filepath.Rel(repoPath, docPath)
+	// Get the commit
+	hash := plumbing.NewHash(commitHash)
+	commit, err := r.CommitObject(hash)
 	if err != nil {
-		return commits, err
+		return "", fmt.Errorf("get commit object: %w", err)
 	}
 
-	cIter, err := r.Log(&git.LogOptions{FileName: &relativePath}) 
+	// Get the file from that commit, wherever the document was then
+	file, err := documentFile(commit, doc)
 	if err != nil {
-		return commits, err
+		return "", fmt.Errorf("get file at commit: %w", err)
 	}
 
-	err = cIter.ForEach(func(c *object.Commit) error {
-		commits = append(commits, Commit {
-			Hash: c.Hash.String(),
-			Message: c.Message,
-			Author: c.Author.Name,
-			Timestamp: c.Author.When,
-		})
-		return nil
-	})
-
-	return commits, err
+	return documentContent(file)
 }
 
-// Add these new functions to the git.go file
+// CommitDocumentAs commits the current state of a single document file,
+// leaving other changes in the worktree alone. Co-authors are recorded as
+// Co-authored-by trailers. It returns the new commit hash, or the HEAD hash
+// if the document had no changes.
+func CommitDocumentAs(repo *Repo, doc Document, message string, author Author, coAuthors []Author) (string, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
 
-func CommitChangesWithHash(repoPath string, message string) (string, error) {
-	r, err := git.PlainOpen(repoPath)
+	r, err := git.PlainOpen(repo.Path)
 	if err != nil {
 		return "", fmt.Errorf("git plain open: %w", err)
 	}
@@ -175,10 +214,7 @@ func CommitChangesWithHash(repoPath string, message string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("get status: %w", err)
 	}
-
-	if len(status) == 0 {
-		// No changes to commit
-		// Get HEAD hash
+	if fileStatus, ok := status[doc.Path]; !ok || fileStatus.Worktree == git.Unmodified && fileStatus.Staging == git.Unmodified {
 		ref, err := r.Head()
 		if err != nil {
 			return "", fmt.Errorf("get head reference: %w", err)
@@ -186,57 +222,15 @@ func CommitChangesWithHash(repoPath string, message string) (string, error) {
 		return ref.Hash().String(), nil
 	}
 
-	for file := range status {
-		_, err = w.Add(file)
-		if err != nil {
-			return "", fmt.Errorf("adding file %s: %w", file, err)
-		}
+	if _, err := w.Add(doc.Path); err != nil {
+		return "", fmt.Errorf("adding file %s: %w", doc.Path, err)
 	}
 
-	hash, err := w.Commit(message, &git.CommitOptions{
-		Author: &object.Signature{
-			Name:  "DocSmith",
-			Email: "docsmith@example.com",
-			When:  time.Now(),
-		},
-	})
-	
+	hash, err := w.Commit(withCoAuthors(message, coAuthors), commitOptions(author))
 	if err != nil {
 		return "", fmt.Errorf("committing changes: %w", err)
 	}
-	
+	committed(repo)
+
 	return hash.String(), nil
 }
-
-func GetDocumentContentAtVersion(repoPath string, docPath string, commitHash string) (string, error) {
-	r, err := git.PlainOpen(repoPath)
-	if err != nil {
-		return "", fmt.Errorf("git plain open: %w", err)
-	}
-
-	// Get the commit
-	hash := plumbing.NewHash(commitHash)
-	commit, err := r.CommitObject(hash)
-	if err != nil {
-		return "", fmt.Errorf("get commit object: %w", err)
-	}
-
-	// Get the file from that commit
-	relativePath, err := filepath.Rel(repoPath, docPath)
-	if err != nil {
-		return "", fmt.Errorf("get relative path: %w", err)
-	}
-
-	file, err := commit.File(relativePath)
-	if err != nil {
-		return "", fmt.Errorf("get file at commit: %w", err)
-	}
-
-	// Get the content
-	content, err := file.Contents()
-	if err != nil {
-		return "", fmt.Errorf("get file contents: %w", err)
-	}
-
-	return content, nil
-}
\ No newline at end of file
@@ -0,0 +1,160 @@
+package git
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// HistoryCommit is a commit with the documents it changed, as the history
+// index keeps it.
+type HistoryCommit struct {
+	Commit
+	// Documents maps the ID of each document the commit changed from its
+	// first parent to the document's path after the change. Documents it
+	// deleted aren't included.
+	Documents map[string]string
+}
+
+// HistoryWalk is the history added since the commits already known.
+type HistoryWalk struct {
+	Head string
+	// Commits are the commits walked, each after its parents.
+	Commits []HistoryCommit
+	// Reached are the known commits the walk stopped at.
+	Reached []string
+}
+
+// legacyName matches the files documents were kept in before files were
+// named after titles.
+var legacyName = regexp.MustCompile(`^([0-9]+)\.md$`)
+
+// HistorySince walks history back from HEAD, including merged drafts, as
+// far as the commits known reports true for. It lists the commits on the
+// way, as a document's history would, with the documents each changed.
+func HistorySince(repo *Repo, known func(hash string) (bool, error)) (*HistoryWalk, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	ref, err := r.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head reference: %w", err)
+	}
+	walk := &HistoryWalk{Head: ref.Hash().String(), Commits: []HistoryCommit{}, Reached: []string{}}
+
+	// the commits that aren't known yet
+	commits := make(map[plumbing.Hash]*object.Commit)
+	queue := []plumbing.Hash{ref.Hash()}
+	checked := make(map[plumbing.Hash]bool)
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		if checked[hash] {
+			continue
+		}
+		checked[hash] = true
+		isKnown, err := known(hash.String())
+		if err != nil {
+			return nil, err
+		}
+		if isKnown {
+			walk.Reached = append(walk.Reached, hash.String())
+			continue
+		}
+		c, err := r.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("get commit object: %w", err)
+		}
+		commits[hash] = c
+		queue = append(queue, c.ParentHashes...)
+	}
+
+	// parents first, and otherwise in the order they were committed
+	var ordered []*object.Commit
+	for _, c := range commits {
+		ordered = append(ordered, c)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].Committer.When.Before(ordered[j].Committer.When)
+	})
+	added := make(map[plumbing.Hash]bool)
+	for len(added) < len(ordered) {
+		for _, c := range ordered {
+			if added[c.Hash] {
+				continue
+			}
+			ready := true
+			for _, parent := range c.ParentHashes {
+				if _, ok := commits[parent]; ok && !added[parent] {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+			added[c.Hash] = true
+			documents, err := changedDocuments(c)
+			if err != nil {
+				return nil, err
+			}
+			walk.Commits = append(walk.Commits, HistoryCommit{Commit: commitInfo(c), Documents: documents})
+		}
+	}
+	return walk, nil
+}
+
+// changedDocuments finds the documents a commit changed from its first
+// parent, by the ID in their front matter or, for files from before that,
+// their name.
+func changedDocuments(c *object.Commit) (map[string]string, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+	var parentTree *object.Tree
+	if c.NumParents() > 0 {
+		parent, err := c.Parent(0)
+		if err != nil {
+			return nil, fmt.Errorf("get parent: %w", err)
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return nil, fmt.Errorf("get tree: %w", err)
+		}
+	}
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, fmt.Errorf("diff trees: %w", err)
+	}
+
+	documents := make(map[string]string)
+	for _, change := range changes {
+		name := change.To.Name
+		if name == "" || !strings.HasSuffix(name, ".md") {
+			continue
+		}
+		file, err := tree.File(name)
+		if err != nil {
+			return nil, fmt.Errorf("get file %s: %w", name, err)
+		}
+		id, err := fileDocumentID(file)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			if m := legacyName.FindStringSubmatch(name); m != nil {
+				id = m[1]
+			}
+		}
+		if id != "" {
+			documents[id] = name
+		}
+	}
+	return documents, nil
+}
@@ -0,0 +1,189 @@
+package git
+
+import (
+	"strings"
+
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Conflict markers, as git writes them.
+const (
+	conflictStart     = "<<<<<<< "
+	conflictSeparator = "======="
+	conflictEnd       = ">>>>>>> "
+)
+
+// MergeResult is the outcome of a three-way merge. Content holds conflict
+// markers for every region both sides changed differently.
+type MergeResult struct {
+	Content   string     `json:"content"`
+	Conflicts []Conflict `json:"conflicts"`
+}
+
+// Conflict is a region both sides of a merge changed. Line is where its
+// start marker is in the merged content, counting from 1.
+type Conflict struct {
+	Line   int    `json:"line"`
+	Base   string `json:"base"`
+	Ours   string `json:"ours"`
+	Theirs string `json:"theirs"`
+}
+
+// HasConflictMarkers reports whether content still has a conflict from a
+// merge in it.
+func HasConflictMarkers(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, conflictStart) || strings.HasPrefix(line, conflictEnd) {
+			return true
+		}
+	}
+	return false
+}
+
+// change replaces base lines [start, end) with lines.
+type change struct {
+	start int
+	end   int
+	lines []string
+}
+
+// Merge3 merges the changes ours and theirs each made to base, line by line.
+// Regions both changed differently are left as conflicts, labelled with
+// oursLabel and theirsLabel.
+func Merge3(base string, ours string, theirs string, oursLabel string, theirsLabel string) MergeResult {
+	baseLines := lineSlice(base)
+	a := changes(base, ours)
+	b := changes(base, theirs)
+
+	var out []string
+	result := MergeResult{Conflicts: []Conflict{}}
+	pos := 0
+	for len(a) > 0 || len(b) > 0 {
+		// Take the next change and every change on either side overlapping
+		// or touching it.
+		start := nextStart(a, b)
+		end := start
+		var groupA, groupB []change
+		for grew := true; grew; {
+			grew = false
+			for len(a) > 0 && a[0].start <= end {
+				end = max(end, a[0].end)
+				groupA, a = append(groupA, a[0]), a[1:]
+				grew = true
+			}
+			for len(b) > 0 && b[0].start <= end {
+				end = max(end, b[0].end)
+				groupB, b = append(groupB, b[0]), b[1:]
+				grew = true
+			}
+		}
+
+		out = append(out, baseLines[pos:start]...)
+		pos = end
+		oursLines := applyChanges(baseLines, start, end, groupA)
+		theirsLines := applyChanges(baseLines, start, end, groupB)
+		switch {
+		case len(groupB) == 0:
+			out = append(out, oursLines...)
+		case len(groupA) == 0, equalLines(oursLines, theirsLines):
+			out = append(out, theirsLines...)
+		default:
+			result.Conflicts = append(result.Conflicts, Conflict{
+				Line:   len(out) + 1,
+				Base:   strings.Join(baseLines[start:end], ""),
+				Ours:   strings.Join(oursLines, ""),
+				Theirs: strings.Join(theirsLines, ""),
+			})
+			out = append(out, conflictStart+oursLabel+"\n")
+			out = append(out, terminated(oursLines)...)
+			out = append(out, conflictSeparator+"\n")
+			out = append(out, terminated(theirsLines)...)
+			out = append(out, conflictEnd+theirsLabel+"\n")
+		}
+	}
+	out = append(out, baseLines[pos:]...)
+
+	result.Content = strings.Join(out, "")
+	return result
+}
+
+// lineSlice splits text into lines, each keeping its newline.
+func lineSlice(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// changes lists what to replace in base to get to other, in order.
+func changes(base string, other string) []change {
+	var list []change
+	var current *change
+	pos := 0
+	for _, d := range diff.Do(base, other) {
+		lines := lineSlice(d.Text)
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			if current != nil {
+				list = append(list, *current)
+				current = nil
+			}
+			pos += len(lines)
+		case diffmatchpatch.DiffDelete:
+			if current == nil {
+				current = &change{start: pos, end: pos}
+			}
+			pos += len(lines)
+			current.end = pos
+		case diffmatchpatch.DiffInsert:
+			if current == nil {
+				current = &change{start: pos, end: pos}
+			}
+			current.lines = append(current.lines, lines...)
+		}
+	}
+	if current != nil {
+		list = append(list, *current)
+	}
+	return list
+}
+
+func nextStart(a []change, b []change) int {
+	switch {
+	case len(a) == 0:
+		return b[0].start
+	case len(b) == 0:
+		return a[0].start
+	default:
+		return min(a[0].start, b[0].start)
+	}
+}
+
+// applyChanges is base lines [start, end) with changes made.
+func applyChanges(base []string, start int, end int, changes []change) []string {
+	lines := []string{}
+	pos := start
+	for _, c := range changes {
+		lines = append(lines, base[pos:c.start]...)
+		lines = append(lines, c.lines...)
+		pos = c.end
+	}
+	return append(lines, base[pos:end]...)
+}
+
+func equalLines(a []string, b []string) bool {
+	return strings.Join(a, "") == strings.Join(b, "")
+}
+
+// terminated makes sure the last line ends in a newline, so a conflict
+// marker can follow it.
+func terminated(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+	out := append([]string{}, lines...)
+	out[len(out)-1] += "\n"
+	return out
+}
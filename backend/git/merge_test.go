@@ -0,0 +1,130 @@
+package git
+
+import "testing"
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		ours      string
+		theirs    string
+		want      string
+		conflicts []Conflict
+	}{
+		{
+			name:   "changes to different lines",
+			base:   "one\ntwo\nthree\nfour\nfive\n",
+			ours:   "ONE\ntwo\nthree\nfour\nfive\n",
+			theirs: "one\ntwo\nthree\nfour\nFIVE\n",
+			want:   "ONE\ntwo\nthree\nfour\nFIVE\n",
+		},
+		{
+			name:   "lines added and removed apart",
+			base:   "one\ntwo\nthree\nfour\nfive\n",
+			ours:   "one\ntwo and a half\ntwo\nthree\nfour\nfive\n",
+			theirs: "one\ntwo\nthree\nfive\n",
+			want:   "one\ntwo and a half\ntwo\nthree\nfive\n",
+		},
+		{
+			name:   "only one side changed",
+			base:   "one\ntwo\n",
+			ours:   "one\ntwo\n",
+			theirs: "one\n2\n",
+			want:   "one\n2\n",
+		},
+		{
+			name:   "the same line changed differently",
+			base:   "one\ntwo\nthree\n",
+			ours:   "one\nours\nthree\n",
+			theirs: "one\ntheirs\nthree\n",
+			want:   "one\n<<<<<<< local\nours\n=======\ntheirs\n>>>>>>> remote\nthree\n",
+			conflicts: []Conflict{
+				{Line: 2, Base: "two\n", Ours: "ours\n", Theirs: "theirs\n"},
+			},
+		},
+		{
+			name:   "the same change on both sides",
+			base:   "one\ntwo\nthree\n",
+			ours:   "one\n2\nthree\nfour\n",
+			theirs: "one\n2\nthree\nfour\n",
+			want:   "one\n2\nthree\nfour\n",
+		},
+		{
+			name:   "changes at the start and end of the file",
+			base:   "one\ntwo\nthree\n",
+			ours:   "zero\none\ntwo\nthree\n",
+			theirs: "one\ntwo\nthree\nfour\n",
+			want:   "zero\none\ntwo\nthree\nfour\n",
+		},
+		{
+			name:   "both add to the end",
+			base:   "one\n",
+			ours:   "one\nours\n",
+			theirs: "one\ntheirs\n",
+			want:   "one\n<<<<<<< local\nours\n=======\ntheirs\n>>>>>>> remote\n",
+			conflicts: []Conflict{
+				{Line: 2, Base: "", Ours: "ours\n", Theirs: "theirs\n"},
+			},
+		},
+		{
+			name:   "no trailing newline, changed away from the end",
+			base:   "one\ntwo\nthree",
+			ours:   "ONE\ntwo\nthree",
+			theirs: "one\ntwo\nthree!",
+			want:   "ONE\ntwo\nthree!",
+		},
+		{
+			name:   "a trailing newline added on one side",
+			base:   "one\ntwo\nthree",
+			ours:   "ONE\ntwo\nthree",
+			theirs: "one\ntwo\nthree\n",
+			want:   "ONE\ntwo\nthree\n",
+		},
+		{
+			name:   "no trailing newline, last line in conflict",
+			base:   "one\ntwo",
+			ours:   "one\nours",
+			theirs: "one\ntheirs",
+			want:   "one\n<<<<<<< local\nours\n=======\ntheirs\n>>>>>>> remote\n",
+			conflicts: []Conflict{
+				{Line: 2, Base: "two", Ours: "ours", Theirs: "theirs"},
+			},
+		},
+		{
+			name:   "lines added to an empty file on one side",
+			base:   "",
+			ours:   "one\n",
+			theirs: "",
+			want:   "one\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Merge3(tt.base, tt.ours, tt.theirs, "local", "remote")
+			if result.Content != tt.want {
+				t.Errorf("merged to %q, want %q", result.Content, tt.want)
+			}
+			if len(result.Conflicts) != len(tt.conflicts) {
+				t.Fatalf("got conflicts %+v, want %+v", result.Conflicts, tt.conflicts)
+			}
+			for i, c := range result.Conflicts {
+				if c != tt.conflicts[i] {
+					t.Errorf("conflict %d is %+v, want %+v", i, c, tt.conflicts[i])
+				}
+			}
+			if got := HasConflictMarkers(result.Content); got != (len(tt.conflicts) > 0) {
+				t.Errorf("HasConflictMarkers = %v with %d conflicts", got, len(tt.conflicts))
+			}
+
+			// Merging is symmetric, but for which side's text comes first
+			swapped := Merge3(tt.base, tt.theirs, tt.ours, "remote", "local")
+			if len(swapped.Conflicts) != len(tt.conflicts) {
+				t.Errorf("swapped sides, got %d conflicts, want %d", len(swapped.Conflicts), len(tt.conflicts))
+			}
+			if len(tt.conflicts) == 0 && swapped.Content != tt.want {
+				t.Errorf("swapped sides, merged to %q, want %q", swapped.Content, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,442 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// ErrPullConflict is returned when a pull can't be merged because both the
+// remote and the local repository changed the same lines of a document.
+var ErrPullConflict = errors.New("remote changes conflict with local changes")
+
+// Remote is a git server the repository is synced with. Credentials are
+// kept by the server and never written to the repository's config.
+type Remote struct {
+	Name string
+	URL  string
+	// Username and Password authenticate over HTTP. Password may be an
+	// access token.
+	Username string
+	Password string
+	// SSHKeyPath is a private key authenticating over SSH, as Username or
+	// "git". KnownHostsPath checks the server's key, defaulting to the
+	// user's known_hosts.
+	SSHKeyPath       string
+	SSHKeyPassphrase string
+	KnownHostsPath   string
+	// SSHKey and KnownHosts are the same given as their contents, and are
+	// used instead when set.
+	SSHKey     string
+	KnownHosts string
+}
+
+// PullResult describes what a pull changed in the local repository.
+type PullResult struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Changed []ChangedFile `json:"changed"`
+}
+
+// ChangedFile is a file a pull changed, with its content before and after.
+type ChangedFile struct {
+	Path       string `json:"path"`
+	OldContent string `json:"-"`
+	Content    string `json:"-"`
+	Deleted    bool   `json:"deleted,omitempty"`
+}
+
+// usesSSH reports whether a remote URL is reached over SSH, either as
+// ssh://host/path or as the scp-like user@host:path.
+func usesSSH(url string) bool {
+	if strings.HasPrefix(url, "ssh://") {
+		return true
+	}
+	return !strings.Contains(url, "://") && strings.Contains(url, "@") && strings.Contains(url, ":")
+}
+
+// auth is how to authenticate with the remote, or nil for none.
+func (remote Remote) auth() (transport.AuthMethod, error) {
+	switch {
+	case usesSSH(remote.URL) && (remote.SSHKeyPath != "" || remote.SSHKey != ""):
+		user := remote.Username
+		if user == "" {
+			user = "git"
+		}
+		var keys *ssh.PublicKeys
+		var err error
+		if remote.SSHKey != "" {
+			keys, err = ssh.NewPublicKeys(user, []byte(remote.SSHKey), remote.SSHKeyPassphrase)
+		} else {
+			keys, err = ssh.NewPublicKeysFromFile(user, remote.SSHKeyPath, remote.SSHKeyPassphrase)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("load ssh key: %w", err)
+		}
+		if remote.KnownHosts != "" || remote.KnownHostsPath != "" {
+			path, done, err := remote.knownHostsFile()
+			if err != nil {
+				return nil, fmt.Errorf("load known hosts: %w", err)
+			}
+			// The callback reads the hosts up front, so the file needn't
+			// outlive it
+			callback, err := ssh.NewKnownHostsCallback(path)
+			done()
+			if err != nil {
+				return nil, fmt.Errorf("load known hosts: %w", err)
+			}
+			keys.HostKeyCallback = callback
+		}
+		return keys, nil
+	case strings.HasPrefix(remote.URL, "http://") || strings.HasPrefix(remote.URL, "https://"):
+		if remote.Username == "" && remote.Password == "" {
+			return nil, nil
+		}
+		return &http.BasicAuth{Username: remote.Username, Password: remote.Password}, nil
+	}
+	return nil, nil
+}
+
+// knownHostsFile is a file of the hosts to trust: KnownHostsPath, or else
+// KnownHosts written to a temporary file, which done removes.
+func (remote Remote) knownHostsFile() (path string, done func(), err error) {
+	if remote.KnownHosts == "" {
+		return remote.KnownHostsPath, func() {}, nil
+	}
+	file, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return "", nil, err
+	}
+	done = func() { os.Remove(file.Name()) }
+	_, err = file.WriteString(remote.KnownHosts)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		done()
+		return "", nil, err
+	}
+	return file.Name(), done, nil
+}
+
+// Check reports whether the remote's credentials can be loaded.
+func (remote Remote) Check() error {
+	_, err := remote.auth()
+	return err
+}
+
+// AddRemote configures a remote in the repository, replacing its URL if it
+// already exists.
+func AddRemote(repo *Repo, remote Remote) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return fmt.Errorf("git plain open: %w", err)
+	}
+	err = r.DeleteRemote(remote.Name)
+	if err != nil && !errors.Is(err, git.ErrRemoteNotFound) {
+		return fmt.Errorf("delete remote: %w", err)
+	}
+	_, err = r.CreateRemote(&config.RemoteConfig{
+		Name:  remote.Name,
+		URLs:  []string{remote.URL},
+		Fetch: []config.RefSpec{config.RefSpec(fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", remote.Name))},
+	})
+	if err != nil {
+		return fmt.Errorf("create remote: %w", err)
+	}
+	return nil
+}
+
+// Push sends every branch and tag to the remote. It fails if the remote has
+// commits the repository doesn't; pull first.
+func Push(repo *Repo, remote Remote) error {
+	auth, err := remote.auth()
+	if err != nil {
+		return err
+	}
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return fmt.Errorf("git plain open: %w", err)
+	}
+	err = r.Push(&git.PushOptions{
+		RemoteName: remote.Name,
+		Auth:       auth,
+		RefSpecs: []config.RefSpec{
+			"refs/heads/*:refs/heads/*",
+			"refs/tags/*:refs/tags/*",
+		},
+	})
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("push to %s: %w", remote.Name, err)
+	}
+	return nil
+}
+
+// Pull fetches the remote and merges its copy of the current branch. Files
+// both sides changed are merged line by line; if any conflict, nothing is
+// merged and ErrPullConflict is returned. A merge commit is only made when
+// both sides have new commits.
+func Pull(repo *Repo, remote Remote) (*PullResult, error) {
+	auth, err := remote.auth()
+	if err != nil {
+		return nil, err
+	}
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	err = r.Fetch(&git.FetchOptions{RemoteName: remote.Name, Auth: auth})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return nil, fmt.Errorf("fetch from %s: %w", remote.Name, err)
+	}
+
+	headRef, err := r.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head reference: %w", err)
+	}
+	result := &PullResult{From: headRef.Hash().String(), To: headRef.Hash().String(), Changed: []ChangedFile{}}
+
+	remoteRef, err := r.Reference(plumbing.NewRemoteReferenceName(remote.Name, headRef.Name().Short()), true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// nothing pushed to the remote yet
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get remote reference: %w", err)
+	}
+
+	local, err := r.CommitObject(headRef.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	theirs, err := r.CommitObject(remoteRef.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	if upToDate, err := theirs.IsAncestor(local); err != nil || upToDate {
+		return result, err
+	}
+
+	bases, err := local.MergeBase(theirs)
+	if err != nil {
+		return nil, fmt.Errorf("find merge base: %w", err)
+	}
+	var base *object.Commit
+	if len(bases) > 0 {
+		base = bases[0]
+	}
+	fastForward := base != nil && base.Hash == local.Hash
+
+	merged, err := mergeTrees(base, local, theirs, remote.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("get worktree: %w", err)
+	}
+	for _, file := range merged {
+		if err := writeWorktreeFile(w, repo, file); err != nil {
+			return nil, err
+		}
+	}
+
+	var newHead plumbing.Hash
+	if fastForward {
+		if err := w.Reset(&git.ResetOptions{Commit: theirs.Hash, Mode: git.MixedReset}); err != nil {
+			return nil, fmt.Errorf("fast forward: %w", err)
+		}
+		newHead = theirs.Hash
+	} else {
+		options := commitOptions(SystemAuthor)
+		options.Parents = []plumbing.Hash{local.Hash, theirs.Hash}
+		options.AllowEmptyCommits = true
+		message := fmt.Sprintf("Merge remote-tracking branch '%s/%s'", remote.Name, headRef.Name().Short())
+		if newHead, err = w.Commit(message, options); err != nil {
+			return nil, fmt.Errorf("committing merge: %w", err)
+		}
+	}
+
+	result.To = newHead.String()
+	result.Changed, err = changedFiles(r, local.Hash, newHead)
+	return result, err
+}
+
+// mergeTrees merges the files theirs changed since base into local's. It
+// returns the files to write.
+func mergeTrees(base *object.Commit, local *object.Commit, theirs *object.Commit, remoteName string) ([]ChangedFile, error) {
+	var baseTree *object.Tree
+	if base != nil {
+		var err error
+		if baseTree, err = base.Tree(); err != nil {
+			return nil, fmt.Errorf("get tree: %w", err)
+		}
+	}
+	localTree, err := local.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+	theirTree, err := theirs.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+
+	changes, err := object.DiffTree(baseTree, theirTree)
+	if err != nil {
+		return nil, fmt.Errorf("diff trees: %w", err)
+	}
+
+	var merged []ChangedFile
+	var conflicts []string
+	for _, change := range changes {
+		path := change.To.Name
+		if path == "" {
+			path = change.From.Name
+		}
+		baseContent, _, err := treeFile(baseTree, path)
+		if err != nil {
+			return nil, err
+		}
+		localContent, inLocal, err := treeFile(localTree, path)
+		if err != nil {
+			return nil, err
+		}
+		theirContent, inTheirs, err := treeFile(theirTree, path)
+		if err != nil {
+			return nil, err
+		}
+
+		file := ChangedFile{Path: path, OldContent: localContent, Content: theirContent, Deleted: !inTheirs}
+		localChanged := localContent != baseContent || inLocal != (change.From.Name != "")
+		switch {
+		case !localChanged:
+		case inLocal == inTheirs && localContent == theirContent:
+			continue
+		case !inLocal || !inTheirs:
+			// changed on one side, deleted on the other
+			conflicts = append(conflicts, path)
+			continue
+		default:
+			result := Merge3(baseContent, localContent, theirContent, "local", remoteName)
+			if len(result.Conflicts) > 0 {
+				conflicts = append(conflicts, path)
+				continue
+			}
+			file.Content = result.Content
+		}
+		merged = append(merged, file)
+	}
+
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPullConflict, strings.Join(conflicts, ", "))
+	}
+	return merged, nil
+}
+
+// treeFile reads a file of a tree, reporting whether it exists. A nil tree
+// is empty.
+func treeFile(tree *object.Tree, path string) (string, bool, error) {
+	if tree == nil {
+		return "", false, nil
+	}
+	file, err := tree.File(path)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("get file %s: %w", path, err)
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return "", false, fmt.Errorf("get file contents: %w", err)
+	}
+	return content, true, nil
+}
+
+// writeWorktreeFile writes or deletes a merged file, and stages it.
+func writeWorktreeFile(w *git.Worktree, repo *Repo, file ChangedFile) error {
+	fullPath := filepath.Join(repo.Path, filepath.FromSlash(file.Path))
+	if file.Deleted {
+		if _, err := w.Remove(file.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing file %s: %w", file.Path, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	if err := os.WriteFile(fullPath, []byte(file.Content), 0644); err != nil {
+		return fmt.Errorf("write file %s: %w", file.Path, err)
+	}
+	if _, err := w.Add(file.Path); err != nil {
+		return fmt.Errorf("adding file %s: %w", file.Path, err)
+	}
+	return nil
+}
+
+// changedFiles lists the files that differ between two commits.
+func changedFiles(r *git.Repository, from plumbing.Hash, to plumbing.Hash) ([]ChangedFile, error) {
+	fromCommit, err := r.CommitObject(from)
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	toCommit, err := r.CommitObject(to)
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	fromTree, err := fromCommit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+	toTree, err := toCommit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, fmt.Errorf("diff trees: %w", err)
+	}
+	files := []ChangedFile{}
+	for _, change := range changes {
+		path := change.To.Name
+		if path == "" {
+			path = change.From.Name
+		}
+		oldContent, _, err := treeFile(fromTree, path)
+		if err != nil {
+			return nil, err
+		}
+		content, exists, err := treeFile(toTree, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ChangedFile{Path: path, OldContent: oldContent, Content: content, Deleted: !exists})
+	}
+	return files, nil
+}
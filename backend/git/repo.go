@@ -0,0 +1,74 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Repo is a handle on a document repository. Worktree and index changes
+// through it are made one at a time, since request handlers and the
+// websocket hubs' autosaves commit concurrently.
+type Repo struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+var (
+	reposMutex sync.Mutex
+	repos      = make(map[string]*Repo)
+)
+
+// OpenRepo returns the handle on the repository at path, first creating it
+// with an initial commit if there is none. Every caller gets the same
+// handle for a repository.
+func OpenRepo(path string) (*Repo, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("resolve repository path: %w", err)
+	}
+
+	reposMutex.Lock()
+	defer reposMutex.Unlock()
+	if repo, ok := repos[path]; ok {
+		return repo, nil
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("create repository folder: %w", err)
+	}
+	if err := initRepo(path); err != nil {
+		return nil, fmt.Errorf("init repository: %w", err)
+	}
+	repo := &Repo{Path: path}
+	repos[path] = repo
+	return repo, nil
+}
+
+// DocumentPath returns the file a document is kept in.
+func (r *Repo) DocumentPath(doc Document) string {
+	return filepath.Join(r.Path, filepath.FromSlash(doc.Path))
+}
+
+// hooksMutex guards commitHooks.
+var hooksMutex sync.RWMutex
+
+// commitHooks are called after every commit, with the repository locked.
+var commitHooks []func(repo *Repo)
+
+// OnCommit registers hook to be told the repository after each commit or
+// tag made through this package. It is called with the repository locked,
+// so it must not block.
+func OnCommit(hook func(repo *Repo)) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	commitHooks = append(commitHooks, hook)
+}
+
+func committed(repo *Repo) {
+	hooksMutex.RLock()
+	defer hooksMutex.RUnlock()
+	for _, hook := range commitHooks {
+		hook(repo)
+	}
+}
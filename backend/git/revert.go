@@ -0,0 +1,53 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// ErrNothingToRevert is returned for reverting a commit that didn't change
+// the document.
+var ErrNothingToRevert = errors.New("version doesn't change the document")
+
+// Revert is the document with the changes of one commit undone.
+type Revert struct {
+	Reverted Commit `json:"reverted"`
+	MergeResult
+}
+
+// RevertVersion undoes the changes a commit made to a document, keeping the
+// later edits in current. It is a three-way merge of current with the
+// commit's parent, based on the commit; conflicts are where later edits
+// overlap the change. Merge commits are reverted against their first
+// parent.
+func RevertVersion(repo *Repo, doc Document, revision string, current string) (*Revert, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	commit, err := resolveCommit(r, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := contentAt(repo, doc, commit.Hash.String())
+	if err != nil {
+		return nil, err
+	}
+	var before string
+	if len(commit.ParentHashes) > 0 {
+		if before, err = contentAt(repo, doc, commit.ParentHashes[0].String()); err != nil {
+			return nil, err
+		}
+	}
+	if before == changed {
+		return nil, fmt.Errorf("%w: %s", ErrNothingToRevert, commit.Hash)
+	}
+
+	return &Revert{
+		Reverted:    commitInfo(commit),
+		MergeResult: Merge3(changed, current, before, "current", "revert "+commit.Hash.String()[:7]),
+	}, nil
+}
@@ -0,0 +1,43 @@
+package git
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRevertVersion(t *testing.T) {
+	repo, err := OpenRepo(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := Document{ID: "1", Path: "plan.md"}
+	splitCommit(t, repo, doc, "a\nb\nc\nd\ne\n", "Create document: Plan")
+	second := splitCommit(t, repo, doc, "a\nB\nc\nd\ne\n", "Save document: Plan")
+	third := splitCommit(t, repo, doc, "a\nB\nc\nd\nE\n", "Save document: Plan")
+	other := splitCommit(t, repo, Document{ID: "2", Path: "other.md"}, "other\n", "Create document: Other")
+
+	// Later edits, committed or not, are kept
+	revert, err := RevertVersion(repo, doc, second, "a\nB\nc\nd\nE\nf\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revert.Reverted.Hash != second || revert.Content != "a\nb\nc\nd\nE\nf\n" || len(revert.Conflicts) != 0 {
+		t.Errorf("reverting %s gave %+v", second[:7], revert)
+	}
+
+	// A later edit over the same line conflicts
+	revert, err = RevertVersion(repo, doc, third[:7], "a\nB\nc\nd\nEE\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revert.Conflicts) != 1 || revert.Conflicts[0].Ours != "EE\n" || revert.Conflicts[0].Theirs != "e\n" || !HasConflictMarkers(revert.Content) {
+		t.Errorf("reverting %s over a later edit gave %+v", third[:7], revert)
+	}
+
+	if _, err := RevertVersion(repo, doc, other, "a\nB\nc\nd\nE\n"); !errors.Is(err, ErrNothingToRevert) {
+		t.Errorf("reverting another document's commit: %v", err)
+	}
+	if _, err := RevertVersion(repo, doc, "0123456", "a\nB\nc\nd\nE\n"); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("reverting a missing commit: %v", err)
+	}
+}
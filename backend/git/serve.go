@@ -0,0 +1,335 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+)
+
+// The services of the git smart HTTP protocol.
+const (
+	UploadPackService  = "git-upload-pack"
+	ReceivePackService = "git-receive-pack"
+)
+
+var ErrUnknownService = errors.New("unknown git service")
+
+// repoLoader loads the one repository being served, whatever the endpoint.
+type repoLoader struct {
+	storer storer.Storer
+}
+
+func (l repoLoader) Load(*transport.Endpoint) (storer.Storer, error) {
+	return l.storer, nil
+}
+
+func serverSession(r *git.Repository, service string) (transport.Session, error) {
+	srv := server.NewServer(repoLoader{r.Storer})
+	endpoint, err := transport.NewEndpoint("/")
+	if err != nil {
+		return nil, err
+	}
+	switch service {
+	case UploadPackService:
+		return srv.NewUploadPackSession(endpoint, nil)
+	case ReceivePackService:
+		return srv.NewReceivePackSession(endpoint, nil)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownService, service)
+}
+
+// AdvertiseRefs writes the references a smart HTTP client of service
+// starts from.
+func AdvertiseRefs(ctx context.Context, repo *Repo, service string, w io.Writer) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return fmt.Errorf("git plain open: %w", err)
+	}
+	session, err := serverSession(r, service)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	refs, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return fmt.Errorf("advertise references: %w", err)
+	}
+	refs.Prefix = [][]byte{[]byte("# service=" + service), pktline.Flush}
+	return refs.Encode(w)
+}
+
+// UploadPack answers a fetch. Until the client is done negotiating it is
+// told the first commit it has in common with the repository, if any; then
+// it is sent the objects it wants but doesn't have.
+func UploadPack(ctx context.Context, repo *Repo, body io.Reader, w io.Writer) error {
+	req := packp.NewUploadPackRequest()
+	if err := req.UploadRequest.Decode(body); err != nil {
+		return fmt.Errorf("decode fetch: %w", err)
+	}
+	done, err := decodeHaves(body, &req.UploadHaves)
+	if err != nil {
+		return err
+	}
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return fmt.Errorf("git plain open: %w", err)
+	}
+	var common []plumbing.Hash
+	for _, have := range req.Haves {
+		if _, err := r.CommitObject(have); err == nil {
+			common = append(common, have)
+			break
+		}
+	}
+	if !done {
+		return (&packp.ServerResponse{ACKs: common}).Encode(w, false)
+	}
+	req.Haves = common
+
+	session, err := serverSession(r, UploadPackService)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	resp, err := session.(transport.UploadPackSession).UploadPack(ctx, req)
+	if err != nil {
+		return fmt.Errorf("upload pack: %w", err)
+	}
+	resp.ServerResponse.ACKs = common
+	return resp.Encode(w)
+}
+
+// decodeHaves reads the haves that follow the wants of a fetch, reporting
+// whether the client is done.
+func decodeHaves(body io.Reader, haves *packp.UploadHaves) (bool, error) {
+	scanner := pktline.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(string(scanner.Bytes()), "\n")
+		switch {
+		case line == "done":
+			return true, nil
+		case strings.HasPrefix(line, "have "):
+			haves.Haves = append(haves.Haves, plumbing.NewHash(strings.TrimPrefix(line, "have ")))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, fmt.Errorf("decode haves: %w", err)
+	}
+	return false, nil
+}
+
+// PushCheck approves or rejects a file changed by a pushed commit.
+type PushCheck func(path string, deleted bool) error
+
+// ReceivePack applies a push of the current branch, if it fast-forwards and
+// check approves of every file each new commit changes. The worktree is
+// updated to match. It returns the files that changed; a rejected push is
+// reported to the client and changes nothing.
+func ReceivePack(ctx context.Context, repo *Repo, body io.Reader, w io.Writer, check PushCheck) ([]ChangedFile, error) {
+	req := packp.NewReferenceUpdateRequest()
+	if err := req.Decode(body); err != nil {
+		return nil, fmt.Errorf("decode push: %w", err)
+	}
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	headRef, err := r.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head reference: %w", err)
+	}
+
+	report := &packp.ReportStatus{UnpackStatus: "ok"}
+	if req.Packfile != nil {
+		// Parsed rather than written as is, since clients send thin packs
+		// that refer to objects they know the repository has. The objects
+		// are kept even if the push is rejected; nothing refers to them.
+		parser, err := packfile.NewParserWithStorage(packfile.NewScanner(req.Packfile), r.Storer)
+		if err == nil {
+			_, err = parser.Parse()
+		}
+		req.Packfile.Close()
+		if err != nil && !errors.Is(err, packfile.ErrEmptyPackfile) {
+			report.UnpackStatus = err.Error()
+		}
+	}
+
+	changed := []ChangedFile{}
+	for _, cmd := range req.Commands {
+		status := "ok"
+		switch {
+		case report.UnpackStatus != "ok":
+			status = "unpacker error"
+		case cmd.Name != headRef.Name():
+			status = fmt.Sprintf("only %s can be pushed to", headRef.Name().Short())
+		case cmd.Action() != packp.Update:
+			status = "branches can't be created or deleted"
+		case cmd.Old != headRef.Hash():
+			status = "fetch first"
+		default:
+			files, err := fastForward(r, repo, cmd.Old, cmd.New, check)
+			if err != nil {
+				status = err.Error()
+				break
+			}
+			headRef = plumbing.NewHashReference(headRef.Name(), cmd.New)
+			changed = append(changed, files...)
+		}
+		report.CommandStatuses = append(report.CommandStatuses, &packp.CommandStatus{ReferenceName: cmd.Name, Status: status})
+	}
+	if len(changed) > 0 {
+		committed(repo)
+	}
+
+	if req.Capabilities.Supports(capability.ReportStatus) {
+		if err := report.Encode(w); err != nil {
+			return changed, fmt.Errorf("report status: %w", err)
+		}
+	}
+	return changed, nil
+}
+
+// fastForward moves the current branch and worktree from old to new, once
+// every commit in between has passed check.
+func fastForward(r *git.Repository, repo *Repo, old plumbing.Hash, new plumbing.Hash, check PushCheck) ([]ChangedFile, error) {
+	oldCommit, err := r.CommitObject(old)
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	newCommit, err := r.CommitObject(new)
+	if err != nil {
+		return nil, errors.New("missing objects")
+	}
+	if ok, err := oldCommit.IsAncestor(newCommit); err != nil || !ok {
+		return nil, errors.New("non-fast-forward")
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	queue := []*object.Commit{newCommit}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if seen[c.Hash] {
+			continue
+		}
+		seen[c.Hash] = true
+		if known, err := c.IsAncestor(oldCommit); err != nil || known || c.Hash == old {
+			continue
+		}
+
+		files, err := introducedFiles(c)
+		if err != nil {
+			return nil, err
+		}
+		for path, deleted := range files {
+			if err := check(path, deleted); err != nil {
+				return nil, fmt.Errorf("%s: %s", c.Hash.String()[:7], err)
+			}
+		}
+		err = c.Parents().ForEach(func(parent *object.Commit) error {
+			queue = append(queue, parent)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("get parents: %w", err)
+		}
+	}
+
+	files, err := changedFiles(r, old, new)
+	if err != nil {
+		return nil, err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("get worktree: %w", err)
+	}
+	for _, file := range files {
+		if err := writeWorktreeFile(w, repo, file); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Reset(&git.ResetOptions{Commit: new, Mode: git.MixedReset}); err != nil {
+		return nil, fmt.Errorf("fast forward: %w", err)
+	}
+	return files, nil
+}
+
+// introducedFiles lists the files a commit changed, and whether it deleted
+// them. A merge only introduces the files that differ from every parent;
+// the rest came from one of them.
+func introducedFiles(c *object.Commit) (map[string]bool, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+	if c.NumParents() == 0 {
+		files := make(map[string]bool)
+		err := tree.Files().ForEach(func(f *object.File) error {
+			files[f.Name] = false
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list files: %w", err)
+		}
+		return files, nil
+	}
+
+	var files map[string]bool
+	err = c.Parents().ForEach(func(parent *object.Commit) error {
+		parentTree, err := parent.Tree()
+		if err != nil {
+			return fmt.Errorf("get tree: %w", err)
+		}
+		changes, err := object.DiffTree(parentTree, tree)
+		if err != nil {
+			return fmt.Errorf("diff trees: %w", err)
+		}
+		changed := make(map[string]bool)
+		for _, change := range changes {
+			if change.From.Name != "" && change.From.Name != change.To.Name {
+				changed[change.From.Name] = true
+			}
+			if change.To.Name != "" {
+				changed[change.To.Name] = false
+			}
+		}
+		if files == nil {
+			files = changed
+			return nil
+		}
+		for path := range files {
+			if _, ok := changed[path]; !ok {
+				delete(files, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
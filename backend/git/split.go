@@ -0,0 +1,389 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// splitFile is a file of a commit being split.
+type splitFile struct {
+	mode filemode.FileMode
+	hash plumbing.Hash
+}
+
+// splitTarget is a repository history is being split into.
+type splitTarget struct {
+	r *git.Repository
+	// head is the last commit replayed into it, zero before the first
+	head plumbing.Hash
+	// first is the first commit replayed into it
+	first   plumbing.Hash
+	commits map[string]string
+}
+
+// SplitRepo rewrites the history of the repository at path into new
+// repositories, at the paths partition gives for each file. Commits on the
+// current branch are replayed oldest first into each repository they change
+// the files of, keeping only those files and the commit's author,
+// committer, date and message; merges become ordinary commits. Document
+// drafts and tags go with the document's file.
+//
+// It returns, for each new repository, what each commit became there.
+// Nothing is left behind if it fails.
+func SplitRepo(path string, partition func(file string) []string) (map[string]map[string]string, error) {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	headRef, err := r.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head reference: %w", err)
+	}
+
+	targets := make(map[string]*splitTarget)
+	result, err := splitRepo(r, headRef, partition, targets)
+	if err != nil {
+		for dest := range targets {
+			os.RemoveAll(dest)
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+func splitRepo(r *git.Repository, headRef *plumbing.Reference, partition func(file string) []string, targets map[string]*splitTarget) (map[string]map[string]string, error) {
+	// the current branch, oldest first
+	var mainline []*object.Commit
+	c, err := r.CommitObject(headRef.Hash())
+	for err == nil {
+		mainline = append(mainline, c)
+		if c.NumParents() == 0 {
+			break
+		}
+		c, err = c.Parent(0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("walk history: %w", err)
+	}
+	onMainline := make(map[plumbing.Hash]bool)
+	for i, j := 0, len(mainline)-1; i < j; i, j = i+1, j-1 {
+		mainline[i], mainline[j] = mainline[j], mainline[i]
+	}
+	for _, c := range mainline {
+		onMainline[c.Hash] = true
+	}
+
+	target := func(dest string) (*splitTarget, error) {
+		if t, ok := targets[dest]; ok {
+			return t, nil
+		}
+		if _, err := os.Stat(filepath.Join(dest, ".git")); err == nil {
+			return nil, fmt.Errorf("%s is already a repository", dest)
+		}
+		tr, err := git.PlainInit(dest, false)
+		if err != nil {
+			return nil, fmt.Errorf("git plain init: %w", err)
+		}
+		t := &splitTarget{r: tr, commits: make(map[string]string)}
+		targets[dest] = t
+		return t, nil
+	}
+
+	for _, c := range mainline {
+		files, err := splitFiles(c, partition)
+		if err != nil {
+			return nil, err
+		}
+		for dest := range files {
+			if _, err := target(dest); err != nil {
+				return nil, err
+			}
+		}
+		for dest, t := range targets {
+			if t.head, err = replayCommit(r, t.r, c, files[dest], t.head); err != nil {
+				return nil, err
+			}
+			if t.first.IsZero() {
+				t.first = t.head
+			}
+			t.commits[c.Hash.String()] = t.head.String()
+		}
+	}
+
+	if err := splitDrafts(r, partition, targets, onMainline); err != nil {
+		return nil, err
+	}
+	if err := splitTags(r, partition, targets); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]map[string]string)
+	for dest, t := range targets {
+		branch := plumbing.NewHashReference(headRef.Name(), t.head)
+		if err := t.r.Storer.SetReference(branch); err != nil {
+			return nil, fmt.Errorf("set branch: %w", err)
+		}
+		if err := t.r.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, headRef.Name())); err != nil {
+			return nil, fmt.Errorf("set head: %w", err)
+		}
+		w, err := t.r.Worktree()
+		if err != nil {
+			return nil, fmt.Errorf("get worktree: %w", err)
+		}
+		if err := w.Reset(&git.ResetOptions{Commit: t.head, Mode: git.HardReset}); err != nil {
+			return nil, fmt.Errorf("check out %s: %w", dest, err)
+		}
+		result[dest] = t.commits
+	}
+	return result, nil
+}
+
+// splitDrafts replays each draft's commits since it left the main line onto
+// what the commit it left from became, or the repository's first commit if
+// that came before it.
+func splitDrafts(r *git.Repository, partition func(file string) []string, targets map[string]*splitTarget, onMainline map[plumbing.Hash]bool) error {
+	refs, err := r.References()
+	if err != nil {
+		return fmt.Errorf("list references: %w", err)
+	}
+	defer refs.Close()
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		documentID, ok := namespacedDocument(ref.Name(), "refs/heads/drafts/")
+		if !ok || ref.Type() != plumbing.HashReference {
+			return nil
+		}
+
+		var commits []*object.Commit
+		c, err := r.CommitObject(ref.Hash())
+		for err == nil && !onMainline[c.Hash] {
+			commits = append([]*object.Commit{c}, commits...)
+			if c.NumParents() == 0 {
+				err = fmt.Errorf("%s doesn't start from the main line", ref.Name().Short())
+				break
+			}
+			c, err = c.Parent(0)
+		}
+		if err != nil {
+			return fmt.Errorf("walk %s: %w", ref.Name().Short(), err)
+		}
+
+		for _, dest := range partition(documentID + ".md") {
+			t, ok := targets[dest]
+			if !ok {
+				continue
+			}
+			replayed, ok := t.commits[c.Hash.String()]
+			head := plumbing.NewHash(replayed)
+			if !ok || head.IsZero() {
+				// The draft left the main line before anything of this
+				// repository was on it; start it from the first commit
+				// that was, so it still shares the branch's history
+				head = t.first
+			}
+			for _, dc := range commits {
+				files, err := splitFiles(dc, partition)
+				if err != nil {
+					return err
+				}
+				if head, err = replayCommit(r, t.r, dc, files[dest], head); err != nil {
+					return err
+				}
+				t.commits[dc.Hash.String()] = head.String()
+			}
+			if err := t.r.Storer.SetReference(plumbing.NewHashReference(ref.Name(), head)); err != nil {
+				return fmt.Errorf("set %s: %w", ref.Name().Short(), err)
+			}
+		}
+		return nil
+	})
+}
+
+// splitTags recreates document tags on what their commits became.
+func splitTags(r *git.Repository, partition func(file string) []string, targets map[string]*splitTarget) error {
+	refs, err := r.Tags()
+	if err != nil {
+		return fmt.Errorf("list tags: %w", err)
+	}
+	defer refs.Close()
+	return refs.ForEach(func(ref *plumbing.Reference) error {
+		documentID, ok := namespacedDocument(ref.Name(), "refs/tags/docs/")
+		if !ok {
+			return nil
+		}
+		commit := ref.Hash()
+		var options *git.CreateTagOptions
+		tag, err := r.TagObject(ref.Hash())
+		switch {
+		case err == nil:
+			commit = tag.Target
+			options = &git.CreateTagOptions{Tagger: &tag.Tagger, Message: tag.Message}
+		case !errors.Is(err, plumbing.ErrObjectNotFound):
+			return fmt.Errorf("get tag %s: %w", ref.Name().Short(), err)
+		}
+
+		for _, dest := range partition(documentID + ".md") {
+			t, ok := targets[dest]
+			if !ok {
+				continue
+			}
+			replayed, ok := t.commits[commit.String()]
+			if !ok {
+				log.Printf("Tag %s is not on a branch that was split; dropping it", ref.Name().Short())
+				continue
+			}
+			if _, err := t.r.CreateTag(ref.Name().Short(), plumbing.NewHash(replayed), options); err != nil {
+				return fmt.Errorf("create tag %s: %w", ref.Name().Short(), err)
+			}
+		}
+		return nil
+	})
+}
+
+// namespacedDocument returns the document a draft or tag reference in the
+// namespace prefix belongs to.
+func namespacedDocument(name plumbing.ReferenceName, prefix string) (string, bool) {
+	rest, ok := strings.CutPrefix(name.String(), prefix)
+	if !ok {
+		return "", false
+	}
+	documentID, _, ok := strings.Cut(rest, "/")
+	return documentID, ok
+}
+
+// splitFiles sorts the files of a commit by the repository they go to.
+func splitFiles(c *object.Commit, partition func(file string) []string) (map[string]map[string]splitFile, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("get tree: %w", err)
+	}
+	files := make(map[string]map[string]splitFile)
+	err = tree.Files().ForEach(func(f *object.File) error {
+		for _, dest := range partition(f.Name) {
+			if files[dest] == nil {
+				files[dest] = make(map[string]splitFile)
+			}
+			files[dest][f.Name] = splitFile{mode: f.Mode, hash: f.Hash}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list files: %w", err)
+	}
+	return files, nil
+}
+
+// replayCommit commits files to dst as c did, on top of parent. If that
+// changes nothing, parent is returned.
+func replayCommit(src *git.Repository, dst *git.Repository, c *object.Commit, files map[string]splitFile, parent plumbing.Hash) (plumbing.Hash, error) {
+	if parent.IsZero() && len(files) == 0 {
+		return parent, nil
+	}
+	for _, file := range files {
+		if err := copyObject(src.Storer, dst.Storer, plumbing.BlobObject, file.hash); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	treeHash, err := writeTree(dst.Storer, files)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	var parents []plumbing.Hash
+	if !parent.IsZero() {
+		parentCommit, err := dst.CommitObject(parent)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("get commit object: %w", err)
+		}
+		if parentCommit.TreeHash == treeHash {
+			return parent, nil
+		}
+		parents = []plumbing.Hash{parent}
+	}
+
+	commit := &object.Commit{
+		Author:       c.Author,
+		Committer:    c.Committer,
+		Message:      c.Message,
+		TreeHash:     treeHash,
+		ParentHashes: parents,
+	}
+	obj := dst.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("encode commit: %w", err)
+	}
+	hash, err := dst.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("store commit: %w", err)
+	}
+	return hash, nil
+}
+
+func copyObject(src storer.EncodedObjectStorer, dst storer.EncodedObjectStorer, t plumbing.ObjectType, hash plumbing.Hash) error {
+	if dst.HasEncodedObject(hash) == nil {
+		return nil
+	}
+	obj, err := src.EncodedObject(t, hash)
+	if err != nil {
+		return fmt.Errorf("get object %s: %w", hash, err)
+	}
+	if _, err := dst.SetEncodedObject(obj); err != nil {
+		return fmt.Errorf("store object %s: %w", hash, err)
+	}
+	return nil
+}
+
+// writeTree stores the tree of files, given by their full paths, and
+// returns its hash.
+func writeTree(s storer.EncodedObjectStorer, files map[string]splitFile) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	subtrees := make(map[string]map[string]splitFile)
+	for path, file := range files {
+		if dir, rest, nested := strings.Cut(path, "/"); nested {
+			if subtrees[dir] == nil {
+				subtrees[dir] = make(map[string]splitFile)
+			}
+			subtrees[dir][rest] = file
+			continue
+		}
+		entries = append(entries, object.TreeEntry{Name: path, Mode: file.mode, Hash: file.hash})
+	}
+	for dir, subfiles := range subtrees {
+		hash, err := writeTree(s, subfiles)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: hash})
+	}
+	// git orders entries by name, with directories sorting as if they ended
+	// in a slash
+	sortKey := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortKey(entries[i]) < sortKey(entries[j])
+	})
+
+	obj := s.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("encode tree: %w", err)
+	}
+	hash, err := s.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("store tree: %w", err)
+	}
+	return hash, nil
+}
@@ -0,0 +1,290 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// splitCommit saves a document in repo and commits it.
+func splitCommit(t *testing.T, repo *Repo, doc Document, content string, message string) string {
+	t.Helper()
+	if err := SaveDocument(repo, doc, content); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := CommitDocumentAs(repo, doc, message, alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// branchFiles lists the files at the tip of a reference of the repository
+// at path.
+func branchFiles(t *testing.T, path string, ref plumbing.ReferenceName) []string {
+	t.Helper()
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, err := r.Reference(ref, true)
+	if err != nil {
+		t.Fatalf("%s in %s: %v", ref, path, err)
+	}
+	c, err := r.CommitObject(resolved.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	tree.Files().ForEach(func(f *object.File) error {
+		files = append(files, f.Name)
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+// subjects lists the subjects of a repository's current branch, oldest
+// first.
+func subjects(t *testing.T, path string) []string {
+	t.Helper()
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := r.Log(&git.LogOptions{From: head.Hash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subjects []string
+	log.ForEach(func(c *object.Commit) error {
+		subject, _, _ := strings.Cut(c.Message, "\n")
+		subjects = append([]string{subject}, subjects...)
+		return nil
+	})
+	return subjects
+}
+
+func TestSplitRepo(t *testing.T) {
+	dir := t.TempDir()
+	shared, err := OpenRepo(filepath.Join(dir, "shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := Document{ID: "1", Path: LegacyPath("1")}
+	two := Document{ID: "2", Path: LegacyPath("2")}
+	splitCommit(t, shared, one, "one\n", "Create document: One")
+	branchPoint := splitCommit(t, shared, two, "two\n", "Create document: Two")
+	if _, err := CreateDraft(shared, one, "rewrite", branchPoint); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CommitDraft(shared, one, "rewrite", "rewritten\n", "Rewrite one", bob); err != nil {
+		t.Fatal(err)
+	}
+	tagged := splitCommit(t, shared, one, "one, again\n", "Save document: One")
+	if _, err := TagDocumentVersion(shared, one, "v1", tagged, "First version", bob); err != nil {
+		t.Fatal(err)
+	}
+	splitCommit(t, shared, two, "two, again\n", "Save document: Two")
+
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	commits, err := SplitRepo(shared.Path, func(file string) []string {
+		switch file {
+		case "README.md":
+			return []string{a, b}
+		case "1.md":
+			return []string{a}
+		case "2.md":
+			return []string{b}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every repository has the README and its own documents, with the
+	// commits that changed them
+	if got := branchFiles(t, a, plumbing.HEAD); strings.Join(got, ",") != "1.md,README.md" {
+		t.Errorf("a has %v", got)
+	}
+	if got := branchFiles(t, b, plumbing.HEAD); strings.Join(got, ",") != "2.md,README.md" {
+		t.Errorf("b has %v", got)
+	}
+	if got := strings.Join(subjects(t, a), ","); got != "Initial commit,Create document: One,Save document: One" {
+		t.Errorf("a's history is %s", got)
+	}
+	if got := strings.Join(subjects(t, b), ","); got != "Initial commit,Create document: Two,Save document: Two" {
+		t.Errorf("b's history is %s", got)
+	}
+	// A commit that changed nothing of a repository's maps to the one
+	// before it there
+	if commits[a][branchPoint] == "" || commits[a][branchPoint] != commits[a][commitBefore(t, shared.Path, branchPoint)] {
+		t.Errorf("%s maps to %s in a", branchPoint, commits[a][branchPoint])
+	}
+
+	// The draft goes with its document, from what its branch point became
+	ra, err := git.PlainOpen(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	draft, err := ra.Reference(plumbing.ReferenceName(DraftBranch("1", "rewrite")), true)
+	if err != nil {
+		t.Fatalf("draft missing from a: %v", err)
+	}
+	draftHead, err := ra.CommitObject(draft.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if draftHead.Message != "Rewrite one" || draftHead.ParentHashes[0].String() != commits[a][branchPoint] {
+		t.Errorf("draft is %q on %s, want it on %s", draftHead.Message, draftHead.ParentHashes, commits[a][branchPoint])
+	}
+	rb, err := git.PlainOpen(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rb.Reference(plumbing.ReferenceName(DraftBranch("1", "rewrite")), true); err == nil {
+		t.Errorf("b has one's draft")
+	}
+
+	// So does the tag, still annotated
+	tags, err := ListDocumentTags(&Repo{Path: a}, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Name != "v1" || tags[0].Hash != commits[a][tagged] || tags[0].Message != "First version" || tags[0].Tagger != bob.Name {
+		t.Errorf("a's tags are %+v, want v1 at %s", tags, commits[a][tagged])
+	}
+}
+
+// commitBefore is the parent of a commit.
+func commitBefore(t *testing.T, path string, hash string) string {
+	t.Helper()
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := r.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.ParentHashes[0].String()
+}
+
+// A draft that left the main line before anything of its repository was on
+// it starts from that repository's first commit.
+func TestSplitRepoEarlyDraft(t *testing.T) {
+	dir := t.TempDir()
+	shared, err := OpenRepo(filepath.Join(dir, "shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial, err := Head(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	one := Document{ID: "1", Path: LegacyPath("1")}
+	two := Document{ID: "2", Path: LegacyPath("2")}
+	splitCommit(t, shared, two, "two\n", "Create document: Two")
+	splitCommit(t, shared, one, "one\n", "Create document: One")
+
+	r, err := git.PlainOpen(shared.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	early := plumbing.NewHashReference(plumbing.ReferenceName(DraftBranch("1", "early")), plumbing.NewHash(initial))
+	if err := r.Storer.SetReference(early); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CommitDraft(shared, one, "early", "early\n", "Early draft", bob); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	commits, err := SplitRepo(shared.Path, func(file string) []string {
+		switch file {
+		case "1.md":
+			return []string{a}
+		case "2.md":
+			return []string{b}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ra, err := git.PlainOpen(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	draft, err := ra.Reference(plumbing.ReferenceName(DraftBranch("1", "early")), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ra.CommitObject(draft.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ra.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Message != "Early draft" || c.NumParents() != 1 || c.ParentHashes[0] != head.Hash() {
+		t.Errorf("draft is %q on %v, want it on a's first commit %s", c.Message, c.ParentHashes, head.Hash())
+	}
+	if _, ok := commits[a][initial]; ok {
+		t.Errorf("the initial commit, before a had anything, maps to %s", commits[a][initial])
+	}
+}
+
+// A split that fails partway removes the repositories it made, and leaves
+// the others alone.
+func TestSplitRepoCleansUp(t *testing.T) {
+	dir := t.TempDir()
+	shared, err := OpenRepo(filepath.Join(dir, "shared"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	splitCommit(t, shared, Document{ID: "2", Path: LegacyPath("2")}, "two\n", "Create document: Two")
+
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if _, err := git.PlainInit(b, false); err != nil {
+		t.Fatal(err)
+	}
+	_, err = SplitRepo(shared.Path, func(file string) []string {
+		switch file {
+		case "README.md":
+			return []string{a}
+		case "2.md":
+			return []string{b}
+		}
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "already a repository") {
+		t.Fatalf("split into an existing repository: %v", err)
+	}
+	if _, err := os.Stat(a); !os.IsNotExist(err) {
+		t.Errorf("a was left behind: %v", err)
+	}
+	if _, err := git.PlainOpen(b); err != nil {
+		t.Errorf("the existing repository was touched: %v", err)
+	}
+	if _, err := git.PlainOpen(shared.Path); err != nil {
+		t.Errorf("the shared repository is gone: %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+var (
+	// ErrInvalidTagName is returned for names validRefName rejects.
+	ErrInvalidTagName = errors.New("invalid tag name")
+	// ErrTagExists is returned when creating a tag that already exists.
+	ErrTagExists = errors.New("tag already exists")
+	// ErrTagNotFound is returned for a document tag that doesn't exist.
+	ErrTagNotFound = errors.New("tag not found")
+)
+
+// refNamePattern is what the names of document tags and drafts look like,
+// e.g. "v1.0-approved".
+var refNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+
+// validRefName reports whether name is usable as the last part of a git
+// reference.
+func validRefName(name string) bool {
+	return refNamePattern.MatchString(name) && !strings.Contains(name, "..") && !strings.HasSuffix(name, ".lock")
+}
+
+// Tag is a named version of a document. It is stored as an annotated git
+// tag under docs/<document id>/, so tags of different documents never clash.
+type Tag struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Message   string    `json:"message"`
+	Tagger    string    `json:"tagger"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// documentTagPrefix is the namespace of a document's tags.
+func documentTagPrefix(documentID string) string {
+	return fmt.Sprintf("docs/%s/", documentID)
+}
+
+// DocumentTagRevision is the revision naming a document tag, usable wherever
+// a version is expected.
+func DocumentTagRevision(documentID string, name string) string {
+	return string(plumbing.NewTagReferenceName(documentTagPrefix(documentID) + name))
+}
+
+func validateTagName(name string) error {
+	if !validRefName(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidTagName, name)
+	}
+	return nil
+}
+
+// ListDocumentTags returns a document's tags, newest first.
+func ListDocumentTags(repo *Repo, documentID string) ([]Tag, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+
+	refs, err := r.Tags()
+	if err != nil {
+		return nil, fmt.Errorf("list tags: %w", err)
+	}
+	defer refs.Close()
+
+	prefix := documentTagPrefix(documentID)
+	tags := []Tag{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().Short()
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		tag, err := readTag(r, ref)
+		if err != nil {
+			return err
+		}
+		tag.Name = strings.TrimPrefix(name, prefix)
+		tags = append(tags, tag)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// newest first, like the version history
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].CreatedAt.After(tags[j].CreatedAt)
+	})
+	return tags, nil
+}
+
+// readTag reads an annotated tag, or a lightweight one made outside
+// DocSmith.
+func readTag(r *git.Repository, ref *plumbing.Reference) (Tag, error) {
+	annotated, err := r.TagObject(ref.Hash())
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		commit, err := r.CommitObject(ref.Hash())
+		if err != nil {
+			return Tag{}, fmt.Errorf("read tag %s: %w", ref.Name().Short(), err)
+		}
+		return Tag{Hash: commit.Hash.String(), Tagger: commit.Author.Name, CreatedAt: commit.Author.When}, nil
+	}
+	if err != nil {
+		return Tag{}, fmt.Errorf("read tag %s: %w", ref.Name().Short(), err)
+	}
+	return Tag{
+		Hash:      annotated.Target.String(),
+		Message:   strings.TrimRight(annotated.Message, "\n"),
+		Tagger:    annotated.Tagger.Name,
+		CreatedAt: annotated.Tagger.When,
+	}, nil
+}
+
+// TagDocumentVersion names a version of a document. The commit must contain
+// the document.
+func TagDocumentVersion(repo *Repo, doc Document, name string, revision string, message string, tagger Author) (*Tag, error) {
+	if err := validateTagName(name); err != nil {
+		return nil, err
+	}
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	fullName := documentTagPrefix(doc.ID) + name
+	if _, err := r.Tag(fullName); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTagExists, name)
+	}
+	return createTag(r, repo, doc, fullName, name, revision, message, tagger)
+}
+
+// MoveDocumentTag points an existing tag at another version, keeping its
+// message unless a new one is given.
+func MoveDocumentTag(repo *Repo, doc Document, name string, revision string, message string, tagger Author) (*Tag, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	fullName := documentTagPrefix(doc.ID) + name
+	ref, err := r.Tag(fullName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTagNotFound, name)
+	}
+	if message == "" {
+		old, err := readTag(r, ref)
+		if err != nil {
+			return nil, err
+		}
+		message = old.Message
+	}
+	// Check the new target before letting go of the old one
+	if _, err := commitWithDocument(r, doc, revision); err != nil {
+		return nil, err
+	}
+	if err := r.DeleteTag(fullName); err != nil {
+		return nil, fmt.Errorf("delete tag: %w", err)
+	}
+	return createTag(r, repo, doc, fullName, name, revision, message, tagger)
+}
+
+// DeleteDocumentTag removes a document's tag.
+func DeleteDocumentTag(repo *Repo, documentID string, name string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return fmt.Errorf("git plain open: %w", err)
+	}
+	err = r.DeleteTag(documentTagPrefix(documentID) + name)
+	if errors.Is(err, git.ErrTagNotFound) {
+		return fmt.Errorf("%w: %s", ErrTagNotFound, name)
+	}
+	return err
+}
+
+// DeleteDocumentTags removes every tag of a document, for when the document
+// itself is deleted.
+func DeleteDocumentTags(repo *Repo, documentID string) error {
+	tags, err := ListDocumentTags(repo, documentID)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := DeleteDocumentTag(repo, documentID, tag.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TaggedCommits returns the hashes of every tagged commit in the
+// repository. History rewriting must keep these commits.
+func TaggedCommits(repo *Repo) (map[string]bool, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	refs, err := r.Tags()
+	if err != nil {
+		return nil, fmt.Errorf("list tags: %w", err)
+	}
+	defer refs.Close()
+
+	tagged := make(map[string]bool)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		tag, err := readTag(r, ref)
+		if err != nil {
+			return err
+		}
+		tagged[tag.Hash] = true
+		return nil
+	})
+	return tagged, err
+}
+
+// commitWithDocument resolves a revision to a commit containing the
+// document.
+func commitWithDocument(r *git.Repository, doc Document, revision string) (*object.Commit, error) {
+	commit, err := resolveCommit(r, revision)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := versionOf(commit, doc); err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+func createTag(r *git.Repository, repo *Repo, doc Document, fullName string, name string, revision string, message string, tagger Author) (*Tag, error) {
+	commit, err := commitWithDocument(r, doc, revision)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(message) == "" {
+		message = "Tag " + name
+	}
+
+	now := time.Now()
+	_, err = r.CreateTag(fullName, commit.Hash, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: tagger.Name, Email: tagger.Email, When: now},
+		Message: message,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create tag: %w", err)
+	}
+	committed(repo)
+	return &Tag{
+		Name:      name,
+		Hash:      commit.Hash.String(),
+		Message:   strings.TrimRight(message, "\n"),
+		Tagger:    tagger.Name,
+		CreatedAt: now,
+	}, nil
+}
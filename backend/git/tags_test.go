@@ -0,0 +1,109 @@
+package git
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestValidRefName(t *testing.T) {
+	for _, name := range []string{"v1", "v1.0-approved", "release_2", "A"} {
+		if !validRefName(name) {
+			t.Errorf("%q is rejected", name)
+		}
+	}
+	for _, name := range []string{"", "-v1", ".v1", "v1/final", "v1 final", "v1..2", "v1.lock", "v1~", "v1^", strings.Repeat("a", 101)} {
+		if validRefName(name) {
+			t.Errorf("%q is accepted", name)
+		}
+	}
+}
+
+func TestDocumentTags(t *testing.T) {
+	h := newHistoryRepo(t)
+	root := h.head().Hash.String()
+	first := h.commit("Create document: Plan", alice)
+	second := h.commit("Save document: Plan", bob)
+	other := Document{ID: "2", Path: "other.md"}
+	otherCommit := splitCommit(t, h.repo, other, "other\n", "Create document: Other")
+
+	tag, err := TagDocumentVersion(h.repo, h.doc, "v1.0-approved", first, "Approved by legal\n", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Name != "v1.0-approved" || tag.Hash != first || tag.Message != "Approved by legal" || tag.Tagger != "alice" {
+		t.Errorf("created %+v", tag)
+	}
+	if _, err := TagDocumentVersion(h.repo, h.doc, "latest", "HEAD", "  ", bob); err != nil {
+		t.Fatal(err)
+	}
+	// Tags of different documents don't clash
+	if _, err := TagDocumentVersion(h.repo, other, "latest", "HEAD", "", bob); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TagDocumentVersion(h.repo, h.doc, "v1.0-approved", second, "", alice); !errors.Is(err, ErrTagExists) {
+		t.Errorf("tagging again: %v", err)
+	}
+	if _, err := TagDocumentVersion(h.repo, h.doc, "v1/final", second, "", alice); !errors.Is(err, ErrInvalidTagName) {
+		t.Errorf("tagging with a bad name: %v", err)
+	}
+	// The initial commit has no version of the document
+	if _, err := TagDocumentVersion(h.repo, h.doc, "empty", root, "", alice); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("tagging a commit without the document: %v", err)
+	}
+
+	tags, err := ListDocumentTags(h.repo, h.doc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	if len(tags) != 2 || tags[0].Name != "latest" || tags[0].Hash != otherCommit || tags[0].Message != "Tag latest" || tags[1].Name != "v1.0-approved" || tags[1].Hash != first {
+		t.Errorf("document 1 has tags %+v", tags)
+	}
+
+	v, err := GetVersion(h.repo, h.doc, DocumentTagRevision(h.doc.ID, "v1.0-approved"))
+	if err != nil || v.Hash != first || v.Content != "revision 1\n" {
+		t.Errorf("content by tag is %+v (%v)", v, err)
+	}
+
+	// Moving a tag keeps its message, and a bad target leaves it alone
+	moved, err := MoveDocumentTag(h.repo, h.doc, "v1.0-approved", second, "", bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Hash != second || moved.Message != "Approved by legal" || moved.Tagger != "bob" {
+		t.Errorf("moved tag is %+v", moved)
+	}
+	if _, err := MoveDocumentTag(h.repo, h.doc, "v1.0-approved", root, "", bob); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("moving to a commit without the document: %v", err)
+	}
+	if v, err := GetVersion(h.repo, h.doc, DocumentTagRevision(h.doc.ID, "v1.0-approved")); err != nil || v.Hash != second {
+		t.Errorf("tag points at %+v (%v), want %s", v, err, second)
+	}
+	if _, err := MoveDocumentTag(h.repo, h.doc, "missing", second, "", bob); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("moving a missing tag: %v", err)
+	}
+
+	tagged, err := TaggedCommits(h.repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tagged) != 2 || !tagged[second] || !tagged[otherCommit] {
+		t.Errorf("tagged commits are %v", tagged)
+	}
+
+	if err := DeleteDocumentTag(h.repo, h.doc.ID, "missing"); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("deleting a missing tag: %v", err)
+	}
+	if err := DeleteDocumentTags(h.repo, h.doc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if tags, err := ListDocumentTags(h.repo, h.doc.ID); err != nil || len(tags) != 0 {
+		t.Errorf("document 1 still has tags %+v (%v)", tags, err)
+	}
+	if tags, err := ListDocumentTags(h.repo, other.ID); err != nil || len(tags) != 1 {
+		t.Errorf("document 2 has tags %+v (%v)", tags, err)
+	}
+}
@@ -0,0 +1,110 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Version is a document as of one commit.
+type Version struct {
+	Commit
+	Content string `json:"content"`
+}
+
+// commitInfo describes a commit for the API.
+func commitInfo(c *object.Commit) Commit {
+	return Commit{
+		Hash:        c.Hash.String(),
+		Message:     c.Message,
+		Author:      c.Author.Name,
+		AuthorEmail: c.Author.Email,
+		CoAuthors:   ParseCoAuthors(c.Message),
+		Timestamp:   c.Author.When,
+	}
+}
+
+// GetVersion reads a document at a revision. It returns ErrVersionNotFound
+// if the revision names no commit or the document didn't exist there.
+func GetVersion(repo *Repo, doc Document, revision string) (*Version, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+	commit, err := resolveCommit(r, revision)
+	if err != nil {
+		return nil, err
+	}
+	return versionOf(commit, doc)
+}
+
+// VersionAt reads a document as it was at a point in time: at the latest
+// commit touching it made no later than at.
+func VersionAt(repo *Repo, doc Document, at time.Time) (*Version, error) {
+	return latestVersion(repo, doc, &at)
+}
+
+// LatestVersion reads a document at the latest commit touching it.
+func LatestVersion(repo *Repo, doc Document) (*Version, error) {
+	return latestVersion(repo, doc, nil)
+}
+
+func latestVersion(repo *Repo, doc Document, until *time.Time) (*Version, error) {
+	r, err := git.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, fmt.Errorf("git plain open: %w", err)
+	}
+
+	ref, err := r.Head()
+	if err != nil {
+		return nil, fmt.Errorf("get head reference: %w", err)
+	}
+	head, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("get commit object: %w", err)
+	}
+	log, err := documentLog(r, head, doc, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *documentCommit
+	for i := range log {
+		if until == nil || !log[i].commit.Committer.When.After(*until) {
+			found = &log[i]
+			break
+		}
+	}
+	if found == nil && until != nil {
+		return nil, fmt.Errorf("%w: no commit before %s", ErrVersionNotFound, until.Format(time.RFC3339))
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: document never committed", ErrVersionNotFound)
+	}
+	return fileVersion(found.commit, found.file)
+}
+
+func versionOf(commit *object.Commit, doc Document) (*Version, error) {
+	file, err := documentFile(commit, doc)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, fmt.Errorf("%w: document not in %s", ErrVersionNotFound, commit.Hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fileVersion(commit, file)
+}
+
+// fileVersion reads a document from its file in a commit.
+func fileVersion(commit *object.Commit, file *object.File) (*Version, error) {
+	content, err := documentContent(file)
+	if err != nil {
+		return nil, err
+	}
+	version := &Version{Commit: commitInfo(commit), Content: content}
+	version.Path = file.Name
+	return version, nil
+}
@@ -0,0 +1,116 @@
+package git
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitAt commits a document's content as made at a given time.
+func (h *historyRepo) commitAt(content string, at time.Time) string {
+	h.t.Helper()
+	if err := SaveDocument(h.repo, h.doc, content); err != nil {
+		h.t.Fatal(err)
+	}
+	w, err := h.open().Worktree()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if _, err := w.Add(h.doc.Path); err != nil {
+		h.t.Fatal(err)
+	}
+	signature := &object.Signature{Name: alice.Name, Email: alice.Email, When: at}
+	hash, err := w.Commit("Save document: Plan", &git.CommitOptions{Author: signature, Committer: signature})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return hash.String()
+}
+
+func TestVersionAt(t *testing.T) {
+	h := newHistoryRepo(t)
+	monday := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	first := h.commitAt("monday\n", monday)
+	second := h.commitAt("tuesday\n", monday.Add(24*time.Hour))
+	// Another document's commit doesn't count as a version of this one
+	other := Document{ID: "2", Path: "other.md"}
+	if err := SaveDocument(h.repo, other, "other\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CommitDocumentAs(h.repo, other, "Create document: Other", bob, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		at      time.Time
+		hash    string
+		content string
+	}{
+		{monday, first, "monday\n"},
+		{monday.Add(time.Hour), first, "monday\n"},
+		{monday.Add(24 * time.Hour), second, "tuesday\n"},
+		{time.Now(), second, "tuesday\n"},
+	}
+	for _, tt := range tests {
+		v, err := VersionAt(h.repo, h.doc, tt.at)
+		if err != nil {
+			t.Errorf("as of %s: %v", tt.at, err)
+			continue
+		}
+		if v.Hash != tt.hash || v.Content != tt.content || v.Path != "plan.md" {
+			t.Errorf("as of %s: %s %q at %s, want %s %q", tt.at, v.Hash, v.Content, v.Path, tt.hash, tt.content)
+		}
+	}
+	if _, err := VersionAt(h.repo, h.doc, monday.Add(-time.Second)); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("as of before the document: %v", err)
+	}
+
+	latest, err := LatestVersion(h.repo, h.doc)
+	if err != nil || latest.Hash != second {
+		t.Errorf("latest version is %+v (%v), want %s", latest, err, second)
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	h := newHistoryRepo(t)
+	initial := h.head().Hash.String()
+	first := h.commit("Create document: Plan", alice)
+	h.commit("Save document: Plan", bob)
+
+	// The document is followed to where it was before it moved
+	moved := Document{ID: "1", Path: "notes/plan.md"}
+	if err := MoveDocument(h.repo, h.doc, moved); err != nil {
+		t.Fatal(err)
+	}
+	renamed, err := CommitPaths(h.repo, []string{h.doc.Path, moved.Path}, "Move document: Plan to /notes", alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, revision := range []string{first, first[:7]} {
+		v, err := GetVersion(h.repo, moved, revision)
+		if err != nil {
+			t.Fatalf("%s: %v", revision, err)
+		}
+		if v.Hash != first || v.Content != "revision 1\n" || v.Path != "plan.md" || v.Author != "alice" {
+			t.Errorf("%s is %+v", revision, v)
+		}
+	}
+	v, err := GetVersion(h.repo, moved, "HEAD")
+	if err != nil || v.Hash != renamed || v.Content != "revision 2\n" || v.Path != "notes/plan.md" {
+		t.Errorf("HEAD is %+v (%v)", v, err)
+	}
+	latest, err := LatestVersion(h.repo, moved)
+	if err != nil || latest.Hash != renamed {
+		t.Errorf("latest version is %+v (%v), want the move", latest, err)
+	}
+
+	for _, revision := range []string{initial, "0123456", "no-such-branch"} {
+		if _, err := GetVersion(h.repo, moved, revision); !errors.Is(err, ErrVersionNotFound) {
+			t.Errorf("%s: %v, want ErrVersionNotFound", revision, err)
+		}
+	}
+}
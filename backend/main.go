@@ -4,10 +4,13 @@ import (
 	"docsmith/api"
 	"docsmith/db"
 	"docsmith/git"
+	"docsmith/ws"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 func main() {
@@ -15,15 +18,10 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to get current working directory: %v", err)
 	}
-	gitRepoPath := filepath.Join(cwd, "docsmith-repo")
-	if _, err := os.Stat(gitRepoPath); os.IsNotExist(err) {
-		if err := os.MkdirAll(gitRepoPath, 0755); err != nil {
-			log.Fatalf("failed to create git repo folder, %v", err)
-		}
-	}
-
-	if err := git.InitRepo(gitRepoPath); err != nil {
-		log.Fatalf("failed to init git repo, %v", err)
+	// Each workspace has a repository in docsmith-repos, named after its ID
+	reposPath := filepath.Join(cwd, "docsmith-repos")
+	if err := os.MkdirAll(reposPath, 0755); err != nil {
+		log.Fatalf("failed to create git repos folder, %v", err)
 	}
 
 	if err != nil {
@@ -36,10 +34,112 @@ func main() {
 	}
 	defer database.Close()
 
+	// Before workspaces, every document was kept in the one repository
+	repos := api.NewRepos(database, reposPath)
+	if err := repos.SplitShared(filepath.Join(cwd, "docsmith-repo")); err != nil {
+		log.Fatalf("failed to split the shared git repo, %v", err)
+	}
+	if err := repos.MoveToReadablePaths(); err != nil {
+		log.Fatalf("failed to move documents to readable paths, %v", err)
+	}
+
 	fmt.Println("Docksmith API server starting...")
-	fmt.Println("Git repo path: ", gitRepoPath)
+	fmt.Println("Git repos path: ", reposPath)
 	fmt.Println("Database path: ", dbPath)
 
-	router := api.SetupRouter(database, gitRepoPath)
+	// Instances behind a load balancer share document hubs through Redis;
+	// a single instance keeps them in memory.
+	var backplane ws.Backplane
+	if redisAddr := os.Getenv("REDIS_ADDR"); redisAddr != "" {
+		backplane = ws.NewRedisBackplane(redisAddr, os.Getenv("REDIS_PASSWORD"))
+		fmt.Println("Redis backplane: ", redisAddr)
+	}
+
+	hubs := ws.NewRegistry(api.NewHubStore(database, repos), backplane)
+	hubs.SetLimits(wsLimits())
+
+	// Pick up edits made directly in the repositories, every RECONCILE_INTERVAL
+	// (2s by default, 0 to turn off)
+	reconcileInterval := 2 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("RECONCILE_INTERVAL")); err == nil {
+		reconcileInterval = v
+	}
+	reconciler := api.NewReconciler(database, repos, hubs, reconcileInterval)
+	if reconcileInterval > 0 {
+		reconciler.Start()
+	}
+
+	// Sync the repositories with the remote git servers their owners set,
+	// or else the one GIT_REMOTE_URL gives
+	remote := gitRemote()
+	interval, _ := time.ParseDuration(os.Getenv("GIT_SYNC_INTERVAL"))
+	pushOnCommit, _ := strconv.ParseBool(os.Getenv("GIT_PUSH_ON_COMMIT"))
+	allowLocal, _ := strconv.ParseBool(os.Getenv("GIT_REMOTE_ALLOW_LOCAL"))
+	syncer := api.NewSyncer(database, repos, hubs, reconciler, api.SyncOptions{
+		Default:      remote,
+		Interval:     interval,
+		PushOnCommit: pushOnCommit,
+		AllowLocal:   allowLocal,
+	})
+	if err := syncer.Start(); err != nil {
+		log.Fatalf("failed to configure git remote, %v", err)
+	}
+	if remote.URL != "" {
+		fmt.Println("Git remote: ", remote.URL)
+	}
+
+	// Squash runs of saves in the history every COMPACT_INTERVAL (off by
+	// default), keeping versions; COMPACT_WINDOW is how far apart squashed
+	// saves may be
+	compactWindow := api.DefaultCompactWindow
+	if v, err := time.ParseDuration(os.Getenv("COMPACT_WINDOW")); err == nil && v > 0 {
+		compactWindow = v
+	}
+	compactInterval, _ := time.ParseDuration(os.Getenv("COMPACT_INTERVAL"))
+	compactor := api.NewCompactor(database, repos, compactWindow, compactInterval)
+	compactor.Start()
+
+	router := api.SetupRouter(database, repos, hubs, syncer, reconciler, compactor)
 	router.Run(":8080")
 }
+
+// gitRemote returns the default remote git server, configured by
+// GIT_REMOTE_URL, in which {workspace} stands for the name of each
+// workspace, with credentials from GIT_REMOTE_USERNAME and
+// GIT_REMOTE_PASSWORD over HTTP, or GIT_REMOTE_SSH_KEY,
+// GIT_REMOTE_SSH_KEY_PASSPHRASE and GIT_REMOTE_KNOWN_HOSTS over SSH.
+// GIT_REMOTE_NAME defaults to origin.
+func gitRemote() git.Remote {
+	remote := git.Remote{
+		Name:             os.Getenv("GIT_REMOTE_NAME"),
+		URL:              os.Getenv("GIT_REMOTE_URL"),
+		Username:         os.Getenv("GIT_REMOTE_USERNAME"),
+		Password:         os.Getenv("GIT_REMOTE_PASSWORD"),
+		SSHKeyPath:       os.Getenv("GIT_REMOTE_SSH_KEY"),
+		SSHKeyPassphrase: os.Getenv("GIT_REMOTE_SSH_KEY_PASSPHRASE"),
+		KnownHostsPath:   os.Getenv("GIT_REMOTE_KNOWN_HOSTS"),
+	}
+	if remote.Name == "" {
+		remote.Name = "origin"
+	}
+	return remote
+}
+
+// wsLimits returns the websocket limits, overridden by WS_MAX_MESSAGE_BYTES,
+// WS_MESSAGES_PER_SECOND, WS_BURST and WS_SEND_QUEUE where set.
+func wsLimits() ws.Limits {
+	limits := ws.DefaultLimits()
+	if v, err := strconv.ParseInt(os.Getenv("WS_MAX_MESSAGE_BYTES"), 10, 64); err == nil {
+		limits.MaxMessageSize = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("WS_MESSAGES_PER_SECOND"), 64); err == nil {
+		limits.MessagesPerSecond = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("WS_BURST")); err == nil {
+		limits.Burst = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("WS_SEND_QUEUE")); err == nil {
+		limits.SendQueue = v
+	}
+	return limits
+}
@@ -3,7 +3,11 @@ package models
 type Document struct {
 	ID string `json:"id"`
 	UserID string `json:"user_id"`
+	WorkspaceID string `json:"workspace_id"`
 	Title string `json:"title"`
+	// Folder and Path place the document's file in its workspace's repository.
+	Folder string `json:"folder"`
+	Path string `json:"path"`
 	Content string `json:"content"`
 	UpdatedAt string `json:"updated_at"`
 }
\ No newline at end of file
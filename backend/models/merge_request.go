@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// Statuses of a merge request.
+const (
+	MergeRequestOpen = "open"
+	MergeRequestMerged = "merged"
+	MergeRequestClosed = "closed"
+)
+
+// MergeRequest proposes merging a draft of a document into its main line.
+type MergeRequest struct {
+	ID int `json:"id"`
+	DocumentID int `json:"document_id"`
+	Draft string `json:"draft"`
+	Title string `json:"title"`
+	Description string `json:"description"`
+	Status string `json:"status"`
+	CreatedBy int `json:"created_by"`
+	ApprovedBy *int `json:"approved_by"`
+	MergeCommit string `json:"merge_commit,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type MergeRequestComment struct {
+	ID int `json:"id"`
+	MergeRequestID int `json:"merge_request_id"`
+	UserID int `json:"user_id"`
+	Username string `json:"username"`
+	Body string `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -4,4 +4,7 @@ type User struct {
 	ID int `json:"id"`
 	Username string `json:"username"`
 	PasswordHash string `json:"-"`
-}
\ No newline at end of file
+	// DisplayName and Email are what commits by the user are signed with.
+	DisplayName string `json:"display_name"`
+	Email string `json:"email"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// Roles of workspace members.
+const (
+	RoleOwner = "owner"
+	RoleMember = "member"
+)
+
+// Workspace groups documents that share a git repository. Every user has a
+// personal one, named after them.
+type Workspace struct {
+	ID int `json:"id"`
+	Name string `json:"name"`
+	OwnerID int `json:"owner_id"`
+	Personal bool `json:"personal"`
+	Role string `json:"role,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WorkspaceMember struct {
+	UserID int `json:"user_id"`
+	Username string `json:"username"`
+	Role string `json:"role"`
+}
+
+// WorkspaceRemote is the git server a workspace is synced with. Its
+// credentials stay on the server; only whether each is set is shown.
+type WorkspaceRemote struct {
+	URL string `json:"url"`
+	Username string `json:"username,omitempty"`
+	HasPassword bool `json:"has_password"`
+	HasSSHKey bool `json:"has_ssh_key"`
+	HasKnownHosts bool `json:"has_known_hosts"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -2,7 +2,9 @@
 CREATE TABLE IF NOT EXISTS users (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     username TEXT NOT NULL UNIQUE,
-    password_hash TEXT NOT NULL
+    password_hash TEXT NOT NULL,
+    display_name TEXT,
+    email TEXT
 );
 
 -- Documents table
@@ -12,9 +14,46 @@ CREATE TABLE IF NOT EXISTS docs (
     title TEXT NOT NULL,
     content TEXT,
     updated_at DATETIME NOT NULL,
+    workspace_id INTEGER REFERENCES workspaces (id),
+    folder TEXT NOT NULL DEFAULT '',
+    path TEXT,
     FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
 );
 
+-- Workspaces table
+CREATE TABLE IF NOT EXISTS workspaces (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    owner_id INTEGER NOT NULL,
+    personal BOOLEAN NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Workspace members table
+CREATE TABLE IF NOT EXISTS workspace_members (
+    workspace_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    role TEXT NOT NULL DEFAULT 'member',
+    PRIMARY KEY (workspace_id, user_id),
+    FOREIGN KEY (workspace_id) REFERENCES workspaces (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Workspace remotes table: a workspace's remote git server, with the
+-- credentials to reach it
+CREATE TABLE IF NOT EXISTS workspace_remotes (
+    workspace_id INTEGER PRIMARY KEY,
+    url TEXT NOT NULL,
+    username TEXT NOT NULL DEFAULT '',
+    password TEXT NOT NULL DEFAULT '',
+    ssh_key TEXT NOT NULL DEFAULT '',
+    ssh_key_passphrase TEXT NOT NULL DEFAULT '',
+    known_hosts TEXT NOT NULL DEFAULT '',
+    updated_at DATETIME NOT NULL,
+    FOREIGN KEY (workspace_id) REFERENCES workspaces (id) ON DELETE CASCADE
+);
+
 -- Document shares table
 CREATE TABLE IF NOT EXISTS doc_shares (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -40,5 +79,100 @@ CREATE TABLE IF NOT EXISTS collaborators (
     FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
 );
 
+-- CRDT sync state table
+CREATE TABLE IF NOT EXISTS doc_crdt_state (
+    doc_id INTEGER PRIMARY KEY,
+    state BLOB NOT NULL,
+    updated_at DATETIME NOT NULL,
+    FOREIGN KEY (doc_id) REFERENCES docs (id) ON DELETE CASCADE
+);
+
+-- Merge requests table
+CREATE TABLE IF NOT EXISTS merge_requests (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    doc_id INTEGER NOT NULL,
+    draft TEXT NOT NULL,
+    title TEXT NOT NULL,
+    description TEXT,
+    status TEXT NOT NULL DEFAULT 'open',
+    created_by INTEGER NOT NULL,
+    approved_by INTEGER,
+    merge_commit TEXT,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME NOT NULL,
+    FOREIGN KEY (doc_id) REFERENCES docs (id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (approved_by) REFERENCES users (id) ON DELETE SET NULL
+);
+
+-- Merge request comments table
+CREATE TABLE IF NOT EXISTS merge_request_comments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    merge_request_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    body TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (merge_request_id) REFERENCES merge_requests (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- Repository state table: the last commit of each repository checked for
+-- edits made outside DocSmith
+CREATE TABLE IF NOT EXISTS repo_state (
+    repo_path TEXT PRIMARY KEY,
+    reconciled_head TEXT NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+-- History index tables: each workspace repository's commits, with the
+-- documents each changed
+CREATE TABLE IF NOT EXISTS commit_index (
+    repo_path TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    seq INTEGER NOT NULL,
+    message TEXT NOT NULL,
+    author TEXT NOT NULL,
+    author_email TEXT NOT NULL,
+    timestamp DATETIME NOT NULL,
+    PRIMARY KEY (repo_path, hash)
+);
+
+CREATE TABLE IF NOT EXISTS commit_documents (
+    repo_path TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    doc_id INTEGER NOT NULL,
+    path TEXT NOT NULL,
+    PRIMARY KEY (repo_path, hash, doc_id)
+);
+
+CREATE TABLE IF NOT EXISTS commit_index_state (
+    repo_path TEXT PRIMARY KEY,
+    head TEXT NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+-- Search index over the title and content of docs, kept up to date by
+-- triggers. It needs SQLite with FTS5; the server drops the triggers when
+-- run without it, and fills the index again when next run with it.
+CREATE VIRTUAL TABLE IF NOT EXISTS docs_fts USING fts5(
+    title, content, content='docs', content_rowid='id', tokenize='unicode61 remove_diacritics 2'
+);
+
+CREATE TRIGGER IF NOT EXISTS docs_fts_insert AFTER INSERT ON docs BEGIN
+    INSERT INTO docs_fts (rowid, title, content) VALUES (new.id, new.title, coalesce(new.content, ''));
+END;
+
+CREATE TRIGGER IF NOT EXISTS docs_fts_delete AFTER DELETE ON docs BEGIN
+    INSERT INTO docs_fts (docs_fts, rowid, title, content) VALUES ('delete', old.id, old.title, coalesce(old.content, ''));
+END;
+
+CREATE TRIGGER IF NOT EXISTS docs_fts_update AFTER UPDATE OF title, content ON docs BEGIN
+    INSERT INTO docs_fts (docs_fts, rowid, title, content) VALUES ('delete', old.id, old.title, coalesce(old.content, ''));
+    INSERT INTO docs_fts (rowid, title, content) VALUES (new.id, new.title, coalesce(new.content, ''));
+END;
+
 -- Indexes from migrations
-CREATE INDEX IF NOT EXISTS idx_docs_user_id ON docs(user_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_docs_user_id ON docs(user_id);
+CREATE INDEX IF NOT EXISTS idx_docs_workspace_id ON docs(workspace_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_docs_workspace_path ON docs(workspace_id, path);
+CREATE INDEX IF NOT EXISTS idx_commit_documents_doc_id ON commit_documents(doc_id, repo_path);
\ No newline at end of file
@@ -0,0 +1,139 @@
+package ws
+
+import "sync"
+
+// Backplane carries messages between the hubs of a document running on
+// different server instances. Every subscription to a channel must see the
+// messages published to it in one order shared by all subscribers, including
+// the messages its own instance published; hubs rely on that order to apply
+// edits identically everywhere.
+type Backplane interface {
+	// Publish sends payload to every subscription of channel.
+	Publish(channel string, payload []byte) error
+	// Subscribe starts receiving the messages published to channel.
+	Subscribe(channel string) (Subscription, error)
+	// Subscribers returns how many subscriptions channel has across all
+	// instances.
+	Subscribers(channel string) (int, error)
+}
+
+// Subscription is a stream of messages from one backplane channel.
+type Subscription interface {
+	// Messages is closed once the subscription is closed or its connection
+	// is lost.
+	Messages() <-chan []byte
+	Close() error
+}
+
+// MemoryBackplane connects the hubs of a single process. It is the default
+// when no shared backplane is configured.
+type MemoryBackplane struct {
+	mutex sync.Mutex
+	subs  map[string]map[*memorySubscription]bool
+}
+
+// NewMemoryBackplane returns an empty in-process backplane.
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{subs: make(map[string]map[*memorySubscription]bool)}
+}
+
+func (b *MemoryBackplane) Publish(channel string, payload []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for sub := range b.subs[channel] {
+		sub.push(payload)
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(channel string) (Subscription, error) {
+	sub := &memorySubscription{
+		backplane: b,
+		channel:   channel,
+		wake:      make(chan struct{}, 1),
+		out:       make(chan []byte),
+		closed:    make(chan struct{}),
+	}
+
+	b.mutex.Lock()
+	if b.subs[channel] == nil {
+		b.subs[channel] = make(map[*memorySubscription]bool)
+	}
+	b.subs[channel][sub] = true
+	b.mutex.Unlock()
+
+	go sub.pump()
+	return sub, nil
+}
+
+func (b *MemoryBackplane) Subscribers(channel string) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.subs[channel]), nil
+}
+
+// memorySubscription queues messages without bound, so publishing never
+// waits for a subscriber; a hub publishes from the same goroutine that
+// drains its subscription.
+type memorySubscription struct {
+	backplane *MemoryBackplane
+	channel   string
+	mutex     sync.Mutex
+	queue     [][]byte
+	wake      chan struct{}
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *memorySubscription) push(payload []byte) {
+	s.mutex.Lock()
+	s.queue = append(s.queue, payload)
+	s.mutex.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *memorySubscription) pump() {
+	defer close(s.out)
+	for {
+		s.mutex.Lock()
+		if len(s.queue) == 0 {
+			s.mutex.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.closed:
+				return
+			}
+		}
+		payload := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mutex.Unlock()
+
+		select {
+		case s.out <- payload:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *memorySubscription) Messages() <-chan []byte {
+	return s.out
+}
+
+func (s *memorySubscription) Close() error {
+	s.closeOnce.Do(func() {
+		s.backplane.mutex.Lock()
+		delete(s.backplane.subs[s.channel], s)
+		if len(s.backplane.subs[s.channel]) == 0 {
+			delete(s.backplane.subs, s.channel)
+		}
+		s.backplane.mutex.Unlock()
+		close(s.closed)
+	})
+	return nil
+}
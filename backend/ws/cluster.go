@@ -0,0 +1,366 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// syncTimeout is how long a starting hub waits for a peer on another
+// instance to send it the document state before loading it from the store.
+const syncTimeout = 500 * time.Millisecond
+
+// Kinds of envelope exchanged over the backplane.
+const (
+	// kindMessage carries a message from a client, or from the server when
+	// Client is nil, to be handled by every hub in backplane order.
+	kindMessage = "message"
+	// kindEvent carries a REST change; see events.go.
+	kindEvent = "event"
+	// kindJoin and kindLeave announce clients connecting to and leaving
+	// another instance.
+	kindJoin  = "join"
+	kindLeave = "leave"
+	// kindSyncRequest asks the running hubs for the document state, which
+	// they answer with kindSyncState.
+	kindSyncRequest = "sync_request"
+	kindSyncState   = "sync_state"
+	// kindCRDTInit creates the CRDT replica at the same point on every
+	// instance, so they generate identical ops from then on.
+	kindCRDTInit = "crdt_init"
+)
+
+// envelope is the unit published on a document's backplane channel.
+type envelope struct {
+	Kind     string      `json:"kind"`
+	Instance string      `json:"instance"`
+	Client   *peerClient `json:"client,omitempty"`
+	Message  *Message    `json:"message,omitempty"`
+	Event    *Event      `json:"event,omitempty"`
+	Presence *Presence   `json:"presence,omitempty"`
+	Request  string      `json:"request,omitempty"`
+	State    *syncState  `json:"state,omitempty"`
+	CRDT     *crdtInit   `json:"crdt,omitempty"`
+}
+
+// peerClient describes the client a message came from, so hubs on other
+// instances can attribute and authorise it.
+type peerClient struct {
+	ID          string `json:"id"`
+	UserID      string `json:"user_id"`
+	Username    string `json:"username"`
+	IsAnonymous bool   `json:"is_anonymous"`
+	CanEdit     bool   `json:"can_edit"`
+	CRDT        bool   `json:"crdt"`
+}
+
+// syncState is everything a hub needs to continue from the same point as
+// the hub that sent it.
+type syncState struct {
+	Content      string        `json:"content"`
+	Revision     int           `json:"revision"`
+	History      [][]Operation `json:"history"`
+	HistoryStart int           `json:"history_start"`
+	CRDT         *crdtInit     `json:"crdt,omitempty"`
+	Replay       *replayState  `json:"replay"`
+	// Presence lists the sender's own clients.
+	Presence []Presence `json:"presence"`
+}
+
+// crdtInit is a CRDT replica in transit. Site is shared by the replicas on
+// every instance, which all generate the same ops for the same edits.
+type crdtInit struct {
+	Site    string   `json:"site"`
+	State   []byte   `json:"state,omitempty"`
+	Pending []CRDTOp `json:"pending,omitempty"`
+}
+
+func randomID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func documentChannel(documentID string) string {
+	return "docsmith:document:" + documentID
+}
+
+func publishEnvelope(backplane Backplane, documentID string, env *envelope) error {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return backplane.Publish(documentChannel(documentID), payload)
+}
+
+func (h *Hub) publish(env *envelope) error {
+	env.Instance = h.instance
+	return publishEnvelope(h.backplane, h.DocumentID, env)
+}
+
+// join subscribes to the document's channel and takes the document state
+// from a peer hub if there is one, or from the store if not.
+func (h *Hub) join() error {
+	sub, err := h.backplane.Subscribe(documentChannel(h.DocumentID))
+	if err != nil {
+		return err
+	}
+	h.sub = sub
+
+	peers, err := h.backplane.Subscribers(documentChannel(h.DocumentID))
+	if err != nil || peers <= 1 {
+		h.loadDocument()
+		return nil
+	}
+
+	h.syncRequest = randomID()
+	if err := h.publish(&envelope{Kind: kindSyncRequest, Request: h.syncRequest}); err != nil {
+		return err
+	}
+
+	// Peers answer with their state as of our request, so messages before
+	// it are already covered and messages after it have to be replayed.
+	var backlog []*envelope
+	requested := false
+	timeout := time.NewTimer(syncTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case payload, ok := <-sub.Messages():
+			if !ok {
+				return errors.New("backplane subscription closed")
+			}
+			var env envelope
+			if err := json.Unmarshal(payload, &env); err != nil {
+				log.Printf("Hub %s: bad backplane message: %v", h.DocumentID, err)
+				continue
+			}
+			switch {
+			case env.Kind == kindSyncRequest && env.Request == h.syncRequest:
+				requested = true
+			case !requested:
+			case env.Kind == kindSyncState && env.Request == h.syncRequest:
+				if err := h.adoptState(env.State); err != nil {
+					log.Printf("Hub %s: bad state from peer: %v", h.DocumentID, err)
+					h.loadDocument()
+				}
+				h.replayBacklog(backlog)
+				return nil
+			default:
+				backlog = append(backlog, &env)
+			}
+
+		case <-timeout.C:
+			// The peers have gone, or are starting up themselves.
+			h.loadDocument()
+			h.replayBacklog(backlog)
+			return nil
+		}
+	}
+}
+
+func (h *Hub) replayBacklog(backlog []*envelope) {
+	for _, env := range backlog {
+		h.deliver(env)
+	}
+}
+
+// receive handles a payload from the backplane. It reports whether the hub
+// should stop.
+func (h *Hub) receive(payload []byte) bool {
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		log.Printf("Hub %s: bad backplane message: %v", h.DocumentID, err)
+		return false
+	}
+	return h.deliver(&env)
+}
+
+// deliver applies an envelope in backplane order. It reports whether the hub
+// should stop.
+func (h *Hub) deliver(env *envelope) bool {
+	remote := env.Instance != h.instance
+
+	switch env.Kind {
+	case kindMessage:
+		if env.Message != nil {
+			h.handleMessage(h.sender(env), env.Message)
+		}
+
+	case kindEvent:
+		if env.Event != nil {
+			return h.handleEvent(*env.Event)
+		}
+
+	case kindJoin:
+		if remote && env.Presence != nil {
+			peer := h.addPeer(*env.Presence)
+			h.notifyClientJoined(peer)
+		}
+
+	case kindLeave:
+		if remote && env.Presence != nil {
+			if peer := h.removePeer(env.Presence.ClientID); peer != nil {
+				h.notifyClientLeft(peer)
+			}
+		}
+
+	case kindSyncRequest:
+		if remote {
+			h.publish(&envelope{Kind: kindSyncState, Request: env.Request, State: h.currentState()})
+		}
+
+	case kindSyncState:
+		// Further answers to our request; the first one supplied the
+		// document, these only add their clients.
+		if remote && env.Request == h.syncRequest && env.State != nil {
+			for _, p := range env.State.Presence {
+				h.addPeer(p)
+			}
+		}
+
+	case kindCRDTInit:
+		if env.CRDT != nil {
+			h.initCRDT(env.CRDT)
+		}
+	}
+	return false
+}
+
+// sender returns the client an envelope came from: the live client for our
+// own connections, or a stand-in for clients of other instances and for
+// connections that closed while their message was in flight.
+func (h *Hub) sender(env *envelope) *Client {
+	if env.Client == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if env.Instance == h.instance {
+		for client := range h.clients {
+			if client.id == env.Client.ID {
+				return client
+			}
+		}
+	}
+	peer, ok := h.peers[env.Client.ID]
+	if !ok {
+		peer = newPeer(env.Client)
+		if env.Instance != h.instance {
+			peer.remote = true
+			h.peers[peer.id] = peer
+		}
+	}
+	peer.CanEdit = env.Client.CanEdit
+	peer.crdt = env.Client.CRDT
+	return peer
+}
+
+func newPeer(info *peerClient) *Client {
+	return &Client{
+		id:          info.ID,
+		UserID:      info.UserID,
+		Username:    info.Username,
+		IsAnonymous: info.IsAnonymous,
+		CanEdit:     info.CanEdit,
+		crdt:        info.CRDT,
+		presence: newPresence(Identity{
+			UserID:      info.UserID,
+			Username:    info.Username,
+			IsAnonymous: info.IsAnonymous,
+			CanEdit:     info.CanEdit,
+		}, info.ID),
+	}
+}
+
+// addPeer records a client connected to another instance.
+func (h *Hub) addPeer(p Presence) *Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	peer := newPeer(&peerClient{
+		ID:          p.ClientID,
+		UserID:      p.UserID,
+		Username:    p.Username,
+		IsAnonymous: p.IsAnonymous,
+		CanEdit:     p.CanEdit,
+	})
+	peer.presence = p
+	peer.remote = true
+	h.peers[p.ClientID] = peer
+	return peer
+}
+
+func (h *Hub) removePeer(clientID string) *Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	peer := h.peers[clientID]
+	delete(h.peers, clientID)
+	return peer
+}
+
+func (c *Client) peerInfo() *peerClient {
+	return &peerClient{
+		ID:          c.id,
+		UserID:      c.UserID,
+		Username:    c.Username,
+		IsAnonymous: c.IsAnonymous,
+		CanEdit:     c.CanEdit,
+		CRDT:        c.crdt,
+	}
+}
+
+// currentState captures the hub for a peer that is starting up.
+func (h *Hub) currentState() *syncState {
+	state := &syncState{
+		Content:      h.content,
+		Revision:     h.revision,
+		History:      h.history,
+		HistoryStart: h.historyStart,
+		Replay:       h.replay.state(),
+	}
+	if h.crdt != nil {
+		encoded, err := h.crdt.Encode()
+		if err != nil {
+			log.Printf("Hub %s: encoding crdt state: %v", h.DocumentID, err)
+		} else {
+			state.CRDT = &crdtInit{Site: h.crdt.site, State: encoded, Pending: h.crdt.pending}
+		}
+	}
+
+	h.mutex.Lock()
+	for client := range h.clients {
+		state.Presence = append(state.Presence, client.presence)
+	}
+	h.mutex.Unlock()
+	return state
+}
+
+func (h *Hub) adoptState(state *syncState) error {
+	if state == nil {
+		return errors.New("missing state")
+	}
+	if state.CRDT != nil {
+		seq, err := DecodeSequence(state.CRDT.State)
+		if err != nil {
+			return err
+		}
+		seq.site = state.CRDT.Site
+		seq.pending = state.CRDT.Pending
+		h.crdt = seq
+	}
+	h.content = state.Content
+	h.revision = state.Revision
+	h.history = state.History
+	h.historyStart = state.HistoryStart
+	if state.Replay != nil {
+		h.replay = replayBufferFrom(state.Replay)
+	}
+	for _, p := range state.Presence {
+		h.addPeer(p)
+	}
+	return nil
+}
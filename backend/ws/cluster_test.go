@@ -0,0 +1,244 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// memoryStore keeps one document in memory and counts what is written.
+type memoryStore struct {
+	mutex   sync.Mutex
+	content string
+	state   []byte
+	saves   int
+	commits []string
+	titles  []string
+}
+
+func (s *memoryStore) LoadDocument(string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.content, nil
+}
+
+func (s *memoryStore) LoadCRDTState(string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state, nil
+}
+
+func (s *memoryStore) SaveDocument(_ string, content string, crdtState []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.content = content
+	if crdtState != nil {
+		s.state = crdtState
+	}
+	s.saves++
+	return nil
+}
+
+func (s *memoryStore) CommitDocument(_ string, content string, _ []Participant) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.commits = append(s.commits, content)
+	return nil
+}
+
+func (s *memoryStore) RenameDocument(_ string, title string, _ Participant) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.titles = append(s.titles, title)
+	return nil
+}
+
+func (s *memoryStore) renames() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.titles...)
+}
+
+func (s *memoryStore) written() (int, []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saves, append([]string(nil), s.commits...)
+}
+
+// instance is a server instance with a registry, serving document 1 to
+// whoever connects as ?user=name.
+type instance struct {
+	registry *Registry
+	store    *memoryStore
+	server   *httptest.Server
+}
+
+func newInstance(t *testing.T, backplane Backplane, content string) *instance {
+	t.Helper()
+	store := &memoryStore{content: content}
+	registry := NewRegistry(store, backplane)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user")
+		ServeWs(registry.GetOrCreateHub("1"), Identity{UserID: user, Username: user, CanEdit: true}, w, r)
+	}))
+	t.Cleanup(server.Close)
+	return &instance{registry: registry, store: store, server: server}
+}
+
+func (in *instance) dial(t *testing.T, user string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(in.server.URL, "http") + "?user=" + user
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// flushed waits for the instance's hub to write what it has, as it does
+// when its last client leaves: a client connecting afterwards is only
+// registered once that's done. It returns the new client.
+func (in *instance) flushed(t *testing.T, user string) *websocket.Conn {
+	t.Helper()
+	conn := in.dial(t, user)
+	readType(t, conn, TypeSnapshot)
+	return conn
+}
+
+// readType reads messages until one of type typ arrives.
+func readType(t *testing.T, conn *websocket.Conn, typ string) map[string]interface{} {
+	t.Helper()
+	for {
+		var message struct {
+			Type string                 `json:"type"`
+			Data map[string]interface{} `json:"data"`
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if message.Type == typ {
+			return message.Data
+		}
+	}
+}
+
+func sendOp(t *testing.T, conn *websocket.Conn, revision int, ops ...Operation) {
+	t.Helper()
+	err := conn.WriteJSON(Message{Type: TypeOp, Data: map[string]interface{}{"revision": revision, "operations": ops}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Only the instance whose client made an edit saves and commits it, and
+// the title it gave the document.
+func TestClusterPersistsOnce(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	a := newInstance(t, backplane, "abc")
+	b := newInstance(t, backplane, "abc")
+
+	alice := a.dial(t, "alice")
+	readType(t, alice, TypeSnapshot)
+	bob := b.dial(t, "bob")
+	readType(t, bob, TypeSnapshot)
+	readType(t, alice, TypeUserJoined)
+
+	err := alice.WriteJSON(Message{Type: TypeOp, Data: map[string]interface{}{"revision": 0, "operations": []Operation{ins(3, "d")}, "title": "Renamed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readType(t, alice, TypeAck)
+	if op := readType(t, bob, TypeOp); op["title"] != "Renamed" {
+		t.Errorf("bob got %v, want the new title", op)
+	}
+
+	bob.Close()
+	readType(t, alice, TypeUserLeft)
+	carol := b.flushed(t, "carol")
+	alice.Close()
+	readType(t, carol, TypeUserLeft)
+	a.flushed(t, "dave")
+
+	if saves, commits := a.store.written(); saves == 0 || len(commits) != 1 || commits[0] != "abcd" {
+		t.Errorf("alice's instance saved %d times and committed %q", saves, commits)
+	}
+	if saves, commits := b.store.written(); saves != 0 || len(commits) != 0 {
+		t.Errorf("bob's instance saved %d times and committed %q", saves, commits)
+	}
+	if onA, onB := a.store.renames(), b.store.renames(); len(onA) != 1 || onA[0] != "Renamed" || len(onB) != 0 {
+		t.Errorf("the instances renamed the document to %q and %q", onA, onB)
+	}
+}
+
+// runCluster connects clients to two instances sharing backplane and checks
+// that edits, presence and state reach the other instance.
+func runCluster(t *testing.T, newBackplane func() Backplane) {
+	a := newInstance(t, newBackplane(), "abc")
+	b := newInstance(t, newBackplane(), "stale")
+
+	// An edit made before the second instance opens the document
+	alice := a.dial(t, "alice")
+	readType(t, alice, TypeSnapshot)
+	sendOp(t, alice, 0, ins(3, "d"))
+	readType(t, alice, TypeAck)
+
+	// The second instance starts from the first's state, not its store
+	bob := b.dial(t, "bob")
+	snapshot := readType(t, bob, TypeSnapshot)
+	if snapshot["content"] != "abcd" || snapshot["revision"] != float64(1) {
+		t.Fatalf("bob's snapshot is %v, want abcd at revision 1", snapshot)
+	}
+	presence := readType(t, bob, TypePresenceSnapshot)
+	if clients, _ := presence["clients"].([]interface{}); len(clients) != 1 {
+		t.Errorf("bob sees %v, want alice", presence["clients"])
+	}
+	if joined := readType(t, alice, TypeUserJoined); joined["username"] != "bob" {
+		t.Errorf("alice saw %v join, want bob", joined)
+	}
+
+	// Concurrent edits on both instances come out the same on each
+	sendOp(t, alice, 1, ins(0, "A"))
+	sendOp(t, bob, 1, ins(4, "B"))
+	readType(t, alice, TypeAck)
+	readType(t, bob, TypeAck)
+	carol := a.dial(t, "carol")
+	dave := b.dial(t, "dave")
+	onA, onB := readType(t, carol, TypeSnapshot), readType(t, dave, TypeSnapshot)
+	if onA["content"] != onB["content"] || onA["revision"] != onB["revision"] || onA["revision"] != float64(3) {
+		t.Fatalf("instances diverged: %v and %v", onA, onB)
+	}
+	if content, _ := onA["content"].(string); len(content) != 6 || !strings.Contains(content, "A") || !strings.Contains(content, "B") {
+		t.Errorf("content is %q, want both edits", content)
+	}
+
+	// Cursors and leaving are seen across instances too
+	if err := alice.WriteJSON(Message{Type: TypeCursor, Data: map[string]interface{}{"position": 2}}); err != nil {
+		t.Fatal(err)
+	}
+	moved := readType(t, bob, TypePresence)
+	if p, _ := moved["presence"].(map[string]interface{}); p["username"] != "alice" || p["cursor"] != float64(2) {
+		t.Errorf("bob saw %v, want alice's cursor at 2", moved)
+	}
+	alice.Close()
+	if left := readType(t, bob, TypeUserLeft); left["username"] != "alice" {
+		t.Errorf("bob saw %v leave, want alice", left)
+	}
+
+	// Events published on one instance reach clients of the other
+	a.registry.Publish("1", Event{Type: EventRenamed, Title: "Renamed"})
+	if renamed := readType(t, dave, EventRenamed); renamed["title"] != "Renamed" {
+		t.Errorf("dave got %v", renamed)
+	}
+}
+
+func TestClusterMemoryBackplane(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	runCluster(t, func() Backplane { return backplane })
+}
@@ -0,0 +1,583 @@
+package ws
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+const (
+	CRDTInsert = "insert"
+	CRDTDelete = "delete"
+)
+
+// baseSite owns the elements a sequence is seeded with when a document has
+// no stored CRDT state. Seeding is deterministic, so every replica built from
+// the same content agrees on the element identities.
+const baseSite = "base"
+
+// maxPendingOps bounds the remote ops held back waiting for their
+// dependencies. Beyond it the oldest are dropped and the sender has to sync
+// again.
+const maxPendingOps = 10000
+
+// ItemID identifies a CRDT operation. Seq counts up from 1 for each site, so a
+// state vector can describe everything a replica has seen.
+type ItemID struct {
+	Site string `json:"site"`
+	Seq  uint64 `json:"seq"`
+}
+
+// CRDTOp is one insertion or deletion of a single code point. These are what
+// replicas exchange in deltas.
+type CRDTOp struct {
+	ID   ItemID `json:"id"`
+	Kind string `json:"kind"`
+	// Clock is the Lamport timestamp used to order concurrent inserts.
+	Clock uint64 `json:"clock"`
+	// Origin is the element an insert was placed after; nil means the start
+	// of the document.
+	Origin *ItemID `json:"origin,omitempty"`
+	Value  string  `json:"value,omitempty"`
+	// Target is the element a delete removes.
+	Target *ItemID `json:"target,omitempty"`
+}
+
+// StateVector maps each site to the highest sequence number seen from it.
+type StateVector map[string]uint64
+
+type crdtElement struct {
+	id      ItemID
+	clock   uint64
+	value   rune
+	deleted bool
+	// deletedBy and deleteClock identify the op that deleted the element,
+	// so it can be sent on to replicas that haven't seen it.
+	deletedBy   ItemID
+	deleteClock uint64
+}
+
+// Sequence is a replicated growable array (RGA) over the code points of a
+// document. Local edits generate ops, remote ops are integrated in causal
+// order, and any two replicas that have seen the same ops hold the same text.
+//
+// No log of ops is kept: the elements, deleted ones included, are enough to
+// give a replica every op it is missing. Deleted elements stay as tombstones
+// since replicas that are behind still need them, in order, for each site.
+type Sequence struct {
+	site     string
+	clock    uint64
+	elements []*crdtElement
+	byID     map[ItemID]*crdtElement
+	vector   StateVector
+	// redundant are deletes of elements that were already deleted, which
+	// take a place in their site's sequence without changing anything
+	redundant []CRDTOp
+	pending   []CRDTOp
+	// last is the index of the most recently inserted element, checked
+	// first when looking up an origin since typing appends to it.
+	last int
+}
+
+// NewSequence returns a sequence holding content, editing as a fresh site.
+func NewSequence(content string) *Sequence {
+	s := newEmptySequence()
+	var origin *ItemID
+	for i, r := range []rune(content) {
+		op := CRDTOp{
+			ID:     ItemID{Site: baseSite, Seq: uint64(i + 1)},
+			Kind:   CRDTInsert,
+			Clock:  uint64(i + 1),
+			Origin: origin,
+			Value:  string(r),
+		}
+		s.integrate(op)
+		id := op.ID
+		origin = &id
+	}
+	return s
+}
+
+func newEmptySequence() *Sequence {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	return &Sequence{
+		site:   "server-" + hex.EncodeToString(buf),
+		byID:   make(map[ItemID]*crdtElement),
+		vector: make(StateVector),
+	}
+}
+
+// sequenceState is the stored form of a sequence: its elements in order,
+// with runs of elements inserted one after another by the same site, or
+// deleted one after another, folded together.
+type sequenceState struct {
+	Clock     uint64       `json:"clock"`
+	Vector    StateVector  `json:"vector"`
+	Runs      []elementRun `json:"runs"`
+	Redundant []CRDTOp     `json:"redundant,omitempty"`
+}
+
+// elementRun is consecutive elements whose ids and clocks count up by one.
+// Text holds the characters of a run of live elements; a run of deleted
+// elements has Deleted set instead, and their characters are dropped.
+type elementRun struct {
+	Site  string `json:"site"`
+	Seq   uint64 `json:"seq"`
+	Clock uint64 `json:"clock"`
+	Text  string `json:"text,omitempty"`
+	// Deleted is the number of deleted elements in the run, deleted by ops
+	// whose ids and clocks count from DeletedBy and DeleteClock in steps of
+	// DeleteStep, 1 or -1, since text is usually deleted backwards.
+	Deleted     int     `json:"deleted,omitempty"`
+	DeletedBy   *ItemID `json:"deleted_by,omitempty"`
+	DeleteClock uint64  `json:"delete_clock,omitempty"`
+	DeleteStep  int     `json:"delete_step,omitempty"`
+}
+
+// DecodeSequence rebuilds a sequence from state produced by Encode, or from
+// the list of ops it used to produce.
+func DecodeSequence(state []byte) (*Sequence, error) {
+	if trimmed := bytes.TrimSpace(state); len(trimmed) > 0 && trimmed[0] == '[' {
+		return decodeOpLog(state)
+	}
+	var stored sequenceState
+	if err := json.Unmarshal(state, &stored); err != nil {
+		return nil, fmt.Errorf("decode crdt state: %w", err)
+	}
+
+	s := newEmptySequence()
+	s.clock = stored.Clock
+	for site, seq := range stored.Vector {
+		s.vector[site] = seq
+	}
+	for _, run := range stored.Runs {
+		if run.Site == "" || run.Seq == 0 {
+			return nil, fmt.Errorf("decode crdt state: run without id")
+		}
+		n := run.Deleted
+		values := []rune(run.Text)
+		if n == 0 {
+			n = len(values)
+		}
+		step := int64(run.DeleteStep)
+		if step == 0 {
+			step = 1
+		}
+		for i := 0; i < n; i++ {
+			e := &crdtElement{
+				id:    ItemID{Site: run.Site, Seq: run.Seq + uint64(i)},
+				clock: run.Clock + uint64(i),
+			}
+			if run.Deleted > 0 {
+				if run.DeletedBy == nil {
+					return nil, fmt.Errorf("decode crdt state: deleted run without deleting op")
+				}
+				e.deleted = true
+				e.deletedBy = ItemID{Site: run.DeletedBy.Site, Seq: uint64(int64(run.DeletedBy.Seq) + step*int64(i))}
+				e.deleteClock = uint64(int64(run.DeleteClock) + step*int64(i))
+			} else {
+				e.value = values[i]
+			}
+			if _, ok := s.byID[e.id]; ok {
+				return nil, fmt.Errorf("decode crdt state: element %s:%d twice", e.id.Site, e.id.Seq)
+			}
+			s.elements = append(s.elements, e)
+			s.byID[e.id] = e
+		}
+	}
+	s.redundant = stored.Redundant
+	return s, nil
+}
+
+// decodeOpLog rebuilds a sequence from every op it integrated, as state
+// used to be stored.
+func decodeOpLog(state []byte) (*Sequence, error) {
+	var ops []CRDTOp
+	if err := json.Unmarshal(state, &ops); err != nil {
+		return nil, fmt.Errorf("decode crdt state: %w", err)
+	}
+	s := newEmptySequence()
+	if _, _, err := s.merge(ops, false); err != nil {
+		return nil, err
+	}
+	if len(s.pending) > 0 {
+		return nil, fmt.Errorf("decode crdt state: %d ops with missing dependencies", len(s.pending))
+	}
+	return s, nil
+}
+
+// Encode serialises the elements, folding runs together, so the state
+// grows with the text and the tombstones rather than with every op.
+func (s *Sequence) Encode() ([]byte, error) {
+	stored := sequenceState{Clock: s.clock, Vector: s.vector, Runs: []elementRun{}, Redundant: s.redundant}
+	var run *elementRun
+	var last *crdtElement
+	for _, e := range s.elements {
+		if run != nil && extendsRun(run, last, e) {
+			if e.deleted {
+				run.Deleted++
+				if run.DeleteStep == 0 {
+					run.DeleteStep = int(int64(e.deletedBy.Seq) - int64(last.deletedBy.Seq))
+				}
+			} else {
+				run.Text += string(e.value)
+			}
+			last = e
+			continue
+		}
+		stored.Runs = append(stored.Runs, elementRun{Site: e.id.Site, Seq: e.id.Seq, Clock: e.clock})
+		run = &stored.Runs[len(stored.Runs)-1]
+		if e.deleted {
+			deletedBy := e.deletedBy
+			run.Deleted = 1
+			run.DeletedBy = &deletedBy
+			run.DeleteClock = e.deleteClock
+		} else {
+			run.Text = string(e.value)
+		}
+		last = e
+	}
+	return json.Marshal(stored)
+}
+
+// extendsRun reports whether e can follow last, the end of run.
+func extendsRun(run *elementRun, last, e *crdtElement) bool {
+	if e.id.Site != last.id.Site || e.id.Seq != last.id.Seq+1 || e.clock != last.clock+1 || e.deleted != last.deleted {
+		return false
+	}
+	if !e.deleted {
+		return true
+	}
+	if e.deletedBy.Site != last.deletedBy.Site {
+		return false
+	}
+	step := int64(e.deletedBy.Seq) - int64(last.deletedBy.Seq)
+	if step != 1 && step != -1 || run.DeleteStep != 0 && step != int64(run.DeleteStep) {
+		return false
+	}
+	return int64(e.deleteClock)-int64(last.deleteClock) == step
+}
+
+// Text returns the visible document.
+func (s *Sequence) Text() string {
+	runes := make([]rune, 0, len(s.elements))
+	for _, e := range s.elements {
+		if !e.deleted {
+			runes = append(runes, e.value)
+		}
+	}
+	return string(runes)
+}
+
+// StateVector returns a copy of the replica's state vector.
+func (s *Sequence) StateVector() StateVector {
+	sv := make(StateVector, len(s.vector))
+	for site, seq := range s.vector {
+		sv[site] = seq
+	}
+	return sv
+}
+
+// Delta returns the ops a replica with the given state vector is missing, in
+// an order it can integrate them. Each insert is placed after the nearest
+// element before it that was inserted earlier, which isn't necessarily
+// where it was first made; RGA puts it in the same place either way.
+func (s *Sequence) Delta(sv StateVector) []CRDTOp {
+	ops := []CRDTOp{}
+	// earlier holds the elements that are, so far, the nearest ones
+	// inserted before each element to come
+	var earlier []*crdtElement
+	for _, e := range s.elements {
+		for len(earlier) > 0 && !insertedBefore(earlier[len(earlier)-1], e) {
+			earlier = earlier[:len(earlier)-1]
+		}
+		if e.id.Seq > sv[e.id.Site] {
+			op := CRDTOp{ID: e.id, Kind: CRDTInsert, Clock: e.clock, Value: string(e.value)}
+			if e.deleted && e.value == 0 {
+				// A tombstone whose character wasn't kept
+				op.Value = string('\uFFFD')
+			}
+			if len(earlier) > 0 {
+				origin := earlier[len(earlier)-1].id
+				op.Origin = &origin
+			}
+			ops = append(ops, op)
+		}
+		if e.deleted && e.deletedBy.Seq > sv[e.deletedBy.Site] {
+			target := e.id
+			ops = append(ops, CRDTOp{ID: e.deletedBy, Kind: CRDTDelete, Clock: e.deleteClock, Target: &target})
+		}
+		earlier = append(earlier, e)
+	}
+	for _, op := range s.redundant {
+		if op.ID.Seq > sv[op.ID.Site] {
+			ops = append(ops, op)
+		}
+	}
+	// Each site's ops in the order it made them, which their clocks follow
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Clock != ops[j].Clock {
+			return ops[i].Clock < ops[j].Clock
+		}
+		if ops[i].ID.Site != ops[j].ID.Site {
+			return ops[i].ID.Site < ops[j].ID.Site
+		}
+		return ops[i].ID.Seq < ops[j].ID.Seq
+	})
+	return ops
+}
+
+// ApplyLocal records positional edits made on this replica and returns the
+// CRDT ops describing them.
+func (s *Sequence) ApplyLocal(ops []Operation) ([]CRDTOp, error) {
+	var out []CRDTOp
+	for _, op := range ops {
+		switch op.Type {
+		case OpInsert:
+			origin, err := s.visibleID(op.Position - 1)
+			if err != nil {
+				return out, err
+			}
+			for _, r := range op.Text {
+				c := s.nextOp(CRDTInsert)
+				c.Origin = origin
+				c.Value = string(r)
+				s.integrate(c)
+				out = append(out, c)
+				id := c.ID
+				origin = &id
+			}
+		case OpDelete:
+			if op.Position < 0 {
+				return out, fmt.Errorf("position %d out of range", op.Position)
+			}
+			for i := 0; i < op.Length; i++ {
+				target, err := s.visibleID(op.Position)
+				if err != nil {
+					return out, err
+				}
+				c := s.nextOp(CRDTDelete)
+				c.Target = target
+				s.integrate(c)
+				out = append(out, c)
+			}
+		default:
+			return out, fmt.Errorf("unknown operation type %q", op.Type)
+		}
+	}
+	return out, nil
+}
+
+// Merge integrates remote ops. Ops whose dependencies have not arrived yet
+// are held back until they do, up to maxPendingOps of them; past that the
+// oldest are dropped and an error is returned along with whatever was
+// integrated. It returns the ops that were integrated and the equivalent
+// positional edits, in the order they took effect.
+func (s *Sequence) Merge(ops []CRDTOp) ([]CRDTOp, []Operation, error) {
+	return s.merge(ops, true)
+}
+
+func (s *Sequence) merge(ops []CRDTOp, wantEdits bool) ([]CRDTOp, []Operation, error) {
+	for _, op := range ops {
+		if err := validateCRDTOp(op); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var integrated []CRDTOp
+	var edits []Operation
+	// Ops sent again while still waiting are only kept once
+	queue := s.pending
+	waitingIDs := make(map[ItemID]bool, len(queue))
+	for _, op := range queue {
+		waitingIDs[op.ID] = true
+	}
+	for _, op := range ops {
+		if !waitingIDs[op.ID] {
+			waitingIDs[op.ID] = true
+			queue = append(queue, op)
+		}
+	}
+	s.pending = nil
+	for progress := true; progress; {
+		progress = false
+		var waiting []CRDTOp
+		for _, op := range queue {
+			if op.ID.Seq <= s.vector[op.ID.Site] {
+				continue // already seen
+			}
+			if !s.ready(op) {
+				waiting = append(waiting, op)
+				continue
+			}
+			if e := s.integrate(op); e != nil && wantEdits {
+				edits = append(edits, s.edit(op, e))
+			}
+			integrated = append(integrated, op)
+			progress = true
+		}
+		queue = waiting
+	}
+	if len(queue) > maxPendingOps {
+		dropped := len(queue) - maxPendingOps
+		s.pending = queue[dropped:]
+		return integrated, edits, fmt.Errorf("dropped %d crdt ops still missing their dependencies", dropped)
+	}
+	s.pending = queue
+	return integrated, edits, nil
+}
+
+func validateCRDTOp(op CRDTOp) error {
+	if op.ID.Site == "" || op.ID.Seq == 0 {
+		return fmt.Errorf("crdt op without id")
+	}
+	switch op.Kind {
+	case CRDTInsert:
+		if len([]rune(op.Value)) != 1 {
+			return fmt.Errorf("crdt insert must carry exactly one character")
+		}
+	case CRDTDelete:
+		if op.Target == nil {
+			return fmt.Errorf("crdt delete without target")
+		}
+	default:
+		return fmt.Errorf("unknown crdt op kind %q", op.Kind)
+	}
+	return nil
+}
+
+// ready reports whether everything op depends on has been integrated.
+func (s *Sequence) ready(op CRDTOp) bool {
+	if op.ID.Seq != s.vector[op.ID.Site]+1 {
+		return false
+	}
+	dep := op.Origin
+	if op.Kind == CRDTDelete {
+		dep = op.Target
+	}
+	if dep == nil {
+		return true
+	}
+	_, ok := s.byID[*dep]
+	return ok
+}
+
+func (s *Sequence) nextOp(kind string) CRDTOp {
+	return CRDTOp{
+		ID:    ItemID{Site: s.site, Seq: s.vector[s.site] + 1},
+		Kind:  kind,
+		Clock: s.clock + 1,
+	}
+}
+
+// integrate applies an op whose dependencies are present. It returns the
+// element that was inserted or deleted, or nil if the op changed nothing.
+func (s *Sequence) integrate(op CRDTOp) *crdtElement {
+	s.vector[op.ID.Site] = op.ID.Seq
+	s.clock = max(s.clock, op.Clock)
+
+	if op.Kind == CRDTDelete {
+		e := s.byID[*op.Target]
+		if e.deleted {
+			s.redundant = append(s.redundant, op)
+			return nil
+		}
+		e.deleted = true
+		e.deletedBy = op.ID
+		e.deleteClock = op.Clock
+		return e
+	}
+
+	i := 0
+	if op.Origin != nil {
+		i = s.index(s.byID[*op.Origin]) + 1
+	}
+	// RGA: concurrent inserts after the same origin are ordered by
+	// descending timestamp; later elements win the spot next to the origin.
+	for i < len(s.elements) && s.after(s.elements[i], op) {
+		i++
+	}
+	e := &crdtElement{id: op.ID, clock: op.Clock, value: []rune(op.Value)[0]}
+	s.elements = append(s.elements, nil)
+	copy(s.elements[i+1:], s.elements[i:])
+	s.elements[i] = e
+	s.byID[op.ID] = e
+	s.last = i
+	return e
+}
+
+// edit returns the positional edit an integrated op made to the text.
+func (s *Sequence) edit(op CRDTOp, e *crdtElement) Operation {
+	if op.Kind == CRDTDelete {
+		// Deleted elements are skipped when counting, so this is the
+		// position the character occupied.
+		return Operation{Type: OpDelete, Position: s.visibleIndex(e), Length: 1}
+	}
+	return Operation{Type: OpInsert, Position: s.visibleIndex(e), Text: op.Value}
+}
+
+// insertedBefore reports whether a was inserted before b in the order RGA
+// gives concurrent inserts, by clock and then site.
+func insertedBefore(a, b *crdtElement) bool {
+	if a.clock != b.clock {
+		return a.clock < b.clock
+	}
+	return a.id.Site < b.id.Site
+}
+
+// after reports whether existing element e sorts before an insert of op.
+func (s *Sequence) after(e *crdtElement, op CRDTOp) bool {
+	if e.clock != op.Clock {
+		return e.clock > op.Clock
+	}
+	return e.id.Site > op.ID.Site
+}
+
+func (s *Sequence) index(e *crdtElement) int {
+	if s.last < len(s.elements) && s.elements[s.last] == e {
+		return s.last
+	}
+	for i, other := range s.elements {
+		if other == e {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Sequence) visibleIndex(e *crdtElement) int {
+	n := 0
+	for _, other := range s.elements {
+		if other == e {
+			return n
+		}
+		if !other.deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// visibleID returns the id of the element at visible position pos, or nil
+// for -1, the start of the document.
+func (s *Sequence) visibleID(pos int) (*ItemID, error) {
+	if pos == -1 {
+		return nil, nil
+	}
+	n := 0
+	for _, e := range s.elements {
+		if e.deleted {
+			continue
+		}
+		if n == pos {
+			id := e.id
+			return &id, nil
+		}
+		n++
+	}
+	return nil, fmt.Errorf("position %d out of range", pos)
+}
@@ -0,0 +1,170 @@
+package ws
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// randomEdit makes a random positional edit to text.
+func randomEdit(rng *rand.Rand, text string) []Operation {
+	n := len([]rune(text))
+	if n > 0 && rng.Intn(3) == 0 {
+		pos := rng.Intn(n)
+		return []Operation{{Type: OpDelete, Position: pos, Length: 1 + rng.Intn(min(3, n-pos))}}
+	}
+	return []Operation{{Type: OpInsert, Position: rng.Intn(n + 1), Text: string(rune('a' + rng.Intn(26)))}}
+}
+
+func mustMerge(t *testing.T, s *Sequence, ops []CRDTOp) {
+	t.Helper()
+	if _, _, err := s.Merge(ops); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.pending) > 0 {
+		t.Fatalf("%d ops left pending", len(s.pending))
+	}
+}
+
+func reencode(t *testing.T, s *Sequence) *Sequence {
+	t.Helper()
+	state, err := s.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeSequence(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded.site = s.site
+	return decoded
+}
+
+// Replicas that catch up through Delta, from a sequence restored from its
+// encoded state, end up with the same text as those that saw every op, and
+// keep agreeing as they go on editing.
+func TestSequenceDeltaConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 50; round++ {
+		server := NewSequence("hello world")
+		a, b := NewSequence("hello world"), NewSequence("hello world")
+
+		// a and b edit concurrently, exchanging ops with the server in
+		// batches
+		for i := 0; i < 20; i++ {
+			for _, client := range []*Sequence{a, b} {
+				ops, err := client.ApplyLocal(randomEdit(rng, client.Text()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				mustMerge(t, server, ops)
+			}
+			if rng.Intn(3) == 0 {
+				mustMerge(t, a, server.Delta(a.StateVector()))
+				mustMerge(t, b, server.Delta(b.StateVector()))
+			}
+		}
+
+		restored := reencode(t, server)
+		if restored.Text() != server.Text() {
+			t.Fatalf("restored %q, want %q", restored.Text(), server.Text())
+		}
+		late := NewSequence("hello world")
+		for _, client := range []*Sequence{a, b, late} {
+			mustMerge(t, client, restored.Delta(client.StateVector()))
+			if client.Text() != server.Text() {
+				t.Fatalf("round %d: replica has %q, want %q", round, client.Text(), server.Text())
+			}
+		}
+
+		// Concurrent edits after the catch up still converge
+		opsA, _ := a.ApplyLocal(randomEdit(rng, a.Text()))
+		opsLate, _ := late.ApplyLocal(randomEdit(rng, late.Text()))
+		mustMerge(t, restored, opsA)
+		mustMerge(t, restored, opsLate)
+		mustMerge(t, a, opsLate)
+		mustMerge(t, late, opsA)
+		if a.Text() != restored.Text() || late.Text() != restored.Text() {
+			t.Fatalf("round %d: diverged: %q, %q, %q", round, a.Text(), late.Text(), restored.Text())
+		}
+	}
+}
+
+// Typing and deleting text leaves a state the size of what's left, not of
+// every keystroke.
+func TestSequenceEncodeFoldsRuns(t *testing.T) {
+	s := NewSequence("")
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 100; i++ {
+			if _, err := s.ApplyLocal([]Operation{{Type: OpInsert, Position: len([]rune(s.Text())), Text: "x"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Backspace it all away again, but the first character
+		for len([]rune(s.Text())) > round+1 {
+			if _, err := s.ApplyLocal([]Operation{{Type: OpDelete, Position: len([]rune(s.Text())) - 1, Length: 1}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	state, err := s.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored sequenceState
+	if err := json.Unmarshal(state, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Runs) > 40 {
+		t.Errorf("got %d runs for 20 bursts of typing", len(stored.Runs))
+	}
+	if restored := reencode(t, s); restored.Text() != s.Text() {
+		t.Errorf("restored %q, want %q", restored.Text(), s.Text())
+	}
+}
+
+// State stored as a list of ops, as it used to be, can still be read.
+func TestDecodeSequenceOpLog(t *testing.T) {
+	s := NewSequence("")
+	ops, err := s.ApplyLocal([]Operation{{Type: OpInsert, Position: 0, Text: "hello"}, {Type: OpDelete, Position: 0, Length: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, _ := json.Marshal(ops)
+	decoded, err := DecodeSequence(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Text() != "ello" {
+		t.Errorf("got %q, want %q", decoded.Text(), "ello")
+	}
+}
+
+// Ops that can never be integrated don't pile up.
+func TestSequencePendingIsBounded(t *testing.T) {
+	s := NewSequence("")
+	var orphans []CRDTOp
+	for i := 0; i < maxPendingOps+10; i++ {
+		orphans = append(orphans, CRDTOp{
+			ID:     ItemID{Site: "gone", Seq: uint64(i + 2)},
+			Kind:   CRDTInsert,
+			Clock:  uint64(i + 2),
+			Origin: &ItemID{Site: "gone", Seq: uint64(i + 1)},
+			Value:  "x",
+		})
+	}
+	_, _, err := s.Merge(orphans)
+	if err == nil || !strings.Contains(err.Error(), "dropped 10") {
+		t.Errorf("got error %v, want 10 ops dropped", err)
+	}
+	if len(s.pending) != maxPendingOps {
+		t.Errorf("%d ops pending, want %d", len(s.pending), maxPendingOps)
+	}
+	// Sending the same ops again doesn't add to them
+	s.Merge(orphans[len(orphans)-5:])
+	if len(s.pending) != maxPendingOps {
+		t.Errorf("%d ops pending after resending, want %d", len(s.pending), maxPendingOps)
+	}
+}
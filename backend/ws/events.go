@@ -0,0 +1,69 @@
+package ws
+
+// Types of Event, each sent on to clients as a message of the same type.
+const (
+	EventUpdated  = "document_updated"
+	EventRenamed  = "document_renamed"
+	EventVersion  = "version_created"
+	EventRestored = "version_restored"
+	EventReverted = "version_reverted"
+	EventMerged   = "draft_merged"
+	// EventConflict warns that an edit made outside DocSmith conflicts with
+	// the document's unsaved changes.
+	EventConflict = "external_edit_conflict"
+	EventDeleted  = "deleted"
+)
+
+// Event is a change made to a document outside its hub, usually through the
+// REST API. Content is nil when the event doesn't change the text.
+type Event struct {
+	Type    string  `json:"type"`
+	UserID  string  `json:"user_id,omitempty"`
+	Title   string  `json:"title,omitempty"`
+	Content *string `json:"content,omitempty"`
+	// Hash and Message describe the commit behind version events.
+	Hash    string `json:"hash,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// handleEvent folds an event into the hub's state and tells the clients. It
+// reports whether the hub should stop.
+func (h *Hub) handleEvent(event Event) bool {
+	if event.Type == EventDeleted {
+		h.discardPending()
+		h.broadcast(newMessage(EventDeleted, EventPayload{
+			DocumentID: h.DocumentID,
+			UserID:     event.UserID,
+		}), nil)
+		h.disconnectAll()
+		return h.stopIfEmpty()
+	}
+
+	if event.Content != nil {
+		if ops := DiffOperations(h.content, *event.Content); len(ops) > 0 {
+			h.applyOperations(nil, h.revision, ops, event.Title)
+		}
+	}
+
+	message := newMessage(event.Type, EventPayload{
+		DocumentID: h.DocumentID,
+		UserID:     event.UserID,
+		Revision:   h.revision,
+		Title:      event.Title,
+		Hash:       event.Hash,
+		Message:    event.Message,
+	})
+	h.record(message)
+	h.broadcast(message, nil)
+	return false
+}
+
+// disconnectAll closes every client connection.
+func (h *Hub) disconnectAll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for client := range h.clients {
+		client.outbox.close(false)
+		delete(h.clients, client)
+	}
+}
@@ -2,6 +2,8 @@ package ws
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
@@ -10,272 +12,884 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// maxHistory is how many applied revisions a hub keeps around for
+// transforming late operations. Clients further behind get a fresh snapshot.
+const maxHistory = 500
+
+// Identity describes who a connection belongs to and what it may do. The API
+// layer fills it in after authenticating the handshake.
+type Identity struct {
+	UserID      string
+	Username    string
+	IsAnonymous bool
+	// CanEdit is false for read-only share links.
+	CanEdit bool
+}
+
 type Client struct {
 	hub  *Hub
 	conn *websocket.Conn
-	send chan []byte
+	// outbox holds messages waiting for the write pump
+	outbox *outbox
+	// id tells connections apart across instances
+	id string
 	// Add document-specific metadata
-	DocumentID string
-	UserID     string
-	Username   string
+	DocumentID  string
+	UserID      string
+	Username    string
 	IsAnonymous bool
+	CanEdit     bool
+	// presence is guarded by the hub mutex
+	presence Presence
+	// crdt is set once the client syncs through the CRDT protocol; it then
+	// receives crdt_delta messages instead of positional ops.
+	crdt bool
+	// remote is set on the stand-ins for clients of other instances, which
+	// save and commit their own clients' edits.
+	remote bool
 }
 type Message struct {
 	Type string                 `json:"type"`
 	Data map[string]interface{} `json:"data"`
 }
 
+// inboundMessage is a message read from a client socket, tagged with the
+// client that sent it.
+type inboundMessage struct {
+	client  *Client
+	message *Message
+	// payload is the message's data decoded by parseMessage
+	payload interface{}
+}
+
 type Hub struct {
 	// Document ID this hub is for
 	DocumentID string
 	// Map of connected clients
-	clients    map[*Client]bool
+	clients map[*Client]bool
 	// Channel for outgoing messages
-	Broadcast  chan *Message
+	Broadcast chan *Message
+	// Channel for messages read from clients
+	inbound chan *inboundMessage
 	// Channel for registering clients
-	register   chan *Client
+	register chan *Client
 	// Channel for unregistering clients
 	unregister chan *Client
+	// Closed once the hub has stopped running
+	done chan struct{}
 	// Protect the clients map during concurrent access
-	mutex      sync.Mutex
+	mutex sync.Mutex
+
+	registry *Registry
+	store    Store
+	limits   Limits
+	metrics  *Metrics
+
+	// Hubs for the same document on other instances are kept in step
+	// through the backplane; see cluster.go. Every edit goes out on it and
+	// is applied when it comes back, in the order all hubs see.
+	backplane   Backplane
+	instance    string
+	sub         Subscription
+	syncRequest string
+	// peers are stand-ins for clients connected to other instances
+	peers map[string]*Client
+	// err is set if the hub could not start
+	err error
+
+	// Canonical document state. Only the Run goroutine touches these.
+	content  string
+	revision int
+	// history[i] holds the operations that produced revision historyStart+i+1
+	history      [][]Operation
+	historyStart int
+	// replay keeps recent broadcasts for clients that reconnect
+	replay *replayBuffer
+	// idleTimer stops the hub once it has been empty for idleGrace
+	idleTimer *time.Timer
+
+	// CRDT replica of the same content, created when the first client syncs
+	// through the CRDT protocol and kept in step with every edit after that.
+	crdt *Sequence
+	// crdtWaiting holds clients whose crdt_sync waits for the replica
+	crdtWaiting []crdtWaiter
+
+	// Persistence of client edits; see persist.go.
+	saves        chan *saveJob
+	saveTimer    *time.Timer
+	commitTimer  *time.Timer
+	dirty        bool
+	uncommitted  bool
+	participants []Participant
+	// title is a rename not yet written, made by renamedBy
+	title     string
+	renamedBy Participant
 }
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{Subprotocol(ProtocolVersion)},
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
+
 func NewHub(documentID string) *Hub {
 	return &Hub{
-		DocumentID: documentID,
-		clients:    make(map[*Client]bool),
-		Broadcast:  make(chan *Message),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+		DocumentID:  documentID,
+		clients:     make(map[*Client]bool),
+		Broadcast:   make(chan *Message),
+		inbound:     make(chan *inboundMessage),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		done:        make(chan struct{}),
+		backplane:   NewMemoryBackplane(),
+		instance:    randomID(),
+		peers:       make(map[string]*Client),
+		replay:      newReplayBuffer(),
+		idleTimer:   newStoppedTimer(),
+		limits:      DefaultLimits(),
+		metrics:     &Metrics{},
+		saves:       make(chan *saveJob, 1),
+		saveTimer:   newStoppedTimer(),
+		commitTimer: newStoppedTimer(),
 	}
 }
 
-
-var documentHubs = make(map[string]*Hub)
-var hubsMutex sync.Mutex
-
-
-func GetOrCreateHub(documentID string) *Hub {
-	hubsMutex.Lock()
-	defer hubsMutex.Unlock()
-	
-	hub, exists := documentHubs[documentID]
-	if !exists {
-		hub = NewHub(documentID)
-		documentHubs[documentID] = hub
-		go hub.Run()
+func (h *Hub) Run() {
+	if err := h.join(); err != nil {
+		log.Printf("Hub %s: joining backplane: %v", h.DocumentID, err)
+		h.err = err
+		if h.sub != nil {
+			h.sub.Close()
+		}
+		h.stopIfEmpty()
+		return
 	}
-	
-	return hub
-}
+	go h.saveLoop()
 
-func (h *Hub) Run() {
 	for {
 		select {
 		case client := <-h.register:
 			h.mutex.Lock()
 			h.clients[client] = true
+			h.mutex.Unlock()
+			h.idleTimer.Stop()
+
+			h.sendTo(client, h.snapshotMessage())
+			h.sendPresenceSnapshot(client)
 			// Notify others that someone joined
 			if client.Username != "" {
 				h.notifyClientJoined(client)
 			}
-			h.mutex.Unlock()
-			
+			h.publish(&envelope{Kind: kindJoin, Presence: &client.presence})
+
 		case client := <-h.unregister:
 			h.mutex.Lock()
-			if _, ok := h.clients[client]; ok {
+			_, ok := h.clients[client]
+			if ok {
 				delete(h.clients, client)
-				close(client.send)
-				// Notify others that someone left
-				if client.Username != "" {
-					h.notifyClientLeft(client)
-				}
-			}
-			
-			// If no clients left, remove this hub
-			if len(h.clients) == 0 {
-				hubsMutex.Lock()
-				delete(documentHubs, h.DocumentID)
-				hubsMutex.Unlock()
+				client.outbox.close(false)
 			}
 			h.mutex.Unlock()
-			
+
+			// Notify others that someone left
+			if ok && client.Username != "" {
+				h.notifyClientLeft(client)
+			}
+			if ok {
+				h.publish(&envelope{Kind: kindLeave, Presence: &client.presence})
+			}
+
+			// If no clients left, save, and remove this hub unless
+			// someone comes back in time to resume
+			if h.clientCount() == 0 {
+				h.flush()
+				h.idleTimer.Reset(idleGrace)
+			}
+
+		case <-h.idleTimer.C:
+			h.flush()
+			if h.stopIfEmpty() {
+				h.shutdown()
+				return
+			}
+
+		case in := <-h.inbound:
+			h.accept(in.client, in.message, in.payload)
+
 		case message := <-h.Broadcast:
-			msgJSON, err := json.Marshal(message)
-			if err != nil {
-				log.Printf("Error marshaling message: %v", err)
-				continue
+			if err := h.publish(&envelope{Kind: kindMessage, Message: message}); err != nil {
+				log.Printf("Hub %s: publishing message: %v", h.DocumentID, err)
 			}
-			
-			h.mutex.Lock()
-			for client := range h.clients {
-				select {
-				case client.send <- msgJSON:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+
+		case payload, ok := <-h.sub.Messages():
+			if !ok {
+				// Without the backplane this hub would drift from its
+				// peers; drop the clients so they reconnect and resync.
+				log.Printf("Hub %s: lost backplane subscription", h.DocumentID)
+				h.disconnectAll()
+				h.flush()
+				h.stopIfEmpty()
+				h.shutdown()
+				return
 			}
-			h.mutex.Unlock()
+			if h.receive(payload) {
+				h.shutdown()
+				return
+			}
+
+		case <-h.saveTimer.C:
+			h.queueSave(false, nil)
+
+		case <-h.commitTimer.C:
+			h.queueSave(true, nil)
 		}
 	}
 }
-// In client.readPump()
-func (c *Client) readPump() {
-    defer func() {
-        c.hub.unregister <- c
-        c.conn.Close()
-    }()
-    
-    c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-    c.conn.SetPongHandler(func(string) error {
-        c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-        return nil
-    })
-    
-    for {
-        _, message, err := c.conn.ReadMessage()
-        if err != nil {
-            if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-                log.Printf("WebSocket read error: %v", err)
-            }
-            break
-        }
-        
-        var msg Message
-        if err := json.Unmarshal(message, &msg); err != nil {
-            log.Printf("Error unmarshaling message: %v", err)
-            continue
-        }
-        
-        // Handle ping messages
-        if msg.Type == "ping" {
-            // Just ignore ping messages, they're just keeping the connection alive
-            continue
-        }
-        
-        c.hub.Broadcast <- &msg
-    }
+
+// shutdown stops the hub's timers and its save loop once it has left the
+// registry.
+func (h *Hub) shutdown() {
+	h.sub.Close()
+	h.saveTimer.Stop()
+	h.commitTimer.Stop()
+	h.idleTimer.Stop()
+	close(h.saves)
 }
 
-func (c *Client) writePump() {
-	defer func() {
-		c.conn.Close()
-	}()
+func (h *Hub) loadDocument() {
+	if h.store == nil {
+		return
+	}
+	content, err := h.store.LoadDocument(h.DocumentID)
+	if err != nil {
+		log.Printf("Error loading document %s: %v", h.DocumentID, err)
+		return
+	}
+	h.content = content
+}
 
-	for {
-		message, ok := <-c.send
-		if !ok {
-			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+func (h *Hub) clientCount() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.clients)
+}
+
+// stopIfEmpty removes the hub from the registry once its last client has
+// gone. It reports whether the hub stopped.
+func (h *Hub) stopIfEmpty() bool {
+	if h.registry != nil {
+		h.registry.mutex.Lock()
+		defer h.registry.mutex.Unlock()
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.clients) > 0 {
+		return false
+	}
+	if h.registry != nil {
+		h.registry.remove(h)
+	}
+	close(h.done)
+	return true
+}
+
+// accept takes a validated message read from a local client. Anything that
+// changes shared state goes out on the backplane and is handled when it
+// comes back.
+func (h *Hub) accept(client *Client, message *Message, payload interface{}) {
+	spec, _ := clientMessage(message.Type)
+	if spec.Edit && !client.CanEdit {
+		h.reject(client, &ProtocolError{Code: ErrReadOnly, Message: "this connection can not edit the document", Type: message.Type})
+		return
+	}
+
+	switch p := payload.(type) {
+	case JoinPayload:
+		if p.DocumentID != "" && p.DocumentID != h.DocumentID {
+			h.reject(client, &ProtocolError{Code: ErrInvalidMessage, Message: "connected to document " + h.DocumentID, Type: message.Type})
+		}
+		return
+	case PingPayload:
+		return
+	case ResumePayload:
+		h.resume(client, p)
+		return
+	case CRDTSyncPayload:
+		h.syncCRDT(client, p.StateVector)
+		return
+	}
+
+	err := h.publish(&envelope{Kind: kindMessage, Client: client.peerInfo(), Message: message})
+	if err != nil {
+		log.Printf("Hub %s: publishing message: %v", h.DocumentID, err)
+		h.sendError(client, ErrUnavailable, "the edit could not be shared, try again")
+	}
+}
+
+// handleMessage processes a message from client, or from the server itself
+// when client is nil. Messages from clients were validated before they were
+// published.
+func (h *Hub) handleMessage(client *Client, message *Message) {
+	spec, ok := clientMessage(message.Type)
+	if !ok {
+		log.Printf("Hub %s: ignoring %q message", h.DocumentID, message.Type)
+		return
+	}
+	if client != nil && spec.Edit && !client.CanEdit {
+		h.sendError(client, ErrReadOnly, "this connection can not edit the document")
+		return
+	}
+
+	switch message.Type {
+	case TypeOp:
+		var payload OpPayload
+		if err := decodeData(message.Data, &payload); err != nil {
+			h.sendError(client, ErrInvalidMessage, err.Error())
+			return
+		}
+		h.applyOperations(client, payload.Revision, payload.Operations, payload.Title)
+
+	case TypeUpdate:
+		// Whole-content updates from older clients and REST saves are turned
+		// into operations against the canonical content, so they take part in
+		// the same revision sequence as everything else.
+		var payload UpdatePayload
+		if err := decodeData(message.Data, &payload); err != nil {
+			h.sendError(client, ErrInvalidMessage, err.Error())
+			return
+		}
+		var ops []Operation
+		if payload.Content != nil {
+			ops = DiffOperations(h.content, *payload.Content)
+		}
+		if len(ops) == 0 && payload.Title == "" {
+			return
+		}
+		h.applyOperations(client, h.revision, ops, payload.Title)
+
+	case TypeCursor, TypeSelection, TypePresence:
+		if client == nil {
+			return
+		}
+		h.updatePresence(client, message)
+
+	case TypeComment:
+		if client == nil {
+			return
+		}
+		var payload CommentPayload
+		if err := decodeData(message.Data, &payload); err != nil {
+			h.sendError(client, ErrInvalidMessage, err.Error())
+			return
+		}
+		h.comment(client, payload)
+
+	case TypeCRDTDelta:
+		if client == nil || !client.crdt {
+			h.sendError(client, ErrCRDTNotSynced, "send crdt_sync before crdt_delta")
+			return
+		}
+		var payload CRDTDeltaPayload
+		if err := decodeData(message.Data, &payload); err != nil {
+			h.sendError(client, ErrInvalidMessage, err.Error())
+			return
+		}
+		h.mergeCRDT(client, payload.Ops)
+	}
+}
+
+// comment passes a comment on to everyone, the sender included so it learns
+// the comment's id.
+func (h *Hub) comment(client *Client, payload CommentPayload) {
+	message := newMessage(TypeComment, CommentBroadcastPayload{
+		ID:       h.nextCommentID(),
+		UserID:   client.UserID,
+		Username: client.Username,
+		Text:     payload.Text,
+		Anchor:   payload.Anchor,
+		ReplyTo:  payload.ReplyTo,
+	})
+	h.record(message)
+	h.broadcast(message, nil)
+}
+
+// nextCommentID numbers comments within the replay stream, which every
+// instance agrees on.
+func (h *Hub) nextCommentID() string {
+	return fmt.Sprintf("%s-%d", h.replay.epoch, h.replay.seq+1)
+}
+
+// crdtWaiter is a crdt_sync waiting for the hub's replica to be created.
+type crdtWaiter struct {
+	client *Client
+	vector StateVector
+}
+
+// syncCRDT answers a client's crdt_sync. The first one for a document asks
+// every instance to create the replica, from the stored state, at the same
+// point in the edit order.
+func (h *Hub) syncCRDT(client *Client, vector StateVector) {
+	if h.crdt != nil {
+		h.sendCRDTDelta(client, vector)
+		return
+	}
+
+	h.crdtWaiting = append(h.crdtWaiting, crdtWaiter{client: client, vector: vector})
+	if len(h.crdtWaiting) > 1 {
+		return
+	}
+
+	init := &crdtInit{Site: "server-" + randomID()}
+	if h.store != nil {
+		state, err := h.store.LoadCRDTState(h.DocumentID)
+		if err != nil {
+			h.failCRDT(err)
 			return
 		}
+		init.State = state
+	}
+	if err := h.publish(&envelope{Kind: kindCRDTInit, CRDT: init}); err != nil {
+		h.failCRDT(err)
+	}
+}
 
-		if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+// initCRDT creates the hub's replica, catching it up with any edits made to
+// the content since its state was saved, and answers the waiting clients.
+func (h *Hub) initCRDT(init *crdtInit) {
+	if h.crdt == nil {
+		var seq *Sequence
+		if init.State == nil {
+			seq = NewSequence(h.content)
+		} else {
+			var err error
+			if seq, err = DecodeSequence(init.State); err != nil {
+				h.failCRDT(err)
+				return
+			}
+		}
+		// Every instance edits the replica as the same site, so the
+		// catch-up below and all later edits produce identical ops.
+		seq.site = init.Site
+		if _, err := seq.ApplyLocal(DiffOperations(seq.Text(), h.content)); err != nil {
+			h.failCRDT(err)
 			return
 		}
+		h.crdt = seq
+
+		// Save straight away so clients never hold element ids the store has
+		// not seen.
+		h.queueSave(false, nil)
+	}
+
+	waiting := h.crdtWaiting
+	h.crdtWaiting = nil
+	for _, w := range waiting {
+		h.sendCRDTDelta(w.client, w.vector)
 	}
 }
 
-// In ws/hub.go
-
-// Add this to the ServeWs function
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-    upgrader.CheckOrigin = func(r *http.Request) bool {
-        return true
-    }
-    
-    conn, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
-        log.Println("Error upgrading WebSocket:", err)
-        return
-    }
-    
-    client := &Client{
-        hub:  hub,
-        conn: conn,
-        send: make(chan []byte, 256),
-    }
-    
-    client.hub.register <- client
-    
-    // Handle ping messages to keep connection alive
-    conn.SetPingHandler(func(string) error {
-        conn.WriteMessage(websocket.PongMessage, []byte{})
-        return nil
-    })
-    
-    go client.writePump()
-    go client.readPump()
-}
-
-// Add these methods to the Hub struct in hub.go
+// sendCRDTDelta switches a client to the CRDT protocol and sends it what it
+// is missing.
+func (h *Hub) sendCRDTDelta(client *Client, vector StateVector) {
+	client.crdt = true
+	h.sendTo(client, newMessage(TypeCRDTDelta, CRDTDeltaPayload{
+		Ops:         h.crdt.Delta(vector),
+		StateVector: h.crdt.StateVector(),
+	}))
+}
 
-// notifyClientJoined informs all clients that a new client has joined
-func (h *Hub) notifyClientJoined(client *Client) {
-	message := &Message{
-		Type: "user_joined",
-		Data: map[string]interface{}{
-			"user_id": client.UserID,
-			"username": client.Username,
-			"is_anonymous": client.IsAnonymous,
-			"document_id": h.DocumentID,
-		},
-	}
-	
+func (h *Hub) failCRDT(err error) {
+	waiting := h.crdtWaiting
+	h.crdtWaiting = nil
+	for _, w := range waiting {
+		h.sendError(w.client, ErrCRDTUnavailable, err.Error())
+	}
+}
+
+// mergeCRDT integrates a delta from a CRDT client and passes the resulting
+// edits on to everyone else.
+func (h *Hub) mergeCRDT(client *Client, ops []CRDTOp) {
+	integrated, edits, err := h.crdt.Merge(ops)
+	if err != nil {
+		// Ops that were integrated before the error still count
+		h.sendError(client, ErrInvalidCRDTDelta, err.Error())
+	}
+	if len(integrated) == 0 {
+		return
+	}
+
+	content, err := ApplyOperations(h.content, edits)
+	if err != nil {
+		// The replica and the content have diverged; the replica wins.
+		log.Printf("Hub %s: crdt edits did not apply, resetting content: %v", h.DocumentID, err)
+		edits = DiffOperations(h.content, h.crdt.Text())
+		content = h.crdt.Text()
+	}
+	h.commitRevision(content, edits)
+
+	opMessage := newMessage(TypeOp, OpBroadcastPayload{
+		Revision:   h.revision,
+		Operations: edits,
+		UserID:     client.UserID,
+		Username:   client.Username,
+		ClientID:   client.id,
+	})
+	seq := h.record(opMessage)
+	h.broadcastWhere(newMessage(TypeCRDTDelta, CRDTDeltaPayload{Ops: integrated, Seq: seq}),
+		func(c *Client) bool { return c.crdt && c != client })
+	h.broadcastWhere(opMessage, func(c *Client) bool { return !c.crdt })
+
+	h.markChanged(client, "")
+}
+
+// commitRevision makes content the canonical state, recording ops as the
+// edit that produced the new revision.
+func (h *Hub) commitRevision(content string, ops []Operation) {
+	h.shiftPresence(ops)
+	h.content = content
+	h.revision++
+	h.history = append(h.history, ops)
+	if len(h.history) > maxHistory {
+		trim := len(h.history) - maxHistory
+		h.history = append([][]Operation(nil), h.history[trim:]...)
+		h.historyStart += trim
+	}
+}
+
+// applyOperations transforms ops made against revision over everything
+// applied since, applies the result to the canonical content, acknowledges
+// the sender and forwards the transformed operations to everyone else.
+func (h *Hub) applyOperations(client *Client, revision int, ops []Operation, title string) {
+	if revision < h.historyStart || revision > h.revision {
+		h.sendError(client, ErrStaleRevision, "revision is no longer available, resynchronising")
+		if client != nil {
+			h.sendTo(client, h.snapshotMessage())
+		}
+		return
+	}
+
+	for _, applied := range h.history[revision-h.historyStart:] {
+		ops, _ = Transform(ops, applied)
+	}
+
+	content, err := ApplyOperations(h.content, ops)
+	if err != nil {
+		h.sendError(client, ErrInvalidOperation, err.Error())
+		return
+	}
+	h.commitRevision(content, ops)
+	h.markChanged(client, title)
+
+	payload := OpBroadcastPayload{Revision: h.revision, Operations: ops, Title: title}
+	if client != nil {
+		payload.UserID = client.UserID
+		payload.Username = client.Username
+		payload.ClientID = client.id
+	}
+	opMessage := newMessage(TypeOp, payload)
+	seq := h.record(opMessage)
+
+	if h.crdt != nil {
+		delta, err := h.crdt.ApplyLocal(ops)
+		if err != nil {
+			log.Printf("Hub %s: crdt replica rejected edit: %v", h.DocumentID, err)
+		}
+		h.broadcastWhere(newMessage(TypeCRDTDelta, CRDTDeltaPayload{Ops: delta, Seq: seq}),
+			func(c *Client) bool { return c.crdt })
+	}
+
+	// The sender gets an ack in place of its own op; the ack carries the
+	// op's sequence number so the sender's position in the stream advances.
+	if client != nil {
+		h.sendTo(client, newMessage(TypeAck, AckPayload{Revision: h.revision, Seq: seq}))
+	}
+
+	h.broadcastWhere(opMessage, func(c *Client) bool {
+		return c != client && !c.crdt
+	})
+}
+
+func (h *Hub) snapshotMessage() *Message {
+	return newMessage(TypeSnapshot, h.snapshot())
+}
+
+func (h *Hub) snapshot() SnapshotPayload {
+	return SnapshotPayload{
+		DocumentID: h.DocumentID,
+		Content:    h.content,
+		Revision:   h.revision,
+		Epoch:      h.replay.epoch,
+		Seq:        h.replay.seq,
+		Protocol:   ProtocolVersion,
+	}
+}
+
+func (h *Hub) sendError(client *Client, code string, message string) {
+	if client == nil {
+		log.Printf("Hub %s rejected server message: %s", h.DocumentID, message)
+		return
+	}
+	h.sendTo(client, newMessage(TypeError, ErrorPayload{Code: code, Message: message}))
+}
+
+// reject tells a client why its message was refused.
+func (h *Hub) reject(client *Client, err *ProtocolError) {
+	h.sendTo(client, err.message())
+}
+
+// sendTo queues a message for a single client.
+func (h *Hub) sendTo(client *Client, message *Message) {
 	msgJSON, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("Error marshaling join message: %v", err)
+		log.Printf("Error marshaling message: %v", err)
 		return
 	}
-	
+
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
-	
-	for c := range h.clients {
-		if c != client { // Don't notify the client who just joined
-			select {
-			case c.send <- msgJSON:
-			default:
-				close(c.send)
-				delete(h.clients, c)
-			}
-		}
+
+	if _, ok := h.clients[client]; !ok {
+		return
 	}
+	h.enqueue(client, message, msgJSON)
 }
 
-// notifyClientLeft informs all clients that a client has left
-func (h *Hub) notifyClientLeft(client *Client) {
-	message := &Message{
-		Type: "user_left",
-		Data: map[string]interface{}{
-			"user_id": client.UserID,
-			"username": client.Username,
-			"document_id": h.DocumentID,
-		},
-	}
-	
+// broadcast queues a message for every client except the given one.
+func (h *Hub) broadcast(message *Message, except *Client) {
+	h.broadcastWhere(message, func(c *Client) bool { return c != except })
+}
+
+// broadcastWhere queues a message for every client matching include.
+func (h *Hub) broadcastWhere(message *Message, include func(*Client) bool) {
 	msgJSON, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("Error marshaling leave message: %v", err)
+		log.Printf("Error marshaling message: %v", err)
 		return
 	}
-	
+
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
-	
-	for c := range h.clients {
+
+	for client := range h.clients {
+		if include(client) {
+			h.enqueue(client, message, msgJSON)
+		}
+	}
+}
+
+// enqueue hands a message to a client's write pump, disconnecting clients
+// too far behind to catch up. Call with the mutex held.
+func (h *Hub) enqueue(client *Client, message *Message, raw []byte) {
+	coalesced, ok := client.outbox.push(message, raw, h.limits.SendQueue)
+	h.metrics.Coalesced.Add(int64(coalesced))
+	if !ok {
+		log.Printf("Hub %s: dropping slow client %s", h.DocumentID, client.UserID)
+		h.metrics.SlowClientsDropped.Add(1)
+		client.outbox.close(true)
+	}
+}
+
+// decodeData converts a message's loosely typed data into a payload struct.
+func decodeData(data map[string]interface{}, v interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// In client.readPump()
+func (c *Client) readPump() {
+	defer func() {
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
+		c.conn.Close()
+	}()
+
+	limits := c.hub.limits
+	limiter := newTokenBucket(limits.MessagesPerSecond, limits.Burst)
+	c.conn.SetReadLimit(limits.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(limits.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(limits.PongWait))
+		return nil
+	})
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				c.hub.metrics.Oversized.Add(1)
+				log.Printf("WebSocket message from %s over %d bytes, closing", c.UserID, limits.MaxMessageSize)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("WebSocket read error: %v", err)
+			}
+			break
+		}
+		c.hub.metrics.MessagesReceived.Add(1)
+
+		// Over the rate, stop reading for a while; the client's writes
+		// back up behind us.
+		if limiter != nil {
+			if wait := limiter.reserve(time.Now()); wait > 0 {
+				c.hub.metrics.Throttled.Add(1)
+				time.Sleep(wait)
+			}
+		}
+
+		msg, payload, perr := parseMessage(message)
+		if perr != nil {
+			c.hub.reject(c, perr)
+			continue
+		}
+
+		select {
+		case c.hub.inbound <- &inboundMessage{client: c, message: msg, payload: payload}:
+		case <-c.hub.done:
+			return
+		}
+	}
+}
+
+func (c *Client) writePump() {
+	limits := c.hub.limits
+	ticker := time.NewTicker(limits.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case <-c.outbox.wake:
+			queue, closed := c.outbox.take()
+			for _, out := range queue {
+				raw := out.raw
+				if raw == nil {
+					var err error
+					if raw, err = json.Marshal(out.message); err != nil {
+						log.Printf("Error marshaling message: %v", err)
+						continue
+					}
+				}
+				c.conn.SetWriteDeadline(time.Now().Add(limits.WriteWait))
+				if err := c.conn.WriteMessage(websocket.TextMessage, raw); err != nil {
+					return
+				}
+				c.hub.metrics.MessagesSent.Add(1)
+			}
+			if closed {
+				c.conn.SetWriteDeadline(time.Now().Add(limits.WriteWait))
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(limits.WriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func ServeWs(hub *Hub, identity Identity, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Error upgrading WebSocket:", err)
+		return
+	}
+
+	// Clients that name protocol versions must speak one we do; clients that
+	// name none get the current version.
+	if len(websocket.Subprotocols(r)) > 0 && conn.Subprotocol() == "" {
+		rejectProtocol(conn, websocket.Subprotocols(r))
+		return
+	}
+
+	id := randomID()
+	client := &Client{
+		hub:         hub,
+		conn:        conn,
+		outbox:      newOutbox(),
+		id:          id,
+		DocumentID:  hub.DocumentID,
+		UserID:      identity.UserID,
+		Username:    identity.Username,
+		IsAnonymous: identity.IsAnonymous,
+		CanEdit:     identity.CanEdit,
+		presence:    newPresence(identity, id),
+	}
+
+	// The hub may have emptied and stopped between lookup and registration;
+	// in that case join its replacement.
+	for registered := false; !registered; {
 		select {
-		case c.send <- msgJSON:
-		default:
-			close(c.send)
-			delete(h.clients, c)
+		case client.hub.register <- client:
+			registered = true
+		case <-client.hub.done:
+			if hub.registry == nil || client.hub.err != nil {
+				conn.Close()
+				return
+			}
+			client.hub = hub.registry.GetOrCreateHub(hub.DocumentID)
 		}
 	}
-}
\ No newline at end of file
+
+	// Answer client pings; control writes may run alongside the write pump.
+	conn.SetPingHandler(func(data string) error {
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(client.hub.limits.WriteWait))
+	})
+
+	go client.writePump()
+	go client.readPump()
+}
+
+// rejectProtocol tells a client none of the protocol versions it offered are
+// supported, and closes the connection.
+func rejectProtocol(conn *websocket.Conn, offered []string) {
+	defer conn.Close()
+	perr := &ProtocolError{
+		Code:    ErrUnsupportedProtocol,
+		Message: fmt.Sprintf("unsupported protocol %v, this server speaks %s", offered, Subprotocol(ProtocolVersion)),
+	}
+	deadline := time.Now().Add(DefaultLimits().WriteWait)
+	conn.SetWriteDeadline(deadline)
+	if err := conn.WriteJSON(perr.message()); err != nil {
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseProtocolError, ErrUnsupportedProtocol), deadline)
+}
+
+// notifyClientJoined informs all clients that a new client has joined
+func (h *Hub) notifyClientJoined(client *Client) {
+	message := newMessage(TypeUserJoined, UserJoinedPayload{
+		DocumentID:  h.DocumentID,
+		ClientID:    client.id,
+		UserID:      client.UserID,
+		Username:    client.Username,
+		IsAnonymous: client.IsAnonymous,
+		Color:       client.presence.Color,
+	})
+
+	// Don't notify the client who just joined
+	h.broadcast(message, client)
+}
+
+// notifyClientLeft informs all clients that a client has left
+func (h *Hub) notifyClientLeft(client *Client) {
+	message := newMessage(TypeUserLeft, UserLeftPayload{
+		DocumentID: h.DocumentID,
+		ClientID:   client.id,
+		UserID:     client.UserID,
+		Username:   client.Username,
+	})
+
+	h.broadcast(message, nil)
+}
@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// A connection without edit rights can follow and show its cursor, but its
+// edits are refused.
+func TestReadOnlyClient(t *testing.T) {
+	store := &memoryStore{content: "abc"}
+	registry := NewRegistry(store, nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user")
+		ServeWs(registry.GetOrCreateHub("1"), Identity{UserID: user, Username: user, CanEdit: user == "alice"}, w, r)
+	}))
+	defer server.Close()
+	dial := func(user string) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?user="+user, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		readType(t, conn, TypeSnapshot)
+		return conn
+	}
+	alice, bob := dial("alice"), dial("bob")
+
+	sendOp(t, bob, 0, ins(0, "x"))
+	if rejected := readType(t, bob, TypeError); rejected["code"] != ErrReadOnly {
+		t.Errorf("bob's edit got %v, want %s", rejected, ErrReadOnly)
+	}
+	if err := bob.WriteJSON(Message{Type: TypeUpdate, Data: map[string]interface{}{"content": "replaced"}}); err != nil {
+		t.Fatal(err)
+	}
+	if rejected := readType(t, bob, TypeError); rejected["code"] != ErrReadOnly {
+		t.Errorf("bob's update got %v, want %s", rejected, ErrReadOnly)
+	}
+
+	if err := bob.WriteJSON(Message{Type: TypeCursor, Data: map[string]interface{}{"position": 1}}); err != nil {
+		t.Fatal(err)
+	}
+	moved := readType(t, alice, TypePresence)
+	if p, _ := moved["presence"].(map[string]interface{}); p["username"] != "bob" {
+		t.Errorf("alice saw %v, want bob's cursor", moved)
+	}
+
+	sendOp(t, alice, 0, ins(3, "d"))
+	readType(t, alice, TypeAck)
+	if op := readType(t, bob, TypeOp); op["revision"] != float64(1) {
+		t.Errorf("bob got %v, want alice's edit as revision 1", op)
+	}
+}
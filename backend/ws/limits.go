@@ -0,0 +1,111 @@
+package ws
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Limits bound what a single connection may cost the server.
+type Limits struct {
+	// MaxMessageSize is the largest message, in bytes, a client may send.
+	// Bigger messages close the connection.
+	MaxMessageSize int64
+	// MessagesPerSecond and Burst configure the token bucket each client's
+	// inbound messages pass through. Reading pauses while a client is over
+	// its rate, which pushes back on it through TCP. Zero disables it.
+	MessagesPerSecond float64
+	Burst             int
+	// SendQueue is how many outbound messages may wait for a slow client.
+	// Beyond that superseded messages are coalesced, and a client that is
+	// still too far behind is disconnected; it can resume afterwards.
+	SendQueue int
+	// WriteWait bounds each write to a client.
+	WriteWait time.Duration
+	// PongWait is how long a client may go without answering a ping, and
+	// PingPeriod how often the server pings. PingPeriod must be shorter.
+	PongWait   time.Duration
+	PingPeriod time.Duration
+}
+
+// DefaultLimits returns the limits used unless a registry is given others.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxMessageSize:    1 << 20,
+		MessagesPerSecond: 50,
+		Burst:             100,
+		SendQueue:         256,
+		WriteWait:         10 * time.Second,
+		PongWait:          60 * time.Second,
+		PingPeriod:        54 * time.Second,
+	}
+}
+
+// tokenBucket rate limits one client's inbound messages. Only its read pump
+// uses it.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token and returns how long to wait before it may be used.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Metrics counts what the hubs of a registry did to protect themselves.
+type Metrics struct {
+	MessagesReceived atomic.Int64
+	MessagesSent     atomic.Int64
+	// Throttled counts inbound messages delayed by rate limiting.
+	Throttled atomic.Int64
+	// Oversized counts connections closed for sending too large a message.
+	Oversized atomic.Int64
+	// Coalesced counts outbound messages folded into later ones for slow
+	// clients, and SlowClientsDropped the clients disconnected anyway.
+	Coalesced          atomic.Int64
+	SlowClientsDropped atomic.Int64
+}
+
+// MetricsSnapshot is a point-in-time copy of Metrics plus gauges.
+type MetricsSnapshot struct {
+	Hubs               int   `json:"hubs"`
+	Clients            int   `json:"clients"`
+	MessagesReceived   int64 `json:"messages_received"`
+	MessagesSent       int64 `json:"messages_sent"`
+	Throttled          int64 `json:"throttled"`
+	Oversized          int64 `json:"oversized"`
+	Coalesced          int64 `json:"coalesced"`
+	SlowClientsDropped int64 `json:"slow_clients_dropped"`
+}
+
+func (m *Metrics) snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		MessagesReceived:   m.MessagesReceived.Load(),
+		MessagesSent:       m.MessagesSent.Load(),
+		Throttled:          m.Throttled.Load(),
+		Oversized:          m.Oversized.Load(),
+		Coalesced:          m.Coalesced.Load(),
+		SlowClientsDropped: m.SlowClientsDropped.Load(),
+	}
+}
@@ -0,0 +1,173 @@
+package ws
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if newTokenBucket(0, 10) != nil {
+		t.Errorf("a zero rate limits")
+	}
+
+	start := time.Now()
+	b := newTokenBucket(10, 3)
+	b.last = start
+	for i := 0; i < 3; i++ {
+		if wait := b.reserve(start); wait != 0 {
+			t.Errorf("message %d of the burst waits %v", i, wait)
+		}
+	}
+	if wait := b.reserve(start); wait != 100*time.Millisecond {
+		t.Errorf("message over the burst waits %v, want 100ms", wait)
+	}
+	if wait := b.reserve(start); wait != 200*time.Millisecond {
+		t.Errorf("next message waits %v, want 200ms", wait)
+	}
+
+	// Tokens come back at the rate, up to the burst
+	later := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if wait := b.reserve(later); wait != 0 {
+			t.Errorf("message %d after a pause waits %v", i, wait)
+		}
+	}
+	if wait := b.reserve(later); wait == 0 {
+		t.Errorf("the burst refilled past its size")
+	}
+}
+
+func opMessage(clientID string, ops ...Operation) *Message {
+	return newMessage(TypeOp, OpBroadcastPayload{Operations: ops, UserID: clientID, Username: clientID, ClientID: clientID})
+}
+
+func presenceMessage(clientID string, cursor int) *Message {
+	return newMessage(TypePresence, PresenceBroadcastPayload{Presence: Presence{ClientID: clientID, Cursor: &cursor}})
+}
+
+func TestOutboxCoalesces(t *testing.T) {
+	o := newOutbox()
+	queued := []*Message{
+		opMessage("a", ins(0, "x")),
+		opMessage("a", ins(1, "y")),
+		presenceMessage("a", 1),
+		presenceMessage("b", 5),
+		presenceMessage("a", 2),
+		opMessage("a", ins(2, "z")),
+		opMessage("b", del(0, 1)),
+	}
+	for _, m := range queued[:3] {
+		if coalesced, ok := o.push(m, nil, 4); coalesced != 0 || !ok {
+			t.Fatalf("pushing under the limit coalesced %d (%v)", coalesced, ok)
+		}
+	}
+	total := 0
+	for _, m := range queued[3:] {
+		coalesced, ok := o.push(m, nil, 4)
+		if !ok {
+			t.Fatalf("pushing %s didn't fit", m.Type)
+		}
+		total += coalesced
+	}
+
+	queue, closed := o.take()
+	if closed {
+		t.Errorf("outbox closed")
+	}
+	var types []string
+	for _, out := range queue {
+		types = append(types, out.message.Type)
+	}
+	// The first two ops merged, a's first presence was superseded, and the
+	// last two ops merged
+	if strings.Join(types, ",") != "op,presence,presence,op" || total != 3 {
+		t.Fatalf("queue is %v after coalescing %d", types, total)
+	}
+	if p := queue[2].message.Data["presence"].(Presence); p.ClientID != "a" || *p.Cursor != 2 {
+		t.Errorf("a's presence is %+v, want its latest", p)
+	}
+
+	// Merged ops do what they did one after another, and are only
+	// attributed to a single author
+	content, err := ApplyOperations("", queue[0].message.Data["operations"].([]Operation))
+	if err != nil || content != "xy" || queue[0].message.Data["client_id"] != "a" {
+		t.Errorf("first op makes %q (%v) by %v", content, err, queue[0].message.Data["client_id"])
+	}
+	content, err = ApplyOperations("xy", queue[3].message.Data["operations"].([]Operation))
+	if err != nil || content != "yz" {
+		t.Errorf("last op makes %q (%v)", content, err)
+	}
+	if _, ok := queue[3].message.Data["client_id"]; ok {
+		t.Errorf("edits by a and b are attributed to %v", queue[3].message.Data["client_id"])
+	}
+}
+
+// A client too far behind for coalescing to help is refused more messages.
+func TestOutboxFull(t *testing.T) {
+	o := newOutbox()
+	for i := 0; i < 2; i++ {
+		if _, ok := o.push(newMessage(TypeUserJoined, UserJoinedPayload{}), nil, 2); !ok {
+			t.Fatal("pushing under the limit failed")
+		}
+	}
+	if _, ok := o.push(newMessage(TypeUserJoined, UserJoinedPayload{}), nil, 2); ok {
+		t.Errorf("pushed over the limit")
+	}
+	if queue, _ := o.take(); len(queue) != 2 {
+		t.Errorf("queue has %d messages, want 2", len(queue))
+	}
+
+	o.close(true)
+	if _, ok := o.push(newMessage(TypeUserJoined, UserJoinedPayload{}), nil, 2); !ok {
+		t.Errorf("pushing to a closed outbox reports it full")
+	}
+	if queue, closed := o.take(); len(queue) != 0 || !closed {
+		t.Errorf("closed outbox has %d messages (%v)", len(queue), closed)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	in := newInstance(t, nil, "abc")
+	limits := DefaultLimits()
+	limits.MaxMessageSize = 512
+	limits.MessagesPerSecond = 20
+	limits.Burst = 2
+	in.registry.SetLimits(limits)
+
+	// Messages over the rate are read late, not refused
+	alice := in.dial(t, "alice")
+	readType(t, alice, TypeSnapshot)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		sendOp(t, alice, i, ins(0, "x"))
+	}
+	for i := 0; i < 6; i++ {
+		readType(t, alice, TypeAck)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("6 messages at 20 a second, 2 at once, took %v", elapsed)
+	}
+	if throttled := in.registry.Metrics().Throttled; throttled != 4 {
+		t.Errorf("%d messages throttled, want 4", throttled)
+	}
+
+	// Too large a message closes the connection
+	bob := in.dial(t, "bob")
+	readType(t, bob, TypeSnapshot)
+	sendOp(t, bob, 6, ins(0, strings.Repeat("x", 1024)))
+	for {
+		bob.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := bob.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Errorf("connection closed with %v, want message too big", err)
+			}
+			break
+		}
+	}
+	if oversized := in.registry.Metrics().Oversized; oversized != 1 {
+		t.Errorf("%d oversized messages, want 1", oversized)
+	}
+}
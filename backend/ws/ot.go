@@ -0,0 +1,183 @@
+package ws
+
+import "fmt"
+
+const (
+	OpInsert = "insert"
+	OpDelete = "delete"
+)
+
+// Operation is a single positional edit. Positions and lengths are counted
+// in Unicode code points, not bytes. A list of operations is applied in order,
+// each one against the result of the previous.
+type Operation struct {
+	Type     string `json:"type"`
+	Position int    `json:"position"`
+	Text     string `json:"text,omitempty"`
+	Length   int    `json:"length,omitempty"`
+}
+
+func (op Operation) size() int {
+	if op.Type == OpInsert {
+		return len([]rune(op.Text))
+	}
+	return op.Length
+}
+
+// ApplyOperations applies ops to content and returns the new content.
+func ApplyOperations(content string, ops []Operation) (string, error) {
+	runes := []rune(content)
+	for _, op := range ops {
+		if op.Position < 0 || op.Position > len(runes) {
+			return "", fmt.Errorf("position %d out of range (length %d)", op.Position, len(runes))
+		}
+		switch op.Type {
+		case OpInsert:
+			text := []rune(op.Text)
+			next := make([]rune, 0, len(runes)+len(text))
+			next = append(next, runes[:op.Position]...)
+			next = append(next, text...)
+			runes = append(next, runes[op.Position:]...)
+		case OpDelete:
+			if op.Length < 0 || op.Position+op.Length > len(runes) {
+				return "", fmt.Errorf("delete of %d at %d out of range (length %d)", op.Length, op.Position, len(runes))
+			}
+			runes = append(runes[:op.Position:op.Position], runes[op.Position+op.Length:]...)
+		default:
+			return "", fmt.Errorf("unknown operation type %q", op.Type)
+		}
+	}
+	return string(runes), nil
+}
+
+// Transform rewrites two concurrent operation lists so they can be applied in
+// either order. a' is a rebased onto b, and b' is b rebased onto a, such that
+// apply(apply(s, a), b') == apply(apply(s, b), a'). When both insert at the
+// same position, b's text ends up first; the hub passes the already-applied
+// server history as b so that earlier revisions win ties.
+func Transform(a, b []Operation) ([]Operation, []Operation) {
+	if len(a) == 0 || len(b) == 0 {
+		return a, b
+	}
+	if len(a) > 1 {
+		head, b1 := Transform(a[:1], b)
+		tail, b2 := Transform(a[1:], b1)
+		return append(head, tail...), b2
+	}
+	if len(b) > 1 {
+		a1, head := Transform(a, b[:1])
+		a2, tail := Transform(a1, b[1:])
+		return a2, append(head, tail...)
+	}
+	return transformOne(a[0], b[0], false), transformOne(b[0], a[0], true)
+}
+
+// transformOne rebases a onto b. wins decides insert/insert ties: when true a
+// stays in front of b's text.
+func transformOne(a, b Operation, wins bool) []Operation {
+	switch {
+	case b.Type == OpInsert && a.Type == OpInsert:
+		if a.Position < b.Position || (a.Position == b.Position && wins) {
+			return []Operation{a}
+		}
+		a.Position += b.size()
+		return []Operation{a}
+
+	case b.Type == OpInsert && a.Type == OpDelete:
+		n := b.size()
+		if a.Position+a.Length <= b.Position {
+			return []Operation{a}
+		}
+		if a.Position >= b.Position {
+			a.Position += n
+			return []Operation{a}
+		}
+		// b inserted inside the range a deletes; keep b's text and delete
+		// around it.
+		before := b.Position - a.Position
+		return []Operation{
+			{Type: OpDelete, Position: a.Position, Length: before},
+			{Type: OpDelete, Position: a.Position + n, Length: a.Length - before},
+		}
+
+	case b.Type == OpDelete && a.Type == OpInsert:
+		if a.Position <= b.Position {
+			return []Operation{a}
+		}
+		if a.Position >= b.Position+b.Length {
+			a.Position -= b.Length
+			return []Operation{a}
+		}
+		a.Position = b.Position
+		return []Operation{a}
+
+	case b.Type == OpDelete && a.Type == OpDelete:
+		aEnd, bEnd := a.Position+a.Length, b.Position+b.Length
+		overlap := min(aEnd, bEnd) - max(a.Position, b.Position)
+		if overlap < 0 {
+			overlap = 0
+		}
+		switch {
+		case a.Position >= bEnd:
+			a.Position -= b.Length
+		case a.Position > b.Position:
+			a.Position = b.Position
+		}
+		a.Length -= overlap
+		if a.Length == 0 {
+			return nil
+		}
+		return []Operation{a}
+	}
+	return []Operation{a}
+}
+
+// DiffOperations returns the operations that turn before into after, as at
+// most one delete followed by one insert around the common prefix and suffix.
+func DiffOperations(before, after string) []Operation {
+	if before == after {
+		return nil
+	}
+	b, a := []rune(before), []rune(after)
+	prefix := 0
+	for prefix < len(b) && prefix < len(a) && b[prefix] == a[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(b)-prefix && suffix < len(a)-prefix && b[len(b)-1-suffix] == a[len(a)-1-suffix] {
+		suffix++
+	}
+
+	var ops []Operation
+	if removed := len(b) - prefix - suffix; removed > 0 {
+		ops = append(ops, Operation{Type: OpDelete, Position: prefix, Length: removed})
+	}
+	if inserted := a[prefix : len(a)-suffix]; len(inserted) > 0 {
+		ops = append(ops, Operation{Type: OpInsert, Position: prefix, Text: string(inserted)})
+	}
+	return ops
+}
+
+func validateOperations(ops []Operation) error {
+	if len(ops) == 0 {
+		return fmt.Errorf("no operations")
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case OpInsert:
+			if op.Text == "" {
+				return fmt.Errorf("insert without text")
+			}
+		case OpDelete:
+			if op.Length <= 0 {
+				return fmt.Errorf("delete needs a positive length")
+			}
+		default:
+			return fmt.Errorf("unknown operation type %q", op.Type)
+		}
+		if op.Position < 0 {
+			return fmt.Errorf("negative position")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package ws
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func ins(pos int, text string) Operation {
+	return Operation{Type: OpInsert, Position: pos, Text: text}
+}
+
+func del(pos, length int) Operation {
+	return Operation{Type: OpDelete, Position: pos, Length: length}
+}
+
+func mustApply(t *testing.T, content string, ops []Operation) string {
+	t.Helper()
+	out, err := ApplyOperations(content, ops)
+	if err != nil {
+		t.Fatalf("apply %v to %q: %v", ops, content, err)
+	}
+	return out
+}
+
+// checkConverges applies a then b', and b then a', to doc, and fails unless
+// both orders give the same text, which it returns.
+func checkConverges(t *testing.T, doc string, a, b []Operation) string {
+	t.Helper()
+	a2, b2 := Transform(a, b)
+	ab := mustApply(t, mustApply(t, doc, a), b2)
+	ba := mustApply(t, mustApply(t, doc, b), a2)
+	if ab != ba {
+		t.Fatalf("%q with a=%v b=%v: a then b' gives %q, b then a' gives %q (a'=%v b'=%v)", doc, a, b, ab, ba, a2, b2)
+	}
+	return ab
+}
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    string
+		a, b   []Operation
+		wantA  []Operation // a rebased onto b
+		wantB  []Operation // b rebased onto a
+		result string
+	}{
+		{
+			name:  "inserts at the same position put b first",
+			doc:   "ab",
+			a:     []Operation{ins(1, "X")},
+			b:     []Operation{ins(1, "Y")},
+			wantA: []Operation{ins(2, "X")},
+			wantB: []Operation{ins(1, "Y")},
+			// b is the server history, which wins the tie
+			result: "aYXb",
+		},
+		{
+			name:   "inserts at different positions",
+			doc:    "abc",
+			a:      []Operation{ins(3, "X")},
+			b:      []Operation{ins(0, "YY")},
+			wantA:  []Operation{ins(5, "X")},
+			wantB:  []Operation{ins(0, "YY")},
+			result: "YYabcX",
+		},
+		{
+			name:   "insert inside a deleted range keeps the text",
+			doc:    "abcdef",
+			a:      []Operation{del(1, 4)},
+			b:      []Operation{ins(3, "X")},
+			wantA:  []Operation{del(1, 2), del(2, 2)},
+			wantB:  []Operation{ins(1, "X")},
+			result: "aXf",
+		},
+		{
+			name:   "delete around an insert, the other way round",
+			doc:    "abcdef",
+			a:      []Operation{ins(3, "X")},
+			b:      []Operation{del(1, 4)},
+			wantA:  []Operation{ins(1, "X")},
+			wantB:  []Operation{del(1, 2), del(2, 2)},
+			result: "aXf",
+		},
+		{
+			name:   "insert at the start of a deleted range",
+			doc:    "abcd",
+			a:      []Operation{ins(1, "X")},
+			b:      []Operation{del(1, 2)},
+			wantA:  []Operation{ins(1, "X")},
+			wantB:  []Operation{del(2, 2)},
+			result: "aXd",
+		},
+		{
+			name:   "insert at the end of a deleted range",
+			doc:    "abcd",
+			a:      []Operation{ins(3, "X")},
+			b:      []Operation{del(1, 2)},
+			wantA:  []Operation{ins(1, "X")},
+			wantB:  []Operation{del(1, 2)},
+			result: "aXd",
+		},
+		{
+			name:   "overlapping deletes",
+			doc:    "abcdefg",
+			a:      []Operation{del(1, 3)},
+			b:      []Operation{del(2, 3)},
+			wantA:  []Operation{del(1, 1)},
+			wantB:  []Operation{del(1, 1)},
+			result: "afg",
+		},
+		{
+			name:   "a delete inside another",
+			doc:    "abcdefg",
+			a:      []Operation{del(2, 2)},
+			b:      []Operation{del(1, 5)},
+			wantA:  nil,
+			wantB:  []Operation{del(1, 3)},
+			result: "ag",
+		},
+		{
+			name:   "the same delete on both sides",
+			doc:    "abcdef",
+			a:      []Operation{del(2, 2)},
+			b:      []Operation{del(2, 2)},
+			wantA:  nil,
+			wantB:  nil,
+			result: "abef",
+		},
+		{
+			name:   "adjacent deletes",
+			doc:    "abcdef",
+			a:      []Operation{del(1, 2)},
+			b:      []Operation{del(3, 2)},
+			wantA:  []Operation{del(1, 2)},
+			wantB:  []Operation{del(1, 2)},
+			result: "af",
+		},
+		{
+			name:   "lists of operations",
+			doc:    "hello world",
+			a:      []Operation{del(0, 5), ins(0, "goodbye")},
+			b:      []Operation{ins(11, "!"), del(5, 1)},
+			wantA:  []Operation{del(0, 5), ins(0, "goodbye")},
+			wantB:  []Operation{ins(13, "!"), del(7, 1)},
+			result: "goodbyeworld!",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a2, b2 := Transform(tt.a, tt.b)
+			if !reflect.DeepEqual(a2, tt.wantA) {
+				t.Errorf("a' = %v, want %v", a2, tt.wantA)
+			}
+			if !reflect.DeepEqual(b2, tt.wantB) {
+				t.Errorf("b' = %v, want %v", b2, tt.wantB)
+			}
+			if got := checkConverges(t, tt.doc, tt.a, tt.b); got != tt.result {
+				t.Errorf("got %q, want %q", got, tt.result)
+			}
+		})
+	}
+}
+
+// Concurrent lists of random edits converge whichever order they're
+// applied in.
+func TestTransformConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	edits := func(doc string) []Operation {
+		var ops []Operation
+		for n := 1 + rng.Intn(3); n > 0; n-- {
+			op := randomEdit(rng, doc)
+			doc = mustApply(t, doc, op)
+			ops = append(ops, op...)
+		}
+		return ops
+	}
+	for round := 0; round < 5000; round++ {
+		doc := "hello world"[:rng.Intn(12)]
+		checkConverges(t, doc, edits(doc), edits(doc))
+	}
+}
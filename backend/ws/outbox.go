@@ -0,0 +1,158 @@
+package ws
+
+import "sync"
+
+// outgoing is a queued message. raw is its encoding, shared between clients
+// when broadcast; it is cleared when coalescing changes the message.
+type outgoing struct {
+	message *Message
+	raw     []byte
+}
+
+// outbox queues messages for a client's write pump.
+type outbox struct {
+	mutex  sync.Mutex
+	queue  []outgoing
+	closed bool
+	// wake has room for one signal, sent whenever the queue or closed
+	// changes.
+	wake chan struct{}
+}
+
+func newOutbox() *outbox {
+	return &outbox{wake: make(chan struct{}, 1)}
+}
+
+// push queues a message. Once more than limit are waiting, superseded ones
+// are coalesced. It returns how many messages were folded away, and false if
+// the queue is still over the limit, in which case nothing is queued.
+func (o *outbox) push(message *Message, raw []byte, limit int) (int, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return 0, true
+	}
+
+	o.queue = append(o.queue, outgoing{message: message, raw: raw})
+	coalesced := 0
+	if len(o.queue) > limit {
+		before := len(o.queue)
+		o.queue = coalesce(o.queue)
+		coalesced = before - len(o.queue)
+		if len(o.queue) > limit {
+			o.queue = o.queue[:len(o.queue)-1]
+			return coalesced, false
+		}
+	}
+	o.signal()
+	return coalesced, true
+}
+
+// close stops the outbox. Messages already queued are still written, unless
+// discard is set.
+func (o *outbox) close(discard bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if discard {
+		o.queue = nil
+	}
+	o.closed = true
+	o.signal()
+}
+
+// take empties the queue, reporting whether the outbox has been closed.
+func (o *outbox) take() ([]outgoing, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	queue := o.queue
+	o.queue = nil
+	return queue, o.closed
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce folds messages a slow client no longer needs separately: runs of
+// consecutive ops become one op, runs of CRDT deltas one delta, and only the
+// latest presence of each connection is kept.
+func coalesce(queue []outgoing) []outgoing {
+	latestPresence := make(map[string]int)
+	for i, out := range queue {
+		if id, ok := presenceClientID(out.message); ok {
+			latestPresence[id] = i
+		}
+	}
+
+	result := make([]outgoing, 0, len(queue))
+	for i, out := range queue {
+		if id, ok := presenceClientID(out.message); ok && latestPresence[id] != i {
+			continue
+		}
+		if n := len(result); n > 0 {
+			if merged := mergeMessages(result[n-1].message, out.message); merged != nil {
+				result[n-1] = outgoing{message: merged}
+				continue
+			}
+		}
+		result = append(result, out)
+	}
+	return result
+}
+
+func presenceClientID(message *Message) (string, bool) {
+	if message.Type != "presence" {
+		return "", false
+	}
+	p, ok := message.Data["presence"].(Presence)
+	return p.ClientID, ok
+}
+
+// mergeMessages returns a single message equivalent to a followed by b, or
+// nil if they can't be merged.
+func mergeMessages(a, b *Message) *Message {
+	if a.Type != b.Type {
+		return nil
+	}
+	switch a.Type {
+	case "op":
+		aOps, okA := a.Data["operations"].([]Operation)
+		bOps, okB := b.Data["operations"].([]Operation)
+		if !okA || !okB {
+			return nil
+		}
+		data := make(map[string]interface{}, len(b.Data))
+		for k, v := range a.Data {
+			data[k] = v
+		}
+		for k, v := range b.Data {
+			data[k] = v
+		}
+		// Edits by several people can only be attributed to none of them.
+		if a.Data["client_id"] != b.Data["client_id"] {
+			delete(data, "user_id")
+			delete(data, "username")
+			delete(data, "client_id")
+		}
+		data["operations"] = append(append([]Operation(nil), aOps...), bOps...)
+		return &Message{Type: "op", Data: data}
+
+	case "crdt_delta":
+		aOps, okA := a.Data["ops"].([]CRDTOp)
+		bOps, okB := b.Data["ops"].([]CRDTOp)
+		if !okA || !okB {
+			return nil
+		}
+		return &Message{
+			Type: "crdt_delta",
+			Data: map[string]interface{}{
+				"ops": append(append([]CRDTOp(nil), aOps...), bOps...),
+				"seq": b.Data["seq"],
+			},
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package ws
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// saveDelay is how long edits may sit in memory before the content is
+	// written to the database.
+	saveDelay = 2 * time.Second
+	// commitIdle is how long a document has to go without edits before the
+	// session's work is committed to git.
+	commitIdle = 30 * time.Second
+)
+
+// Participant is a user whose edits went into an autosave commit.
+type Participant struct {
+	UserID      string
+	Username    string
+	IsAnonymous bool
+}
+
+// saveJob is hub state queued for saveLoop. done, if set, is closed once the
+// job has been written.
+type saveJob struct {
+	content      string
+	crdtState    []byte
+	commit       bool
+	participants []Participant
+	// title, if set, renames the document, by renamedBy
+	title     string
+	renamedBy Participant
+	done      chan struct{}
+}
+
+func newStoppedTimer() *time.Timer {
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	return t
+}
+
+// markChanged schedules persistence after an edit, and of the title it gave
+// the document, if any. Edits from clients are also committed once the
+// document goes quiet; server-side changes, renames included, were already
+// persisted by whoever made them. Edits by clients of other
+// instances are left to those instances, so each is only committed once.
+func (h *Hub) markChanged(client *Client, title string) {
+	if client != nil && client.remote {
+		return
+	}
+	if client != nil && title != "" {
+		h.title = title
+		h.renamedBy = Participant{UserID: client.UserID, Username: client.Username, IsAnonymous: client.IsAnonymous}
+	}
+	if !h.dirty {
+		h.dirty = true
+		h.saveTimer.Reset(saveDelay)
+	}
+	if client == nil {
+		return
+	}
+
+	h.uncommitted = true
+	h.commitTimer.Reset(commitIdle)
+	for _, p := range h.participants {
+		if p.UserID == client.UserID {
+			return
+		}
+	}
+	h.participants = append(h.participants, Participant{
+		UserID:      client.UserID,
+		Username:    client.Username,
+		IsAnonymous: client.IsAnonymous,
+	})
+}
+
+// queueSave hands the current state to saveLoop. A job still waiting there is
+// folded into the new one, so the loop only ever writes the latest content.
+func (h *Hub) queueSave(commit bool, done chan struct{}) {
+	if h.store == nil {
+		if done != nil {
+			close(done)
+		}
+		return
+	}
+
+	job := &saveJob{content: h.content, title: h.title, renamedBy: h.renamedBy, done: done}
+	if h.crdt != nil {
+		state, err := h.crdt.Encode()
+		if err != nil {
+			log.Printf("Hub %s: encoding crdt state: %v", h.DocumentID, err)
+		}
+		job.crdtState = state
+	}
+	if commit && h.uncommitted {
+		job.commit = true
+		job.participants = h.participants
+		h.participants = nil
+		h.uncommitted = false
+		h.commitTimer.Stop()
+	}
+	h.dirty = false
+	h.title = ""
+	h.saveTimer.Stop()
+
+	select {
+	case pending := <-h.saves:
+		if job.title == "" {
+			job.title, job.renamedBy = pending.title, pending.renamedBy
+		}
+		if pending.commit {
+			job.commit = true
+			job.participants = mergeParticipants(pending.participants, job.participants)
+		}
+	default:
+	}
+	h.saves <- job
+}
+
+// discardPending drops unsaved edits, for documents that no longer exist.
+func (h *Hub) discardPending() {
+	h.dirty = false
+	h.uncommitted = false
+	h.participants = nil
+	h.title = ""
+	h.saveTimer.Stop()
+	h.commitTimer.Stop()
+	select {
+	case <-h.saves:
+	default:
+	}
+}
+
+// flush writes and commits everything outstanding and waits for it.
+func (h *Hub) flush() {
+	if !h.dirty && !h.uncommitted {
+		return
+	}
+	done := make(chan struct{})
+	h.queueSave(true, done)
+	<-done
+}
+
+func (h *Hub) saveLoop() {
+	for job := range h.saves {
+		if job.title != "" {
+			if err := h.store.RenameDocument(h.DocumentID, job.title, job.renamedBy); err != nil {
+				log.Printf("Hub %s: renaming document: %v", h.DocumentID, err)
+			}
+		}
+		if err := h.store.SaveDocument(h.DocumentID, job.content, job.crdtState); err != nil {
+			log.Printf("Hub %s: saving document: %v", h.DocumentID, err)
+		} else if job.commit {
+			if err := h.store.CommitDocument(h.DocumentID, job.content, job.participants); err != nil {
+				log.Printf("Hub %s: committing document: %v", h.DocumentID, err)
+			}
+		}
+		if job.done != nil {
+			close(job.done)
+		}
+	}
+}
+
+func mergeParticipants(a, b []Participant) []Participant {
+	merged := append([]Participant(nil), a...)
+	for _, p := range b {
+		seen := false
+		for _, q := range merged {
+			if q.UserID == p.UserID {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,173 @@
+package ws
+
+import "hash/fnv"
+
+// presenceColors is the palette collaborators are drawn in.
+var presenceColors = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#42d4f4",
+	"#f032e6", "#469990", "#9a6324", "#800000", "#808000", "#000075",
+}
+
+// Selection is a selected range; Anchor is where it started and Head where
+// the caret is, so Head may come before Anchor.
+type Selection struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+// Presence is what collaborators see of each other: who is connected, in
+// which colour, and where their caret and selection are. Positions use the
+// same code point offsets as operations.
+type Presence struct {
+	// ClientID tells apart several connections of the same user.
+	ClientID    string     `json:"client_id"`
+	UserID      string     `json:"user_id"`
+	Username    string     `json:"username"`
+	IsAnonymous bool       `json:"is_anonymous"`
+	CanEdit     bool       `json:"can_edit"`
+	Color       string     `json:"color"`
+	Cursor      *int       `json:"cursor,omitempty"`
+	Selection   *Selection `json:"selection,omitempty"`
+}
+
+// colorFor picks a colour from the user id, so people keep their colour
+// across sessions and devices.
+func colorFor(userID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return presenceColors[h.Sum32()%uint32(len(presenceColors))]
+}
+
+func newPresence(identity Identity, clientID string) Presence {
+	return Presence{
+		ClientID:    clientID,
+		UserID:      identity.UserID,
+		Username:    identity.Username,
+		IsAnonymous: identity.IsAnonymous,
+		CanEdit:     identity.CanEdit,
+		Color:       colorFor(identity.UserID),
+	}
+}
+
+// Presence returns the presence of every connected client, including those
+// connected to other instances.
+func (h *Hub) Presence() []Presence {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.presenceLocked(nil)
+}
+
+func (h *Hub) presenceLocked(except *Client) []Presence {
+	presence := []Presence{}
+	for client := range h.clients {
+		if client != except {
+			presence = append(presence, client.presence)
+		}
+	}
+	for _, peer := range h.peers {
+		presence = append(presence, peer.presence)
+	}
+	return presence
+}
+
+// updatePresence records a cursor, selection or presence message and
+// relays it.
+func (h *Hub) updatePresence(client *Client, message *Message) {
+	var update PresenceUpdatePayload
+	var err error
+	switch message.Type {
+	case TypeCursor:
+		var payload CursorPayload
+		err = decodeData(message.Data, &payload)
+		update.Cursor = payload.Position
+	case TypeSelection:
+		var payload SelectionPayload
+		err = decodeData(message.Data, &payload)
+		update.Selection = payload.Selection
+	case TypePresence:
+		err = decodeData(message.Data, &update)
+	}
+	if err != nil {
+		h.sendError(client, ErrInvalidMessage, err.Error())
+		return
+	}
+
+	h.mutex.Lock()
+	if message.Type != TypeSelection {
+		client.presence.Cursor = update.Cursor
+	}
+	if message.Type != TypeCursor {
+		client.presence.Selection = update.Selection
+	}
+	presence := client.presence
+	h.mutex.Unlock()
+
+	h.broadcast(newMessage(TypePresence, PresenceBroadcastPayload{Presence: presence}), client)
+}
+
+// sendPresenceSnapshot tells a newly registered client who else is here.
+func (h *Hub) sendPresenceSnapshot(client *Client) {
+	h.mutex.Lock()
+	presence := h.presenceLocked(client)
+	h.mutex.Unlock()
+
+	h.sendTo(client, newMessage(TypePresenceSnapshot, PresenceSnapshotPayload{
+		Self:    client.presence,
+		Clients: presence,
+	}))
+}
+
+// shiftPresence moves every stored caret and selection through ops, so the
+// positions stay on the same text until their owners report new ones.
+func (h *Hub) shiftPresence(ops []Operation) {
+	if len(ops) == 0 {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, client := range h.presenceHolders() {
+		p := &client.presence
+		if p.Cursor != nil {
+			pos := transformPosition(*p.Cursor, ops)
+			p.Cursor = &pos
+		}
+		if p.Selection != nil {
+			p.Selection = &Selection{
+				Anchor: transformPosition(p.Selection.Anchor, ops),
+				Head:   transformPosition(p.Selection.Head, ops),
+			}
+		}
+	}
+}
+
+// presenceHolders returns local clients and peers. Call with the mutex held.
+func (h *Hub) presenceHolders() []*Client {
+	holders := make([]*Client, 0, len(h.clients)+len(h.peers))
+	for client := range h.clients {
+		holders = append(holders, client)
+	}
+	for _, peer := range h.peers {
+		holders = append(holders, peer)
+	}
+	return holders
+}
+
+// transformPosition maps a position in the text before ops to the text
+// after them. Text inserted at the position ends up before it.
+func transformPosition(pos int, ops []Operation) int {
+	for _, op := range ops {
+		switch op.Type {
+		case OpInsert:
+			if op.Position <= pos {
+				pos += op.size()
+			}
+		case OpDelete:
+			if pos >= op.Position+op.Length {
+				pos -= op.Length
+			} else if pos > op.Position {
+				pos = op.Position
+			}
+		}
+	}
+	return pos
+}
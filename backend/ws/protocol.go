@@ -0,0 +1,449 @@
+package ws
+
+//go:generate go run ../cmd/wsschema -o ../../frontend/src/services/protocol.schema.json
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ProtocolVersion is the version of the message protocol this server speaks.
+// Clients ask for it as the websocket subprotocol "docsmith.v<version>";
+// clients that ask for no subprotocol get this version too.
+const ProtocolVersion = 1
+
+// Subprotocol returns the websocket subprotocol naming a protocol version.
+func Subprotocol(version int) string {
+	return fmt.Sprintf("docsmith.v%d", version)
+}
+
+// Message types. Clients send the first group; the server sends the second,
+// plus the event types in events.go.
+const (
+	TypeJoin      = "join"
+	TypeUpdate    = "update"
+	TypeOp        = "op"
+	TypeCursor    = "cursor"
+	TypeSelection = "selection"
+	TypePresence  = "presence"
+	TypeComment   = "comment"
+	TypeResume    = "resume"
+	TypeCRDTSync  = "crdt_sync"
+	TypeCRDTDelta = "crdt_delta"
+	TypePing      = "ping"
+
+	TypeSnapshot         = "snapshot"
+	TypeAck              = "ack"
+	TypeError            = "error"
+	TypeReplay           = "replay"
+	TypePresenceSnapshot = "presence_snapshot"
+	TypeUserJoined       = "user_joined"
+	TypeUserLeft         = "user_left"
+)
+
+// Error codes sent in error messages.
+const (
+	ErrInvalidMessage      = "invalid_message"
+	ErrUnknownType         = "unknown_type"
+	ErrUnsupportedProtocol = "unsupported_protocol"
+	ErrReadOnly            = "read_only"
+	ErrInvalidOperation    = "invalid_operation"
+	ErrStaleRevision       = "stale_revision"
+	ErrUnavailable         = "unavailable"
+	ErrCRDTUnavailable     = "crdt_unavailable"
+	ErrCRDTNotSynced       = "crdt_not_synced"
+	ErrInvalidCRDTDelta    = "invalid_crdt_delta"
+)
+
+// maxCommentLength caps the text of a comment, in characters.
+const maxCommentLength = 10000
+
+// Payloads clients send.
+
+// JoinPayload is sent once connected. The connection already belongs to the
+// document given at the handshake, which the payload must match.
+type JoinPayload struct {
+	DocumentID string `json:"document_id"`
+}
+
+// UpdatePayload replaces the whole content and/or title. It is turned into
+// operations against the current revision.
+type UpdatePayload struct {
+	Content *string `json:"content,omitempty"`
+	Title   string  `json:"title,omitempty"`
+}
+
+// OpPayload carries operations made against the given revision.
+type OpPayload struct {
+	Revision   int         `json:"revision"`
+	Operations []Operation `json:"operations"`
+	// Title optionally renames the document along with the edit.
+	Title string `json:"title,omitempty"`
+}
+
+// CursorPayload moves the sender's caret; a null position hides it.
+type CursorPayload struct {
+	Position *int `json:"position"`
+}
+
+// SelectionPayload sets the sender's selection; null clears it.
+type SelectionPayload struct {
+	Selection *Selection `json:"selection"`
+}
+
+// PresenceUpdatePayload sets caret and selection together.
+type PresenceUpdatePayload struct {
+	Cursor    *int       `json:"cursor"`
+	Selection *Selection `json:"selection"`
+}
+
+// CommentPayload comments on the document, optionally on a range of it or
+// in reply to an earlier comment.
+type CommentPayload struct {
+	Text    string     `json:"text"`
+	Anchor  *Selection `json:"anchor,omitempty"`
+	ReplyTo string     `json:"reply_to,omitempty"`
+}
+
+// ResumePayload asks for the broadcasts after seq in the stream identified
+// by epoch, after a dropped connection.
+type ResumePayload struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+// CRDTSyncPayload switches the connection to the CRDT protocol, sending what
+// the client has seen.
+type CRDTSyncPayload struct {
+	StateVector StateVector `json:"state_vector"`
+}
+
+// CRDTDeltaPayload carries CRDT ops. From the server, Seq places them in the
+// broadcast stream and StateVector answers a crdt_sync.
+type CRDTDeltaPayload struct {
+	Ops         []CRDTOp    `json:"ops"`
+	StateVector StateVector `json:"state_vector,omitempty"`
+	Seq         uint64      `json:"seq,omitempty"`
+}
+
+// PingPayload keeps the connection alive; it has no fields.
+type PingPayload struct{}
+
+// Payloads the server sends.
+
+// SnapshotPayload is the whole document, sent on connect and whenever a
+// client has to start over.
+type SnapshotPayload struct {
+	DocumentID string `json:"document_id"`
+	Content    string `json:"content"`
+	Revision   int    `json:"revision"`
+	Epoch      string `json:"epoch"`
+	Seq        uint64 `json:"seq"`
+	Protocol   int    `json:"protocol"`
+	// Resync marks a snapshot answering a resume that could not be served.
+	Resync bool `json:"resync,omitempty"`
+}
+
+// AckPayload confirms the sender's op became revision; Seq is the sequence
+// number the op was broadcast under.
+type AckPayload struct {
+	Revision int    `json:"revision"`
+	Seq      uint64 `json:"seq"`
+}
+
+// OpBroadcastPayload is an edit by someone else, or by the server when the
+// user fields are empty.
+type OpBroadcastPayload struct {
+	Revision   int         `json:"revision"`
+	Operations []Operation `json:"operations"`
+	UserID     string      `json:"user_id,omitempty"`
+	Username   string      `json:"username,omitempty"`
+	ClientID   string      `json:"client_id,omitempty"`
+	Title      string      `json:"title,omitempty"`
+	Seq        uint64      `json:"seq,omitempty"`
+}
+
+// ErrorPayload reports a rejected message or failed request.
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Type is the type of the rejected message, when there is one.
+	Type string `json:"type,omitempty"`
+}
+
+// ReplayPayload holds the broadcasts a resuming client missed, oldest
+// first, and where the stream is now.
+type ReplayPayload struct {
+	Epoch    string     `json:"epoch"`
+	Seq      uint64     `json:"seq"`
+	Messages []*Message `json:"messages"`
+}
+
+// PresenceSnapshotPayload tells a new connection its own presence and who
+// else is connected.
+type PresenceSnapshotPayload struct {
+	Self    Presence   `json:"self"`
+	Clients []Presence `json:"clients"`
+}
+
+// PresenceBroadcastPayload is a collaborator's changed presence.
+type PresenceBroadcastPayload struct {
+	Presence Presence `json:"presence"`
+}
+
+// UserJoinedPayload announces a new connection.
+type UserJoinedPayload struct {
+	DocumentID  string `json:"document_id"`
+	ClientID    string `json:"client_id"`
+	UserID      string `json:"user_id"`
+	Username    string `json:"username"`
+	IsAnonymous bool   `json:"is_anonymous"`
+	Color       string `json:"color"`
+}
+
+// UserLeftPayload announces a closed connection.
+type UserLeftPayload struct {
+	DocumentID string `json:"document_id"`
+	ClientID   string `json:"client_id"`
+	UserID     string `json:"user_id"`
+	Username   string `json:"username"`
+}
+
+// CommentBroadcastPayload is a comment as collaborators see it.
+type CommentBroadcastPayload struct {
+	ID       string     `json:"id"`
+	UserID   string     `json:"user_id"`
+	Username string     `json:"username"`
+	Text     string     `json:"text"`
+	Anchor   *Selection `json:"anchor,omitempty"`
+	ReplyTo  string     `json:"reply_to,omitempty"`
+	Seq      uint64     `json:"seq,omitempty"`
+}
+
+// EventPayload describes a change made through the REST API; see events.go.
+type EventPayload struct {
+	DocumentID string `json:"document_id"`
+	UserID     string `json:"user_id,omitempty"`
+	Revision   int    `json:"revision,omitempty"`
+	Title      string `json:"title,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Seq        uint64 `json:"seq,omitempty"`
+}
+
+// messageSpec describes one message type of the protocol.
+type messageSpec struct {
+	Type string
+	// FromClient is set for messages clients may send.
+	FromClient bool
+	// Edit marks messages that change the document, which read-only
+	// connections may not send.
+	Edit    bool
+	Payload interface{}
+}
+
+// protocolMessages lists every message of the protocol. It drives inbound
+// validation and the generated JSON schema.
+var protocolMessages = []messageSpec{
+	{Type: TypeJoin, FromClient: true, Payload: JoinPayload{}},
+	{Type: TypeUpdate, FromClient: true, Edit: true, Payload: UpdatePayload{}},
+	{Type: TypeOp, FromClient: true, Edit: true, Payload: OpPayload{}},
+	{Type: TypeCursor, FromClient: true, Payload: CursorPayload{}},
+	{Type: TypeSelection, FromClient: true, Payload: SelectionPayload{}},
+	{Type: TypePresence, FromClient: true, Payload: PresenceUpdatePayload{}},
+	{Type: TypeComment, FromClient: true, Payload: CommentPayload{}},
+	{Type: TypeResume, FromClient: true, Payload: ResumePayload{}},
+	{Type: TypeCRDTSync, FromClient: true, Payload: CRDTSyncPayload{}},
+	{Type: TypeCRDTDelta, FromClient: true, Edit: true, Payload: CRDTDeltaPayload{}},
+	{Type: TypePing, FromClient: true, Payload: PingPayload{}},
+
+	{Type: TypeSnapshot, Payload: SnapshotPayload{}},
+	{Type: TypeAck, Payload: AckPayload{}},
+	{Type: TypeOp, Payload: OpBroadcastPayload{}},
+	{Type: TypeCRDTDelta, Payload: CRDTDeltaPayload{}},
+	{Type: TypeError, Payload: ErrorPayload{}},
+	{Type: TypeReplay, Payload: ReplayPayload{}},
+	{Type: TypePresenceSnapshot, Payload: PresenceSnapshotPayload{}},
+	{Type: TypePresence, Payload: PresenceBroadcastPayload{}},
+	{Type: TypeUserJoined, Payload: UserJoinedPayload{}},
+	{Type: TypeUserLeft, Payload: UserLeftPayload{}},
+	{Type: TypeComment, Payload: CommentBroadcastPayload{}},
+	{Type: EventUpdated, Payload: EventPayload{}},
+	{Type: EventRenamed, Payload: EventPayload{}},
+	{Type: EventVersion, Payload: EventPayload{}},
+	{Type: EventRestored, Payload: EventPayload{}},
+	{Type: EventReverted, Payload: EventPayload{}},
+	{Type: EventMerged, Payload: EventPayload{}},
+	{Type: EventConflict, Payload: EventPayload{}},
+	{Type: EventDeleted, Payload: EventPayload{}},
+}
+
+// clientMessage returns the spec of a type clients may send.
+func clientMessage(messageType string) (messageSpec, bool) {
+	for _, spec := range protocolMessages {
+		if spec.FromClient && spec.Type == messageType {
+			return spec, true
+		}
+	}
+	return messageSpec{}, false
+}
+
+// ProtocolError is a rejected client message, sent back as an error message.
+type ProtocolError struct {
+	Code    string
+	Message string
+	Type    string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *ProtocolError) message() *Message {
+	return newMessage(TypeError, ErrorPayload{Code: e.Code, Message: e.Message, Type: e.Type})
+}
+
+// parseMessage decodes and validates a message read from a client. Unknown
+// types, unknown fields and out of range values are all rejected.
+func parseMessage(raw []byte) (*Message, interface{}, *ProtocolError) {
+	var frame struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &frame); err != nil {
+		return nil, nil, &ProtocolError{Code: ErrInvalidMessage, Message: "message is not valid JSON"}
+	}
+	spec, ok := clientMessage(frame.Type)
+	if !ok {
+		return nil, nil, &ProtocolError{Code: ErrUnknownType, Message: fmt.Sprintf("unknown message type %q", frame.Type), Type: frame.Type}
+	}
+
+	if len(frame.Data) == 0 || string(frame.Data) == "null" {
+		frame.Data = json.RawMessage("{}")
+	}
+	payload := reflect.New(reflect.TypeOf(spec.Payload))
+	decoder := json.NewDecoder(bytes.NewReader(frame.Data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(payload.Interface()); err != nil {
+		return nil, nil, &ProtocolError{Code: ErrInvalidMessage, Message: strings.TrimPrefix(err.Error(), "json: "), Type: frame.Type}
+	}
+	if err := validatePayload(payload.Interface()); err != nil {
+		return nil, nil, &ProtocolError{Code: ErrInvalidMessage, Message: err.Error(), Type: frame.Type}
+	}
+
+	var data map[string]interface{}
+	json.Unmarshal(frame.Data, &data)
+	return &Message{Type: frame.Type, Data: data}, payload.Elem().Interface(), nil
+}
+
+// validatePayload checks what the JSON types alone can't.
+func validatePayload(payload interface{}) error {
+	switch p := payload.(type) {
+	case *UpdatePayload:
+		if p.Content == nil && p.Title == "" {
+			return fmt.Errorf("update needs content or a title")
+		}
+	case *OpPayload:
+		if p.Revision < 0 {
+			return fmt.Errorf("revision must not be negative")
+		}
+		if len(p.Operations) > 0 || p.Title == "" {
+			if err := validateOperations(p.Operations); err != nil {
+				return err
+			}
+		}
+	case *CursorPayload:
+		if p.Position != nil && *p.Position < 0 {
+			return fmt.Errorf("position must not be negative")
+		}
+	case *SelectionPayload:
+		return validateSelection(p.Selection)
+	case *PresenceUpdatePayload:
+		if p.Cursor != nil && *p.Cursor < 0 {
+			return fmt.Errorf("cursor must not be negative")
+		}
+		return validateSelection(p.Selection)
+	case *CommentPayload:
+		n := len([]rune(strings.TrimSpace(p.Text)))
+		if n == 0 {
+			return fmt.Errorf("comment text is empty")
+		}
+		if n > maxCommentLength {
+			return fmt.Errorf("comment is longer than %d characters", maxCommentLength)
+		}
+		return validateSelection(p.Anchor)
+	case *ResumePayload:
+		if p.Epoch == "" {
+			return fmt.Errorf("epoch is required")
+		}
+	case *CRDTDeltaPayload:
+		for _, op := range p.Ops {
+			if err := validateCRDTOp(op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateSelection(s *Selection) error {
+	if s != nil && (s.Anchor < 0 || s.Head < 0) {
+		return fmt.Errorf("selection must not be negative")
+	}
+	return nil
+}
+
+// newMessage builds a message from a payload struct. Fields keep their Go
+// values, so the hub can still inspect them before the message is encoded.
+func newMessage(messageType string, payload interface{}) *Message {
+	return &Message{Type: messageType, Data: payloadData(payload)}
+}
+
+// payloadData flattens a payload struct into message data, following its
+// json tags.
+func payloadData(payload interface{}) map[string]interface{} {
+	v := reflect.ValueOf(payload)
+	t := v.Type()
+	data := make(map[string]interface{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, omitEmpty := jsonName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		field := v.Field(i)
+		if omitEmpty && isEmptyValue(field) {
+			continue
+		}
+		data[name] = field.Interface()
+	}
+	return data
+}
+
+// jsonName returns the name a struct field is encoded under, or "" if it is
+// not encoded.
+func jsonName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name, options, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = field.Name
+	}
+	return name, strings.Contains(options, "omitempty")
+}
+
+// isEmptyValue reports whether encoding/json would omit v under omitempty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
@@ -0,0 +1,276 @@
+package ws
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisDialTimeout bounds connecting to the Redis server.
+const redisDialTimeout = 5 * time.Second
+
+// RedisBackplane connects hubs on different instances through Redis pub/sub.
+// Redis delivers the messages of a channel to every subscriber in the order
+// it received them, which is the ordering hubs need. Only PUBLISH, SUBSCRIBE
+// and PUBSUB NUMSUB are used, so any server speaking the Redis protocol will
+// do.
+type RedisBackplane struct {
+	addr     string
+	password string
+
+	// conn is shared by Publish and Subscribers and reopened after errors.
+	mutex sync.Mutex
+	conn  *redisConn
+}
+
+// NewRedisBackplane returns a backplane using the Redis server at addr
+// (host:port). An empty password skips AUTH. Connections are opened lazily.
+func NewRedisBackplane(addr, password string) *RedisBackplane {
+	return &RedisBackplane{addr: addr, password: password}
+}
+
+func (b *RedisBackplane) Publish(channel string, payload []byte) error {
+	_, err := b.do("PUBLISH", channel, string(payload))
+	return err
+}
+
+func (b *RedisBackplane) Subscribers(channel string) (int, error) {
+	reply, err := b.do("PUBSUB", "NUMSUB", channel)
+	if err != nil {
+		return 0, err
+	}
+	// The reply alternates channel names and counts.
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return 0, fmt.Errorf("redis: unexpected PUBSUB NUMSUB reply %v", reply)
+	}
+	n, ok := items[1].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected PUBSUB NUMSUB reply %v", reply)
+	}
+	return int(n), nil
+}
+
+func (b *RedisBackplane) Subscribe(channel string) (Subscription, error) {
+	conn, err := dialRedis(b.addr, b.password)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.send("SUBSCRIBE", channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Wait for the confirmation so messages published after Subscribe
+	// returns are guaranteed to arrive.
+	reply, err := conn.read()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if kind, _ := redisPush(reply); kind != "subscribe" {
+		conn.Close()
+		return nil, fmt.Errorf("redis: unexpected SUBSCRIBE reply %v", reply)
+	}
+
+	sub := &redisSubscription{
+		conn:   conn,
+		out:    make(chan []byte),
+		closed: make(chan struct{}),
+	}
+	go sub.receive()
+	return sub, nil
+}
+
+// do runs a command on the shared connection, reconnecting once if the
+// connection has gone bad.
+func (b *RedisBackplane) do(args ...string) (interface{}, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.conn == nil {
+			if b.conn, err = dialRedis(b.addr, b.password); err != nil {
+				return nil, err
+			}
+		}
+		var reply interface{}
+		if reply, err = b.conn.do(args...); err == nil {
+			return reply, nil
+		}
+		var replyErr redisError
+		if errors.As(err, &replyErr) {
+			return nil, err
+		}
+		b.conn.Close()
+		b.conn = nil
+	}
+	return nil, err
+}
+
+type redisSubscription struct {
+	conn      *redisConn
+	out       chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *redisSubscription) receive() {
+	defer close(s.out)
+	for {
+		reply, err := s.conn.read()
+		if err != nil {
+			return
+		}
+		kind, items := redisPush(reply)
+		if kind != "message" || len(items) != 3 {
+			continue
+		}
+		payload, ok := items[2].(string)
+		if !ok {
+			continue
+		}
+		select {
+		case s.out <- []byte(payload):
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *redisSubscription) Messages() <-chan []byte {
+	return s.out
+}
+
+func (s *redisSubscription) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// redisPush splits a pub/sub push such as ["message", channel, payload] into
+// its kind and items.
+func redisPush(reply interface{}) (string, []interface{}) {
+	items, ok := reply.([]interface{})
+	if !ok || len(items) == 0 {
+		return "", nil
+	}
+	kind, _ := items[0].(string)
+	return kind, items
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn speaks RESP, the Redis serialisation protocol, over one
+// connection.
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func dialRedis(addr, password string) (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", addr, redisDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	if password != "" {
+		if _, err := conn.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// send writes a command as an array of bulk strings.
+func (c *redisConn) send(args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := c.Write(buf)
+	return err
+}
+
+// read parses one reply: a string, an int64, nil, a slice of replies, or a
+// redisError returned as the error.
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed integer %q", body)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
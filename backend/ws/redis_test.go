@@ -0,0 +1,297 @@
+package ws
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a server speaking just enough RESP for RedisBackplane:
+// AUTH, PUBLISH, SUBSCRIBE and PUBSUB NUMSUB.
+type fakeRedis struct {
+	password string
+
+	mutex    sync.Mutex
+	subs     map[string][]*fakeRedisConn
+	commands [][]string
+}
+
+type fakeRedisConn struct {
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+func (c *fakeRedisConn) write(reply string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.Write([]byte(reply))
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// startFakeRedis serves on a local port and returns its address.
+func startFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &fakeRedis{password: password, subs: make(map[string][]*fakeRedisConn)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(&fakeRedisConn{conn: conn})
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+func (s *fakeRedis) serve(c *fakeRedisConn) {
+	defer c.conn.Close()
+	defer s.unsubscribe(c)
+	reader := bufio.NewReader(c.conn)
+	authed := s.password == ""
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.commands = append(s.commands, args)
+		s.mutex.Unlock()
+
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if len(args) != 2 || args[1] != s.password {
+				c.write("-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			c.write("+OK\r\n")
+		case "PUBLISH":
+			if !authed {
+				c.write("-NOAUTH Authentication required.\r\n")
+				continue
+			}
+			s.mutex.Lock()
+			subs := s.subs[args[1]]
+			for _, sub := range subs {
+				sub.write("*3\r\n" + bulk("message") + bulk(args[1]) + bulk(args[2]))
+			}
+			s.mutex.Unlock()
+			c.write(fmt.Sprintf(":%d\r\n", len(subs)))
+		case "SUBSCRIBE":
+			s.mutex.Lock()
+			s.subs[args[1]] = append(s.subs[args[1]], c)
+			c.write("*3\r\n" + bulk("subscribe") + bulk(args[1]) + ":1\r\n")
+			s.mutex.Unlock()
+		case "PUBSUB":
+			s.mutex.Lock()
+			c.write(fmt.Sprintf("*2\r\n%s:%d\r\n", bulk(args[2]), len(s.subs[args[2]])))
+			s.mutex.Unlock()
+		default:
+			c.write("-ERR unknown command '" + args[0] + "'\r\n")
+		}
+	}
+}
+
+func (s *fakeRedis) unsubscribe(c *fakeRedisConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for channel, subs := range s.subs {
+		var kept []*fakeRedisConn
+		for _, sub := range subs {
+			if sub != c {
+				kept = append(kept, sub)
+			}
+		}
+		s.subs[channel] = kept
+	}
+}
+
+func (s *fakeRedis) received() [][]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([][]string(nil), s.commands...)
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bad argument %q", line)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func TestRedisBackplane(t *testing.T) {
+	server, addr := startFakeRedis(t, "secret")
+	backplane := NewRedisBackplane(addr, "secret")
+
+	if n, err := backplane.Subscribers("doc:1"); err != nil || n != 0 {
+		t.Fatalf("Subscribers = %d, %v before subscribing", n, err)
+	}
+	sub, err := backplane.Subscribe("doc:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRedisBackplane(addr, "secret").Subscribe("doc:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := backplane.Subscribers("doc:1"); err != nil || n != 2 {
+		t.Fatalf("Subscribers = %d, %v, want 2", n, err)
+	}
+
+	payloads := []string{"one", "", "with\r\nnewlines", strings.Repeat("x", 10000)}
+	for _, p := range payloads {
+		if err := backplane.Publish("doc:1", []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []Subscription{sub, other} {
+		for _, want := range payloads {
+			select {
+			case got := <-s.Messages():
+				if string(got) != want {
+					t.Errorf("received %.20q, want %.20q", got, want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("no message, want %.20q", want)
+			}
+		}
+	}
+
+	sub.Close()
+	if _, ok := <-sub.Messages(); ok {
+		t.Errorf("messages still open after Close")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n, err := backplane.Subscribers("doc:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Subscribers = %d after closing one of two", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	other.Close()
+
+	// The connection authenticated before its first command
+	commands := server.received()
+	if len(commands) < 2 {
+		t.Fatalf("server received %v", commands)
+	}
+	if !reflect.DeepEqual(commands[0], []string{"AUTH", "secret"}) {
+		t.Errorf("first command was %v, want AUTH", commands[0])
+	}
+	if !reflect.DeepEqual(commands[1], []string{"PUBSUB", "NUMSUB", "doc:1"}) {
+		t.Errorf("second command was %v, want PUBSUB NUMSUB", commands[1])
+	}
+
+	if _, err := NewRedisBackplane(addr, "wrong").Subscribe("doc:1"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("subscribing with the wrong password: %v", err)
+	}
+}
+
+func TestRedisRead(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  interface{}
+		err   string
+	}{
+		{reply: "+OK\r\n", want: "OK"},
+		{reply: ":42\r\n", want: int64(42)},
+		{reply: ":-1\r\n", want: int64(-1)},
+		{reply: "$5\r\nhello\r\n", want: "hello"},
+		{reply: "$0\r\n\r\n", want: ""},
+		{reply: "$-1\r\n", want: nil},
+		{reply: "*-1\r\n", want: nil},
+		{reply: "*2\r\n$5\r\ndoc:1\r\n:3\r\n", want: []interface{}{"doc:1", int64(3)}},
+		{reply: "*3\r\n$7\r\nmessage\r\n$5\r\ndoc:1\r\n$2\r\n{}\r\n", want: []interface{}{"message", "doc:1", "{}"}},
+		{reply: "*1\r\n*1\r\n:1\r\n", want: []interface{}{[]interface{}{int64(1)}}},
+		{reply: "-ERR unknown command\r\n", err: "redis: ERR unknown command"},
+		{reply: ":abc\r\n", err: "malformed integer"},
+		{reply: "$x\r\n", err: "malformed bulk length"},
+		{reply: "+OK\n", err: "malformed reply"},
+		{reply: "?1\r\n", err: "unknown reply type"},
+		{reply: "$5\r\nhel", err: "EOF"},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			server.Write([]byte(tt.reply))
+			server.Close()
+		}()
+		conn := &redisConn{Conn: client, reader: bufio.NewReader(client)}
+		got, err := conn.read()
+		client.Close()
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("read(%q) = %v, %v, want error %q", tt.reply, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("read(%q) = %#v, %v, want %#v", tt.reply, got, err, tt.want)
+		}
+	}
+}
+
+func TestRedisSend(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		conn := &redisConn{Conn: client, reader: bufio.NewReader(client)}
+		conn.send("PUBSUB", "NUMSUB", "doc:1")
+	}()
+	args, err := readCommand(bufio.NewReader(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args, []string{"PUBSUB", "NUMSUB", "doc:1"}) {
+		t.Errorf("sent %v", args)
+	}
+}
+
+func TestClusterRedisBackplane(t *testing.T) {
+	_, addr := startFakeRedis(t, "")
+	runCluster(t, func() Backplane { return NewRedisBackplane(addr, "") })
+}
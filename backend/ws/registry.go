@@ -0,0 +1,129 @@
+package ws
+
+import (
+	"log"
+	"sync"
+)
+
+// Registry owns the running hubs, one per open document. The API layer holds
+// a registry to open hubs for websocket clients and to tell them about
+// changes made through REST.
+type Registry struct {
+	store     Store
+	backplane Backplane
+	limits    Limits
+	metrics   *Metrics
+	// instance identifies this server on the backplane
+	instance string
+	mutex    sync.Mutex
+	hubs     map[string]*Hub
+}
+
+// NewRegistry returns a registry whose hubs load and save documents through
+// store. A nil store keeps documents in memory only. Hubs share documents
+// with other server instances through backplane; a nil backplane keeps them
+// to this process.
+func NewRegistry(store Store, backplane Backplane) *Registry {
+	if backplane == nil {
+		backplane = NewMemoryBackplane()
+	}
+	return &Registry{
+		store:     store,
+		backplane: backplane,
+		instance:  randomID(),
+		limits:    DefaultLimits(),
+		metrics:   &Metrics{},
+		hubs:      make(map[string]*Hub),
+	}
+}
+
+// SetLimits changes the limits applied to connections. Call it before
+// serving; hubs already running keep their limits.
+func (r *Registry) SetLimits(limits Limits) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.limits = limits
+}
+
+// Metrics returns the counters of every hub the registry has run, and the
+// current number of hubs and clients.
+func (r *Registry) Metrics() MetricsSnapshot {
+	r.mutex.Lock()
+	hubs := make([]*Hub, 0, len(r.hubs))
+	for _, hub := range r.hubs {
+		hubs = append(hubs, hub)
+	}
+	r.mutex.Unlock()
+
+	snapshot := r.metrics.snapshot()
+	snapshot.Hubs = len(hubs)
+	for _, hub := range hubs {
+		snapshot.Clients += hub.clientCount()
+	}
+	return snapshot
+}
+
+// GetOrCreateHub returns the running hub for a document, starting one if
+// needed.
+func (r *Registry) GetOrCreateHub(documentID string) *Hub {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	hub, exists := r.hubs[documentID]
+	if !exists {
+		hub = NewHub(documentID)
+		hub.registry = r
+		hub.store = r.store
+		hub.backplane = r.backplane
+		hub.instance = r.instance
+		hub.limits = r.limits
+		hub.metrics = r.metrics
+		r.hubs[documentID] = hub
+		go hub.Run()
+	}
+
+	return hub
+}
+
+// Lookup returns the running hub for a document, or nil if nobody has it
+// open.
+func (r *Registry) Lookup(documentID string) *Hub {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.hubs[documentID]
+}
+
+// Collaborators returns who is connected to a document, once per user. Only
+// documents open on this instance are known; their hubs also track the
+// collaborators connected elsewhere.
+func (r *Registry) Collaborators(documentID string) []Presence {
+	collaborators := []Presence{}
+	hub := r.Lookup(documentID)
+	if hub == nil {
+		return collaborators
+	}
+	seen := make(map[string]bool)
+	for _, p := range hub.Presence() {
+		if !seen[p.UserID] {
+			seen[p.UserID] = true
+			collaborators = append(collaborators, p)
+		}
+	}
+	return collaborators
+}
+
+// Publish delivers an event to the document's hubs on every instance.
+// Documents nobody has open have no hub, and the event is dropped.
+func (r *Registry) Publish(documentID string, event Event) {
+	env := &envelope{Kind: kindEvent, Instance: r.instance, Event: &event}
+	if err := publishEnvelope(r.backplane, documentID, env); err != nil {
+		log.Printf("Publishing %s event for document %s: %v", event.Type, documentID, err)
+	}
+}
+
+// remove drops a stopping hub, unless it has already been replaced.
+func (r *Registry) remove(hub *Hub) {
+	if r.hubs[hub.DocumentID] == hub {
+		delete(r.hubs, hub.DocumentID)
+	}
+}
@@ -0,0 +1,109 @@
+package ws
+
+import "time"
+
+// replaySize is how many sequenced messages a hub keeps for clients resuming
+// after a dropped connection. Clients further behind get a fresh snapshot.
+const replaySize = 512
+
+// idleGrace is how long a hub keeps running after its last client leaves,
+// so that a client whose connection dropped can still resume from its
+// replay buffer rather than start over from a snapshot.
+const idleGrace = 2 * time.Minute
+
+// replayBuffer is a ring of the messages broadcast to a document. Each one
+// carries its sequence number as data["seq"]. The epoch changes whenever a
+// hub starts from the store, since sequence numbers then start over.
+type replayBuffer struct {
+	epoch    string
+	seq      uint64
+	messages []*Message
+	// head is the index of the oldest message once the ring is full
+	head int
+}
+
+func newReplayBuffer() *replayBuffer {
+	return &replayBuffer{epoch: randomID()}
+}
+
+// add stamps message with the next sequence number and keeps it.
+func (b *replayBuffer) add(message *Message) uint64 {
+	b.seq++
+	if message.Data == nil {
+		message.Data = map[string]interface{}{}
+	}
+	message.Data["seq"] = b.seq
+	if len(b.messages) < replaySize {
+		b.messages = append(b.messages, message)
+	} else {
+		b.messages[b.head] = message
+		b.head = (b.head + 1) % replaySize
+	}
+	return b.seq
+}
+
+// since returns the messages after seq, oldest first. It reports false if
+// some of them have already been dropped, or seq is from another epoch.
+func (b *replayBuffer) since(epoch string, seq uint64) ([]*Message, bool) {
+	if epoch != b.epoch || seq > b.seq {
+		return nil, false
+	}
+	missed := int(b.seq - seq)
+	if missed > len(b.messages) {
+		return nil, false
+	}
+	ordered := b.ordered()
+	return ordered[len(ordered)-missed:], true
+}
+
+func (b *replayBuffer) ordered() []*Message {
+	ordered := make([]*Message, 0, len(b.messages))
+	ordered = append(ordered, b.messages[b.head:]...)
+	return append(ordered, b.messages[:b.head]...)
+}
+
+// replayState is a replay buffer in transit to a peer hub.
+type replayState struct {
+	Epoch    string     `json:"epoch"`
+	Seq      uint64     `json:"seq"`
+	Messages []*Message `json:"messages"`
+}
+
+func (b *replayBuffer) state() *replayState {
+	return &replayState{Epoch: b.epoch, Seq: b.seq, Messages: b.ordered()}
+}
+
+func replayBufferFrom(state *replayState) *replayBuffer {
+	messages := state.Messages
+	if len(messages) > replaySize {
+		messages = messages[len(messages)-replaySize:]
+	}
+	return &replayBuffer{
+		epoch:    state.Epoch,
+		seq:      state.Seq,
+		messages: append([]*Message(nil), messages...),
+	}
+}
+
+// record sequences a message for the document's replay buffer before it is
+// broadcast, and returns its sequence number.
+func (h *Hub) record(message *Message) uint64 {
+	return h.replay.add(message)
+}
+
+// resume replays what a reconnecting client missed, or sends it a fresh
+// snapshot when that is no longer available.
+func (h *Hub) resume(client *Client, payload ResumePayload) {
+	missed, ok := h.replay.since(payload.Epoch, payload.Seq)
+	if !ok {
+		snapshot := h.snapshot()
+		snapshot.Resync = true
+		h.sendTo(client, newMessage(TypeSnapshot, snapshot))
+		return
+	}
+	h.sendTo(client, newMessage(TypeReplay, ReplayPayload{
+		Epoch:    h.replay.epoch,
+		Seq:      h.replay.seq,
+		Messages: missed,
+	}))
+}
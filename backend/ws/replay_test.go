@@ -0,0 +1,120 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayBuffer(t *testing.T) {
+	b := newReplayBuffer()
+	for i := 0; i < 5; i++ {
+		b.add(&Message{Type: TypeOp})
+	}
+	seqs := func(messages []*Message) []uint64 {
+		var seqs []uint64
+		for _, m := range messages {
+			seqs = append(seqs, m.Data["seq"].(uint64))
+		}
+		return seqs
+	}
+
+	if missed, ok := b.since(b.epoch, 2); !ok || len(missed) != 3 || seqs(missed)[0] != 3 || seqs(missed)[2] != 5 {
+		t.Errorf("since 2 = %v, %v, want 3 to 5", seqs(missed), ok)
+	}
+	if missed, ok := b.since(b.epoch, 5); !ok || len(missed) != 0 {
+		t.Errorf("since 5 = %v, %v, want nothing", seqs(missed), ok)
+	}
+	if _, ok := b.since(b.epoch, 6); ok {
+		t.Errorf("since 6 is ahead of the buffer")
+	}
+	if _, ok := b.since("other", 2); ok {
+		t.Errorf("since 2 of another epoch")
+	}
+
+	// Once the ring wraps, only the last replaySize messages are kept
+	for i := 0; i < replaySize; i++ {
+		b.add(&Message{Type: TypeOp})
+	}
+	last := uint64(replaySize + 5)
+	if _, ok := b.since(b.epoch, 4); ok {
+		t.Errorf("since 4 was dropped")
+	}
+	missed, ok := b.since(b.epoch, last-replaySize)
+	if !ok || len(missed) != replaySize || seqs(missed)[0] != last-replaySize+1 || seqs(missed)[replaySize-1] != last {
+		t.Errorf("since %d returned %d messages from %v", last-replaySize, len(missed), ok)
+	}
+
+	// A peer taking the buffer over carries on from it
+	copied := replayBufferFrom(b.state())
+	if copied.epoch != b.epoch || copied.seq != last {
+		t.Errorf("copy is at %s %d", copied.epoch, copied.seq)
+	}
+	if missed, ok := copied.since(b.epoch, last-2); !ok || len(missed) != 2 || seqs(missed)[1] != last {
+		t.Errorf("copy since %d = %v, %v", last-2, seqs(missed), ok)
+	}
+	if seq := copied.add(&Message{Type: TypeOp}); seq != last+1 {
+		t.Errorf("copy went on with %d", seq)
+	}
+}
+
+// A client whose connection dropped gets what it missed, or a fresh
+// snapshot if that can't be had.
+func TestResume(t *testing.T) {
+	in := newInstance(t, nil, "abc")
+	alice := in.dial(t, "alice")
+	snapshot := readType(t, alice, TypeSnapshot)
+	epoch, seq := snapshot["epoch"].(string), snapshot["seq"].(float64)
+	bob := in.dial(t, "bob")
+	readType(t, bob, TypeSnapshot)
+	alice.Close()
+
+	sendOp(t, bob, 0, ins(3, "d"))
+	readType(t, bob, TypeAck)
+	sendOp(t, bob, 1, ins(4, "e"))
+	last := readType(t, bob, TypeAck)
+
+	resume := func(epoch string, seq float64) map[string]interface{} {
+		t.Helper()
+		conn := in.dial(t, "alice")
+		readType(t, conn, TypeSnapshot)
+		if err := conn.WriteJSON(Message{Type: TypeResume, Data: map[string]interface{}{"epoch": epoch, "seq": seq}}); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			var message struct {
+				Type string                 `json:"type"`
+				Data map[string]interface{} `json:"data"`
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if err := conn.ReadJSON(&message); err != nil {
+				t.Fatal(err)
+			}
+			if message.Type == TypeReplay || message.Type == TypeSnapshot {
+				message.Data["type"] = message.Type
+				return message.Data
+			}
+		}
+	}
+
+	replay := resume(epoch, seq)
+	if replay["type"] != TypeReplay || replay["seq"] != last["seq"] {
+		t.Fatalf("resuming got %v, want a replay up to %v", replay, last["seq"])
+	}
+	var revisions []float64
+	messages, _ := replay["messages"].([]interface{})
+	for _, m := range messages {
+		m, _ := m.(map[string]interface{})
+		if m["type"] == TypeOp {
+			data, _ := m["data"].(map[string]interface{})
+			revisions = append(revisions, data["revision"].(float64))
+		}
+	}
+	if len(revisions) != 2 || revisions[0] != 1 || revisions[1] != 2 {
+		t.Errorf("replayed ops are revisions %v, want 1 and 2", revisions)
+	}
+
+	resynced := resume("stale", seq)
+	if resynced["type"] != TypeSnapshot || resynced["resync"] != true || resynced["content"] != "abcde" {
+		t.Errorf("resuming another epoch got %v, want a fresh snapshot", resynced)
+	}
+}
@@ -0,0 +1,120 @@
+package ws
+
+import (
+	"reflect"
+	"sort"
+)
+
+// errorCodes lists the codes error messages may carry, for the schema.
+var errorCodes = []string{
+	ErrInvalidMessage,
+	ErrUnknownType,
+	ErrUnsupportedProtocol,
+	ErrReadOnly,
+	ErrInvalidOperation,
+	ErrStaleRevision,
+	ErrUnavailable,
+	ErrCRDTUnavailable,
+	ErrCRDTNotSynced,
+	ErrInvalidCRDTDelta,
+}
+
+// Schema describes the message protocol as a JSON Schema document. The
+// "client" and "server" sections map each message type to the schema of its
+// data; the frontend reads them to know what it may send and receive.
+func Schema() map[string]interface{} {
+	client := map[string]interface{}{}
+	server := map[string]interface{}{}
+	for _, spec := range protocolMessages {
+		schema := typeSchema(reflect.TypeOf(spec.Payload))
+		if spec.FromClient {
+			if spec.Edit {
+				schema["x-edit"] = true
+			}
+			client[spec.Type] = schema
+		} else {
+			server[spec.Type] = schema
+		}
+	}
+
+	return map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "Docsmith WebSocket protocol",
+		"version":     ProtocolVersion,
+		"subprotocol": Subprotocol(ProtocolVersion),
+		"type":        "object",
+		"required":    []string{"type", "data"},
+		"properties": map[string]interface{}{
+			"type": map[string]interface{}{"type": "string"},
+			"data": map[string]interface{}{"type": "object"},
+		},
+		"client":      client,
+		"server":      server,
+		"error_codes": errorCodes,
+	}
+}
+
+// typeSchema returns the schema of values of t as encoding/json writes them.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := typeSchema(t.Elem())
+		if kind, ok := schema["type"].(string); ok {
+			schema["type"] = []string{kind, "null"}
+		}
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t == reflect.TypeOf(Message{}) {
+			// Replayed messages are checked against their own type's schema.
+			return map[string]interface{}{
+				"type":     "object",
+				"required": []string{"type", "data"},
+				"properties": map[string]interface{}{
+					"type": map[string]interface{}{"type": "string"},
+					"data": map[string]interface{}{"type": "object"},
+				},
+			}
+		}
+		return structSchema(t)
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, omitEmpty := jsonName(field)
+		if name == "" {
+			continue
+		}
+		properties[name] = typeSchema(field.Type)
+		if !omitEmpty {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
@@ -0,0 +1,20 @@
+package ws
+
+// Store is how a hub reads and writes the document it owns. The API layer
+// provides the implementation so this package stays free of database code.
+type Store interface {
+	// LoadDocument returns the current content of a document.
+	LoadDocument(documentID string) (string, error)
+	// LoadCRDTState returns the stored CRDT state of a document, or nil if
+	// it has never been synced through the CRDT protocol.
+	LoadCRDTState(documentID string) ([]byte, error)
+	// SaveDocument stores the latest content, and the CRDT state producing
+	// it when the hub has a replica (crdtState is nil otherwise).
+	SaveDocument(documentID string, content string, crdtState []byte) error
+	// CommitDocument records content in the document's git history,
+	// attributed to the users who edited it.
+	CommitDocument(documentID string, content string, participants []Participant) error
+	// RenameDocument gives a document a new title, renamed by a client of
+	// the hub.
+	RenameDocument(documentID string, title string, by Participant) error
+}
@@ -3,6 +3,8 @@ import { useAuth } from '../context/AuthContext';
 
 function Register() {
   const [username, setUsername] = useState('');
+  const [displayName, setDisplayName] = useState('');
+  const [email, setEmail] = useState('');
   const [password, setPassword] = useState('');
   const [confirmPassword, setConfirmPassword] = useState('');
   const [error, setError] = useState('');
@@ -30,7 +32,7 @@ function Register() {
 
     try {
       setLoading(true);
-      await registerUser(username, password);
+      await registerUser(username, password, { displayName, email });
     } catch (err) {
       setError(err.message);
     } finally {
@@ -73,6 +75,36 @@ function Register() {
             />
           </div>
           
+          <div className="space-y-2">
+            <label htmlFor="display-name" className="block text-sm font-medium text-gray-700">
+              Display Name <span className="text-gray-400">(optional)</span>
+            </label>
+            <input
+              id="display-name"
+              type="text"
+              value={displayName}
+              onChange={(e) => setDisplayName(e.target.value)}
+              disabled={loading}
+              className="w-full px-3 py-2 border border-gray-300 rounded-md shadow-sm focus:outline-none focus:ring-2 focus:ring-blue-500 focus:border-blue-500"
+              placeholder="How your name appears in the history"
+            />
+          </div>
+
+          <div className="space-y-2">
+            <label htmlFor="email" className="block text-sm font-medium text-gray-700">
+              Email <span className="text-gray-400">(optional)</span>
+            </label>
+            <input
+              id="email"
+              type="email"
+              value={email}
+              onChange={(e) => setEmail(e.target.value)}
+              disabled={loading}
+              className="w-full px-3 py-2 border border-gray-300 rounded-md shadow-sm focus:outline-none focus:ring-2 focus:ring-blue-500 focus:border-blue-500"
+              placeholder="Used to sign your versions"
+            />
+          </div>
+
           <div className="space-y-2">
             <label htmlFor="password" className="block text-sm font-medium text-gray-700">
               Password
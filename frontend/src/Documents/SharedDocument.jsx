@@ -2,7 +2,7 @@ import React, { useState, useEffect } from 'react';
 import { useParams } from 'react-router-dom';
 import DocumentPreview from './DocumentPreview';
 import api from '../services/api';
-import { connectToDocument, sendDocumentUpdate, disconnectWebSocket } from '../services/websocket';
+import { connectToDocument, sendDocumentUpdate, disconnectWebSocket, sendCursor, sendSelection } from '../services/websocket';
 
 function SharedDocument() {
   const { shareId } = useParams();
@@ -45,6 +45,7 @@ function SharedDocument() {
         
         // Connect to WebSocket for collaboration
         const params = new URLSearchParams({
+          shareId,
           username: localStorage.getItem('anonymous_username')
         }).toString();
         
@@ -79,18 +80,28 @@ function SharedDocument() {
     if (data.content) setContent(data.content);
     
     // Update collaborators list
-    if (data.type === 'user_joined' || data.type === 'user_left') {
+    if (['user_joined', 'user_left', 'presence', 'presence_snapshot'].includes(data.type)) {
       updateCollaborators(data);
     }
   }
   
+  function toCollaborator(presence) {
+    return {
+      id: presence.user_id,
+      name: presence.username,
+      isAnonymous: presence.is_anonymous,
+      color: presence.color,
+      cursor: presence.cursor,
+      selection: presence.selection
+    };
+  }
+
   function updateCollaborators(data) {
-    if (data.type === 'user_joined') {
-      setCollaborators(prev => [...prev.filter(u => u.id !== data.user_id), {
-        id: data.user_id,
-        name: data.username,
-        isAnonymous: data.is_anonymous
-      }]);
+    if (data.type === 'presence_snapshot') {
+      setCollaborators((data.clients || []).map(toCollaborator));
+    } else if (data.type === 'user_joined' || data.type === 'presence') {
+      const user = toCollaborator(data.presence || data);
+      setCollaborators(prev => [...prev.filter(u => u.id !== user.id), user]);
     } else if (data.type === 'user_left') {
       setCollaborators(prev => prev.filter(u => u.id !== data.user_id));
     }
@@ -112,6 +123,19 @@ function SharedDocument() {
     );
   }
 
+  // Share where the caret is; textarea offsets are UTF-16 units, the server
+  // counts code points.
+  function handleSelect(e) {
+    const { value, selectionStart, selectionEnd } = e.target;
+    const toPosition = offset => Array.from(value.slice(0, offset)).length;
+    sendCursor(toPosition(selectionEnd));
+    if (selectionStart === selectionEnd) {
+      sendSelection(null);
+    } else {
+      sendSelection(toPosition(selectionStart), toPosition(selectionEnd));
+    }
+  }
+
   function handleTitleChange(e) {
     if (!shareInfo?.can_edit) return;
     
@@ -173,7 +197,7 @@ function SharedDocument() {
               </span>
               <div className="collaborators">
                 {collaborators.map(user => (
-                  <div key={user.id} className="collaborator-badge">
+                  <div key={user.id} className="collaborator-badge" style={{ borderColor: user.color }}>
                     {user.name}
                     {user.isAnonymous && ' (Guest)'}
                   </div>
@@ -186,6 +210,7 @@ function SharedDocument() {
             className="editor-textarea"
             value={content}
             onChange={handleContentChange}
+            onSelect={handleSelect}
             disabled={!shareInfo?.can_edit}
             placeholder="This document is empty..."
           />
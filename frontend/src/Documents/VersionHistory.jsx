@@ -1,8 +1,114 @@
-import React, { useState } from 'react';
-import { restoreDocumentVersion } from '../services/document';
+import React, { useEffect, useState } from 'react';
+import {
+  restoreDocumentVersion,
+  revertDocumentVersion,
+  fetchVersionDiff,
+  fetchDocumentVersion,
+  fetchDocumentTags,
+  createDocumentTag,
+  deleteDocumentTag,
+} from '../services/document';
+
+const lineStyles = {
+  insert: 'bg-green-50 text-green-800',
+  delete: 'bg-red-50 text-red-800',
+  equal: 'text-gray-600',
+};
+
+const wordStyles = {
+  insert: 'bg-green-200',
+  delete: 'bg-red-200 line-through',
+  equal: '',
+};
+
+// Renders the structured hunks of a version diff, with changed words marked.
+function DiffView({ diff }) {
+  if (diff.hunks.length === 0) {
+    return <p className="text-xs text-gray-500">No changes.</p>;
+  }
+  return (
+    <div className="font-mono text-xs border border-gray-200 rounded overflow-x-auto">
+      <div className="px-2 py-1 bg-gray-50 text-gray-500">
+        +{diff.additions} −{diff.deletions}
+      </div>
+      {diff.hunks.map((hunk) => (
+        <div key={`${hunk.old_start}-${hunk.new_start}`}>
+          <div className="px-2 py-0.5 bg-blue-50 text-blue-700">
+            @@ -{hunk.old_start},{hunk.old_lines} +{hunk.new_start},{hunk.new_lines} @@
+          </div>
+          {hunk.lines.map((line, i) => (
+            <div key={i} className={`flex whitespace-pre ${lineStyles[line.type]}`}>
+              <span className="w-8 shrink-0 text-right pr-1 text-gray-400">{line.old_line || ''}</span>
+              <span className="w-8 shrink-0 text-right pr-1 text-gray-400">{line.new_line || ''}</span>
+              <span className="px-1">
+                {line.words
+                  ? line.words.map((word, j) => (
+                      <span key={j} className={wordStyles[word.type]}>{word.text}</span>
+                    ))
+                  : line.text}
+              </span>
+            </div>
+          ))}
+        </div>
+      ))}
+    </div>
+  );
+}
 
 function VersionHistory({ versions, documentId, onClose }) {
   const [selectedVersion, setSelectedVersion] = useState(null);
+  const [diff, setDiff] = useState(null);
+  const [preview, setPreview] = useState(null);
+  const [tags, setTags] = useState([]);
+
+  useEffect(() => {
+    fetchDocumentTags(documentId)
+      .then(setTags)
+      .catch((error) => console.error('Failed to load tags:', error));
+  }, [documentId]);
+
+  async function handleTag(versionId) {
+    const name = window.prompt('Tag name, e.g. v1.0-approved');
+    if (!name) return;
+    try {
+      const tag = await createDocumentTag(documentId, name, versionId);
+      setTags([tag, ...tags]);
+    } catch (error) {
+      console.error('Failed to tag version:', error);
+      alert(error.message);
+    }
+  }
+
+  async function handleUntag(name) {
+    if (!window.confirm(`Remove the tag "${name}"?`)) return;
+    try {
+      await deleteDocumentTag(documentId, name);
+      setTags(tags.filter((tag) => tag.name !== name));
+    } catch (error) {
+      console.error('Failed to remove tag:', error);
+      alert(error.message);
+    }
+  }
+
+  async function handleView(versionId) {
+    try {
+      setDiff(null);
+      setPreview(await fetchDocumentVersion(documentId, versionId));
+    } catch (error) {
+      console.error('Failed to load version:', error);
+      alert('Failed to load version');
+    }
+  }
+
+  async function handleCompare(versionId) {
+    try {
+      setPreview(null);
+      setDiff(await fetchVersionDiff(documentId, versionId));
+    } catch (error) {
+      console.error('Failed to compare versions:', error);
+      alert('Failed to compare versions');
+    }
+  }
 
   async function handleRestoreVersion(versionId) {
     if (window.confirm('Are you sure you want to restore this version?')) {
@@ -16,6 +122,18 @@ function VersionHistory({ versions, documentId, onClose }) {
     }
   }
 
+  async function handleRevertVersion(versionId) {
+    if (window.confirm('Undo the changes made in this version, keeping later edits?')) {
+      try {
+        await revertDocumentVersion(documentId, versionId);
+        window.location.reload();
+      } catch (error) {
+        console.error('Failed to revert version:', error);
+        alert(error.revert ? 'Later edits overlap this change, so it can\'t be undone automatically' : error.message);
+      }
+    }
+  }
+
   // Function to get a shortened hash (like Git)
   const getShortHash = (hash) => {
     return hash.substring(0, 7);
@@ -71,24 +189,89 @@ function VersionHistory({ versions, documentId, onClose }) {
                   key={version.hash}
                   className={`mb-4 p-3 border rounded-md cursor-pointer transition-colors
                     ${selectedVersion === version.hash ? 'border-blue-500 bg-blue-50' : 'border-gray-200 hover:bg-gray-50'}`}
-                  onClick={() => setSelectedVersion(version.hash)}
+                  onClick={() => {
+                    setSelectedVersion(version.hash);
+                    if (diff?.from !== version.hash) setDiff(null);
+                    if (preview?.version.hash !== version.hash) setPreview(null);
+                  }}
                 >
                   <div className="flex items-center justify-between">
                     <div className="flex-1">
-                      <p className="text-sm font-medium text-gray-800">{version.message}</p>
+                      <p className="text-sm font-medium text-gray-800">
+                        {version.message}
+                        {tags.filter((tag) => tag.hash === version.hash).map((tag) => (
+                          <span
+                            key={tag.name}
+                            title={tag.message}
+                            className="ml-2 inline-flex items-center px-1.5 py-0.5 text-xs font-medium text-teal-800 bg-teal-100 rounded"
+                          >
+                            {tag.name}
+                            {selectedVersion === version.hash && (
+                              <button
+                                onClick={(e) => {
+                                  e.stopPropagation();
+                                  handleUntag(tag.name);
+                                }}
+                                className="ml-1 text-teal-600 hover:text-teal-900"
+                              >
+                                ×
+                              </button>
+                            )}
+                          </span>
+                        ))}
+                      </p>
                       <div className="mt-1.5 flex items-center text-xs text-gray-500">
                         <span className="text-xs font-mono bg-gray-100 px-1.5 py-0.5 rounded text-gray-600">
                           {getShortHash(version.hash)}
                         </span>
                         <span className="mx-2">•</span>
-                        <span>{version.author}</span>
+                        <span title={version.author_email}>
+                          {version.author}
+                          {version.co_authors?.length > 0 && ` with ${version.co_authors.map((co) => co.name).join(', ')}`}
+                        </span>
                         <span className="mx-2">•</span>
                         <span>{new Date(version.timestamp).toLocaleString()}</span>
                       </div>
                     </div>
                     
                     {selectedVersion === version.hash && (
-                      <div className="ml-4 flex-shrink-0">
+                      <div className="ml-4 flex-shrink-0 space-x-2">
+                        <button
+                          onClick={(e) => {
+                            e.stopPropagation();
+                            handleView(version.hash);
+                          }}
+                          className="px-3 py-1 text-xs font-medium text-gray-700 bg-gray-100 rounded-md hover:bg-gray-200 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-gray-400 transition-colors"
+                        >
+                          View
+                        </button>
+                        <button
+                          onClick={(e) => {
+                            e.stopPropagation();
+                            handleCompare(version.hash);
+                          }}
+                          className="px-3 py-1 text-xs font-medium text-gray-700 bg-gray-100 rounded-md hover:bg-gray-200 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-gray-400 transition-colors"
+                        >
+                          Compare with current
+                        </button>
+                        <button
+                          onClick={(e) => {
+                            e.stopPropagation();
+                            handleTag(version.hash);
+                          }}
+                          className="px-3 py-1 text-xs font-medium text-teal-700 bg-teal-100 rounded-md hover:bg-teal-200 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-teal-500 transition-colors"
+                        >
+                          Tag
+                        </button>
+                        <button
+                          onClick={(e) => {
+                            e.stopPropagation();
+                            handleRevertVersion(version.hash);
+                          }}
+                          className="px-3 py-1 text-xs font-medium text-gray-700 bg-gray-100 rounded-md hover:bg-gray-200 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-gray-400 transition-colors"
+                        >
+                          Revert
+                        </button>
                         <button 
                           onClick={() => handleRestoreVersion(version.hash)}
                           className="px-3 py-1 text-xs font-medium text-blue-700 bg-blue-100 rounded-md hover:bg-blue-200 focus:outline-none focus:ring-2 focus:ring-offset-2 focus:ring-blue-500 transition-colors"
@@ -113,6 +296,16 @@ function VersionHistory({ versions, documentId, onClose }) {
                           </div>
                         )}
                       </div>
+                      {preview && preview.version.hash === version.hash && (
+                        <pre className="mt-3 p-3 max-h-64 overflow-auto text-xs whitespace-pre-wrap bg-gray-50 border border-gray-200 rounded">
+                          {preview.content}
+                        </pre>
+                      )}
+                      {diff && diff.from === version.hash && (
+                        <div className="mt-3">
+                          <DiffView diff={diff} />
+                        </div>
+                      )}
                     </div>
                   )}
                 </div>
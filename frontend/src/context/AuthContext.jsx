@@ -29,9 +29,9 @@ export function AuthProvider({ children }) {
     }
   }
 
-  async function registerUser(username, password) {
+  async function registerUser(username, password, profile) {
     try {
-      const userData = await register(username, password);
+      const userData = await register(username, password, profile);
       setCurrentUser(userData);
       return userData;
     } catch (error) {
@@ -173,7 +173,7 @@ export function DocumentProvider({ children }) {
     try {
       setLoading(true);
       setError(null);
-      const versions = await fetchDocumentVersions(id);
+      const { versions } = await fetchDocumentVersions(id);
       setDocumentVersions(versions);
       return versions;
     } catch (err) {
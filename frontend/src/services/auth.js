@@ -23,9 +23,15 @@ export async function login(username, password) {
   }
 }
 
-export async function register(username, password) {
+// displayName and email are optional; commits are signed with them.
+export async function register(username, password, { displayName = '', email = '' } = {}) {
   try {
-    const response = await api.post('/register', { username, password });
+    const response = await api.post('/register', {
+      username,
+      password,
+      display_name: displayName,
+      email,
+    });
     const userData = response.data;
     localStorage.setItem('auth', JSON.stringify(userData));
     return userData;
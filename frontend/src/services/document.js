@@ -1,8 +1,10 @@
 import api from './api';
 
-export async function fetchDocuments() {
+// Lists the user's documents, in every workspace or just `workspaceId`.
+export async function fetchDocuments(workspaceId) {
   try {
-    const response = await api.get('/documents');
+    const params = workspaceId ? { workspace_id: workspaceId } : {};
+    const response = await api.get('/documents', { params });
     return response.data;
   } catch (error) {
     throw new Error(error.response?.data?.error || 'Failed to fetch documents');
@@ -22,9 +24,11 @@ export async function fetchDocument(id) {
   }
 }
 
-export async function createDocument(title, content = '') {
+// Creates a document in `workspaceId`, or the user's personal workspace,
+// optionally inside `folder` (e.g. "design/api").
+export async function createDocument(title, content = '', workspaceId, folder = '') {
   try {
-    const response = await api.post('/documents', { title, content });
+    const response = await api.post('/documents', { title, content, workspace_id: workspaceId, folder });
     return response.data;
   } catch (error) {
     throw new Error(error.response?.data?.error || 'Failed to create document');
@@ -40,6 +44,16 @@ export async function updateDocument(id, title, content) {
   }
 }
 
+// Moves a document's file to `folder`; '' is the top of the workspace.
+export async function moveDocument(id, folder) {
+  try {
+    const response = await api.post(`/documents/${id}/move`, { folder });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to move document');
+  }
+}
+
 export async function deleteDocument(id) {
   try {
     await api.delete(`/documents/${id}`);
@@ -62,9 +76,11 @@ export async function createDocumentVersion(id, title, content, comment) {
   }
 }
 
-export async function fetchDocumentVersions(id) {
+// Fetches a page of versions, newest first: `params` can hold limit, cursor
+// (the previous page's next_cursor), author, since, until, q and named.
+export async function fetchDocumentVersions(id, params = {}) {
   try {
-    const response = await api.get(`/documents/${id}/versions`);
+    const response = await api.get(`/documents/${id}/versions`, { params });
     return response.data;
   } catch (error) {
     throw new Error(error.response?.data?.error || 'Failed to fetch document versions');
@@ -117,4 +133,316 @@ export async function updateDocumentPermissions(id, permissions) {
   } catch (error) {
     throw new Error(error.response?.data?.error || 'Failed to update document permissions');
   }
-}
\ No newline at end of file
+}
+
+// Undoes the changes of one version, keeping later edits. If later edits
+// overlap the change the error carries the `revert`, with conflict markers in
+// its content.
+export async function revertDocumentVersion(id, versionId) {
+  try {
+    const response = await api.post(`/documents/${id}/versions/${versionId}/revert`);
+    return response.data;
+  } catch (error) {
+    const err = new Error(error.response?.data?.error || 'Failed to revert version');
+    err.revert = error.response?.data?.revert;
+    throw err;
+  }
+}
+
+// Compares two versions; without `other` the version is compared with the
+// current document.
+export async function fetchVersionDiff(id, versionId, other = 'current') {
+  try {
+    const response = await api.get(`/documents/${id}/versions/${versionId}/diff/${other}`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to compare versions');
+  }
+}
+
+// Reads a version without restoring it.
+export async function fetchDocumentVersion(id, versionId) {
+  try {
+    const response = await api.get(`/documents/${id}/versions/${versionId}`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to fetch document version');
+  }
+}
+
+// Reads the document as it was at `at`, a Date or ISO 8601 string.
+export async function fetchDocumentAt(id, at) {
+  try {
+    const time = at instanceof Date ? at.toISOString() : at;
+    const response = await api.get(`/documents/${id}`, { params: { at: time } });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to fetch document version');
+  }
+}
+
+export async function fetchDocumentTags(id) {
+  try {
+    const response = await api.get(`/documents/${id}/tags`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to fetch tags');
+  }
+}
+
+// Tags a version; without `versionId` the latest version is tagged.
+export async function createDocumentTag(id, name, versionId, message) {
+  try {
+    const response = await api.post(`/documents/${id}/tags`, { name, version: versionId, message });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to create tag');
+  }
+}
+
+export async function moveDocumentTag(id, name, versionId, message) {
+  try {
+    const response = await api.put(`/documents/${id}/tags/${encodeURIComponent(name)}`, { version: versionId, message });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to move tag');
+  }
+}
+
+export async function deleteDocumentTag(id, name) {
+  try {
+    const response = await api.delete(`/documents/${id}/tags/${encodeURIComponent(name)}`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to delete tag');
+  }
+}
+
+// Reads the version a tag names.
+export async function fetchDocumentByTag(id, name) {
+  try {
+    const response = await api.get(`/documents/${id}/tags/${encodeURIComponent(name)}`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to fetch tagged version');
+  }
+}
+
+export async function fetchDrafts(id) {
+  try {
+    const response = await api.get(`/documents/${id}/drafts`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to fetch drafts');
+  }
+}
+
+// Forks the document into a draft; without `versionId` the latest version is
+// forked.
+export async function createDraft(id, name, versionId) {
+  try {
+    const response = await api.post(`/documents/${id}/drafts`, { name, version: versionId });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to create draft');
+  }
+}
+
+export async function fetchDraft(id, name) {
+  try {
+    const response = await api.get(`/documents/${id}/drafts/${encodeURIComponent(name)}`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to fetch draft');
+  }
+}
+
+// Commits content to a draft, leaving the document itself alone.
+export async function saveDraft(id, name, content, message) {
+  try {
+    const response = await api.put(`/documents/${id}/drafts/${encodeURIComponent(name)}`, { content, message });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to save draft');
+  }
+}
+
+export async function deleteDraft(id, name) {
+  try {
+    const response = await api.delete(`/documents/${id}/drafts/${encodeURIComponent(name)}`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to delete draft');
+  }
+}
+
+export async function fetchMergeRequests(id, status) {
+  try {
+    const response = await api.get(`/documents/${id}/merge-requests`, { params: { status } });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to fetch merge requests');
+  }
+}
+
+export async function createMergeRequest(id, draft, title, description) {
+  try {
+    const response = await api.post(`/documents/${id}/merge-requests`, { draft, title, description });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to create merge request');
+  }
+}
+
+// Reads a merge request with its comments, diff and a preview of the merge.
+export async function fetchMergeRequest(id, requestId) {
+  try {
+    const response = await api.get(`/documents/${id}/merge-requests/${requestId}`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to fetch merge request');
+  }
+}
+
+export async function commentOnMergeRequest(id, requestId, body) {
+  try {
+    const response = await api.post(`/documents/${id}/merge-requests/${requestId}/comments`, { body });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to add comment');
+  }
+}
+
+export async function approveMergeRequest(id, requestId) {
+  try {
+    const response = await api.post(`/documents/${id}/merge-requests/${requestId}/approve`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to approve merge request');
+  }
+}
+
+export async function closeMergeRequest(id, requestId) {
+  try {
+    const response = await api.post(`/documents/${id}/merge-requests/${requestId}/close`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to close merge request');
+  }
+}
+
+// Merges an approved request. If the merge has conflicts the error carries
+// the `merge` preview, with conflict markers in its content; pass the
+// resolved text as `content` to merge anyway.
+export async function mergeMergeRequest(id, requestId, content) {
+  try {
+    const response = await api.post(`/documents/${id}/merge-requests/${requestId}/merge`, { content });
+    return response.data;
+  } catch (error) {
+    const err = new Error(error.response?.data?.error || 'Failed to merge');
+    err.merge = error.response?.data?.merge;
+    throw err;
+  }
+}
+
+// Returns an edit made directly in the repository that conflicts with the
+// document's unsaved changes, or null if there isn't one.
+export async function getExternalEdit(id) {
+  try {
+    const response = await api.get(`/documents/${id}/external-edit`);
+    return response.data;
+  } catch (error) {
+    if (error.response?.status === 404) {
+      return null;
+    }
+    throw new Error(error.response?.data?.error || 'Failed to fetch external edit');
+  }
+}
+
+export async function resolveExternalEdit(id, content) {
+  try {
+    const response = await api.post(`/documents/${id}/external-edit/resolve`, { content });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to resolve external edit');
+  }
+}
+
+export async function fetchWorkspaces() {
+  try {
+    const response = await api.get('/workspaces');
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to fetch workspaces');
+  }
+}
+
+export async function createWorkspace(name) {
+  try {
+    const response = await api.post('/workspaces', { name });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to create workspace');
+  }
+}
+
+export async function fetchWorkspaceMembers(id) {
+  try {
+    const response = await api.get(`/workspaces/${id}/members`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to fetch members');
+  }
+}
+
+export async function addWorkspaceMember(id, username) {
+  try {
+    const response = await api.post(`/workspaces/${id}/members`, { username });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to add member');
+  }
+}
+
+export async function removeWorkspaceMember(id, userId) {
+  try {
+    const response = await api.delete(`/workspaces/${id}/members/${userId}`);
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to remove member');
+  }
+}
+
+// Shows which runs of saves compacting the workspace's history would squash,
+// without changing anything. `window` is a duration like '15m'.
+export async function previewCompaction(id, window) {
+  try {
+    const params = window ? { window } : {};
+    const response = await api.get(`/workspaces/${id}/compact`, { params });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to preview compaction');
+  }
+}
+
+export async function compactWorkspace(id, window) {
+  try {
+    const params = window ? { window } : {};
+    const response = await api.post(`/workspaces/${id}/compact`, null, { params });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to compact history');
+  }
+}
+
+// Searches the documents the user can open, best match first. Each result's
+// `highlight` and `snippet` are HTML with the matches in <mark> tags.
+export async function searchDocuments(q, limit) {
+  try {
+    const params = limit ? { q, limit } : { q };
+    const response = await api.get('/search', { params });
+    return response.data;
+  } catch (error) {
+    throw new Error(error.response?.data?.error || 'Failed to search documents');
+  }
+}
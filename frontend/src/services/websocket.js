@@ -1,49 +1,337 @@
+import { getStoredAuth } from './auth';
+// Generated from backend/ws by `go generate`; describes every message type.
+import protocol from './protocol.schema.json';
+
 const WS_URL = 'ws://localhost:8080/ws';
 let activeSocket = null;
 let reconnectTimeout = null;
 
-// Only connect to the WebSocket when actively collaborating
-export function connectToDocument(documentId, onUpdateCallback) {
+// Collaboration state, mirroring the server's operational transform hub.
+// `document` is the local text, `outstanding` the ops sent but not yet
+// acknowledged, `buffer` the ops made while waiting for that ack. `server` is
+// the text at `revision`, which `outstanding` applies to. `epoch` and `seq`
+// locate the last broadcast seen, so a dropped connection can resume.
+let session = null;
+// Set when the document is deleted while open, so the socket stays closed.
+let deleted = false;
+
+function codePoints(text) {
+  return Array.from(text);
+}
+
+function applyOperations(content, ops) {
+  let chars = codePoints(content);
+  for (const op of ops) {
+    if (op.type === 'insert') {
+      chars.splice(op.position, 0, ...codePoints(op.text));
+    } else if (op.type === 'delete') {
+      chars.splice(op.position, op.length);
+    }
+  }
+  return chars.join('');
+}
+
+function opSize(op) {
+  return op.type === 'insert' ? codePoints(op.text).length : op.length;
+}
+
+// Same rules as Transform in backend/ws/ot.go: b's inserts win ties.
+function transformOne(a, b, wins) {
+  a = { ...a };
+  if (b.type === 'insert' && a.type === 'insert') {
+    if (a.position < b.position || (a.position === b.position && wins)) return [a];
+    a.position += opSize(b);
+    return [a];
+  }
+  if (b.type === 'insert' && a.type === 'delete') {
+    const n = opSize(b);
+    if (a.position + a.length <= b.position) return [a];
+    if (a.position >= b.position) {
+      a.position += n;
+      return [a];
+    }
+    const before = b.position - a.position;
+    return [
+      { type: 'delete', position: a.position, length: before },
+      { type: 'delete', position: a.position + n, length: a.length - before },
+    ];
+  }
+  if (b.type === 'delete' && a.type === 'insert') {
+    if (a.position <= b.position) return [a];
+    if (a.position >= b.position + b.length) {
+      a.position -= b.length;
+      return [a];
+    }
+    a.position = b.position;
+    return [a];
+  }
+  const aEnd = a.position + a.length;
+  const bEnd = b.position + b.length;
+  const overlap = Math.max(0, Math.min(aEnd, bEnd) - Math.max(a.position, b.position));
+  if (a.position >= bEnd) {
+    a.position -= b.length;
+  } else if (a.position > b.position) {
+    a.position = b.position;
+  }
+  a.length -= overlap;
+  return a.length === 0 ? [] : [a];
+}
+
+function transform(a, b) {
+  if (a.length === 0 || b.length === 0) return [a, b];
+  if (a.length > 1) {
+    const [head, b1] = transform(a.slice(0, 1), b);
+    const [tail, b2] = transform(a.slice(1), b1);
+    return [head.concat(tail), b2];
+  }
+  if (b.length > 1) {
+    const [a1, head] = transform(a, b.slice(0, 1));
+    const [a2, tail] = transform(a1, b.slice(1));
+    return [a2, head.concat(tail)];
+  }
+  return [transformOne(a[0], b[0], false), transformOne(b[0], a[0], true)];
+}
+
+function diffOperations(before, after) {
+  if (before === after) return [];
+  const b = codePoints(before);
+  const a = codePoints(after);
+  let prefix = 0;
+  while (prefix < b.length && prefix < a.length && b[prefix] === a[prefix]) prefix++;
+  let suffix = 0;
+  while (
+    suffix < b.length - prefix &&
+    suffix < a.length - prefix &&
+    b[b.length - 1 - suffix] === a[a.length - 1 - suffix]
+  ) suffix++;
+
+  const ops = [];
+  const removed = b.length - prefix - suffix;
+  if (removed > 0) ops.push({ type: 'delete', position: prefix, length: removed });
+  const inserted = a.slice(prefix, a.length - suffix).join('');
+  if (inserted) ops.push({ type: 'insert', position: prefix, text: inserted });
+  return ops;
+}
+
+// send checks a message against the protocol schema before sending it, so
+// mistakes show up here rather than as errors from the server.
+function send(socket, type, data) {
+  const schema = protocol.client[type];
+  if (!schema) {
+    console.warn('Not sending unknown WebSocket message type:', type);
+    return false;
+  }
+  const missing = (schema.required || []).filter((field) => !(field in data));
+  if (missing.length > 0) {
+    console.warn(`Not sending ${type} message without:`, missing.join(', '));
+    return false;
+  }
+  socket.send(JSON.stringify({ type, data }));
+  return true;
+}
+
+function sendOperations(ops) {
+  const data = { revision: session.revision, operations: ops };
+  if (session.pendingTitle) {
+    data.title = session.pendingTitle;
+    session.pendingTitle = null;
+  }
+  session.outstanding = ops;
+  send(activeSocket, 'op', data);
+}
+
+function acknowledge(revision) {
+  session.revision = revision;
+  session.server = applyOperations(session.server, session.outstanding || []);
+  session.outstanding = null;
+  if (session.buffer) {
+    const buffered = session.buffer;
+    session.buffer = null;
+    sendOperations(buffered);
+  }
+}
+
+function handleServerMessage(message, onUpdateCallback) {
+  const data = message.data || {};
+
+  if (session && data.seq !== undefined && message.type !== 'snapshot' && message.type !== 'replay') {
+    // While resuming, the replay covers everything broadcast so far.
+    if (session.resuming || data.seq <= session.seq) return;
+    session.seq = data.seq;
+  }
+
+  switch (message.type) {
+    case 'snapshot': {
+      // The connection's first snapshot is superseded by the resume reply.
+      if (session?.resuming && !data.resync) return;
+      // When the server could not replay what we missed, the edits it never
+      // acknowledged are rebased onto its snapshot and sent again.
+      let unsent = [];
+      if (session && data.resync) {
+        let base = session.server;
+        let pending = session.outstanding || [];
+        if (pending.length > 0 && applyOperations(base, pending) === data.content) {
+          // They arrived; only the ack was lost.
+          base = data.content;
+          pending = [];
+        }
+        pending = pending.concat(session.buffer || []);
+        [unsent] = transform(pending, diffOperations(base, data.content));
+      }
+      const content = applyOperations(data.content, unsent);
+      session = {
+        revision: data.revision,
+        document: content,
+        server: data.content,
+        title: session?.title,
+        pendingTitle: data.resync ? session?.pendingTitle || null : null,
+        outstanding: null,
+        buffer: null,
+        epoch: data.epoch,
+        seq: data.seq,
+        clientId: session?.clientId,
+      };
+      if (onUpdateCallback) onUpdateCallback({ content });
+      if (unsent.length > 0 || session.pendingTitle) sendOperations(unsent);
+      break;
+    }
+    case 'replay': {
+      if (!session) return;
+      session.resuming = false;
+      const inFlight = session.outstanding;
+      for (const missed of data.messages || []) {
+        handleServerMessage(missed, onUpdateCallback);
+      }
+      session.epoch = data.epoch;
+      session.seq = data.seq;
+      // Unless the replay acknowledged it, what was in flight when the
+      // connection dropped never arrived.
+      if (session.outstanding === inFlight) {
+        const unsent = (inFlight || []).concat(session.buffer || []);
+        session.outstanding = null;
+        session.buffer = null;
+        if (unsent.length > 0 || session.pendingTitle) sendOperations(unsent);
+      }
+      break;
+    }
+    case 'ack':
+      if (!session) return;
+      acknowledge(data.revision);
+      break;
+    case 'op': {
+      if (!session) return;
+      // A replayed op of our previous connection is the ack we missed.
+      if (data.client_id && data.client_id === session.previousClientId && session.outstanding) {
+        acknowledge(data.revision);
+        break;
+      }
+      let ops = data.operations || [];
+      session.revision = data.revision;
+      session.server = applyOperations(session.server, ops);
+      if (session.outstanding) {
+        [session.outstanding, ops] = transform(session.outstanding, ops);
+      }
+      if (session.buffer) {
+        [session.buffer, ops] = transform(session.buffer, ops);
+      }
+      session.document = applyOperations(session.document, ops);
+      if (data.title) session.title = data.title;
+      if (onUpdateCallback) {
+        onUpdateCallback(data.title ? { title: data.title, content: session.document } : { content: session.document });
+      }
+      break;
+    }
+    case 'update':
+      if (onUpdateCallback) onUpdateCallback(data);
+      break;
+    case 'document_renamed':
+      if (session) session.title = data.title;
+      if (onUpdateCallback) onUpdateCallback({ title: data.title });
+      break;
+    case 'deleted':
+      // The server closes the socket next; don't try to reconnect.
+      deleted = true;
+      if (onUpdateCallback) onUpdateCallback({ deleted: true });
+      break;
+    case 'presence_snapshot':
+      if (session) session.clientId = data.self?.client_id;
+      if (onUpdateCallback) onUpdateCallback({ type: message.type, ...data });
+      break;
+    case 'user_joined':
+    case 'user_left':
+    case 'presence':
+    case 'comment':
+      if (onUpdateCallback) onUpdateCallback({ type: message.type, ...data });
+      break;
+    case 'error':
+      console.warn('WebSocket error from server:', data.code, data.message, data.type || '');
+      break;
+    default:
+      if (!protocol.server[message.type]) {
+        console.warn('Ignoring unknown WebSocket message type:', message.type);
+      }
+      break;
+  }
+}
+
+// Only connect to the WebSocket when actively collaborating. `params` is an
+// optional query string, e.g. the shareId and username for shared links.
+export function connectToDocument(documentId, onUpdateCallback, params = '') {
   if (activeSocket) {
     disconnectWebSocket();
   }
-  
-  const socket = new WebSocket(`${WS_URL}?docId=${documentId}`);
-  
+
+  deleted = false;
+  return openSocket(documentId, onUpdateCallback, params);
+}
+
+function openSocket(documentId, onUpdateCallback, params) {
+  const query = new URLSearchParams(params);
+  query.set('docId', documentId);
+  const auth = getStoredAuth();
+  if (auth && auth.token) {
+    query.set('token', auth.token);
+  }
+
+  const socket = new WebSocket(`${WS_URL}?${query.toString()}`, [protocol.subprotocol]);
+
   socket.onopen = () => {
     console.log('WebSocket connection established for document:', documentId);
-    socket.send(JSON.stringify({ 
-      type: 'join', 
-      data: { documentId }
-    }));
+    send(socket, 'join', { document_id: String(documentId) });
+    // After a dropped connection, ask for what we missed instead of
+    // starting over from a snapshot.
+    if (session && session.epoch) {
+      session.resuming = true;
+      session.previousClientId = session.clientId;
+      send(socket, 'resume', { epoch: session.epoch, seq: session.seq });
+    }
   };
-  
+
   socket.onerror = (error) => {
     console.error('WebSocket error:', error);
   };
-  
+
   socket.onclose = (event) => {
     console.log('WebSocket connection closed:', event.code, event.reason);
-    if (event.code !== 1000) {
+    // 1002 means the server doesn't speak our protocol version; retrying
+    // won't help until the page is reloaded with a matching frontend.
+    if (event.code !== 1000 && event.code !== 1002 && !deleted) {
       clearTimeout(reconnectTimeout);
       reconnectTimeout = setTimeout(() => {
         console.log('Attempting to reconnect WebSocket...');
-        connectToDocument(documentId, onUpdateCallback);
+        openSocket(documentId, onUpdateCallback, params);
       }, 3000);
     }
   };
-  
+
   socket.onmessage = (event) => {
     try {
-      const message = JSON.parse(event.data);
-      if (message.type === 'update' && message.data && onUpdateCallback) {
-        onUpdateCallback(message.data);
-      }
+      handleServerMessage(JSON.parse(event.data), onUpdateCallback);
     } catch (err) {
       console.error('Error processing WebSocket message:', err);
     }
   };
-  
+
   activeSocket = socket;
   return socket;
 }
@@ -51,26 +339,57 @@ export function connectToDocument(documentId, onUpdateCallback) {
 export function disconnectWebSocket() {
   if (activeSocket) {
     clearTimeout(reconnectTimeout);
-    
+
     if (activeSocket.readyState === WebSocket.OPEN) {
       activeSocket.close(1000);
     }
-    
+
     activeSocket = null;
+    session = null;
   }
 }
 
+// Edits made while the connection is down are kept and sent once it resumes.
 export function sendDocumentUpdate(documentId, title, content) {
-  if (activeSocket && activeSocket.readyState === WebSocket.OPEN) {
-    activeSocket.send(JSON.stringify({
-      type: 'update',
-      data: {
-        id: documentId,
-        title,
-        content
-      }
-    }));
+  if (activeSocket && session) {
+    const ops = diffOperations(session.document, content);
+    session.document = content;
+    if (title && title !== session.title) {
+      session.title = title;
+      session.pendingTitle = title;
+    }
+    if (ops.length === 0 && !session.pendingTitle) return true;
+
+    if (session.outstanding || session.resuming || activeSocket.readyState !== WebSocket.OPEN) {
+      session.buffer = (session.buffer || []).concat(ops);
+    } else {
+      sendOperations(ops);
+    }
     return true;
   }
   return false;
-}
\ No newline at end of file
+}
+
+function sendPresence(type, data) {
+  if (activeSocket && activeSocket.readyState === WebSocket.OPEN) {
+    return send(activeSocket, type, data);
+  }
+  return false;
+}
+
+// Positions are code point offsets into the document, like operations.
+export function sendCursor(position) {
+  return sendPresence('cursor', { position });
+}
+
+// Pass null for anchor to clear the selection.
+export function sendSelection(anchor, head) {
+  return sendPresence('selection', { selection: anchor === null ? null : { anchor, head } });
+}
+
+// anchor optionally ties the comment to a selection, as { anchor, head }.
+export function sendComment(text, anchor = null) {
+  const data = { text };
+  if (anchor) data.anchor = anchor;
+  return sendPresence('comment', data);
+}
@@ -12,7 +12,7 @@ command -v electron >/dev/null 2>&1 || npm install -g electron
 echo "Setting up backend..."
 cd backend
 go mod download
-go build -o docsmith
+go build -tags sqlite_fts5 -o docsmith
 
 
 echo "Setting up frontend..."